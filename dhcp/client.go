@@ -15,9 +15,10 @@ import (
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	netheader "github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/network/ipv4"
 	"github.com/google/netstack/tcpip/stack"
-	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/tcpip/transport/packet"
 	"github.com/google/netstack/waiter"
 )
 
@@ -90,35 +91,22 @@ func (c *Client) Shutdown() {
 
 // Request executes a DHCP request session.
 //
-// On success, it adds a new address to this client's TCPIP stack.
-// If the server sets a lease limit a timer is set to automatically
-// renew it.
+// It exchanges frames with the server through a packet endpoint bound to the
+// client's NIC, so the NIC doesn't need an address beforehand. On success, it
+// adds a new address to this client's TCPIP stack. If the server sets a lease
+// limit a timer is set to automatically renew it.
 func (c *Client) Request(ctx context.Context, requestedAddr tcpip.Address) error {
 	var wq waiter.Queue
-	ep, err := c.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	ep, err := packet.NewEndpoint(c.stack, true, ipv4.ProtocolNumber, &wq)
 	if err != nil {
-		return fmt.Errorf("dhcp: outbound endpoint: %v", err)
+		return fmt.Errorf("dhcp: endpoint: %v", err)
 	}
-	err = ep.Bind(tcpip.FullAddress{
-		Addr: "\x00\x00\x00\x00",
-		Port: clientPort,
-	}, nil)
 	defer ep.Close()
-	if err != nil {
-		return fmt.Errorf("dhcp: connect failed: %v", err)
-	}
-
-	epin, err := c.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
-	if err != nil {
-		return fmt.Errorf("dhcp: inbound endpoint: %v", err)
-	}
-	err = epin.Bind(tcpip.FullAddress{
-		Addr: "\xff\xff\xff\xff",
-		Port: clientPort,
+	err = ep.Bind(tcpip.FullAddress{
+		NIC: c.nicid,
 	}, nil)
-	defer epin.Close()
 	if err != nil {
-		return fmt.Errorf("dhcp: connect failed: %v", err)
+		return fmt.Errorf("dhcp: bind failed: %v", err)
 	}
 
 	var xid [4]byte
@@ -145,11 +133,7 @@ func (c *Client) Request(ctx context.Context, requestedAddr tcpip.Address) error
 	copy(h.chaddr(), c.linkAddr)
 	h.setOptions(options)
 
-	serverAddr := &tcpip.FullAddress{
-		Addr: "\xff\xff\xff\xff",
-		Port: serverPort,
-	}
-	if _, err := ep.Write(buffer.View(h), serverAddr); err != nil {
+	if err := c.send(ep, h); err != nil {
 		return fmt.Errorf("dhcp discovery write: %v", err)
 	}
 
@@ -159,8 +143,7 @@ func (c *Client) Request(ctx context.Context, requestedAddr tcpip.Address) error
 
 	// DHCPOFFER
 	for {
-		var addr tcpip.FullAddress
-		v, err := epin.Read(&addr)
+		v, err := ep.Read(nil)
 		if err == tcpip.ErrWouldBlock {
 			select {
 			case <-ch:
@@ -169,7 +152,7 @@ func (c *Client) Request(ctx context.Context, requestedAddr tcpip.Address) error
 				return tcpip.ErrAborted
 			}
 		}
-		h = header(v)
+		h = clientPayload(v)
 		if h.isValid() && h.op() == opReply && bytes.Equal(h.xidbytes(), xid[:]) {
 			break
 		}
@@ -183,19 +166,12 @@ func (c *Client) Request(ctx context.Context, requestedAddr tcpip.Address) error
 
 	// DHCPREQUEST
 	addr := tcpip.Address(h.yiaddr())
-	if err := c.stack.AddAddress(c.nicid, ipv4.ProtocolNumber, addr); err != nil {
-		if err != tcpip.ErrDuplicateAddress {
-			return err
-		}
-	}
 	defer func() {
 		if ack {
 			c.mu.Lock()
 			c.addr = addr
 			c.cfg = cfg
 			c.mu.Unlock()
-		} else {
-			c.stack.RemoveAddress(c.nicid, addr)
 		}
 	}()
 	h.setOp(opRequest)
@@ -207,14 +183,13 @@ func (c *Client) Request(ctx context.Context, requestedAddr tcpip.Address) error
 		{optReqIPAddr, []byte(addr)},
 		{optDHCPServer, h.siaddr()},
 	})
-	if _, err := ep.Write([]byte(h), serverAddr); err != nil {
+	if err := c.send(ep, h); err != nil {
 		return fmt.Errorf("dhcp discovery write: %v", err)
 	}
 
 	// DHCPACK
 	for {
-		var addr tcpip.FullAddress
-		v, err := epin.Read(&addr)
+		v, err := ep.Read(nil)
 		if err == tcpip.ErrWouldBlock {
 			select {
 			case <-ch:
@@ -223,7 +198,7 @@ func (c *Client) Request(ctx context.Context, requestedAddr tcpip.Address) error
 				return tcpip.ErrAborted
 			}
 		}
-		h = header(v)
+		h = clientPayload(v)
 		if h.isValid() && h.op() == opReply && bytes.Equal(h.xidbytes(), xid[:]) {
 			break
 		}
@@ -239,16 +214,84 @@ func (c *Client) Request(ctx context.Context, requestedAddr tcpip.Address) error
 	if err != nil {
 		return fmt.Errorf("dhcp ack: %v", err)
 	}
-	ack = msgtype == dhcpACK
-	if !ack {
+	if msgtype != dhcpACK {
 		return fmt.Errorf("dhcp: request not acknowledged")
 	}
+	if err := c.stack.AddAddress(c.nicid, ipv4.ProtocolNumber, addr); err != nil {
+		if err != tcpip.ErrDuplicateAddress {
+			return err
+		}
+	}
+	ack = true
 	if cfg.LeaseLength != 0 {
 		go c.renewAfter(cfg.LeaseLength)
 	}
 	return nil
 }
 
+// send broadcasts a DHCP message from the unspecified address through ep, in a
+// UDP datagram built by hand, as the client's NIC may not have an address yet.
+func (c *Client) send(ep tcpip.Endpoint, h header) error {
+	const hdrsSize = netheader.IPv4MinimumSize + netheader.UDPMinimumSize
+	const serverAddr = tcpip.Address("\xff\xff\xff\xff")
+
+	v := buffer.NewView(hdrsSize + len(h))
+	copy(v[hdrsSize:], h)
+
+	length := uint16(netheader.UDPMinimumSize + len(h))
+	udp := netheader.UDP(v[netheader.IPv4MinimumSize:])
+	udp.Encode(&netheader.UDPFields{
+		SrcPort: clientPort,
+		DstPort: serverPort,
+		Length:  length,
+	})
+	xsum := netheader.PseudoHeaderChecksum(netheader.UDPProtocolNumber, netheader.IPv4Any, serverAddr)
+	xsum = netheader.Checksum(h, xsum)
+	udp.SetChecksum(^udp.CalculateChecksum(xsum, length))
+
+	ip := netheader.IPv4(v)
+	ip.Encode(&netheader.IPv4Fields{
+		IHL:         netheader.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         stack.DefaultTTL,
+		Protocol:    uint8(netheader.UDPProtocolNumber),
+		SrcAddr:     netheader.IPv4Any,
+		DstAddr:     serverAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	_, err := ep.Write(v, &tcpip.FullAddress{
+		NIC:  c.nicid,
+		Addr: tcpip.Address(netheader.EthernetBroadcastAddress),
+		Port: uint16(ipv4.ProtocolNumber),
+	})
+	return err
+}
+
+// clientPayload returns the DHCP message carried by v, an IPv4 packet, if it is
+// a UDP datagram sent to the client port. It returns nil otherwise.
+func clientPayload(v buffer.View) header {
+	ip := netheader.IPv4(v)
+	if !ip.IsValid(len(v)) || ip.TransportProtocol() != netheader.UDPProtocolNumber {
+		return nil
+	}
+	if ip.FragmentOffset() != 0 || ip.Flags()&netheader.IPv4FlagMoreFragments != 0 {
+		return nil
+	}
+
+	b := ip.Payload()
+	udp := netheader.UDP(b)
+	if len(b) < netheader.UDPMinimumSize || udp.DestinationPort() != clientPort {
+		return nil
+	}
+	l := int(udp.Length())
+	if l < netheader.UDPMinimumSize || l > len(b) {
+		return nil
+	}
+
+	return header(b[netheader.UDPMinimumSize:l])
+}
+
 func (c *Client) renewAfter(d time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
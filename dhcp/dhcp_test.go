@@ -42,12 +42,6 @@ func TestDHCP(t *testing.T) {
 	if err := s.CreateNIC(nicid, id); err != nil {
 		t.Fatal(err)
 	}
-	if err := s.AddAddress(nicid, ipv4.ProtocolNumber, "\x00\x00\x00\x00"); err != nil {
-		t.Fatal(err)
-	}
-	if err := s.AddAddress(nicid, ipv4.ProtocolNumber, "\xff\xff\xff\xff"); err != nil {
-		t.Fatal(err)
-	}
 	const serverAddr = tcpip.Address("\xc0\xa8\x03\x01")
 	if err := s.AddAddress(nicid, ipv4.ProtocolNumber, serverAddr); err != nil {
 		t.Fatal(err)
@@ -57,6 +57,9 @@ func NewServer(ctx context.Context, stack *stack.Stack, addrs []tcpip.Address, c
 	if err != nil {
 		return nil, fmt.Errorf("dhcp: server endpoint: %v", err)
 	}
+	if err = s.ep.SetSockOpt(tcpip.BroadcastOption(1)); err != nil {
+		return nil, fmt.Errorf("dhcp: server broadcast option: %v", err)
+	}
 	serverBroadcast := tcpip.FullAddress{
 		Addr: "",
 		Port: serverPort,
@@ -378,6 +378,58 @@ func (c *Conn) SetDeadline(t time.Time) error {
 	return nil
 }
 
+// SetKeepAlive sets whether keepalive probes are sent on the connection, like
+// net.TCPConn.SetKeepAlive.
+func (c *Conn) SetKeepAlive(keepalive bool) error {
+	v := tcpip.KeepaliveEnabledOption(0)
+	if keepalive {
+		v = 1
+	}
+	if err := c.ep.SetSockOpt(v); err != nil {
+		return c.newOpError("set", err)
+	}
+	return nil
+}
+
+// SetKeepAlivePeriod sets the idle time before keepalive probes are sent, and
+// the interval between them, like net.TCPConn.SetKeepAlivePeriod.
+func (c *Conn) SetKeepAlivePeriod(d time.Duration) error {
+	if err := c.ep.SetSockOpt(tcpip.KeepaliveIdleOption(d)); err != nil {
+		return c.newOpError("set", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.KeepaliveIntervalOption(d)); err != nil {
+		return c.newOpError("set", err)
+	}
+	return nil
+}
+
+// SetLinger sets how the connection is closed, like net.TCPConn.SetLinger. With
+// a negative sec, it's closed gracefully in the background. With a zero sec,
+// Close resets it. Otherwise it's reset if it can't be closed gracefully within
+// sec seconds, in the background too: as with net.TCPConn, Close doesn't block
+// until then.
+func (c *Conn) SetLinger(sec int) error {
+	var v tcpip.LingerOption
+	if sec >= 0 {
+		v.Enabled = true
+		v.Timeout = time.Duration(sec) * time.Second
+	}
+	if err := c.ep.SetSockOpt(v); err != nil {
+		return c.newOpError("set", err)
+	}
+	return nil
+}
+
+// TCPInfo returns the state of the TCP connection, like Linux's TCP_INFO
+// socket option.
+func (c *Conn) TCPInfo() (tcpip.TCPInfoOption, error) {
+	var v tcpip.TCPInfoOption
+	if err := c.ep.GetSockOpt(&v); err != nil {
+		return tcpip.TCPInfoOption{}, c.newOpError("get", err)
+	}
+	return v, nil
+}
+
 func (c *Conn) newOpError(op string, err error) error {
 	return &net.OpError{
 		Op:     op,
@@ -270,3 +270,91 @@ func TestDeadlineChange(t *testing.T) {
 	}
 	sender.close()
 }
+
+func TestKeepAlive(t *testing.T) {
+	s, err := newLoopbackStack()
+	if err != nil {
+		t.Fatalf("newLoopbackStack() = %v", err)
+	}
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %v", err)
+	}
+	c := NewConn(&wq, ep)
+	defer c.Close()
+
+	if err := c.SetKeepAlive(true); err != nil {
+		t.Errorf("SetKeepAlive(true) = %v", err)
+	}
+	if err := c.SetKeepAlivePeriod(30 * time.Second); err != nil {
+		t.Errorf("SetKeepAlivePeriod(30s) = %v", err)
+	}
+	if err := c.SetKeepAlivePeriod(0); err == nil {
+		t.Errorf("SetKeepAlivePeriod(0) succeeded")
+	}
+
+	var enabled tcpip.KeepaliveEnabledOption
+	if err := ep.GetSockOpt(&enabled); err != nil || enabled != 1 {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want 1, nil", enabled, enabled, err)
+	}
+	var idle tcpip.KeepaliveIdleOption
+	if err := ep.GetSockOpt(&idle); err != nil || time.Duration(idle) != 30*time.Second {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want 30s, nil", idle, time.Duration(idle), err)
+	}
+	var interval tcpip.KeepaliveIntervalOption
+	if err := ep.GetSockOpt(&interval); err != nil || time.Duration(interval) != 30*time.Second {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want 30s, nil", interval, time.Duration(interval), err)
+	}
+}
+
+func TestTCPInfo(t *testing.T) {
+	s, err := newLoopbackStack()
+	if err != nil {
+		t.Fatalf("newLoopbackStack() = %v", err)
+	}
+
+	addr := tcpip.FullAddress{NICID, tcpip.Address(net.IPv4(169, 254, 10, 1).To4()), 11211}
+	s.AddAddress(NICID, ipv4.ProtocolNumber, addr.Addr)
+
+	l, err := NewListener(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewListener() = %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("l.Accept() = %v", err)
+		}
+		accepted <- c
+	}()
+
+	sender, err := connect(s, addr)
+	if err != nil {
+		t.Fatalf("connect() = %v", err)
+	}
+	defer sender.close()
+
+	c := <-accepted
+	if c == nil {
+		return
+	}
+	defer c.Close()
+
+	data := []byte("hello")
+	if _, err := c.Write(data); err != nil {
+		t.Fatalf("c.Write() = %v", err)
+	}
+
+	info, err := c.(*Conn).TCPInfo()
+	if err != nil {
+		t.Fatalf("c.TCPInfo() = %v", err)
+	}
+	if info.State != "ESTABLISHED" || info.BytesSent != uint64(len(data)) {
+		t.Errorf("c.TCPInfo() = %+v, want state ESTABLISHED and %d bytes sent", info, len(data))
+	}
+}
@@ -118,6 +118,22 @@ func TOS(tos uint8, label uint32) NetworkChecker {
 	}
 }
 
+// TTL creates a checker that checks the TTL (IPv4) or hop limit (IPv6) field.
+func TTL(ttl uint8) NetworkChecker {
+	return func(t *testing.T, h []header.Network) {
+		var v uint8
+		switch ip := h[0].(type) {
+		case header.IPv4:
+			v = ip.TTL()
+		case header.IPv6:
+			v = ip.HopLimit()
+		}
+		if v != ttl {
+			t.Fatalf("Bad TTL, got %v, want %v", v, ttl)
+		}
+	}
+}
+
 // Raw creates a checker that checks the bytes of payload.
 // The checker always checks the payload of the last network header.
 // For instance, in case of IPv6 fragments, the payload that will be checked
@@ -341,6 +357,37 @@ func TCPSynOptions(mss uint16, wndscale int) TransportChecker {
 	}
 }
 
+// TCPSACKPermitted creates a checker that checks whether the SACK-permitted
+// option is present.
+func TCPSACKPermitted(want bool) TransportChecker {
+	return func(t *testing.T, h header.Transport) {
+		tcp, ok := h.(header.TCP)
+		if !ok {
+			return
+		}
+
+		if _, got := header.TCPOption(tcp.Options(), header.TCPOptionSACKPermitted); got != want {
+			t.Fatalf("Bad SACK-permitted option presence, got %v, want %v. Options: %x", got, want, tcp.Options())
+		}
+	}
+}
+
+// TCPSACKBlocks creates a checker that checks the blocks of the SACK option.
+// If want is empty, the option must not be present.
+func TCPSACKBlocks(want ...header.SACKBlock) TransportChecker {
+	return func(t *testing.T, h header.Transport) {
+		tcp, ok := h.(header.TCP)
+		if !ok {
+			return
+		}
+
+		got := header.ParseSACKBlocks(tcp.Options())
+		if len(got) != len(want) || (len(want) != 0 && !reflect.DeepEqual(got, want)) {
+			t.Fatalf("Bad SACK blocks, got %v, want %v", got, want)
+		}
+	}
+}
+
 // Payload creates a checker that checks the payload.
 func Payload(want []byte) TransportChecker {
 	return func(t *testing.T, h header.Transport) {
@@ -35,6 +35,14 @@ func ChecksumCombine(a, b uint16) uint16 {
 	return uint16(v + v>>16)
 }
 
+// UpdateChecksum returns the new value of the checksum field xsum of a block
+// of data in which the bytes old were replaced with new, computed
+// incrementally as described in RFC 1624. old and new must have the same, even
+// length, and start at an even offset of the data.
+func UpdateChecksum(xsum uint16, old, new []byte) uint16 {
+	return ^ChecksumCombine(ChecksumCombine(^xsum, ^Checksum(old, 0)), Checksum(new, 0))
+}
+
 // PseudoHeaderChecksum calculates the pseudo-header checksum for the
 // given destination protocol and network address, ignoring the length
 // field. Pseudo-headers are needed by transport layers when calculating
@@ -0,0 +1,87 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	dstMAC  = 0
+	srcMAC  = 6
+	ethType = 12
+)
+
+// EthernetFields contains the fields of an Ethernet frame header. It is used to
+// describe the fields of a frame that needs to be encoded.
+type EthernetFields struct {
+	// SrcAddr is the "MAC source" field of an ethernet frame header.
+	SrcAddr tcpip.LinkAddress
+
+	// DstAddr is the "MAC destination" field of an ethernet frame header.
+	DstAddr tcpip.LinkAddress
+
+	// Type is the "ethertype" field of an ethernet frame header.
+	Type tcpip.NetworkProtocolNumber
+}
+
+// Ethernet represents an ethernet frame header stored in a byte array.
+type Ethernet []byte
+
+// EthernetMinimumSize is the size, in bytes, of an Ethernet frame header.
+const EthernetMinimumSize = 14
+
+// EthernetAddressSize is the size, in bytes, of an Ethernet MAC address.
+const EthernetAddressSize = 6
+
+// EthernetBroadcastAddress is the Ethernet address frames sent to every host
+// of the link are addressed to.
+const EthernetBroadcastAddress tcpip.LinkAddress = "\xff\xff\xff\xff\xff\xff"
+
+// EthernetAddressFromMulticastIPv4Address returns the Ethernet address frames
+// sent to the given IPv4 multicast group are addressed to. As described in
+// RFC 1112 section 6.4, it is formed by placing the low 23 bits of the group
+// into 01:00:5e:00:00:00.
+func EthernetAddressFromMulticastIPv4Address(addr tcpip.Address) tcpip.LinkAddress {
+	return tcpip.LinkAddress([]byte{0x01, 0x00, 0x5e, addr[1] & 0x7f, addr[2], addr[3]})
+}
+
+// EthernetAddressFromMulticastIPv6Address returns the Ethernet address frames
+// sent to the given IPv6 multicast group are addressed to. As described in
+// RFC 2464 section 7, it is formed by appending the low 32 bits of the group
+// to 33:33.
+func EthernetAddressFromMulticastIPv6Address(addr tcpip.Address) tcpip.LinkAddress {
+	return tcpip.LinkAddress([]byte{0x33, 0x33, addr[12], addr[13], addr[14], addr[15]})
+}
+
+// SourceAddress returns the "MAC source" field of the ethernet frame header.
+func (b Ethernet) SourceAddress() tcpip.LinkAddress {
+	return tcpip.LinkAddress(b[srcMAC:][:EthernetAddressSize])
+}
+
+// DestinationAddress returns the "MAC destination" field of the ethernet frame
+// header.
+func (b Ethernet) DestinationAddress() tcpip.LinkAddress {
+	return tcpip.LinkAddress(b[dstMAC:][:EthernetAddressSize])
+}
+
+// Type returns the network protocol number of the payload of the ethernet
+// frame.
+func (b Ethernet) Type() tcpip.NetworkProtocolNumber {
+	return tcpip.NetworkProtocolNumber(binary.BigEndian.Uint16(b[ethType:]))
+}
+
+// Encode encodes all the fields of the ethernet frame header. Link addresses
+// that aren't Ethernet addresses, e.g. empty ones, are encoded as zeros.
+func (b Ethernet) Encode(e *EthernetFields) {
+	for i := range b[:ethType] {
+		b[i] = 0
+	}
+	copy(b[srcMAC:][:EthernetAddressSize], e.SrcAddr)
+	copy(b[dstMAC:][:EthernetAddressSize], e.DstAddr)
+	binary.BigEndian.PutUint16(b[ethType:], uint16(e.Type))
+}
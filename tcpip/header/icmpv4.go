@@ -18,7 +18,7 @@ const (
 	ICMPv4MinimumSize = 4
 
 	// ICMPv4EchoMinimumSize is the minimum size of a valid ICMP echo packet.
-	ICMPv4EchoMinimumSize = 6
+	ICMPv4EchoMinimumSize = 8
 
 	// ICMPv4ProtocolNumber is the ICMP transport protocol number.
 	ICMPv4ProtocolNumber tcpip.TransportProtocolNumber = 1
@@ -42,6 +42,10 @@ const (
 	ICMPv4InfoReply      ICMPv4Type = 16
 )
 
+// ICMPv4AdminProhibited is the code of Destination Unreachable messages about
+// packets that were administratively filtered, defined in RFC 1812.
+const ICMPv4AdminProhibited = 13
+
 // Type is the ICMP type field.
 func (b ICMPv4) Type() ICMPv4Type { return ICMPv4Type(b[0]) }
 
@@ -54,7 +58,33 @@ func (b ICMPv4) Code() byte { return b[1] }
 // SetCode sets the ICMP code field.
 func (b ICMPv4) SetCode(c byte) { b[1] = c }
 
+// Checksum is the ICMP checksum field.
+func (b ICMPv4) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[2:])
+}
+
 // SetChecksum sets the ICMP checksum field.
 func (b ICMPv4) SetChecksum(checksum uint16) {
 	binary.BigEndian.PutUint16(b[2:], checksum)
 }
+
+// Ident is the ICMP identifier field of echo requests and replies.
+func (b ICMPv4) Ident() uint16 {
+	return binary.BigEndian.Uint16(b[4:])
+}
+
+// SetIdent sets the ICMP identifier field of echo requests and replies.
+func (b ICMPv4) SetIdent(ident uint16) {
+	binary.BigEndian.PutUint16(b[4:], ident)
+}
+
+// Sequence is the ICMP sequence number field of echo requests and replies.
+func (b ICMPv4) Sequence() uint16 {
+	return binary.BigEndian.Uint16(b[6:])
+}
+
+// SetSequence sets the ICMP sequence number field of echo requests and
+// replies.
+func (b ICMPv4) SetSequence(sequence uint16) {
+	binary.BigEndian.PutUint16(b[6:], sequence)
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// ICMPv6 represents an ICMPv6 header stored in a byte array.
+type ICMPv6 []byte
+
+const (
+	// ICMPv6MinimumSize is the minimum size of a valid ICMP packet.
+	ICMPv6MinimumSize = 4
+
+	// ICMPv6ErrorHeaderSize is the size of the header of ICMPv6 error
+	// messages (e.g., Time Exceeded), which is followed by as much of the
+	// invoking packet as possible.
+	ICMPv6ErrorHeaderSize = 8
+
+	// ICMPv6EchoMinimumSize is the minimum size of a valid ICMP echo packet.
+	ICMPv6EchoMinimumSize = 8
+
+	// ICMPv6ProtocolNumber is the ICMP transport protocol number.
+	ICMPv6ProtocolNumber tcpip.TransportProtocolNumber = 58
+)
+
+// ICMPv6Type is the ICMP type field described in RFC 4443.
+type ICMPv6Type byte
+
+// Typical values of ICMPv6Type defined in RFC 4443, RFC 2710 and RFC 3810.
+const (
+	ICMPv6DstUnreachable            ICMPv6Type = 1
+	ICMPv6PacketTooBig              ICMPv6Type = 2
+	ICMPv6TimeExceeded              ICMPv6Type = 3
+	ICMPv6ParamProblem              ICMPv6Type = 4
+	ICMPv6EchoRequest               ICMPv6Type = 128
+	ICMPv6EchoReply                 ICMPv6Type = 129
+	ICMPv6MulticastListenerQuery    ICMPv6Type = 130
+	ICMPv6MulticastListenerReport   ICMPv6Type = 131
+	ICMPv6MulticastListenerDone     ICMPv6Type = 132
+	ICMPv6MulticastListenerV2Report ICMPv6Type = 143
+)
+
+// ICMPv6AdminProhibited is the code of Destination Unreachable messages about
+// packets whose delivery was administratively prohibited, defined in RFC 4443.
+const ICMPv6AdminProhibited = 1
+
+// Type is the ICMP type field.
+func (b ICMPv6) Type() ICMPv6Type { return ICMPv6Type(b[0]) }
+
+// SetType sets the ICMP type field.
+func (b ICMPv6) SetType(t ICMPv6Type) { b[0] = byte(t) }
+
+// Code is the ICMP code field. Its meaning depends on the value of Type.
+func (b ICMPv6) Code() byte { return b[1] }
+
+// SetCode sets the ICMP code field.
+func (b ICMPv6) SetCode(c byte) { b[1] = c }
+
+// Checksum is the ICMP checksum field.
+func (b ICMPv6) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[2:])
+}
+
+// SetChecksum sets the ICMP checksum field.
+func (b ICMPv6) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(b[2:], checksum)
+}
+
+// Ident is the ICMP identifier field of echo requests and replies.
+func (b ICMPv6) Ident() uint16 {
+	return binary.BigEndian.Uint16(b[4:])
+}
+
+// SetIdent sets the ICMP identifier field of echo requests and replies.
+func (b ICMPv6) SetIdent(ident uint16) {
+	binary.BigEndian.PutUint16(b[4:], ident)
+}
+
+// Sequence is the ICMP sequence number field of echo requests and replies.
+func (b ICMPv6) Sequence() uint16 {
+	return binary.BigEndian.Uint16(b[6:])
+}
+
+// SetSequence sets the ICMP sequence number field of echo requests and
+// replies.
+func (b ICMPv6) SetSequence(sequence uint16) {
+	binary.BigEndian.PutUint16(b[6:], sequence)
+}
+
+// ICMPv6Checksum calculates the checksum of an ICMPv6 message, which unlike
+// ICMPv4 covers a pseudo-header with the source and destination addresses and
+// the length of the message. The checksum field of h must be zero.
+func ICMPv6Checksum(h ICMPv6, src, dst tcpip.Address, data []byte) uint16 {
+	xsum := PseudoHeaderChecksum(ICMPv6ProtocolNumber, src, dst)
+
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, uint32(len(h)+len(data)))
+	xsum = Checksum(l, xsum)
+
+	xsum = Checksum(h, xsum)
+	return ^Checksum(data, xsum)
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// IGMP represents an IGMP header stored in a byte array. IGMPv1 and IGMPv2
+// messages, as well as IGMPv3 queries, share its first 8 bytes.
+type IGMP []byte
+
+const (
+	// IGMPMinimumSize is the size of IGMPv1 and IGMPv2 messages, and the
+	// minimum size of a valid IGMP packet.
+	IGMPMinimumSize = 8
+
+	// IGMPv3QueryMinimumSize is the minimum size of an IGMPv3 query.
+	IGMPv3QueryMinimumSize = 12
+
+	// IGMPv3ReportMinimumSize is the size of the fixed part of an IGMPv3
+	// membership report.
+	IGMPv3ReportMinimumSize = 8
+
+	// IGMPv3GroupRecordMinimumSize is the size of an IGMPv3 group record
+	// without sources.
+	IGMPv3GroupRecordMinimumSize = 8
+
+	// IGMPProtocolNumber is the IGMP transport protocol number.
+	IGMPProtocolNumber tcpip.TransportProtocolNumber = 2
+)
+
+// IGMPType is the IGMP type field.
+type IGMPType byte
+
+// Values of IGMPType defined in RFC 1112, RFC 2236 and RFC 3376.
+const (
+	IGMPMembershipQuery    IGMPType = 0x11
+	IGMPv1MembershipReport IGMPType = 0x12
+	IGMPv2MembershipReport IGMPType = 0x16
+	IGMPLeaveGroup         IGMPType = 0x17
+	IGMPv3MembershipReport IGMPType = 0x22
+)
+
+// IGMPv3RecordType is the type of an IGMPv3 group record.
+type IGMPv3RecordType byte
+
+// Values of IGMPv3RecordType defined in RFC 3376, section 4.2.12.
+const (
+	IGMPv3ModeIsInclude       IGMPv3RecordType = 1
+	IGMPv3ModeIsExclude       IGMPv3RecordType = 2
+	IGMPv3ChangeToIncludeMode IGMPv3RecordType = 3
+	IGMPv3ChangeToExcludeMode IGMPv3RecordType = 4
+)
+
+// Type is the IGMP type field.
+func (b IGMP) Type() IGMPType { return IGMPType(b[0]) }
+
+// SetType sets the IGMP type field.
+func (b IGMP) SetType(t IGMPType) { b[0] = byte(t) }
+
+// MaxRespCode is the "max response time" (IGMPv2) or "max response code"
+// (IGMPv3) field of queries, in tenths of a second. It is zero in IGMPv1
+// queries.
+func (b IGMP) MaxRespCode() byte { return b[1] }
+
+// SetMaxRespCode sets the "max response code" field.
+func (b IGMP) SetMaxRespCode(c byte) { b[1] = c }
+
+// Checksum is the IGMP checksum field.
+func (b IGMP) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[2:])
+}
+
+// SetChecksum sets the IGMP checksum field.
+func (b IGMP) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(b[2:], checksum)
+}
+
+// GroupAddress is the group address field of IGMPv1 and IGMPv2 messages and
+// of IGMPv3 queries.
+func (b IGMP) GroupAddress() tcpip.Address {
+	return tcpip.Address(b[4:8])
+}
+
+// SetGroupAddress sets the group address field.
+func (b IGMP) SetGroupAddress(addr tcpip.Address) {
+	copy(b[4:8], addr)
+}
+
+// IGMPv3Report represents the fixed part of an IGMPv3 membership report, which
+// is followed by its group records.
+type IGMPv3Report []byte
+
+// SetNumberOfRecords sets the "number of group records" field.
+func (b IGMPv3Report) SetNumberOfRecords(n uint16) {
+	binary.BigEndian.PutUint16(b[6:], n)
+}
+
+// IGMPv3GroupRecord represents an IGMPv3 group record without sources.
+type IGMPv3GroupRecord []byte
+
+// Encode encodes a group record of the given type, for the given group and
+// without sources.
+func (b IGMPv3GroupRecord) Encode(t IGMPv3RecordType, group tcpip.Address) {
+	b[0] = byte(t)
+	b[1] = 0
+	binary.BigEndian.PutUint16(b[2:], 0)
+	copy(b[4:8], group)
+}
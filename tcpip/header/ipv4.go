@@ -23,6 +23,25 @@ const (
 	dstAddr  = 16
 )
 
+// ECN codepoints, carried in the two least significant bits of the "type of
+// service" field of IPv4 packets and of the "traffic class" field of IPv6
+// packets, as defined in RFC 3168.
+const (
+	// ECNNotECT marks packets of transports that aren't ECN-capable.
+	ECNNotECT = 0
+
+	// ECNECT1 and ECNECT0 mark packets of ECN-capable transports.
+	ECNECT1 = 1
+	ECNECT0 = 2
+
+	// ECNCE is set by routers to signal congestion instead of dropping
+	// packets of ECN-capable transports.
+	ECNCE = 3
+
+	// ECNMask is the mask of the ECN bits.
+	ECNMask = 3
+)
+
 // IPv4Fields contains the fields of an IPv4 packet. It is used to describe the
 // fields of a packet that needs to be encoded.
 type IPv4Fields struct {
@@ -183,6 +202,16 @@ func (b IPv4) SetTotalLength(totalLength uint16) {
 	binary.BigEndian.PutUint16(b[totalLen:], totalLength)
 }
 
+// SetID sets the "identification" field of the ipv4 header.
+func (b IPv4) SetID(v uint16) {
+	binary.BigEndian.PutUint16(b[id:], v)
+}
+
+// SetTTL sets the "TTL" field of the ipv4 header.
+func (b IPv4) SetTTL(v uint8) {
+	b[ttl] = v
+}
+
 // SetChecksum sets the checksum field of the ipv4 header.
 func (b IPv4) SetChecksum(v uint16) {
 	binary.BigEndian.PutUint16(b[checksum:], v)
@@ -249,3 +278,33 @@ func (b IPv4) IsValid(pktSize int) bool {
 
 	return true
 }
+
+// IPv4Any is the unspecified IPv4 address, 0.0.0.0.
+const IPv4Any tcpip.Address = "\x00\x00\x00\x00"
+
+// IPv4Broadcast is the limited broadcast address, 255.255.255.255.
+const IPv4Broadcast tcpip.Address = "\xff\xff\xff\xff"
+
+// Well-known IPv4 multicast groups defined in RFC 1112, RFC 2236 and RFC 3376.
+const (
+	// IPv4AllHostsGroup is the group all multicast-capable hosts are
+	// members of.
+	IPv4AllHostsGroup tcpip.Address = "\xe0\x00\x00\x01"
+
+	// IPv4AllRoutersGroup is the group IGMPv2 Leave Group messages are
+	// sent to.
+	IPv4AllRoutersGroup tcpip.Address = "\xe0\x00\x00\x02"
+
+	// IPv4AllIGMPv3RoutersGroup is the group IGMPv3 membership reports are
+	// sent to.
+	IPv4AllIGMPv3RoutersGroup tcpip.Address = "\xe0\x00\x00\x16"
+)
+
+// IsV4MulticastAddress determines if the provided address is an IPv4
+// multicast address, i.e., if it is in 224.0.0.0/4.
+func IsV4MulticastAddress(addr tcpip.Address) bool {
+	if len(addr) != IPv4AddressSize {
+		return false
+	}
+	return addr[0]&0xf0 == 0xe0
+}
@@ -66,6 +66,10 @@ const (
 	// IPv6MinimumMTU is the minimum MTU required by IPv6, per RFC 2460,
 	// section 5.
 	IPv6MinimumMTU = 1280
+
+	// IPv6HopByHopOptionsHeader is the number used to specify that the
+	// next header is a Hop-by-Hop Options header, per RFC 2460.
+	IPv6HopByHopOptionsHeader = 0
 )
 
 // PayloadLength returns the value of the "payload length" field of the ipv6
@@ -128,6 +132,11 @@ func (b IPv6) SetPayloadLength(payloadLength uint16) {
 	binary.BigEndian.PutUint16(b[payloadLen:], payloadLength)
 }
 
+// SetHopLimit sets the value of the "hop limit" field of the ipv6 header.
+func (b IPv6) SetHopLimit(v uint8) {
+	b[hopLimit] = v
+}
+
 // SetSourceAddress sets the "source address" field of the ipv6 header.
 func (b IPv6) SetSourceAddress(addr tcpip.Address) {
 	copy(b[v6SrcAddr:v6SrcAddr+IPv6AddressSize], addr)
@@ -184,3 +193,38 @@ func IsV4MappedAddress(addr tcpip.Address) bool {
 
 	return true
 }
+
+// IPv6Any is the unspecified IPv6 address, ::.
+const IPv6Any tcpip.Address = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+// Well-known IPv6 multicast groups defined in RFC 4291 and RFC 3810.
+const (
+	// IPv6AllNodesMulticastAddress is the link-local group all nodes are
+	// members of.
+	IPv6AllNodesMulticastAddress tcpip.Address = "\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+
+	// IPv6AllRoutersMulticastAddress is the link-local group all routers
+	// are members of, which MLDv1 Done messages are sent to.
+	IPv6AllRoutersMulticastAddress tcpip.Address = "\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"
+
+	// IPv6AllMLDv2RoutersMulticastAddress is the group MLDv2 reports are
+	// sent to.
+	IPv6AllMLDv2RoutersMulticastAddress tcpip.Address = "\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x16"
+)
+
+// IsV6MulticastAddress determines if the provided address is an IPv6
+// multicast address, i.e., if it is in ff00::/8.
+func IsV6MulticastAddress(addr tcpip.Address) bool {
+	if len(addr) != IPv6AddressSize {
+		return false
+	}
+	return addr[0] == 0xff
+}
+
+// SolicitedNodeAddr returns the solicited-node multicast group of addr, as
+// described in RFC 4291 section 2.7.1. It is formed by appending the low 24
+// bits of addr to the prefix ff02::1:ff00:0/104.
+func SolicitedNodeAddr(addr tcpip.Address) tcpip.Address {
+	const prefix = "\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xff"
+	return prefix + addr[len(addr)-3:]
+}
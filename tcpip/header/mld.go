@@ -0,0 +1,87 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// MLD represents an MLD message stored in a byte array, starting with its
+// ICMPv6 header. MLDv1 messages, as well as MLDv2 queries, share its first 24
+// bytes.
+type MLD []byte
+
+const (
+	// MLDMinimumSize is the size of MLDv1 messages, and the minimum size of
+	// a valid MLD query.
+	MLDMinimumSize = 24
+
+	// MLDv2QueryMinimumSize is the minimum size of an MLDv2 query.
+	MLDv2QueryMinimumSize = 28
+
+	// MLDv2ReportMinimumSize is the size of the fixed part of an MLDv2
+	// report.
+	MLDv2ReportMinimumSize = 8
+
+	// MLDv2RecordMinimumSize is the size of an MLDv2 multicast address
+	// record without sources.
+	MLDv2RecordMinimumSize = 20
+)
+
+// MLDv2RecordType is the type of an MLDv2 multicast address record.
+type MLDv2RecordType byte
+
+// Values of MLDv2RecordType defined in RFC 3810, section 5.2.12.
+const (
+	MLDv2ModeIsInclude       MLDv2RecordType = 1
+	MLDv2ModeIsExclude       MLDv2RecordType = 2
+	MLDv2ChangeToIncludeMode MLDv2RecordType = 3
+	MLDv2ChangeToExcludeMode MLDv2RecordType = 4
+)
+
+// MaxRespCode is the "maximum response delay" (MLDv1) or "maximum response
+// code" (MLDv2) field of queries, in milliseconds.
+func (b MLD) MaxRespCode() uint16 {
+	return binary.BigEndian.Uint16(b[4:])
+}
+
+// SetMaxRespCode sets the "maximum response code" field.
+func (b MLD) SetMaxRespCode(c uint16) {
+	binary.BigEndian.PutUint16(b[4:], c)
+}
+
+// MulticastAddress is the multicast address field of MLDv1 messages and of
+// MLDv2 queries.
+func (b MLD) MulticastAddress() tcpip.Address {
+	return tcpip.Address(b[8:24])
+}
+
+// SetMulticastAddress sets the multicast address field.
+func (b MLD) SetMulticastAddress(addr tcpip.Address) {
+	copy(b[8:24], addr)
+}
+
+// MLDv2Report represents the fixed part of an MLDv2 report, which is followed
+// by its multicast address records.
+type MLDv2Report []byte
+
+// SetNumberOfRecords sets the "number of multicast address records" field.
+func (b MLDv2Report) SetNumberOfRecords(n uint16) {
+	binary.BigEndian.PutUint16(b[6:], n)
+}
+
+// MLDv2Record represents an MLDv2 multicast address record without sources.
+type MLDv2Record []byte
+
+// Encode encodes a multicast address record of the given type, for the given
+// group and without sources.
+func (b MLDv2Record) Encode(t MLDv2RecordType, group tcpip.Address) {
+	b[0] = byte(t)
+	b[1] = 0
+	binary.BigEndian.PutUint16(b[2:], 0)
+	copy(b[4:20], group)
+}
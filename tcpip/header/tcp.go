@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 
 	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/seqnum"
 )
 
 const (
@@ -30,16 +31,50 @@ const (
 	TCPFlagPsh
 	TCPFlagAck
 	TCPFlagUrg
+	TCPFlagEce
+	TCPFlagCwr
 )
 
 // Options that may be present in a TCP segment.
 const (
-	TCPOptionEOL = 0
-	TCPOptionNOP = 1
-	TCPOptionMSS = 2
-	TCPOptionWS  = 3
+	TCPOptionEOL           = 0
+	TCPOptionNOP           = 1
+	TCPOptionMSS           = 2
+	TCPOptionWS            = 3
+	TCPOptionSACKPermitted = 4
+	TCPOptionSACK          = 5
+	TCPOptionTS            = 8
+	TCPOptionFastOpen      = 34
 )
 
+const (
+	// TCPOptionsMaximumSize is the maximum size of the options of a tcp
+	// header.
+	TCPOptionsMaximumSize = 40
+
+	// TCPMaxSACKBlocks is the maximum number of blocks that fit in a SACK
+	// option, when it is the only option.
+	TCPMaxSACKBlocks = 4
+
+	// TCPFastOpenCookieMinimumSize and TCPFastOpenCookieMaximumSize are the
+	// bounds of the size of the cookie of a Fast Open option, per RFC 7413,
+	// section 4.1.1.
+	TCPFastOpenCookieMinimumSize = 4
+	TCPFastOpenCookieMaximumSize = 16
+
+	// TCPTimestampOptionSize is the size of a timestamps option, padded
+	// with two NOP options, as added by AppendTimestampOption.
+	TCPTimestampOptionSize = 12
+)
+
+// SACKBlock is a block of contiguous data reported as received by a SACK option
+// (RFC 2018). Start is the sequence number of its first byte, and End is the
+// sequence number following its last byte.
+type SACKBlock struct {
+	Start seqnum.Value
+	End   seqnum.Value
+}
+
 // TCPFields contains the fields of a TCP packet. It is used to describe the
 // fields of a packet that needs to be encoded.
 type TCPFields struct {
@@ -196,3 +231,95 @@ func (b TCP) EncodePartial(partialChecksum, length uint16, seqnum, acknum uint32
 	// Encode the checksum.
 	b.SetChecksum(^checksum)
 }
+
+// Options returns a subslice of the tcp header containing its options.
+func (b TCP) Options() []byte {
+	return b[TCPMinimumSize:b.DataOffset()]
+}
+
+// TCPOption returns the data of the first option of the given kind in the tcp
+// options opts, excluding its kind and length bytes, and whether it was found.
+// The search stops at the end-of-options option or at a malformed option.
+func TCPOption(opts []byte, kind byte) ([]byte, bool) {
+	limit := len(opts)
+	for i := 0; i < limit; {
+		switch opts[i] {
+		case TCPOptionEOL:
+			return nil, false
+		case TCPOptionNOP:
+			i++
+		default:
+			if i+2 > limit {
+				return nil, false
+			}
+			l := int(opts[i+1])
+			if l < 2 || i+l > limit {
+				return nil, false
+			}
+			if opts[i] == kind {
+				return opts[i+2 : i+l], true
+			}
+			i += l
+		}
+	}
+	return nil, false
+}
+
+// ParseSACKBlocks returns the blocks of the SACK option found in the tcp
+// options opts, or nil if there is no valid one.
+func ParseSACKBlocks(opts []byte) []SACKBlock {
+	v, ok := TCPOption(opts, TCPOptionSACK)
+	if !ok || len(v) == 0 || len(v)%8 != 0 {
+		return nil
+	}
+
+	blocks := make([]SACKBlock, len(v)/8)
+	for i := range blocks {
+		blocks[i].Start = seqnum.Value(binary.BigEndian.Uint32(v[8*i:]))
+		blocks[i].End = seqnum.Value(binary.BigEndian.Uint32(v[8*i+4:]))
+	}
+	return blocks
+}
+
+// AppendSACKOption appends to b a SACK option carrying the given blocks,
+// preceded by two NOP options so that the blocks are 4-byte aligned, and
+// returns the extended slice. At most TCPMaxSACKBlocks blocks are encoded.
+func AppendSACKOption(b []byte, blocks []SACKBlock) []byte {
+	if len(blocks) > TCPMaxSACKBlocks {
+		blocks = blocks[:TCPMaxSACKBlocks]
+	}
+
+	b = append(b, TCPOptionNOP, TCPOptionNOP, TCPOptionSACK, byte(2+8*len(blocks)))
+	var v [8]byte
+	for _, block := range blocks {
+		binary.BigEndian.PutUint32(v[0:], uint32(block.Start))
+		binary.BigEndian.PutUint32(v[4:], uint32(block.End))
+		b = append(b, v[:]...)
+	}
+	return b
+}
+
+// ParseTimestampOption returns the TSval and TSecr fields of the timestamps
+// option (RFC 7323) found in the tcp options opts, and whether there is a valid
+// one.
+func ParseTimestampOption(opts []byte) (tsVal, tsEcr uint32, ok bool) {
+	v, ok := TCPOption(opts, TCPOptionTS)
+	if !ok || len(v) != 8 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(v), binary.BigEndian.Uint32(v[4:]), true
+}
+
+// AppendTimestampOption appends to b a timestamps option with the given TSval
+// and TSecr fields, preceded by two NOP options so that it is 4-byte aligned,
+// and returns the extended slice.
+func AppendTimestampOption(b []byte, tsVal, tsEcr uint32) []byte {
+	var v [TCPTimestampOptionSize]byte
+	v[0] = TCPOptionNOP
+	v[1] = TCPOptionNOP
+	v[2] = TCPOptionTS
+	v[3] = 10
+	binary.BigEndian.PutUint32(v[4:], tsVal)
+	binary.BigEndian.PutUint32(v[8:], tsEcr)
+	return append(b, v[:]...)
+}
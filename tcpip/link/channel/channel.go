@@ -18,6 +18,9 @@ type PacketInfo struct {
 	Header  buffer.View
 	Payload buffer.View
 	Proto   tcpip.NetworkProtocolNumber
+
+	// RemoteLinkAddress is the link address the packet is sent to.
+	RemoteLinkAddress tcpip.LinkAddress
 }
 
 // Endpoint is link layer endpoint that stores outbound packets in a channel
@@ -57,8 +60,13 @@ func (e *Endpoint) Drain() int {
 
 // Inject injects an inbound packet.
 func (e *Endpoint) Inject(protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	e.InjectLinkAddr(protocol, "", vv)
+}
+
+// InjectLinkAddr injects an inbound packet sent from the given link address.
+func (e *Endpoint) InjectLinkAddr(protocol tcpip.NetworkProtocolNumber, remoteLinkAddr tcpip.LinkAddress, vv *buffer.VectorisedView) {
 	uu := vv.Clone(nil)
-	e.dispatcher.DeliverNetworkPacket(e, "", protocol, &uu)
+	e.dispatcher.DeliverNetworkPacket(e, remoteLinkAddr, protocol, &uu)
 }
 
 // Attach saves the stack network-layer dispatcher for use later when packets
@@ -85,10 +93,11 @@ func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
 }
 
 // WritePacket stores outbound packets into the channel.
-func (e *Endpoint) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
+func (e *Endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
 	p := PacketInfo{
-		Header: hdr.View(),
-		Proto:  protocol,
+		Header:            hdr.View(),
+		Proto:             protocol,
+		RemoteLinkAddress: r.RemoteLinkAddress,
 	}
 
 	if payload != nil {
@@ -69,7 +69,13 @@ func (e *endpoint) LinkAddress() tcpip.LinkAddress {
 // higher-level protocols to write packets; it just logs the packet and forwards
 // the request to the lower endpoint.
 func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
-	LogPacket("send", protocol, hdr.UsedBytes(), payload)
+	b, plb := hdr.UsedBytes(), []byte(payload)
+	if len(b) == 0 {
+		// Packets written directly to the link, e.g. by packet
+		// endpoints, carry their network-layer header in the payload.
+		b, plb = plb, nil
+	}
+	LogPacket("send", protocol, b, plb)
 	return e.lower.WritePacket(r, hdr, payload, protocol)
 }
 
@@ -0,0 +1,194 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ip_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+func TestConnTrackEntries(t *testing.T) {
+	s, ep1, ep2 := newRouter(t)
+	if err := s.SetConnTrackOptions(tcpip.ConnTrackOptions{Enabled: true}); err != nil {
+		t.Fatalf("SetConnTrackOptions failed: %v", err)
+	}
+	events := make(chan tcpip.ConnTrackEvent, 10)
+	s.SubscribeConnTrack(events)
+
+	original := tcpip.ConnTrackTuple{
+		Protocol:        header.UDPProtocolNumber,
+		Source:          v4Remote1,
+		SourcePort:      5000,
+		Destination:     v4Remote2,
+		DestinationPort: 53,
+	}
+	checkEvent := func(typ tcpip.ConnTrackEventType) {
+		select {
+		case e := <-events:
+			if e.Type != typ || e.Entry.Original != original || e.Entry.Reply != original.Reverse() {
+				t.Errorf("got event %d for %+v, want %d for %+v", e.Type, e.Entry.Original, typ, original)
+			}
+		default:
+			t.Errorf("no event %d", typ)
+		}
+	}
+
+	injectUDP(ep1, v4Remote1, 5000, v4Remote2, 53)
+	injectUDP(ep1, v4Remote1, 5000, v4Remote2, 53)
+	checkEvent(tcpip.ConnTrackNew)
+	entries := s.ConnTrackEntries()
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if e := entries[0]; e.Original != original || e.Established || e.OriginalCounters.Packets != 2 || e.ReplyCounters.Packets != 0 {
+		t.Errorf("got entry %+v, want 2 original packets and no reply", e)
+	}
+
+	injectUDP(ep2, v4Remote2, 53, v4Remote1, 5000)
+	checkEvent(tcpip.ConnTrackEstablished)
+	entries = s.ConnTrackEntries()
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	want := tcpip.FilterCounters{Packets: 1, Bytes: header.UDPMinimumSize + 10}
+	if e := entries[0]; !e.Established || e.ReplyCounters != want {
+		t.Errorf("got entry %+v, want established with reply counters %+v", e, want)
+	}
+
+	s.FlushConnTrack()
+	checkEvent(tcpip.ConnTrackDestroyed)
+	if entries := s.ConnTrackEntries(); len(entries) != 0 {
+		t.Errorf("got %d entries after flush, want 0", len(entries))
+	}
+
+	// Unsubscribed channels don't get events.
+	s.UnsubscribeConnTrack(events)
+	injectUDP(ep1, v4Remote1, 5000, v4Remote2, 53)
+	select {
+	case e := <-events:
+		t.Errorf("got event %+v after unsubscribing", e)
+	default:
+	}
+
+	ep1.Drain()
+	ep2.Drain()
+}
+
+func TestConnTrackStatefulFilter(t *testing.T) {
+	s, ep1, ep2 := newRouter(t)
+
+	// Only connections started from NIC 1, and errors related to them,
+	// are forwarded.
+	rules := []tcpip.FilterRule{
+		{ConnStates: tcpip.ConnStateEstablished | tcpip.ConnStateRelated, Verdict: tcpip.FilterAccept},
+		{InputNIC: 1, ConnStates: tcpip.ConnStateNew, Verdict: tcpip.FilterAccept},
+		{Verdict: tcpip.FilterDrop},
+	}
+	if err := s.SetFilterRules(tcpip.FilterForward, rules); err != nil {
+		t.Fatalf("SetFilterRules failed: %v", err)
+	}
+
+	injectTCP(ep1, v4Remote1, 6000, v4Remote2, 80, header.TCPFlagSyn, 1000, 0)
+	checkTranslated(t, ep2, v4Remote1, 6000, v4Remote2, 80)
+	injectTCP(ep2, v4Remote2, 80, v4Remote1, 6000, header.TCPFlagSyn|header.TCPFlagAck, 5000, 1001)
+	checkTranslated(t, ep1, v4Remote2, 80, v4Remote1, 6000)
+	injectTCP(ep1, v4Remote1, 6000, v4Remote2, 80, header.TCPFlagAck, 1001, 5001)
+	checkTranslated(t, ep2, v4Remote1, 6000, v4Remote2, 80)
+
+	// New connections from NIC 2, and segments that belong to no
+	// connection, are dropped.
+	injectTCP(ep2, v4Remote2, 7000, v4Remote1, 22, header.TCPFlagSyn, 1000, 0)
+	injectTCP(ep2, v4Remote2, 7001, v4Remote1, 22, header.TCPFlagAck, 1000, 1)
+	injectUDP(ep2, v4Remote2, 7002, v4Remote1, 53)
+	if c := ep1.Drain(); c != 0 {
+		t.Errorf("got %d forwarded packets, want 0", c)
+	}
+
+	// ICMP errors about forwarded packets are related to their
+	// connection.
+	injectUDP(ep1, v4Remote1, 5000, v4Remote2, 53)
+	ep2.Drain()
+	unreachable := func(srcPort uint16) buffer.View {
+		quoted := buffer.NewView(header.IPv4MinimumSize + 8)
+		header.IPv4(quoted).Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(quoted)),
+			TTL:         63,
+			Protocol:    uint8(header.UDPProtocolNumber),
+			SrcAddr:     v4Remote1,
+			DstAddr:     v4Remote2,
+		})
+		header.UDP(quoted[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+			SrcPort: srcPort,
+			DstPort: 53,
+			Length:  8,
+		})
+		v := buffer.NewView(8 + len(quoted))
+		header.ICMPv4(v).SetType(header.ICMPv4DstUnreachable)
+		copy(v[8:], quoted)
+		return v
+	}
+	injectTransport(ep2, header.ICMPv4ProtocolNumber, v4Remote2, v4Remote1, unreachable(5000))
+	if c := ep1.Drain(); c != 1 {
+		t.Errorf("got %d forwarded related errors, want 1", c)
+	}
+	injectTransport(ep2, header.ICMPv4ProtocolNumber, v4Remote2, v4Remote1, unreachable(5001))
+	if c := ep1.Drain(); c != 0 {
+		t.Errorf("got %d forwarded unrelated errors, want 0", c)
+	}
+
+	// Connections stop being tracked once no rules need them.
+	if err := s.SetFilterRules(tcpip.FilterForward, nil); err != nil {
+		t.Fatalf("SetFilterRules failed: %v", err)
+	}
+	s.FlushConnTrack()
+	injectUDP(ep1, v4Remote1, 5000, v4Remote2, 53)
+	ep2.Drain()
+	if entries := s.ConnTrackEntries(); len(entries) != 0 {
+		t.Errorf("got %d entries without tracking, want 0", len(entries))
+	}
+}
+
+func TestConnTrackEarlyDrop(t *testing.T) {
+	s, ep1, ep2 := newRouter(t)
+	if err := s.SetConnTrackOptions(tcpip.ConnTrackOptions{Enabled: true, MaxConnections: 2}); err != nil {
+		t.Fatalf("SetConnTrackOptions failed: %v", err)
+	}
+
+	// The connection without replies is dropped to make room for a new
+	// one.
+	injectUDP(ep1, v4Remote1, 1, v4Remote2, 53)
+	injectUDP(ep2, v4Remote2, 53, v4Remote1, 1)
+	injectUDP(ep1, v4Remote1, 2, v4Remote2, 53)
+	injectUDP(ep1, v4Remote1, 3, v4Remote2, 53)
+	ports := make(map[uint16]bool)
+	for _, e := range s.ConnTrackEntries() {
+		ports[e.Original.SourcePort] = true
+	}
+	if len(ports) != 2 || !ports[1] || !ports[3] {
+		t.Errorf("got connections from ports %v, want 1 and 3", ports)
+	}
+
+	// Once all connections are established, packets starting new ones
+	// are dropped.
+	injectUDP(ep2, v4Remote2, 53, v4Remote1, 3)
+	ep1.Drain()
+	ep2.Drain()
+	injectUDP(ep1, v4Remote1, 4, v4Remote2, 53)
+	if c := ep2.Drain(); c != 0 {
+		t.Errorf("got %d forwarded packets with a full table, want 0", c)
+	}
+	if got := s.Stats().ConnTrackDroppedPackets; got != 1 {
+		t.Errorf("got %d dropped packets, want 1", got)
+	}
+
+	// Invalid options are refused.
+	if err := s.SetConnTrackOptions(tcpip.ConnTrackOptions{UDPTimeout: -1}); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetConnTrackOptions with a negative timeout = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+}
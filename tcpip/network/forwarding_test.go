@@ -0,0 +1,312 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ip_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	v4Addr1   = "\x0a\x00\x00\x01"
+	v4Addr2   = "\x0a\x00\x01\x01"
+	v4Remote1 = "\x0a\x00\x00\x02"
+	v4Remote2 = "\x0a\x00\x01\x02"
+
+	v6Addr1   = "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+	v6Addr2   = "\x20\x01\x0d\xb8\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+	v6Remote1 = "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"
+	v6Remote2 = "\x20\x01\x0d\xb8\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"
+	v6Subnet1 = "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	v6Subnet2 = "\x20\x01\x0d\xb8\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	v6Mask    = "\xff\xff\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00\x00\x00\x00\x00"
+)
+
+// newRouter creates a stack with two NICs, each attached to its own subnet,
+// and with forwarding enabled.
+func newRouter(t *testing.T) (*stack.Stack, *channel.Endpoint, *channel.Endpoint) {
+	s := stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id1, ep1 := channel.New(10, 1500, "")
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	id2, ep2 := channel.New(10, 1500, "")
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	for _, a := range []struct {
+		nic   tcpip.NICID
+		proto tcpip.NetworkProtocolNumber
+		addr  tcpip.Address
+	}{
+		{1, ipv4.ProtocolNumber, v4Addr1},
+		{2, ipv4.ProtocolNumber, v4Addr2},
+		{1, ipv6.ProtocolNumber, v6Addr1},
+		{2, ipv6.ProtocolNumber, v6Addr2},
+	} {
+		if err := s.AddAddress(a.nic, a.proto, a.addr); err != nil {
+			t.Fatalf("AddAddress(%d, %v) failed: %v", a.nic, a.addr, err)
+		}
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x0a\x00\x00\x00", Mask: "\xff\xff\xff\x00", NIC: 1},
+		{Destination: "\x0a\x00\x01\x00", Mask: "\xff\xff\xff\x00", NIC: 2},
+		{Destination: v6Subnet1, Mask: v6Mask, NIC: 1},
+		{Destination: v6Subnet2, Mask: v6Mask, NIC: 2},
+	})
+	s.SetForwarding(true)
+
+	// Discard the MLD reports announcing the solicited-node groups of the
+	// IPv6 addresses.
+	ep1.Drain()
+	ep2.Drain()
+
+	return s, ep1, ep2
+}
+
+func injectV4(ep *channel.Endpoint, src, dst tcpip.Address, ttl uint8) {
+	const payloadLen = 10
+	v := buffer.NewView(header.IPv4MinimumSize + payloadLen)
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         ttl,
+		Protocol:    200,
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	vv := v.ToVectorisedView([1]buffer.View{})
+	ep.Inject(ipv4.ProtocolNumber, &vv)
+}
+
+func injectV6(ep *channel.Endpoint, src, dst tcpip.Address, hopLimit uint8) {
+	const payloadLen = 10
+	v := buffer.NewView(header.IPv6MinimumSize + payloadLen)
+	header.IPv6(v).Encode(&header.IPv6Fields{
+		PayloadLength: payloadLen,
+		NextHeader:    200,
+		HopLimit:      hopLimit,
+		SrcAddr:       src,
+		DstAddr:       dst,
+	})
+	vv := v.ToVectorisedView([1]buffer.View{})
+	ep.Inject(ipv6.ProtocolNumber, &vv)
+}
+
+func packetBytes(p channel.PacketInfo) buffer.View {
+	return append(append(buffer.View(nil), p.Header...), p.Payload...)
+}
+
+func TestIPv4Forwarding(t *testing.T) {
+	s, ep1, ep2 := newRouter(t)
+
+	injectV4(ep1, v4Remote1, v4Remote2, 5)
+	select {
+	case p := <-ep2.C:
+		ip := header.IPv4(packetBytes(p))
+		if got, want := ip.TTL(), uint8(4); got != want {
+			t.Errorf("TTL = %d, want %d", got, want)
+		}
+		if ip.CalculateChecksum() != 0xffff {
+			t.Errorf("bad checksum in forwarded packet: %x", ip.Checksum())
+		}
+		if ip.DestinationAddress() != v4Remote2 {
+			t.Errorf("DestinationAddress = %v, want %v", ip.DestinationAddress(), tcpip.Address(v4Remote2))
+		}
+	default:
+		t.Fatalf("packet wasn't forwarded")
+	}
+	if got := s.Stats().ForwardedPackets; got != 1 {
+		t.Errorf("ForwardedPackets = %d, want 1", got)
+	}
+
+	// A packet whose TTL expires must be dropped and reported.
+	injectV4(ep1, v4Remote1, v4Remote2, 1)
+	if c := ep2.Drain(); c != 0 {
+		t.Errorf("got %d forwarded packets, want 0", c)
+	}
+	select {
+	case p := <-ep1.C:
+		b := packetBytes(p)
+		ip := header.IPv4(b)
+		if ip.DestinationAddress() != v4Remote1 || ip.SourceAddress() != v4Addr1 {
+			t.Errorf("got ICMP from %v to %v, want from %v to %v", ip.SourceAddress(), ip.DestinationAddress(), tcpip.Address(v4Addr1), tcpip.Address(v4Remote1))
+		}
+		icmp := header.ICMPv4(ip.Payload())
+		if icmp.Type() != header.ICMPv4TimeExceeded {
+			t.Errorf("ICMP type = %d, want %d", icmp.Type(), header.ICMPv4TimeExceeded)
+		}
+	default:
+		t.Fatalf("no ICMP Time Exceeded was sent")
+	}
+	if got := s.Stats().ForwardDroppedPackets; got != 1 {
+		t.Errorf("ForwardDroppedPackets = %d, want 1", got)
+	}
+
+	// Unroutable packets are counted.
+	injectV4(ep1, v4Remote1, "\x0b\x00\x00\x01", 5)
+	if got := s.Stats().UnroutablePackets; got != 1 {
+		t.Errorf("UnroutablePackets = %d, want 1", got)
+	}
+
+	// Nothing is forwarded when forwarding is disabled on the ingress NIC.
+	if err := s.SetNICForwarding(1, false); err != nil {
+		t.Fatalf("SetNICForwarding failed: %v", err)
+	}
+	injectV4(ep1, v4Remote1, v4Remote2, 5)
+	if c := ep2.Drain(); c != 0 {
+		t.Errorf("got %d forwarded packets, want 0", c)
+	}
+
+	// Nor when it is disabled stack-wide.
+	if err := s.SetNICForwarding(1, true); err != nil {
+		t.Fatalf("SetNICForwarding failed: %v", err)
+	}
+	s.SetForwarding(false)
+	injectV4(ep1, v4Remote1, v4Remote2, 5)
+	if c := ep2.Drain(); c != 0 {
+		t.Errorf("got %d forwarded packets, want 0", c)
+	}
+}
+
+func TestIPv6Forwarding(t *testing.T) {
+	s, ep1, ep2 := newRouter(t)
+
+	injectV6(ep2, v6Remote2, v6Remote1, 5)
+	select {
+	case p := <-ep1.C:
+		ip := header.IPv6(packetBytes(p))
+		if got, want := ip.HopLimit(), uint8(4); got != want {
+			t.Errorf("HopLimit = %d, want %d", got, want)
+		}
+	default:
+		t.Fatalf("packet wasn't forwarded")
+	}
+
+	injectV6(ep2, v6Remote2, v6Remote1, 1)
+	if c := ep1.Drain(); c != 0 {
+		t.Errorf("got %d forwarded packets, want 0", c)
+	}
+	select {
+	case p := <-ep2.C:
+		b := packetBytes(p)
+		ip := header.IPv6(b)
+		icmp := header.ICMPv6(ip.Payload())
+		if icmp.Type() != header.ICMPv6TimeExceeded {
+			t.Errorf("ICMPv6 type = %d, want %d", icmp.Type(), header.ICMPv6TimeExceeded)
+		}
+		sum := icmp.Checksum()
+		icmp.SetChecksum(0)
+		if want := header.ICMPv6Checksum(icmp[:header.ICMPv6ErrorHeaderSize], ip.SourceAddress(), ip.DestinationAddress(), icmp[header.ICMPv6ErrorHeaderSize:]); sum != want {
+			t.Errorf("ICMPv6 checksum = %x, want %x", sum, want)
+		}
+	default:
+		t.Fatalf("no ICMPv6 Time Exceeded was sent")
+	}
+
+	if got := s.Stats().ForwardedPackets; got != 1 {
+		t.Errorf("ForwardedPackets = %d, want 1", got)
+	}
+}
+
+func TestForwardingLocalDelivery(t *testing.T) {
+	s, ep1, ep2 := newRouter(t)
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: v4Addr2, Port: 80}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// A packet addressed to the router's address on NIC 2, but received on
+	// NIC 1, is delivered locally rather than forwarded.
+	payload := []byte{1, 2, 3, 4}
+	v := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize + len(payload))
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         5,
+		Protocol:    uint8(udp.ProtocolNumber),
+		SrcAddr:     v4Remote1,
+		DstAddr:     v4Addr2,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	header.UDP(ip.Payload()).Encode(&header.UDPFields{
+		SrcPort: 1000,
+		DstPort: 80,
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	copy(ip.Payload()[header.UDPMinimumSize:], payload)
+	vv := v.ToVectorisedView([1]buffer.View{})
+	ep1.Inject(ipv4.ProtocolNumber, &vv)
+
+	var addr tcpip.FullAddress
+	got, err := ep.Read(&addr)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(got) != string(payload) || addr.Addr != v4Remote1 {
+		t.Errorf("Read = %x from %v, want %x from %v", got, addr.Addr, payload, tcpip.Address(v4Remote1))
+	}
+	if c := ep2.Drain(); c != 0 {
+		t.Errorf("got %d forwarded packets, want 0", c)
+	}
+	if got := s.Stats().ForwardedPackets; got != 0 {
+		t.Errorf("ForwardedPackets = %d, want 0", got)
+	}
+}
+
+func TestForwardingInvalidSource(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		v6   bool
+		src  tcpip.Address
+		dst  tcpip.Address
+	}{
+		{"v4 unspecified", false, header.IPv4Any, v4Remote2},
+		{"v4 limited broadcast", false, header.IPv4Broadcast, v4Remote2},
+		{"v4 directed broadcast", false, "\x0a\x00\x00\xff", v4Remote2},
+		{"v4 multicast", false, "\xe0\x00\x00\x01", v4Remote2},
+		{"v6 unspecified", true, header.IPv6Any, v6Remote2},
+		{"v6 multicast", true, "\xff\x0e\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01", v6Remote2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s, ep1, ep2 := newRouter(t)
+			if test.v6 {
+				injectV6(ep1, test.src, test.dst, 5)
+			} else {
+				injectV4(ep1, test.src, test.dst, 5)
+			}
+			if c := ep2.Drain(); c != 0 {
+				t.Errorf("got %d forwarded packets, want 0", c)
+			}
+			if c := ep1.Drain(); c != 0 {
+				t.Errorf("got %d replies, want 0", c)
+			}
+			if got := s.Stats().ForwardDroppedPackets; got != 1 {
+				t.Errorf("ForwardDroppedPackets = %d, want 1", got)
+			}
+		})
+	}
+}
@@ -6,25 +6,23 @@ package ipv4
 
 import (
 	"context"
-	"encoding/binary"
 	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/stack"
-	"github.com/google/netstack/waiter"
+	"github.com/google/netstack/tcpip/transport/icmp"
 )
 
-// PingProtocolName is a pseudo transport protocol used to handle ping replies.
-// Use it when constructing a stack that intends to use ipv4.Ping.
-const PingProtocolName = "icmpv4ping"
-
-// pingProtocolNumber is a fake transport protocol used to
-// deliver incoming ICMP echo replies. The ICMP identifier
-// number is used as a port number for multiplexing.
-const pingProtocolNumber tcpip.TransportProtocolNumber = 256 + 11
+// PingProtocolName is the name of the transport protocol Pinger sends echo
+// requests through, which must be enabled on the stack. It is the ICMPv4
+// protocol of the icmp package.
+const PingProtocolName = icmp.ProtocolName4
 
+// handleICMP handles an ICMP packet received by the endpoint. Echo requests are
+// answered by the endpoint itself and echo replies are delivered to the
+// transport dispatcher, while raw endpoints receive a copy of every message.
 func (e *endpoint) handleICMP(r *stack.Route, vv *buffer.VectorisedView) {
 	v := vv.First()
 	if len(v) < header.ICMPv4MinimumSize {
@@ -32,6 +30,14 @@ func (e *endpoint) handleICMP(r *stack.Route, vv *buffer.VectorisedView) {
 	}
 	h := header.ICMPv4(v)
 
+	// Echo replies go through the transport dispatcher, which delivers
+	// the raw copies itself.
+	if h.Type() == header.ICMPv4EchoReply && len(v) >= header.ICMPv4EchoMinimumSize {
+		e.dispatcher.DeliverTransportPacket(r, header.ICMPv4ProtocolNumber, vv)
+		return
+	}
+	e.deliverRawPacket(r, header.ICMPv4ProtocolNumber, vv)
+
 	switch h.Type() {
 	case header.ICMPv4Echo:
 		if len(v) < header.ICMPv4EchoMinimumSize {
@@ -44,8 +50,6 @@ func (e *endpoint) handleICMP(r *stack.Route, vv *buffer.VectorisedView) {
 		default:
 			req.r.Release()
 		}
-	case header.ICMPv4EchoReply:
-		e.dispatcher.DeliverTransportPacket(r, pingProtocolNumber, vv)
 	}
 	// TODO(crawshaw): Handle other ICMP types.
 }
@@ -73,103 +77,120 @@ func sendICMPv4(r *stack.Route, typ header.ICMPv4Type, code byte, data buffer.Vi
 	return r.WritePacket(&hdr, data, header.ICMPv4ProtocolNumber)
 }
 
-// A Pinger can send echo requests to an address.
-type Pinger struct {
-	Stack     *stack.Stack
-	NICID     tcpip.NICID
-	Addr      tcpip.Address
-	LocalAddr tcpip.Address // optional
-	Wait      time.Duration // if zero, defaults to 1 second
-	Count     uint16        // if zero, defaults to MaxUint16
-}
+// sendTimeExceeded sends an ICMP Time Exceeded message about the given packet
+// through r. As required by RFC 792, the message carries the IP header of the
+// packet and the first 8 bytes of its payload.
+func sendTimeExceeded(r *stack.Route, vv *buffer.VectorisedView) {
+	h := header.IPv4(vv.First())
 
-// Ping sends echo requests to an ICMPv4 endpoint.
-// Responses are streamed to the channel ch.
-func (p *Pinger) Ping(ctx context.Context, ch chan<- PingReply) error {
-	count := p.Count
-	if count == 0 {
-		count = 1<<16 - 1
-	}
-	wait := p.Wait
-	if wait == 0 {
-		wait = 1 * time.Second
+	// Never report errors about ICMP error messages, to avoid storms.
+	if h.Protocol() == uint8(header.ICMPv4ProtocolNumber) && len(h) >= int(h.HeaderLength())+header.ICMPv4MinimumSize {
+		switch header.ICMPv4(h[h.HeaderLength():]).Type() {
+		case header.ICMPv4Echo, header.ICMPv4EchoReply:
+		default:
+			return
+		}
 	}
 
-	r, err := p.Stack.FindRoute(p.NICID, p.LocalAddr, p.Addr, ProtocolNumber)
-	if err != nil {
-		return err
+	n := int(h.HeaderLength()) + 8
+	if n > vv.Size() {
+		n = vv.Size()
 	}
 
-	netProtos := []tcpip.NetworkProtocolNumber{ProtocolNumber}
-	ep := &pingEndpoint{
-		stack: p.Stack,
-		pktCh: make(chan buffer.View, 1),
-	}
-	id := stack.TransportEndpointID{
-		LocalAddress:  r.LocalAddress,
-		RemoteAddress: p.Addr,
+	v := vv.First()
+	if len(v) < n {
+		v = vv.ToView()
 	}
 
-	_, err = p.Stack.PickEphemeralPort(func(port uint16) (bool, error) {
-		id.LocalPort = port
-		err := p.Stack.RegisterTransportEndpoint(p.NICID, netProtos, pingProtocolNumber, id, ep)
-		switch err {
-		case nil:
-			return true, nil
-		case tcpip.ErrDuplicateAddress:
-			return false, nil
+	// The first 4 bytes of the message body are unused.
+	data := buffer.NewView(4 + n)
+	copy(data[4:], v[:n])
+
+	sendICMPv4(r, header.ICMPv4TimeExceeded, 0, data)
+}
+
+// sendAdminProhibited sends an ICMP Destination Unreachable message, with the
+// "administratively prohibited" code, through r about a packet of the given
+// transport protocol sent from src to dst. The message carries an IP header
+// rebuilt from these, followed by the first 8 bytes of transport.
+func sendAdminProhibited(r *stack.Route, src, dst tcpip.Address, protocol tcpip.TransportProtocolNumber, transport buffer.View) {
+	// Never report errors about ICMP error messages, to avoid storms.
+	if protocol == header.ICMPv4ProtocolNumber {
+		if len(transport) < header.ICMPv4MinimumSize {
+			return
+		}
+		switch header.ICMPv4(transport).Type() {
+		case header.ICMPv4Echo, header.ICMPv4EchoReply:
 		default:
-			return false, err
+			return
 		}
-	})
-	if err != nil {
-		return err
 	}
-	defer p.Stack.UnregisterTransportEndpoint(p.NICID, netProtos, pingProtocolNumber, id)
 
-	v := buffer.NewView(4)
-	binary.BigEndian.PutUint16(v[0:], id.LocalPort)
+	// Nor about packets that don't identify a single source.
+	if src == header.IPv4Any || src == header.IPv4Broadcast || header.IsV4MulticastAddress(src) {
+		return
+	}
 
-	start := time.Now()
+	n := 8
+	if n > len(transport) {
+		n = len(transport)
+	}
 
-	done := make(chan struct{})
-	go func(count int) {
-	loop:
-		for ; count > 0; count-- {
-			select {
-			case v := <-ep.pktCh:
-				seq := binary.BigEndian.Uint16(v[header.ICMPv4MinimumSize+2:])
-				ch <- PingReply{
-					Duration:  time.Since(start) - time.Duration(seq)*wait,
-					SeqNumber: seq,
-				}
-			case <-ctx.Done():
-				break loop
-			}
-		}
-		close(done)
-	}(int(count))
-	defer func() { <-done }()
+	// The first 4 bytes of the message body are unused.
+	data := buffer.NewView(4 + header.IPv4MinimumSize + n)
+	ip := header.IPv4(data[4:])
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(header.IPv4MinimumSize + len(transport)),
+		Protocol:    uint8(protocol),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	copy(data[4+header.IPv4MinimumSize:], transport)
 
-	t := time.NewTicker(wait)
-	defer t.Stop()
-	for seq := uint16(0); seq < count; seq++ {
-		select {
-		case <-t.C:
-		case <-ctx.Done():
-			return nil
-		}
-		binary.BigEndian.PutUint16(v[2:], seq)
-		sent := time.Now()
-		if err := sendICMPv4(&r, header.ICMPv4Echo, 0, v); err != nil {
+	sendICMPv4(r, header.ICMPv4DstUnreachable, header.ICMPv4AdminProhibited, data)
+}
+
+// A Pinger can send echo requests to an address. It is a thin wrapper around
+// icmp.Pinger; use the latter for IPv6 addresses and more options.
+type Pinger struct {
+	Stack     *stack.Stack
+	NICID     tcpip.NICID
+	Addr      tcpip.Address
+	LocalAddr tcpip.Address // optional
+	Wait      time.Duration // if zero, defaults to 1 second
+	Count     uint16        // if zero, defaults to MaxUint16
+}
+
+// Ping sends echo requests to an ICMPv4 endpoint.
+// Responses are streamed to the channel ch.
+func (p *Pinger) Ping(ctx context.Context, ch chan<- PingReply) error {
+	replies := make(chan icmp.PingReply)
+	done := make(chan struct{})
+	go func() {
+		for r := range replies {
 			ch <- PingReply{
-				Error:     err,
-				Duration:  time.Since(sent),
-				SeqNumber: seq,
+				Error:     r.Error,
+				Duration:  r.Duration,
+				SeqNumber: r.SeqNumber,
 			}
 		}
+		close(done)
+	}()
+
+	ip := icmp.Pinger{
+		Stack:     p.Stack,
+		NICID:     p.NICID,
+		Addr:      p.Addr,
+		LocalAddr: p.LocalAddr,
+		Interval:  p.Wait,
+		Count:     p.Count,
 	}
-	return nil
+	_, err := ip.Ping(ctx, replies)
+	close(replies)
+	<-done
+	return err
 }
 
 // PingReply summarizes an ICMP echo reply.
@@ -178,42 +199,3 @@ type PingReply struct {
 	Duration  time.Duration
 	SeqNumber uint16
 }
-
-type pingProtocol struct{}
-
-func (*pingProtocol) NewEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
-	return nil, tcpip.ErrNotSupported // endpoints are created directly
-}
-
-func (*pingProtocol) Number() tcpip.TransportProtocolNumber { return pingProtocolNumber }
-
-func (*pingProtocol) MinimumPacketSize() int { return header.ICMPv4EchoMinimumSize }
-
-func (*pingProtocol) ParsePorts(v buffer.View) (src, dst uint16, err error) {
-	ident := binary.BigEndian.Uint16(v[4:])
-	return 0, ident, nil
-}
-
-func (*pingProtocol) HandleUnknownDestinationPacket(*stack.Route, stack.TransportEndpointID, *buffer.VectorisedView) bool {
-	return true
-}
-
-func init() {
-	stack.RegisterTransportProtocol(PingProtocolName, &pingProtocol{})
-}
-
-type pingEndpoint struct {
-	stack *stack.Stack
-	pktCh chan buffer.View
-}
-
-func (e *pingEndpoint) Close() {
-	close(e.pktCh)
-}
-
-func (e *pingEndpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv *buffer.VectorisedView) {
-	select {
-	case e.pktCh <- vv.ToView():
-	default:
-	}
-}
@@ -11,6 +11,8 @@ import (
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/checker"
+	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/link/channel"
 	"github.com/google/netstack/tcpip/link/sniffer"
 	"github.com/google/netstack/tcpip/network/ipv4"
@@ -122,3 +124,79 @@ func TestEchoSequence(t *testing.T) {
 		}
 	}
 }
+
+const remoteAddr = "\x0a\x00\x00\x02"
+
+// sendEcho injects an ICMP echo request from remoteAddr.
+func (c *testContext) sendEcho() {
+	buf := buffer.NewView(header.IPv4MinimumSize + header.ICMPv4EchoMinimumSize + 4)
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     remoteAddr,
+		DstAddr:     stackAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	icmp := header.ICMPv4(ip.Payload())
+	icmp.SetType(header.ICMPv4Echo)
+	icmp.SetIdent(1234)
+	icmp.SetSequence(5)
+	copy(icmp[header.ICMPv4EchoMinimumSize:], "ping")
+	icmp.SetChecksum(^header.Checksum(icmp, 0))
+
+	vv := buf.ToVectorisedView([1]buffer.View{})
+	c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+}
+
+func TestEchoReply(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	c.sendEcho()
+
+	select {
+	case p := <-c.linkEP.C:
+		b := make([]byte, len(p.Header)+len(p.Payload))
+		copy(b, p.Header)
+		copy(b[len(p.Header):], p.Payload)
+
+		checker.IPv4(t, b, checker.SrcAddr(stackAddr), checker.DstAddr(remoteAddr))
+		reply := header.ICMPv4(header.IPv4(b).Payload())
+		if reply.Type() != header.ICMPv4EchoReply || reply.Ident() != 1234 || reply.Sequence() != 5 {
+			t.Fatalf("Got type %v, ident %v, sequence %v, want %v, 1234, 5", reply.Type(), reply.Ident(), reply.Sequence(), header.ICMPv4EchoReply)
+		}
+		if string(reply[header.ICMPv4EchoMinimumSize:]) != "ping" {
+			t.Fatalf("Got data %q, want %q", reply[header.ICMPv4EchoMinimumSize:], "ping")
+		}
+		if xsum := header.Checksum(reply, 0); xsum != 0xffff {
+			t.Fatalf("Bad ICMP checksum: 0x%x", xsum)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Echo reply wasn't written out")
+	}
+}
+
+func TestEchoFiltered(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	rules := []tcpip.FilterRule{{Protocol: header.ICMPv4ProtocolNumber, Verdict: tcpip.FilterDrop}}
+	if err := c.s.SetFilterRules(tcpip.FilterInput, rules); err != nil {
+		t.Fatalf("SetFilterRules failed: %v", err)
+	}
+
+	c.sendEcho()
+	select {
+	case <-c.linkEP.C:
+		t.Fatalf("Dropped echo request was answered")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := c.s.Stats().FilteredPackets; got != 1 {
+		t.Errorf("FilteredPackets = %d, want 1", got)
+	}
+}
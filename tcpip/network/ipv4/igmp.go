@@ -0,0 +1,383 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipv4
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	// olderVersionQuerierTimeout is the "Older Version Querier Present
+	// Timeout" of RFC 3376 section 8.12, computed with the default
+	// robustness variable, query interval and query response interval.
+	olderVersionQuerierTimeout = 2*125*time.Second + 10*time.Second
+
+	// v1MaxResponseTime is the maximum response time of IGMPv1 queries,
+	// which don't carry one.
+	v1MaxResponseTime = 10 * time.Second
+)
+
+// igmpState holds the state of the host side of IGMP for an endpoint. Hosts
+// use IGMPv3 unless an older querier is present on the network, as described
+// in RFC 3376 section 7.2.1.
+//
+// TODO: Retransmit unsolicited reports, suppress reports heard from other
+// hosts in IGMPv1/v2 mode, and add the Router Alert option to IGMP packets.
+type igmpState struct {
+	mu sync.Mutex
+
+	// v1Until and v2Until are the times until which an IGMPv1 or IGMPv2
+	// querier, respectively, is considered present.
+	v1Until time.Time
+	v2Until time.Time
+
+	// reports holds the pending responses to queries, keyed by the group
+	// they report, or by header.IPv4Any for the response to an IGMPv3
+	// general query, which reports every group.
+	reports map[tcpip.Address]*pendingReport
+	closed  bool
+}
+
+// pendingReport is a response to a query that is sent when its timer fires.
+type pendingReport struct {
+	timer    *time.Timer
+	deadline time.Time
+	route    stack.Route
+}
+
+// version returns the version of IGMP the endpoint currently speaks.
+func (s *igmpState) version() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case now.Before(s.v1Until):
+		return 1
+	case now.Before(s.v2Until):
+		return 2
+	}
+	return 3
+}
+
+// querierSeen records that a querier of the given version is present.
+func (s *igmpState) querierSeen(version int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until := time.Now().Add(olderVersionQuerierTimeout)
+	switch version {
+	case 1:
+		s.v1Until = until
+	case 2:
+		s.v2Until = until
+	}
+}
+
+// pending returns the deadline of the pending response for the given key, if
+// any.
+func (s *igmpState) pending(key tcpip.Address) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.reports[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return p.deadline, true
+}
+
+// schedule schedules a response for the given key that send sends through a
+// clone of r after delay. If a response is already pending for the key, its
+// timer is only moved earlier, as described in RFC 2236 section 3 and RFC 3376
+// section 5.2.
+func (s *igmpState) schedule(key tcpip.Address, delay time.Duration, r *stack.Route, send func(key tcpip.Address, r *stack.Route)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	deadline := time.Now().Add(delay)
+	if p, ok := s.reports[key]; ok {
+		// The timer can't be stopped if it's firing, in which case
+		// the response is being sent anyway.
+		if deadline.Before(p.deadline) && p.timer.Stop() {
+			p.timer.Reset(delay)
+			p.deadline = deadline
+		}
+		return
+	}
+
+	if s.reports == nil {
+		s.reports = make(map[tcpip.Address]*pendingReport)
+	}
+	p := &pendingReport{deadline: deadline, route: r.Clone()}
+	p.timer = time.AfterFunc(delay, func() {
+		// The response may have been cancelled while the timer fired;
+		// whoever removes it from the map releases its route.
+		s.mu.Lock()
+		if s.reports[key] != p {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.reports, key)
+		s.mu.Unlock()
+
+		send(key, &p.route)
+		p.route.Release()
+	})
+	s.reports[key] = p
+}
+
+// cancel cancels the pending response for the given key, if any.
+func (s *igmpState) cancel(key tcpip.Address) {
+	s.mu.Lock()
+	p, ok := s.reports[key]
+	if ok {
+		p.timer.Stop()
+		delete(s.reports, key)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		p.route.Release()
+	}
+}
+
+// stop cancels all pending responses, and prevents new ones from being
+// scheduled.
+func (s *igmpState) stop() {
+	s.mu.Lock()
+	reports := s.reports
+	s.reports = nil
+	s.closed = true
+	s.mu.Unlock()
+
+	for _, p := range reports {
+		p.timer.Stop()
+		p.route.Release()
+	}
+}
+
+// JoinedGroup implements stack.GroupReporter.JoinedGroup. It sends an
+// unsolicited membership report for the group.
+func (e *endpoint) JoinedGroup(r *stack.Route) {
+	group := r.RemoteAddress
+	switch e.igmp.version() {
+	case 1:
+		sendIGMP(r, group, header.IGMPv1MembershipReport, group)
+	case 2:
+		sendIGMP(r, group, header.IGMPv2MembershipReport, group)
+	default:
+		sendIGMPv3Report(r, header.IGMPv3ChangeToExcludeMode, []tcpip.Address{group})
+	}
+}
+
+// LeftGroup implements stack.GroupReporter.LeftGroup. It tells routers that
+// the NIC left the group.
+func (e *endpoint) LeftGroup(r *stack.Route) {
+	group := r.RemoteAddress
+	e.igmp.cancel(group)
+
+	switch e.igmp.version() {
+	case 1:
+		// IGMPv1 has no leave messages; routers time memberships out.
+	case 2:
+		sendIGMP(r, header.IPv4AllRoutersGroup, header.IGMPLeaveGroup, group)
+	default:
+		sendIGMPv3Report(r, header.IGMPv3ChangeToIncludeMode, []tcpip.Address{group})
+	}
+}
+
+// handleIGMP handles an IGMP packet received by the endpoint. Membership
+// queries are answered, after a random delay bounded by their maximum response
+// time, with reports for the groups they ask about. Only one response is kept
+// pending per group, and per endpoint for IGMPv3 general queries.
+func (e *endpoint) handleIGMP(r *stack.Route, vv *buffer.VectorisedView) {
+	v := vv.First()
+	if len(v) < vv.Size() {
+		v = vv.ToView()
+	}
+	if len(v) < header.IGMPMinimumSize || header.Checksum(v, 0) != 0xffff {
+		return
+	}
+
+	h := header.IGMP(v)
+	if h.Type() != header.IGMPMembershipQuery {
+		return
+	}
+
+	var version int
+	var maxResp time.Duration
+	switch {
+	case len(v) == header.IGMPMinimumSize && h.MaxRespCode() == 0:
+		version = 1
+		maxResp = v1MaxResponseTime
+	case len(v) == header.IGMPMinimumSize:
+		version = 2
+		maxResp = time.Duration(h.MaxRespCode()) * 100 * time.Millisecond
+	case len(v) >= header.IGMPv3QueryMinimumSize:
+		version = 3
+		maxResp = decodeMaxRespCode(h.MaxRespCode())
+	default:
+		return
+	}
+	e.igmp.querierSeen(version)
+
+	group := h.GroupAddress()
+	groups := queriedGroups(r, group)
+	if len(groups) == 0 {
+		return
+	}
+
+	delay := func() time.Duration {
+		if maxResp <= 0 {
+			return 0
+		}
+		return time.Duration(rand.Int63n(int64(maxResp)))
+	}
+
+	if version != 3 {
+		// IGMPv1 and IGMPv2 hosts report each group after its own delay.
+		for _, g := range groups {
+			e.igmp.schedule(g, delay(), r, e.sendQueryReport)
+		}
+		return
+	}
+
+	// No response needs to be scheduled if the one to a previous general
+	// query is sent first.
+	d := delay()
+	if deadline, ok := e.igmp.pending(header.IPv4Any); ok && deadline.Before(time.Now().Add(d)) {
+		return
+	}
+	e.igmp.schedule(group, d, r, e.sendQueryReport)
+}
+
+// queriedGroups returns the groups of the NIC of r that a query about group,
+// or about every group if it's the unspecified address, asks about. Sources of
+// IGMPv3 queries are ignored, as the stack only supports any-source
+// memberships.
+func queriedGroups(r *stack.Route, group tcpip.Address) []tcpip.Address {
+	var groups []tcpip.Address
+	for _, g := range r.MulticastGroups() {
+		if g == header.IPv4AllHostsGroup {
+			continue
+		}
+		if group == header.IPv4Any || group == g {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// sendQueryReport sends the pending response to a query about group, or about
+// every group if it's the unspecified address, with the version of IGMP the
+// endpoint speaks when it's sent.
+func (e *endpoint) sendQueryReport(group tcpip.Address, r *stack.Route) {
+	groups := queriedGroups(r, group)
+	if len(groups) == 0 {
+		return
+	}
+
+	switch e.igmp.version() {
+	case 1:
+		for _, g := range groups {
+			sendIGMP(r, g, header.IGMPv1MembershipReport, g)
+		}
+	case 2:
+		for _, g := range groups {
+			sendIGMP(r, g, header.IGMPv2MembershipReport, g)
+		}
+	default:
+		sendIGMPv3Report(r, header.IGMPv3ModeIsExclude, groups)
+	}
+}
+
+// decodeMaxRespCode decodes the "max response code" field of IGMPv3 queries,
+// as described in RFC 3376 section 4.1.1.
+func decodeMaxRespCode(code byte) time.Duration {
+	t := int(code)
+	if code >= 128 {
+		mant := int(code & 0xf)
+		exp := int(code>>4) & 0x7
+		t = (mant | 0x10) << uint(exp+3)
+	}
+	return time.Duration(t) * 100 * time.Millisecond
+}
+
+// igmpRoute returns a copy of r that sends IGMP packets to dst. It shares the
+// reference of r, so it must not be used once r is released.
+func igmpRoute(r *stack.Route, dst tcpip.Address) stack.Route {
+	ir := *r
+	ir.SetMulticastDestination(dst)
+	ir.TTL = 1
+	ir.MulticastLoop = false
+	return ir
+}
+
+// sendIGMP sends an IGMPv1 or IGMPv2 message of the given type about group to
+// dst.
+func sendIGMP(r *stack.Route, dst tcpip.Address, typ header.IGMPType, group tcpip.Address) error {
+	ir := igmpRoute(r, dst)
+	hdr := buffer.NewPrependable(header.IGMPMinimumSize + int(r.MaxHeaderLength()))
+
+	igmp := header.IGMP(hdr.Prepend(header.IGMPMinimumSize))
+	igmp.SetType(typ)
+	igmp.SetMaxRespCode(0)
+	igmp.SetGroupAddress(group)
+	igmp.SetChecksum(0)
+	igmp.SetChecksum(^header.Checksum(igmp, 0))
+
+	return ir.WritePacket(&hdr, nil, header.IGMPProtocolNumber)
+}
+
+// sendIGMPv3Report sends IGMPv3 membership reports with records of the given
+// type and without sources for the given groups, splitting them in as many
+// reports as needed to fit the MTU.
+func sendIGMPv3Report(r *stack.Route, typ header.IGMPv3RecordType, groups []tcpip.Address) error {
+	ir := igmpRoute(r, header.IPv4AllIGMPv3RoutersGroup)
+
+	max := (int(r.MTU()) - header.IGMPv3ReportMinimumSize) / header.IGMPv3GroupRecordMinimumSize
+	if max < 1 {
+		max = 1
+	}
+
+	for len(groups) > 0 {
+		n := len(groups)
+		if n > max {
+			n = max
+		}
+
+		size := header.IGMPv3ReportMinimumSize + n*header.IGMPv3GroupRecordMinimumSize
+		hdr := buffer.NewPrependable(size + int(r.MaxHeaderLength()))
+		b := hdr.Prepend(size)
+
+		igmp := header.IGMP(b)
+		igmp.SetType(header.IGMPv3MembershipReport)
+		header.IGMPv3Report(b).SetNumberOfRecords(uint16(n))
+		for i, g := range groups[:n] {
+			off := header.IGMPv3ReportMinimumSize + i*header.IGMPv3GroupRecordMinimumSize
+			header.IGMPv3GroupRecord(b[off:]).Encode(typ, g)
+		}
+		igmp.SetChecksum(^header.Checksum(b, 0))
+
+		if err := ir.WritePacket(&hdr, nil, header.IGMPProtocolNumber); err != nil {
+			return err
+		}
+		groups = groups[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipv4_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/checker"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/ipv4"
+)
+
+const (
+	testGroup   = "\xef\x01\x02\x03"
+	querierAddr = "\x0a\x00\x00\x02"
+)
+
+// getIGMP waits for an IGMP packet to be sent to dst and returns its IGMP
+// message.
+func (c *testContext) getIGMP(dst tcpip.Address) header.IGMP {
+	select {
+	case p := <-c.linkEP.C:
+		b := make([]byte, len(p.Header)+len(p.Payload))
+		copy(b, p.Header)
+		copy(b[len(p.Header):], p.Payload)
+
+		checker.IPv4(c.t, b, checker.SrcAddr(stackAddr), checker.DstAddr(dst), checker.TTL(1))
+		ip := header.IPv4(b)
+		if p := tcpip.TransportProtocolNumber(ip.Protocol()); p != header.IGMPProtocolNumber {
+			c.t.Fatalf("Bad protocol: got %v, want %v", p, header.IGMPProtocolNumber)
+		}
+
+		igmp := header.IGMP(ip.Payload())
+		if xsum := header.Checksum(igmp, 0); xsum != 0xffff {
+			c.t.Fatalf("Bad IGMP checksum: 0x%x", xsum)
+		}
+		return igmp
+
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Packet wasn't written out")
+	}
+
+	return nil
+}
+
+// expectNoPacket checks that no packet is sent for the given duration.
+func (c *testContext) expectNoPacket(d time.Duration) {
+	select {
+	case p := <-c.linkEP.C:
+		c.t.Fatalf("Unexpected packet: %v", p)
+	case <-time.After(d):
+	}
+}
+
+// sendQuery injects an IGMPv2 general query with the given maximum response
+// time, in tenths of a second.
+func (c *testContext) sendQuery(maxRespCode byte) {
+	buf := buffer.NewView(header.IPv4MinimumSize + header.IGMPMinimumSize)
+
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         1,
+		Protocol:    uint8(header.IGMPProtocolNumber),
+		SrcAddr:     querierAddr,
+		DstAddr:     header.IPv4AllHostsGroup,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	igmp := header.IGMP(buf[header.IPv4MinimumSize:])
+	igmp.SetType(header.IGMPMembershipQuery)
+	igmp.SetMaxRespCode(maxRespCode)
+	igmp.SetChecksum(^header.Checksum(igmp, 0))
+
+	vv := buf.ToVectorisedView([1]buffer.View{})
+	c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+}
+
+func TestIGMP(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	if err := c.s.JoinGroup(ipv4.ProtocolNumber, 1, stackAddr); err != tcpip.ErrBadAddress {
+		t.Fatalf("JoinGroup of a unicast address = %v, want %v", err, tcpip.ErrBadAddress)
+	}
+
+	// Joining sends an IGMPv3 report that changes the group to exclude
+	// mode.
+	if err := c.s.JoinGroup(ipv4.ProtocolNumber, 1, testGroup); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+	igmp := c.getIGMP(header.IPv4AllIGMPv3RoutersGroup)
+	if got, want := igmp.Type(), header.IGMPv3MembershipReport; got != want {
+		t.Fatalf("Bad IGMP type: got %v, want %v", got, want)
+	}
+	if len(igmp) != header.IGMPv3ReportMinimumSize+header.IGMPv3GroupRecordMinimumSize {
+		t.Fatalf("Bad IGMPv3 report length: %d", len(igmp))
+	}
+	record := igmp[header.IGMPv3ReportMinimumSize:]
+	if got, want := header.IGMPv3RecordType(record[0]), header.IGMPv3ChangeToExcludeMode; got != want {
+		t.Errorf("Bad record type: got %v, want %v", got, want)
+	}
+	if got := tcpip.Address(record[4:8]); got != testGroup {
+		t.Errorf("Bad record group: got %v, want %v", got, testGroup)
+	}
+
+	// Memberships are reference counted, so joining again sends nothing.
+	if err := c.s.JoinGroup(ipv4.ProtocolNumber, 1, testGroup); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+	if err := c.s.LeaveGroup(ipv4.ProtocolNumber, 1, testGroup); err != nil {
+		t.Fatalf("LeaveGroup failed: %v", err)
+	}
+
+	// An IGMPv2 query is answered with an IGMPv2 report, and switches the
+	// endpoint to IGMPv2.
+	c.sendQuery(1)
+	igmp = c.getIGMP(testGroup)
+	if got, want := igmp.Type(), header.IGMPv2MembershipReport; got != want {
+		t.Fatalf("Bad IGMP type: got %v, want %v", got, want)
+	}
+	if got := igmp.GroupAddress(); got != testGroup {
+		t.Errorf("Bad group: got %v, want %v", got, testGroup)
+	}
+
+	if err := c.s.LeaveGroup(ipv4.ProtocolNumber, 1, testGroup); err != nil {
+		t.Fatalf("LeaveGroup failed: %v", err)
+	}
+	igmp = c.getIGMP(header.IPv4AllRoutersGroup)
+	if got, want := igmp.Type(), header.IGMPLeaveGroup; got != want {
+		t.Fatalf("Bad IGMP type: got %v, want %v", got, want)
+	}
+	if got := igmp.GroupAddress(); got != testGroup {
+		t.Errorf("Bad group: got %v, want %v", got, testGroup)
+	}
+
+	if err := c.s.LeaveGroup(ipv4.ProtocolNumber, 1, testGroup); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("LeaveGroup of a group that isn't joined = %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+}
+
+func TestIGMPPendingReports(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	if err := c.s.JoinGroup(ipv4.ProtocolNumber, 1, testGroup); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+	c.getIGMP(header.IPv4AllIGMPv3RoutersGroup)
+
+	// Repeated queries are answered with a single report.
+	for i := 0; i < 5; i++ {
+		c.sendQuery(10)
+	}
+	igmp := c.getIGMP(testGroup)
+	if got, want := igmp.Type(), header.IGMPv2MembershipReport; got != want {
+		t.Fatalf("Bad IGMP type: got %v, want %v", got, want)
+	}
+	c.expectNoPacket(1500 * time.Millisecond)
+
+	// Leaving the group cancels its pending report.
+	c.sendQuery(10)
+	if err := c.s.LeaveGroup(ipv4.ProtocolNumber, 1, testGroup); err != nil {
+		t.Fatalf("LeaveGroup failed: %v", err)
+	}
+	igmp = c.getIGMP(header.IPv4AllRoutersGroup)
+	if got, want := igmp.Type(), header.IGMPLeaveGroup; got != want {
+		t.Fatalf("Bad IGMP type: got %v, want %v", got, want)
+	}
+	c.expectNoPacket(1500 * time.Millisecond)
+}
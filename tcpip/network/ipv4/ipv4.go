@@ -44,8 +44,10 @@ type endpoint struct {
 	address       address
 	linkEP        stack.LinkEndpoint
 	dispatcher    stack.TransportDispatcher
+	rawDispatcher stack.RawTransportDispatcher
 	echoRequests  chan echoRequest
 	fragmentation fragmentation.Fragmentation
+	igmp          igmpState
 }
 
 func newEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) *endpoint {
@@ -56,6 +58,7 @@ func newEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.Transpo
 		echoRequests:  make(chan echoRequest, 10),
 		fragmentation: fragmentation.NewFragmentation(fragmentation.MemoryLimit, fragmentation.DefaultReassembleTimeout),
 	}
+	e.rawDispatcher, _ = dispatcher.(stack.RawTransportDispatcher)
 	copy(e.address[:], addr)
 	e.id = stack.NetworkEndpointID{tcpip.Address(e.address[:])}
 
@@ -64,6 +67,14 @@ func newEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.Transpo
 	return e
 }
 
+// deliverRawPacket delivers a copy of a packet handled by the endpoint itself
+// to raw endpoints, if the dispatcher supports them.
+func (e *endpoint) deliverRawPacket(r *stack.Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView) {
+	if e.rawDispatcher != nil {
+		e.rawDispatcher.DeliverRawPacket(r, protocol, vv)
+	}
+}
+
 // MTU implements stack.NetworkEndpoint.MTU. It returns the link-layer MTU minus
 // the network layer max header length.
 func (e *endpoint) MTU() uint32 {
@@ -100,11 +111,23 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload
 		// fragmented, so we only assign ids to larger packets.
 		id = atomic.AddUint32(&ids[hashRoute(r, protocol)%buckets], 1)
 	}
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = r.DefaultTTL()
+	}
+	tos := r.TOS
+	if !r.HasTOS {
+		tos = r.DefaultTOS()
+	}
+	if r.ECN != 0 {
+		tos = tos&^header.ECNMask | r.ECN
+	}
 	ip.Encode(&header.IPv4Fields{
 		IHL:         header.IPv4MinimumSize,
+		TOS:         tos,
 		TotalLength: length,
 		ID:          uint16(id),
-		TTL:         65,
+		TTL:         ttl,
 		Protocol:    uint8(protocol),
 		SrcAddr:     tcpip.Address(e.address[:]),
 		DstAddr:     r.RemoteAddress,
@@ -114,6 +137,32 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload
 	return e.linkEP.WritePacket(r, hdr, payload, ProtocolNumber)
 }
 
+// WriteHeaderIncludedPacket implements stack.HeaderIncludedWriter. Like Linux,
+// it always fills in the total length and checksum of the header, and its id
+// and source address when they are zero.
+func (e *endpoint) WriteHeaderIncludedPacket(r *stack.Route, packet buffer.View) error {
+	h := header.IPv4(packet)
+	if len(h) < header.IPv4MinimumSize || len(h) > 0xffff {
+		return tcpip.ErrMalformedHeader
+	}
+	if hlen := int(h.HeaderLength()); hlen < header.IPv4MinimumSize || hlen > len(h) {
+		return tcpip.ErrMalformedHeader
+	}
+
+	h.SetTotalLength(uint16(len(h)))
+	if h.ID() == 0 && len(h) > header.IPv4MaximumHeaderSize+8 {
+		h.SetID(uint16(atomic.AddUint32(&ids[hashRoute(r, h.TransportProtocol())%buckets], 1)))
+	}
+	if h.SourceAddress() == header.IPv4Any {
+		h.SetSourceAddress(tcpip.Address(e.address[:]))
+	}
+	h.SetChecksum(0)
+	h.SetChecksum(^h.CalculateChecksum())
+
+	hdr := buffer.NewPrependable(int(e.linkEP.MaxHeaderLength()))
+	return e.linkEP.WritePacket(r, &hdr, packet, ProtocolNumber)
+}
+
 // HandlePacket is called by the link layer when new ipv4 packets arrive for
 // this endpoint.
 func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
@@ -136,11 +185,30 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
 			return
 		}
 		vv = &tt
+
+		// The header describes the last fragment, so give the
+		// transport layer one that describes the reassembled packet.
+		nh := header.IPv4(buffer.NewView(hlen))
+		copy(nh, h)
+		nh.SetTotalLength(uint16(hlen + vv.Size()))
+		nh.SetFlagsFragmentOffset(0, 0)
+		nh.SetChecksum(0)
+		nh.SetChecksum(^nh.CalculateChecksum())
+		h = nh
 	}
+	tos, _ := h.TOS()
+	r.ReceivedECN = tos & header.ECNMask
+	r.NetworkHeader = buffer.View(h[:hlen])
+
 	p := tcpip.TransportProtocolNumber(h.Protocol())
-	if p == header.ICMPv4ProtocolNumber {
+	switch p {
+	case header.ICMPv4ProtocolNumber:
 		e.handleICMP(r, vv)
 		return
+	case header.IGMPProtocolNumber:
+		e.deliverRawPacket(r, p, vv)
+		e.handleIGMP(r, vv)
+		return
 	}
 	e.dispatcher.DeliverTransportPacket(r, p, vv)
 }
@@ -148,6 +216,7 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
 // Close cleans up resources associated with the endpoint.
 func (e *endpoint) Close() {
 	close(e.echoRequests)
+	e.igmp.stop()
 }
 
 type protocol struct{}
@@ -176,6 +245,69 @@ func (*protocol) ParseAddresses(v buffer.View) (src, dst tcpip.Address) {
 	return h.SourceAddress(), h.DestinationAddress()
 }
 
+// IsMulticastAddress implements stack.MulticastProtocol.IsMulticastAddress.
+func (*protocol) IsMulticastAddress(addr tcpip.Address) bool {
+	return header.IsV4MulticastAddress(addr)
+}
+
+// IsImplicitGroup implements stack.MulticastProtocol.IsImplicitGroup. Every
+// host is a member of the all-hosts group.
+func (*protocol) IsImplicitGroup(addr tcpip.Address) bool {
+	return addr == header.IPv4AllHostsGroup
+}
+
+// AddressGroups implements stack.MulticastProtocol.AddressGroups. IPv4
+// addresses don't imply any group membership.
+func (*protocol) AddressGroups(addr tcpip.Address) []tcpip.Address {
+	return nil
+}
+
+// MulticastLinkAddress implements stack.MulticastProtocol.MulticastLinkAddress.
+func (*protocol) MulticastLinkAddress(group tcpip.Address) tcpip.LinkAddress {
+	return header.EthernetAddressFromMulticastIPv4Address(group)
+}
+
+// ReportDestination implements stack.MulticastProtocol.ReportDestination.
+// IGMP reports are sent from the address best suited to reach the group.
+func (*protocol) ReportDestination(group tcpip.Address) tcpip.Address {
+	return group
+}
+
+// ForwardPacket implements stack.PacketForwarder.ForwardPacket. It decrements
+// the TTL of the packet and updates its checksum, and sends an ICMP Time
+// Exceeded message back to the source when the TTL expires.
+func (*protocol) ForwardPacket(reply *stack.Route, vv *buffer.VectorisedView) bool {
+	h := header.IPv4(vv.First())
+	if !h.IsValid(vv.Size()) || len(h) < int(h.HeaderLength()) {
+		return false
+	}
+
+	// Packets with a broadcast, multicast or unspecified source address
+	// must not be forwarded, per RFC 1812, section 5.3.7.
+	if src := h.SourceAddress(); src == header.IPv4Any || src == header.IPv4Broadcast || header.IsV4MulticastAddress(src) {
+		return false
+	}
+
+	if h.TTL() <= 1 {
+		if reply != nil {
+			sendTimeExceeded(reply, vv)
+		}
+		return false
+	}
+
+	h.SetTTL(h.TTL() - 1)
+	h.SetChecksum(0)
+	h.SetChecksum(^h.CalculateChecksum())
+	vv.CapLength(int(h.TotalLength()))
+
+	return true
+}
+
+// RejectPacket implements stack.PacketRejecter.RejectPacket.
+func (*protocol) RejectPacket(r *stack.Route, src, dst tcpip.Address, protocol tcpip.TransportProtocolNumber, transport buffer.View) {
+	sendAdminProhibited(r, src, dst, protocol, transport)
+}
+
 // NewEndpoint creates a new ipv4 endpoint.
 func (p *protocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache stack.LinkAddressCache, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, error) {
 	return newEndpoint(nicid, addr, dispatcher, linkEP), nil
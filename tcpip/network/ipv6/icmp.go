@@ -0,0 +1,126 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipv6
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// handleICMP handles an ICMPv6 packet received by the endpoint. MLD queries and
+// echo requests are handled by the endpoint itself and echo replies are
+// delivered to the transport dispatcher, while raw endpoints receive a copy of
+// every message.
+func (e *endpoint) handleICMP(r *stack.Route, vv *buffer.VectorisedView) {
+	v := vv.First()
+
+	// Echo replies go through the transport dispatcher, which delivers
+	// the raw copies itself.
+	if len(v) >= header.ICMPv6EchoMinimumSize && header.ICMPv6(v).Type() == header.ICMPv6EchoReply {
+		e.dispatcher.DeliverTransportPacket(r, header.ICMPv6ProtocolNumber, vv)
+		return
+	}
+	e.deliverRawPacket(r, header.ICMPv6ProtocolNumber, vv)
+
+	if len(v) < header.ICMPv6MinimumSize {
+		return
+	}
+	switch header.ICMPv6(v).Type() {
+	case header.ICMPv6MulticastListenerQuery:
+		e.handleMLD(r, vv)
+
+	case header.ICMPv6EchoRequest:
+		// Requests sent to multicast groups aren't answered, as the
+		// reply couldn't come from the group address.
+		if len(v) < header.ICMPv6EchoMinimumSize || header.IsV6MulticastAddress(r.LocalAddress) {
+			return
+		}
+		sendEchoReply(r, vv.ToView())
+	}
+}
+
+// sendEchoReply answers the given echo request through r, echoing its
+// identifier, sequence number and data.
+func sendEchoReply(r *stack.Route, req buffer.View) error {
+	hdr := buffer.NewPrependable(header.ICMPv6EchoMinimumSize + int(r.MaxHeaderLength()))
+
+	icmpv6 := header.ICMPv6(hdr.Prepend(header.ICMPv6EchoMinimumSize))
+	copy(icmpv6, req[:header.ICMPv6EchoMinimumSize])
+	icmpv6.SetType(header.ICMPv6EchoReply)
+	icmpv6.SetChecksum(0)
+	data := req[header.ICMPv6EchoMinimumSize:]
+	icmpv6.SetChecksum(header.ICMPv6Checksum(icmpv6, r.LocalAddress, r.RemoteAddress, data))
+
+	return r.WritePacket(&hdr, data, header.ICMPv6ProtocolNumber)
+}
+
+func sendICMPv6(r *stack.Route, typ header.ICMPv6Type, code byte, hdrSize int, data buffer.View) error {
+	hdr := buffer.NewPrependable(hdrSize + int(r.MaxHeaderLength()))
+
+	icmpv6 := header.ICMPv6(hdr.Prepend(hdrSize))
+	icmpv6.SetType(typ)
+	icmpv6.SetCode(code)
+	icmpv6.SetChecksum(header.ICMPv6Checksum(icmpv6, r.LocalAddress, r.RemoteAddress, data))
+
+	return r.WritePacket(&hdr, data, header.ICMPv6ProtocolNumber)
+}
+
+// sendTimeExceeded sends an ICMPv6 Time Exceeded message about the given
+// packet through r. As required by RFC 4443, the message carries as much of the
+// packet as possible without exceeding the minimum IPv6 MTU.
+func sendTimeExceeded(r *stack.Route, vv *buffer.VectorisedView) {
+	h := header.IPv6(vv.First())
+
+	// Never report errors about ICMP error messages, to avoid storms.
+	if h.NextHeader() == uint8(header.ICMPv6ProtocolNumber) && len(h) >= header.IPv6MinimumSize+header.ICMPv6MinimumSize {
+		if header.ICMPv6(h[header.IPv6MinimumSize:]).Type() < header.ICMPv6EchoRequest {
+			return
+		}
+	}
+
+	n := header.IPv6MinimumMTU - header.IPv6MinimumSize - header.ICMPv6ErrorHeaderSize
+	if n > vv.Size() {
+		n = vv.Size()
+	}
+
+	sendICMPv6(r, header.ICMPv6TimeExceeded, 0, header.ICMPv6ErrorHeaderSize, vv.ToView()[:n])
+}
+
+// sendAdminProhibited sends an ICMPv6 Destination Unreachable message, with
+// the "administratively prohibited" code, through r about a packet of the
+// given transport protocol sent from src to dst. The message carries an IPv6
+// header rebuilt from these, followed by as much of transport as fits in the
+// minimum IPv6 MTU.
+func sendAdminProhibited(r *stack.Route, src, dst tcpip.Address, protocol tcpip.TransportProtocolNumber, transport buffer.View) {
+	// Never report errors about ICMP error messages, to avoid storms.
+	if protocol == header.ICMPv6ProtocolNumber {
+		if len(transport) < header.ICMPv6MinimumSize || header.ICMPv6(transport).Type() < header.ICMPv6EchoRequest {
+			return
+		}
+	}
+
+	// Nor about packets that don't identify a single source.
+	if src == header.IPv6Any || header.IsV6MulticastAddress(src) {
+		return
+	}
+
+	n := header.IPv6MinimumMTU - 2*header.IPv6MinimumSize - header.ICMPv6ErrorHeaderSize
+	if n > len(transport) {
+		n = len(transport)
+	}
+
+	data := buffer.NewView(header.IPv6MinimumSize + n)
+	header.IPv6(data).Encode(&header.IPv6Fields{
+		PayloadLength: uint16(len(transport)),
+		NextHeader:    uint8(protocol),
+		SrcAddr:       src,
+		DstAddr:       dst,
+	})
+	copy(data[header.IPv6MinimumSize:], transport)
+
+	sendICMPv6(r, header.ICMPv6DstUnreachable, header.ICMPv6AdminProhibited, header.ICMPv6ErrorHeaderSize, data)
+}
@@ -32,20 +32,31 @@ const (
 type address [header.IPv6AddressSize]byte
 
 type endpoint struct {
-	nicid      tcpip.NICID
-	id         stack.NetworkEndpointID
-	address    address
-	linkEP     stack.LinkEndpoint
-	dispatcher stack.TransportDispatcher
+	nicid         tcpip.NICID
+	id            stack.NetworkEndpointID
+	address       address
+	linkEP        stack.LinkEndpoint
+	dispatcher    stack.TransportDispatcher
+	rawDispatcher stack.RawTransportDispatcher
+	mld           mldState
 }
 
 func newEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) *endpoint {
 	e := &endpoint{nicid: nicid, linkEP: linkEP, dispatcher: dispatcher}
+	e.rawDispatcher, _ = dispatcher.(stack.RawTransportDispatcher)
 	copy(e.address[:], addr)
 	e.id = stack.NetworkEndpointID{tcpip.Address(e.address[:])}
 	return e
 }
 
+// deliverRawPacket delivers a copy of a packet handled by the endpoint itself
+// to raw endpoints, if the dispatcher supports them.
+func (e *endpoint) deliverRawPacket(r *stack.Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView) {
+	if e.rawDispatcher != nil {
+		e.rawDispatcher.DeliverRawPacket(r, protocol, vv)
+	}
+}
+
 // MTU implements stack.NetworkEndpoint.MTU. It returns the link-layer MTU minus
 // the network layer max header length.
 func (e *endpoint) MTU() uint32 {
@@ -78,11 +89,23 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload
 	if payload != nil {
 		length += uint16(len(payload))
 	}
+	hopLimit := r.TTL
+	if hopLimit == 0 {
+		hopLimit = r.DefaultTTL()
+	}
+	trafficClass := r.TOS
+	if !r.HasTOS {
+		trafficClass = r.DefaultTOS()
+	}
+	if r.ECN != 0 {
+		trafficClass = trafficClass&^header.ECNMask | r.ECN
+	}
 	ip := header.IPv6(hdr.Prepend(header.IPv6MinimumSize))
 	ip.Encode(&header.IPv6Fields{
+		TrafficClass:  trafficClass,
 		PayloadLength: length,
 		NextHeader:    uint8(protocol),
-		HopLimit:      65,
+		HopLimit:      hopLimit,
 		SrcAddr:       tcpip.Address(e.address[:]),
 		DstAddr:       r.RemoteAddress,
 	})
@@ -90,6 +113,24 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload
 	return e.linkEP.WritePacket(r, hdr, payload, ProtocolNumber)
 }
 
+// WriteHeaderIncludedPacket implements stack.HeaderIncludedWriter. It fills in
+// the payload length of the header, and its source address when it is
+// unspecified.
+func (e *endpoint) WriteHeaderIncludedPacket(r *stack.Route, packet buffer.View) error {
+	h := header.IPv6(packet)
+	if len(h) < header.IPv6MinimumSize || len(h)-header.IPv6MinimumSize > maxPayloadSize {
+		return tcpip.ErrMalformedHeader
+	}
+
+	h.SetPayloadLength(uint16(len(h) - header.IPv6MinimumSize))
+	if h.SourceAddress() == header.IPv6Any {
+		h.SetSourceAddress(tcpip.Address(e.address[:]))
+	}
+
+	hdr := buffer.NewPrependable(int(e.linkEP.MaxHeaderLength()))
+	return e.linkEP.WritePacket(r, &hdr, packet, ProtocolNumber)
+}
+
 // HandlePacket is called by the link layer when new ipv6 packets arrive for
 // this endpoint.
 func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
@@ -98,9 +139,38 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
 		return
 	}
 
+	trafficClass, _ := h.TOS()
+	r.ReceivedECN = trafficClass & header.ECNMask
+
 	vv.TrimFront(header.IPv6MinimumSize)
 	vv.CapLength(int(h.PayloadLength()))
-	e.dispatcher.DeliverTransportPacket(r, tcpip.TransportProtocolNumber(h.NextHeader()), vv)
+	r.NetworkHeader = buffer.View(h[:header.IPv6MinimumSize])
+
+	p := h.NextHeader()
+	if p == header.IPv6HopByHopOptionsHeader {
+		// Skip the Hop-by-Hop Options header, which carries the Router
+		// Alert option of MLD messages. None of its options are
+		// processed.
+		hbh := vv.First()
+		if len(hbh) < 2 {
+			return
+		}
+		n := (int(hbh[1]) + 1) * 8
+		if n > vv.Size() {
+			return
+		}
+		p = hbh[0]
+		vv.TrimFront(n)
+		if len(h) >= header.IPv6MinimumSize+n {
+			r.NetworkHeader = buffer.View(h[:header.IPv6MinimumSize+n])
+		}
+	}
+
+	if tcpip.TransportProtocolNumber(p) == header.ICMPv6ProtocolNumber {
+		e.handleICMP(r, vv)
+		return
+	}
+	e.dispatcher.DeliverTransportPacket(r, tcpip.TransportProtocolNumber(p), vv)
 }
 
 // Close cleans up resources associated with the endpoint.
@@ -132,6 +202,81 @@ func (*protocol) ParseAddresses(v buffer.View) (src, dst tcpip.Address) {
 	return h.SourceAddress(), h.DestinationAddress()
 }
 
+// IsMulticastAddress implements stack.MulticastProtocol.IsMulticastAddress.
+func (*protocol) IsMulticastAddress(addr tcpip.Address) bool {
+	return header.IsV6MulticastAddress(addr)
+}
+
+// IsImplicitGroup implements stack.MulticastProtocol.IsImplicitGroup. Every
+// node is a member of the all-nodes group.
+func (*protocol) IsImplicitGroup(addr tcpip.Address) bool {
+	return addr == header.IPv6AllNodesMulticastAddress
+}
+
+// AddressGroups implements stack.MulticastProtocol.AddressGroups. Nodes must
+// join the solicited-node group of each of their addresses, so that they can
+// be found by Neighbor Discovery.
+func (*protocol) AddressGroups(addr tcpip.Address) []tcpip.Address {
+	return []tcpip.Address{header.SolicitedNodeAddr(addr)}
+}
+
+// MulticastLinkAddress implements stack.MulticastProtocol.MulticastLinkAddress.
+func (*protocol) MulticastLinkAddress(group tcpip.Address) tcpip.LinkAddress {
+	return header.EthernetAddressFromMulticastIPv6Address(group)
+}
+
+// ReportDestination implements stack.MulticastProtocol.ReportDestination. MLD
+// reports are sent to link-local groups regardless of the scope of the group
+// they are about, so they are sent from a link-local address when possible.
+func (*protocol) ReportDestination(group tcpip.Address) tcpip.Address {
+	return header.IPv6AllMLDv2RoutersMulticastAddress
+}
+
+// ForwardPacket implements stack.PacketForwarder.ForwardPacket. It decrements
+// the hop limit of the packet, and sends an ICMPv6 Time Exceeded message back
+// to the source when it expires.
+func (*protocol) ForwardPacket(reply *stack.Route, vv *buffer.VectorisedView) bool {
+	h := header.IPv6(vv.First())
+	if !h.IsValid(vv.Size()) {
+		return false
+	}
+
+	// Packets with a multicast or unspecified source address are never
+	// forwarded.
+	if src := h.SourceAddress(); src == header.IPv6Any || header.IsV6MulticastAddress(src) {
+		return false
+	}
+
+	// Packets with link-local or multicast addresses must not leave the
+	// link they were received on.
+	if isLinkLocal(h.SourceAddress()) || isLinkLocal(h.DestinationAddress()) || h.DestinationAddress()[0] == 0xff {
+		return false
+	}
+
+	if h.HopLimit() <= 1 {
+		if reply != nil {
+			sendTimeExceeded(reply, vv)
+		}
+		return false
+	}
+
+	h.SetHopLimit(h.HopLimit() - 1)
+	vv.CapLength(header.IPv6MinimumSize + int(h.PayloadLength()))
+
+	return true
+}
+
+// isLinkLocal determines if addr is a link-local unicast address, that is, if
+// it is in fe80::/10.
+func isLinkLocal(addr tcpip.Address) bool {
+	return addr[0] == 0xfe && addr[1]&0xc0 == 0x80
+}
+
+// RejectPacket implements stack.PacketRejecter.RejectPacket.
+func (*protocol) RejectPacket(r *stack.Route, src, dst tcpip.Address, protocol tcpip.TransportProtocolNumber, transport buffer.View) {
+	sendAdminProhibited(r, src, dst, protocol, transport)
+}
+
 // NewEndpoint creates a new ipv6 endpoint.
 func (p *protocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache stack.LinkAddressCache, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, error) {
 	return newEndpoint(nicid, addr, dispatcher, linkEP), nil
@@ -0,0 +1,251 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipv6
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// olderVersionQuerierTimeout is the "Older Version Querier Present Timeout" of
+// RFC 3810 section 9.12, computed with the default robustness variable, query
+// interval and query response interval.
+const olderVersionQuerierTimeout = 2*125*time.Second + 10*time.Second
+
+// mldState holds the state of the listener side of MLD for an endpoint.
+// Listeners use MLDv2 unless an MLDv1 querier is present on the link, as
+// described in RFC 3810 section 8.2.1.
+//
+// MLD messages are sent from a link-local address. The memberships of a NIC
+// are reported by its link-local endpoint, or from the unspecified address by
+// other endpoints if it has none, as allowed by RFC 3810 section 5.2.13.
+//
+// TODO: Retransmit unsolicited reports, suppress reports heard from other
+// listeners in MLDv1 mode, and add the Router Alert option to MLD packets.
+type mldState struct {
+	mu sync.Mutex
+
+	// v1Until is the time until which an MLDv1 querier is considered
+	// present.
+	v1Until time.Time
+}
+
+// version returns the version of MLD the endpoint currently speaks.
+func (s *mldState) version() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Now().Before(s.v1Until) {
+		return 1
+	}
+	return 2
+}
+
+// querierSeen records that a querier of the given version is present.
+func (s *mldState) querierSeen(version int) {
+	if version != 1 {
+		return
+	}
+
+	s.mu.Lock()
+	s.v1Until = time.Now().Add(olderVersionQuerierTimeout)
+	s.mu.Unlock()
+}
+
+// isReportable determines if memberships in group are reported. As required by
+// RFC 3810 section 6, groups of reserved or interface-local scope, and the
+// all-nodes group, are never reported.
+func isReportable(group tcpip.Address) bool {
+	return group[1]&0xf > 1 && group != header.IPv6AllNodesMulticastAddress
+}
+
+// JoinedGroup implements stack.GroupReporter.JoinedGroup. It sends an
+// unsolicited report for the group.
+func (e *endpoint) JoinedGroup(r *stack.Route) {
+	group := r.RemoteAddress
+	if !isReportable(group) {
+		return
+	}
+
+	if e.mld.version() == 1 {
+		sendMLD(r, group, header.ICMPv6MulticastListenerReport, group)
+		return
+	}
+	sendMLDv2Report(r, header.MLDv2ChangeToExcludeMode, []tcpip.Address{group})
+}
+
+// LeftGroup implements stack.GroupReporter.LeftGroup. It tells routers that
+// the NIC stopped listening to the group.
+func (e *endpoint) LeftGroup(r *stack.Route) {
+	group := r.RemoteAddress
+	if !isReportable(group) {
+		return
+	}
+
+	if e.mld.version() == 1 {
+		sendMLD(r, header.IPv6AllRoutersMulticastAddress, header.ICMPv6MulticastListenerDone, group)
+		return
+	}
+	sendMLDv2Report(r, header.MLDv2ChangeToIncludeMode, []tcpip.Address{group})
+}
+
+// handleMLD handles an MLD query received by the endpoint. It is answered,
+// after a random delay bounded by its maximum response delay, with reports for
+// the groups it asks about.
+func (e *endpoint) handleMLD(r *stack.Route, vv *buffer.VectorisedView) {
+	v := vv.First()
+	if len(v) < vv.Size() {
+		v = vv.ToView()
+	}
+	if len(v) < header.MLDMinimumSize || header.ICMPv6Checksum(header.ICMPv6(v), r.RemoteAddress, r.LocalAddress, nil) != 0 {
+		return
+	}
+
+	// Queries must come from link-local addresses, and can only be answered
+	// from one.
+	if !isLinkLocal(r.RemoteAddress) || !isLinkLocal(e.id.LocalAddress) {
+		return
+	}
+
+	h := header.MLD(v)
+	var version int
+	var maxResp time.Duration
+	switch {
+	case len(v) == header.MLDMinimumSize:
+		version = 1
+		maxResp = time.Duration(h.MaxRespCode()) * time.Millisecond
+	case len(v) >= header.MLDv2QueryMinimumSize:
+		version = 2
+		maxResp = decodeMaxRespCode(h.MaxRespCode())
+	default:
+		return
+	}
+	e.mld.querierSeen(version)
+
+	// General queries ask about every group; multicast-address-specific
+	// ones only about their group. Sources of MLDv2 queries are ignored, as
+	// the stack only supports any-source memberships.
+	var groups []tcpip.Address
+	for _, g := range r.MulticastGroups() {
+		if !isReportable(g) {
+			continue
+		}
+		if q := h.MulticastAddress(); q == header.IPv6Any || q == g {
+			groups = append(groups, g)
+		}
+	}
+	if len(groups) == 0 {
+		return
+	}
+
+	var delay time.Duration
+	if maxResp > 0 {
+		delay = time.Duration(rand.Int63n(int64(maxResp)))
+	}
+
+	// The local address of r is the destination of the query; reports are
+	// sent from the address of the endpoint.
+	rr := r.Clone()
+	rr.LocalAddress = e.id.LocalAddress
+	time.AfterFunc(delay, func() {
+		defer rr.Release()
+		if version == 2 {
+			sendMLDv2Report(&rr, header.MLDv2ModeIsExclude, groups)
+			return
+		}
+
+		for _, g := range groups {
+			sendMLD(&rr, g, header.ICMPv6MulticastListenerReport, g)
+		}
+	})
+}
+
+// decodeMaxRespCode decodes the "maximum response code" field of MLDv2
+// queries, as described in RFC 3810 section 5.1.3.
+func decodeMaxRespCode(code uint16) time.Duration {
+	t := int(code)
+	if code >= 32768 {
+		mant := int(code & 0xfff)
+		exp := int(code>>12) & 0x7
+		t = (mant | 0x1000) << uint(exp+3)
+	}
+	return time.Duration(t) * time.Millisecond
+}
+
+// mldRoute returns a copy of r that sends MLD packets to dst, from the
+// unspecified address if the local address of r isn't link-local. It shares
+// the reference of r, so it must not be used once r is released.
+func mldRoute(r *stack.Route, dst tcpip.Address) stack.Route {
+	mr := *r
+	if !isLinkLocal(mr.LocalAddress) {
+		mr.LocalAddress = header.IPv6Any
+	}
+	mr.SetMulticastDestination(dst)
+	mr.TTL = 1
+	mr.MulticastLoop = false
+	return mr
+}
+
+// sendMLD sends an MLDv1 message of the given type about group to dst.
+func sendMLD(r *stack.Route, dst tcpip.Address, typ header.ICMPv6Type, group tcpip.Address) error {
+	mr := mldRoute(r, dst)
+	hdr := buffer.NewPrependable(header.MLDMinimumSize + int(r.MaxHeaderLength()))
+
+	mld := header.MLD(hdr.Prepend(header.MLDMinimumSize))
+	icmpv6 := header.ICMPv6(mld)
+	icmpv6.SetType(typ)
+	icmpv6.SetCode(0)
+	icmpv6.SetChecksum(0)
+	mld.SetMaxRespCode(0)
+	mld.SetMulticastAddress(group)
+	icmpv6.SetChecksum(header.ICMPv6Checksum(icmpv6, mr.LocalAddress, mr.RemoteAddress, nil))
+
+	return mr.WritePacket(&hdr, nil, header.ICMPv6ProtocolNumber)
+}
+
+// sendMLDv2Report sends MLDv2 reports with records of the given type and
+// without sources for the given groups, splitting them in as many reports as
+// needed to fit the MTU.
+func sendMLDv2Report(r *stack.Route, typ header.MLDv2RecordType, groups []tcpip.Address) error {
+	mr := mldRoute(r, header.IPv6AllMLDv2RoutersMulticastAddress)
+
+	max := (int(r.MTU()) - header.MLDv2ReportMinimumSize) / header.MLDv2RecordMinimumSize
+	if max < 1 {
+		max = 1
+	}
+
+	for len(groups) > 0 {
+		n := len(groups)
+		if n > max {
+			n = max
+		}
+
+		size := header.MLDv2ReportMinimumSize + n*header.MLDv2RecordMinimumSize
+		hdr := buffer.NewPrependable(size + int(r.MaxHeaderLength()))
+		b := hdr.Prepend(size)
+
+		icmpv6 := header.ICMPv6(b)
+		icmpv6.SetType(header.ICMPv6MulticastListenerV2Report)
+		header.MLDv2Report(b).SetNumberOfRecords(uint16(n))
+		for i, g := range groups[:n] {
+			off := header.MLDv2ReportMinimumSize + i*header.MLDv2RecordMinimumSize
+			header.MLDv2Record(b[off:]).Encode(typ, g)
+		}
+		icmpv6.SetChecksum(header.ICMPv6Checksum(icmpv6, mr.LocalAddress, mr.RemoteAddress, nil))
+
+		if err := mr.WritePacket(&hdr, nil, header.ICMPv6ProtocolNumber); err != nil {
+			return err
+		}
+		groups = groups[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipv6_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/checker"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/sniffer"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	linkAddr    = tcpip.LinkAddress("\x02\x02\x03\x04\x05\x06")
+	stackAddr   = "\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+	querierAddr = "\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"
+	testGroup   = "\xff\x0e\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x02\x03"
+)
+
+type testContext struct {
+	t      *testing.T
+	linkEP *channel.Endpoint
+	s      *stack.Stack
+}
+
+func newTestContext(t *testing.T) *testContext {
+	s := stack.New([]string{ipv6.ProtocolName}, nil)
+
+	const defaultMTU = 65536
+	id, linkEP := channel.New(256, defaultMTU, linkAddr)
+	if testing.Verbose() {
+		id = sniffer.New(id)
+	}
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	return &testContext{
+		t:      t,
+		s:      s.(*stack.Stack),
+		linkEP: linkEP,
+	}
+}
+
+func (c *testContext) cleanup() {
+	close(c.linkEP.C)
+}
+
+// getMLD waits for an MLD packet to be sent to dst and returns its MLD
+// message.
+func (c *testContext) getMLD(dst tcpip.Address) header.MLD {
+	select {
+	case p := <-c.linkEP.C:
+		return c.checkMLD(p, dst)
+
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Packet wasn't written out")
+	}
+
+	return nil
+}
+
+// checkMLD checks that p is an MLD packet sent to dst and returns its MLD
+// message.
+func (c *testContext) checkMLD(p channel.PacketInfo, dst tcpip.Address) header.MLD {
+	b := make([]byte, len(p.Header)+len(p.Payload))
+	copy(b, p.Header)
+	copy(b[len(p.Header):], p.Payload)
+
+	checker.IPv6(c.t, b, checker.SrcAddr(stackAddr), checker.DstAddr(dst), checker.TTL(1))
+	ip := header.IPv6(b)
+	if p := ip.TransportProtocol(); p != header.ICMPv6ProtocolNumber {
+		c.t.Fatalf("Bad protocol: got %v, want %v", p, header.ICMPv6ProtocolNumber)
+	}
+
+	mld := header.MLD(ip.Payload())
+	if xsum := header.ICMPv6Checksum(header.ICMPv6(mld), stackAddr, dst, nil); xsum != 0 {
+		c.t.Fatalf("Bad MLD checksum: 0x%x", xsum)
+	}
+	return mld
+}
+
+// sendQuery injects an MLDv1 general query.
+func (c *testContext) sendQuery() {
+	buf := buffer.NewView(header.IPv6MinimumSize + header.MLDMinimumSize)
+
+	ip := header.IPv6(buf)
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength: header.MLDMinimumSize,
+		NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+		HopLimit:      1,
+		SrcAddr:       querierAddr,
+		DstAddr:       header.IPv6AllNodesMulticastAddress,
+	})
+
+	mld := header.MLD(buf[header.IPv6MinimumSize:])
+	icmpv6 := header.ICMPv6(mld)
+	icmpv6.SetType(header.ICMPv6MulticastListenerQuery)
+	mld.SetMaxRespCode(1)
+	icmpv6.SetChecksum(header.ICMPv6Checksum(icmpv6, querierAddr, header.IPv6AllNodesMulticastAddress, nil))
+
+	vv := buf.ToVectorisedView([1]buffer.View{})
+	c.linkEP.Inject(ipv6.ProtocolNumber, &vv)
+}
+
+func TestMLD(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	// Adding an address joins its solicited-node group, which is reported
+	// with an MLDv2 report.
+	if err := c.s.AddAddress(1, ipv6.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	solicitedNode := header.SolicitedNodeAddr(stackAddr)
+	mld := c.getMLD(header.IPv6AllMLDv2RoutersMulticastAddress)
+	if got, want := header.ICMPv6(mld).Type(), header.ICMPv6MulticastListenerV2Report; got != want {
+		t.Fatalf("Bad MLD type: got %v, want %v", got, want)
+	}
+	if len(mld) != header.MLDv2ReportMinimumSize+header.MLDv2RecordMinimumSize {
+		t.Fatalf("Bad MLDv2 report length: %d", len(mld))
+	}
+	record := mld[header.MLDv2ReportMinimumSize:]
+	if got, want := header.MLDv2RecordType(record[0]), header.MLDv2ChangeToExcludeMode; got != want {
+		t.Errorf("Bad record type: got %v, want %v", got, want)
+	}
+	if got := tcpip.Address(record[4:20]); got != solicitedNode {
+		t.Errorf("Bad record group: got %v, want %v", got, solicitedNode)
+	}
+
+	if err := c.s.JoinGroup(ipv6.ProtocolNumber, 1, testGroup); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+	c.getMLD(header.IPv6AllMLDv2RoutersMulticastAddress)
+
+	// Frames to the group are sent to its Ethernet multicast address.
+	r, err := c.s.FindRoute(1, "", testGroup, ipv6.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	if want := tcpip.LinkAddress("\x33\x33\x00\x01\x02\x03"); r.RemoteLinkAddress != want {
+		t.Errorf("Bad remote link address: got %v, want %v", r.RemoteLinkAddress, want)
+	}
+	r.Release()
+
+	// An MLDv1 query is answered with MLDv1 reports for every group, and
+	// switches the endpoint to MLDv1.
+	c.sendQuery()
+	want := map[tcpip.Address]bool{solicitedNode: true, testGroup: true}
+	for len(want) > 0 {
+		var p channel.PacketInfo
+		select {
+		case p = <-c.linkEP.C:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Packet wasn't written out")
+		}
+
+		dst := header.IPv6(p.Header).DestinationAddress()
+		if !want[dst] {
+			t.Fatalf("Unexpected report to %v", dst)
+		}
+		delete(want, dst)
+
+		mld := c.checkMLD(p, dst)
+		if got, want := header.ICMPv6(mld).Type(), header.ICMPv6MulticastListenerReport; got != want {
+			t.Fatalf("Bad MLD type: got %v, want %v", got, want)
+		}
+		if got := mld.MulticastAddress(); got != dst {
+			t.Errorf("Bad group: got %v, want %v", got, dst)
+		}
+	}
+
+	if err := c.s.LeaveGroup(ipv6.ProtocolNumber, 1, testGroup); err != nil {
+		t.Fatalf("LeaveGroup failed: %v", err)
+	}
+	mld = c.getMLD(header.IPv6AllRoutersMulticastAddress)
+	if got, want := header.ICMPv6(mld).Type(), header.ICMPv6MulticastListenerDone; got != want {
+		t.Fatalf("Bad MLD type: got %v, want %v", got, want)
+	}
+	if got := mld.MulticastAddress(); got != testGroup {
+		t.Errorf("Bad group: got %v, want %v", got, testGroup)
+	}
+
+	// Memberships are still reported from the link-local address once the
+	// NIC has a global one, even for groups of global scope.
+	const globalAddr = "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05"
+	if err := c.s.AddAddress(1, ipv6.ProtocolNumber, globalAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	globalSolicitedNode := header.SolicitedNodeAddr(globalAddr)
+	if got := c.getMLD(globalSolicitedNode).MulticastAddress(); got != globalSolicitedNode {
+		t.Errorf("Bad group: got %v, want %v", got, globalSolicitedNode)
+	}
+
+	if err := c.s.JoinGroup(ipv6.ProtocolNumber, 1, testGroup); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+	mld = c.getMLD(testGroup)
+	if got, want := header.ICMPv6(mld).Type(), header.ICMPv6MulticastListenerReport; got != want {
+		t.Fatalf("Bad MLD type: got %v, want %v", got, want)
+	}
+	if err := c.s.LeaveGroup(ipv6.ProtocolNumber, 1, testGroup); err != nil {
+		t.Fatalf("LeaveGroup failed: %v", err)
+	}
+	if got, want := header.ICMPv6(c.getMLD(header.IPv6AllRoutersMulticastAddress)).Type(), header.ICMPv6MulticastListenerDone; got != want {
+		t.Fatalf("Bad MLD type: got %v, want %v", got, want)
+	}
+
+	// Removing the address leaves its solicited-node group.
+	if err := c.s.RemoveAddress(1, stackAddr); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+	if err := c.s.LeaveGroup(ipv6.ProtocolNumber, 1, solicitedNode); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("LeaveGroup of the solicited-node group = %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+}
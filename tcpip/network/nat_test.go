@@ -0,0 +1,327 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ip_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+)
+
+// v4Remote3 is a second node on the subnet of NIC 1.
+const v4Remote3 = "\x0a\x00\x00\x03"
+
+// transportChecksum computes the checksum of the transport-layer part of an
+// IPv4 packet.
+func transportChecksum(protocol tcpip.TransportProtocolNumber, src, dst tcpip.Address, transport buffer.View) uint16 {
+	if protocol == header.ICMPv4ProtocolNumber {
+		return header.Checksum(transport, 0)
+	}
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(transport)))
+	xsum := header.PseudoHeaderChecksum(protocol, src, dst)
+	xsum = header.Checksum(length[:], xsum)
+	return header.Checksum(transport, xsum)
+}
+
+// injectTransport injects an IPv4 packet of the given transport protocol, with
+// transport as its transport-layer part, after filling in its checksum.
+func injectTransport(ep *channel.Endpoint, protocol tcpip.TransportProtocolNumber, src, dst tcpip.Address, transport buffer.View) {
+	v := buffer.NewView(header.IPv4MinimumSize + len(transport))
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         64,
+		Protocol:    uint8(protocol),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	t := v[header.IPv4MinimumSize:]
+	copy(t, transport)
+	switch protocol {
+	case header.TCPProtocolNumber:
+		header.TCP(t).SetChecksum(^transportChecksum(protocol, src, dst, t))
+	case header.UDPProtocolNumber:
+		header.UDP(t).SetChecksum(^transportChecksum(protocol, src, dst, t))
+	case header.ICMPv4ProtocolNumber:
+		header.ICMPv4(t).SetChecksum(^transportChecksum(protocol, src, dst, t))
+	}
+
+	vv := v.ToVectorisedView([1]buffer.View{})
+	ep.Inject(ipv4.ProtocolNumber, &vv)
+}
+
+func injectUDP(ep *channel.Endpoint, src tcpip.Address, srcPort uint16, dst tcpip.Address, dstPort uint16) {
+	t := buffer.NewView(header.UDPMinimumSize + 10)
+	header.UDP(t).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  uint16(len(t)),
+	})
+	injectTransport(ep, header.UDPProtocolNumber, src, dst, t)
+}
+
+func injectTCP(ep *channel.Endpoint, src tcpip.Address, srcPort uint16, dst tcpip.Address, dstPort uint16, flags uint8, seq, ack uint32) {
+	t := buffer.NewView(header.TCPMinimumSize)
+	header.TCP(t).Encode(&header.TCPFields{
+		SrcPort:    srcPort,
+		DstPort:    dstPort,
+		SeqNum:     seq,
+		AckNum:     ack,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 30000,
+	})
+	injectTransport(ep, header.TCPProtocolNumber, src, dst, t)
+}
+
+func injectEcho(ep *channel.Endpoint, src, dst tcpip.Address, typ header.ICMPv4Type, ident uint16) {
+	t := buffer.NewView(header.ICMPv4EchoMinimumSize + 2)
+	icmp := header.ICMPv4(t)
+	icmp.SetType(typ)
+	icmp.SetIdent(ident)
+	injectTransport(ep, header.ICMPv4ProtocolNumber, src, dst, t)
+}
+
+// checkTranslated checks that a packet with the given addresses and ports (or
+// echo identifier) was sent through ep, and that its checksums are valid.
+func checkTranslated(t *testing.T, ep *channel.Endpoint, src tcpip.Address, srcPort uint16, dst tcpip.Address, dstPort uint16) {
+	var p channel.PacketInfo
+	select {
+	case p = <-ep.C:
+	default:
+		t.Fatalf("packet wasn't forwarded")
+	}
+
+	ip := header.IPv4(packetBytes(p))
+	if ip.CalculateChecksum() != 0xffff {
+		t.Errorf("bad IP checksum: %x", ip.Checksum())
+	}
+	if ip.SourceAddress() != src || ip.DestinationAddress() != dst {
+		t.Errorf("got packet from %v to %v, want from %v to %v", ip.SourceAddress(), ip.DestinationAddress(), src, dst)
+	}
+
+	protocol := tcpip.TransportProtocolNumber(ip.Protocol())
+	transport := buffer.View(ip.Payload())
+	if xsum := transportChecksum(protocol, src, dst, transport); xsum != 0xffff {
+		t.Errorf("bad transport checksum: %x", xsum)
+	}
+
+	var gotSrc, gotDst uint16
+	switch protocol {
+	case header.ICMPv4ProtocolNumber:
+		icmp := header.ICMPv4(transport)
+		if icmp.Type() == header.ICMPv4Echo {
+			gotSrc = icmp.Ident()
+		} else {
+			gotDst = icmp.Ident()
+		}
+	default:
+		// TCP and UDP headers both start with the ports.
+		gotSrc, gotDst = header.UDP(transport).SourcePort(), header.UDP(transport).DestinationPort()
+	}
+	if gotSrc != srcPort || gotDst != dstPort {
+		t.Errorf("got ports %d -> %d, want %d -> %d", gotSrc, gotDst, srcPort, dstPort)
+	}
+}
+
+func TestMasquerade(t *testing.T) {
+	s, ep1, ep2 := newRouter(t)
+	if err := s.AddSNATRule(tcpip.SNATRule{OutputNIC: 2}); err != nil {
+		t.Fatalf("AddSNATRule failed: %v", err)
+	}
+
+	// The source of connections going out through NIC 2 is translated to
+	// its address, keeping the port when possible, and replies are
+	// translated back.
+	injectUDP(ep1, v4Remote1, 5000, v4Remote2, 53)
+	checkTranslated(t, ep2, v4Addr2, 5000, v4Remote2, 53)
+	injectUDP(ep2, v4Remote2, 53, v4Addr2, 5000)
+	checkTranslated(t, ep1, v4Remote2, 53, v4Remote1, 5000)
+
+	// Another node using the same port gets another one.
+	injectUDP(ep1, v4Remote3, 5000, v4Remote2, 53)
+	var p channel.PacketInfo
+	select {
+	case p = <-ep2.C:
+	default:
+		t.Fatalf("packet wasn't forwarded")
+	}
+	port := header.UDP(header.IPv4(packetBytes(p)).Payload()).SourcePort()
+	if port == 5000 {
+		t.Fatalf("port %d was assigned twice", port)
+	}
+	injectUDP(ep2, v4Remote2, 53, v4Addr2, port)
+	checkTranslated(t, ep1, v4Remote2, 53, v4Remote3, 5000)
+
+	// Ports used by translations can't be bound by local endpoints.
+	if _, err := s.ReservePort([]tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber}, header.UDPProtocolNumber, v4Addr2, 5000); err != tcpip.ErrPortInUse {
+		t.Errorf("ReservePort of translated port = %v, want %v", err, tcpip.ErrPortInUse)
+	}
+
+	// TCP connections are only translated from their SYN on.
+	injectTCP(ep1, v4Remote1, 6000, v4Remote2, 80, header.TCPFlagAck, 1, 1)
+	checkTranslated(t, ep2, v4Remote1, 6000, v4Remote2, 80)
+	injectTCP(ep1, v4Remote1, 6000, v4Remote2, 80, header.TCPFlagSyn, 1000, 0)
+	checkTranslated(t, ep2, v4Addr2, 6000, v4Remote2, 80)
+	injectTCP(ep2, v4Remote2, 80, v4Addr2, 6000, header.TCPFlagSyn|header.TCPFlagAck, 5000, 1001)
+	checkTranslated(t, ep1, v4Remote2, 80, v4Remote1, 6000)
+	injectTCP(ep1, v4Remote1, 6000, v4Remote2, 80, header.TCPFlagAck, 1001, 5001)
+	checkTranslated(t, ep2, v4Addr2, 6000, v4Remote2, 80)
+
+	// ICMP echo identifiers are translated like ports.
+	injectEcho(ep1, v4Remote1, v4Remote2, header.ICMPv4Echo, 77)
+	checkTranslated(t, ep2, v4Addr2, 77, v4Remote2, 0)
+	injectEcho(ep2, v4Remote2, v4Addr2, header.ICMPv4EchoReply, 77)
+	checkTranslated(t, ep1, v4Remote2, 0, v4Remote1, 77)
+
+	// Connections going out through NIC 1 aren't translated.
+	injectUDP(ep2, v4Remote2, 5000, v4Remote1, 53)
+	checkTranslated(t, ep1, v4Remote2, 5000, v4Remote1, 53)
+}
+
+func TestPortForwarding(t *testing.T) {
+	s, ep1, ep2 := newRouter(t)
+
+	rule := tcpip.DNATRule{
+		Protocol:         header.UDPProtocolNumber,
+		Destination:      v4Addr2,
+		DestinationPorts: tcpip.PortRange{Start: 8080, End: 8081},
+		ToAddress:        v4Remote1,
+		ToPort:           80,
+	}
+	if err := s.AddDNATRule(rule); err != nil {
+		t.Fatalf("AddDNATRule failed: %v", err)
+	}
+
+	// Connections to the forwarded ports are redirected, and the source of
+	// replies is translated back.
+	injectUDP(ep2, v4Remote2, 1234, v4Addr2, 8081)
+	checkTranslated(t, ep1, v4Remote2, 1234, v4Remote1, 81)
+	injectUDP(ep1, v4Remote1, 81, v4Remote2, 1234)
+	checkTranslated(t, ep2, v4Addr2, 8081, v4Remote2, 1234)
+
+	// Nodes behind the same NIC as the destination reach it through the
+	// stack too (hairpinning), so their source is translated as well.
+	injectUDP(ep1, v4Remote3, 1234, v4Addr2, 8080)
+	checkTranslated(t, ep1, v4Addr1, 1234, v4Remote1, 80)
+	injectUDP(ep1, v4Remote1, 80, v4Addr1, 1234)
+	checkTranslated(t, ep1, v4Addr2, 8080, v4Remote3, 1234)
+
+	// Removed rules don't redirect new connections.
+	if err := s.RemoveDNATRule(rule); err != nil {
+		t.Fatalf("RemoveDNATRule failed: %v", err)
+	}
+	if err := s.RemoveDNATRule(rule); err != tcpip.ErrInvalidNATRule {
+		t.Fatalf("RemoveDNATRule of removed rule = %v, want %v", err, tcpip.ErrInvalidNATRule)
+	}
+	injectUDP(ep2, v4Remote2, 1235, v4Addr2, 8080)
+	if c := ep1.Drain(); c != 0 {
+		t.Errorf("got %d forwarded packets, want 0", c)
+	}
+
+	// Invalid rules are refused.
+	for _, r := range []tcpip.DNATRule{
+		{ToAddress: v6Addr1},
+		{DestinationPorts: tcpip.PortRange{Start: 1, End: 2}, ToAddress: v4Remote1},
+		{Protocol: header.UDPProtocolNumber, DestinationPorts: tcpip.PortRange{Start: 2, End: 1}, ToAddress: v4Remote1},
+	} {
+		if err := s.AddDNATRule(r); err != tcpip.ErrInvalidNATRule {
+			t.Errorf("AddDNATRule(%+v) = %v, want %v", r, err, tcpip.ErrInvalidNATRule)
+		}
+	}
+}
+
+// quotingError returns an ICMP Destination Unreachable message quoting the
+// start of a UDP packet with the given addresses and ports.
+func quotingError(src tcpip.Address, srcPort uint16, dst tcpip.Address, dstPort uint16) buffer.View {
+	quoted := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize)
+	ip := header.IPv4(quoted)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(quoted)) + 10,
+		TTL:         63,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	header.UDP(quoted[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  header.UDPMinimumSize + 10,
+	})
+
+	v := buffer.NewView(header.ICMPv6ErrorHeaderSize + len(quoted))
+	header.ICMPv4(v).SetType(header.ICMPv4DstUnreachable)
+	copy(v[header.ICMPv6ErrorHeaderSize:], quoted)
+	return v
+}
+
+// checkQuoted checks that an ICMP error from src to dst was sent through ep,
+// quoting a UDP packet with the given addresses and ports, and that its
+// checksums are valid.
+func checkQuoted(t *testing.T, ep *channel.Endpoint, src, dst, quotedSrc tcpip.Address, quotedSrcPort uint16, quotedDst tcpip.Address, quotedDstPort uint16) {
+	var p channel.PacketInfo
+	select {
+	case p = <-ep.C:
+	default:
+		t.Fatalf("error wasn't forwarded")
+	}
+
+	ip := header.IPv4(packetBytes(p))
+	if ip.CalculateChecksum() != 0xffff {
+		t.Errorf("bad IP checksum: %x", ip.Checksum())
+	}
+	if ip.SourceAddress() != src || ip.DestinationAddress() != dst {
+		t.Errorf("got error from %v to %v, want from %v to %v", ip.SourceAddress(), ip.DestinationAddress(), src, dst)
+	}
+	icmp := buffer.View(ip.Payload())
+	if xsum := header.Checksum(icmp, 0); xsum != 0xffff {
+		t.Errorf("bad ICMP checksum: %x", xsum)
+	}
+
+	quoted := header.IPv4(icmp[header.ICMPv6ErrorHeaderSize:])
+	if quoted.CalculateChecksum() != 0xffff {
+		t.Errorf("bad quoted IP checksum: %x", quoted.Checksum())
+	}
+	udp := header.UDP(quoted[quoted.HeaderLength():])
+	if quoted.SourceAddress() != quotedSrc || udp.SourcePort() != quotedSrcPort || quoted.DestinationAddress() != quotedDst || udp.DestinationPort() != quotedDstPort {
+		t.Errorf("got quoted packet from %v:%d to %v:%d, want from %v:%d to %v:%d", quoted.SourceAddress(), udp.SourcePort(), quoted.DestinationAddress(), udp.DestinationPort(), quotedSrc, quotedSrcPort, quotedDst, quotedDstPort)
+	}
+}
+
+func TestNATRelatedErrors(t *testing.T) {
+	s, ep1, ep2 := newRouter(t)
+	if err := s.AddSNATRule(tcpip.SNATRule{OutputNIC: 2}); err != nil {
+		t.Fatalf("AddSNATRule failed: %v", err)
+	}
+	if err := s.AddDNATRule(tcpip.DNATRule{Protocol: header.UDPProtocolNumber, InputNIC: 2, Destination: v4Addr2, ToAddress: v4Remote1}); err != nil {
+		t.Fatalf("AddDNATRule failed: %v", err)
+	}
+
+	// Errors about masqueraded packets, sent to the address of NIC 2 by a
+	// router, are translated back for the node that sent them.
+	const router = "\x0a\x00\x01\x03"
+	injectUDP(ep1, v4Remote1, 5000, v4Remote2, 53)
+	checkTranslated(t, ep2, v4Addr2, 5000, v4Remote2, 53)
+	injectTransport(ep2, header.ICMPv4ProtocolNumber, router, v4Addr2, quotingError(v4Addr2, 5000, v4Remote2, 53))
+	checkQuoted(t, ep1, router, v4Remote1, v4Remote1, 5000, v4Remote2, 53)
+
+	// Errors about redirected packets seem to come from the address they
+	// were sent to.
+	injectUDP(ep2, v4Remote2, 7000, v4Addr2, 53)
+	checkTranslated(t, ep1, v4Remote2, 7000, v4Remote1, 53)
+	injectTransport(ep1, header.ICMPv4ProtocolNumber, v4Remote1, v4Remote2, quotingError(v4Remote2, 7000, v4Remote1, 53))
+	checkQuoted(t, ep2, v4Addr2, v4Remote2, v4Remote2, 7000, v4Addr2, 53)
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// Address scopes, as defined by RFC 4291 section 2.7 and used by RFC 6724.
+const (
+	linkLocalScope = 0x2
+	siteLocalScope = 0x5
+	globalScope    = 0xe
+)
+
+// addressScope returns the scope of addr. IPv4 addresses are treated as their
+// IPv4-mapped IPv6 equivalents, as described in RFC 6724 section 3.2.
+func addressScope(addr tcpip.Address) uint8 {
+	switch len(addr) {
+	case header.IPv4AddressSize:
+		// Loopback and auto-configuration addresses are link-local.
+		if addr[0] == 127 || (addr[0] == 169 && addr[1] == 254) {
+			return linkLocalScope
+		}
+
+	case header.IPv6AddressSize:
+		switch {
+		case addr[0] == 0xff:
+			// Multicast addresses carry their scope.
+			return addr[1] & 0xf
+		case addr[0] == 0xfe && addr[1]&0xc0 == 0x80:
+			return linkLocalScope
+		case addr[0] == 0xfe && addr[1]&0xc0 == 0xc0:
+			return siteLocalScope
+		case addr == "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01":
+			return linkLocalScope
+		}
+	}
+
+	return globalScope
+}
+
+// policyEntry is a row of the RFC 6724 policy table.
+type policyEntry struct {
+	prefix    tcpip.Address
+	prefixLen int
+	label     uint8
+}
+
+// policyTable is the default policy table of RFC 6724 section 2.1, sorted by
+// decreasing prefix length so that the first matching row is the longest
+// match.
+var policyTable = []policyEntry{
+	{"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01", 128, 0},
+	{"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x00\x00\x00\x00", 96, 4},
+	{"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", 96, 3},
+	{"\x20\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", 32, 5},
+	{"\x20\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", 16, 2},
+	{"\x3f\xfe\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", 16, 12},
+	{"\xfe\xc0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", 10, 11},
+	{"\xfc\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", 7, 13},
+}
+
+// addressLabel returns the label the policy table assigns to addr.
+func addressLabel(addr tcpip.Address) uint8 {
+	switch len(addr) {
+	case header.IPv4AddressSize:
+		// IPv4-mapped addresses.
+		return 4
+
+	case header.IPv6AddressSize:
+		for _, p := range policyTable {
+			if commonPrefixLen(addr, p.prefix) >= p.prefixLen {
+				return p.label
+			}
+		}
+	}
+
+	// Everything else matches ::/0.
+	return 1
+}
+
+// commonPrefixLen returns the number of leading bits a and b have in common.
+func commonPrefixLen(a, b tcpip.Address) int {
+	n := 0
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
+
+// preferSource determines if a is preferred over b as the source of traffic to
+// dst, according to the rules of RFC 6724 section 5. Rules that don't apply to
+// the stack (home addresses, outgoing interface and temporary addresses) are
+// skipped. The caller must hold the mutex of the NIC the endpoints belong to.
+func preferSource(a, b *referencedNetworkEndpoint, dst tcpip.Address) bool {
+	sa, sb := a.ep.ID().LocalAddress, b.ep.ID().LocalAddress
+
+	// Rule 1: Prefer same address.
+	if sa == dst || sb == dst {
+		return sa == dst && sb != dst
+	}
+
+	// Rule 2: Prefer appropriate scope.
+	scopeA, scopeB, scopeD := addressScope(sa), addressScope(sb), addressScope(dst)
+	if scopeA != scopeB {
+		if scopeA < scopeB {
+			return scopeA >= scopeD
+		}
+		return scopeB < scopeD
+	}
+
+	// Rule 3: Avoid deprecated addresses.
+	if a.deprecated != b.deprecated {
+		return b.deprecated
+	}
+
+	// Rule 6: Prefer matching label.
+	labelD := addressLabel(dst)
+	if matchA, matchB := addressLabel(sa) == labelD, addressLabel(sb) == labelD; matchA != matchB {
+		return matchA
+	}
+
+	// Rule 8: Use longest matching prefix. Only the on-link prefix of the
+	// source addresses is compared, as given by the subnets of their NIC.
+	// The rule only applies to IPv4 and IPv6 addresses.
+	if len(dst) != header.IPv4AddressSize && len(dst) != header.IPv6AddressSize {
+		return false
+	}
+	lenA, lenB := commonPrefixLen(sa, dst), commonPrefixLen(sb, dst)
+	if lenA > a.prefixLen {
+		lenA = a.prefixLen
+	}
+	if lenB > b.prefixLen {
+		lenB = b.prefixLen
+	}
+	return lenA > lenB
+}
@@ -0,0 +1,781 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/ports"
+	"github.com/google/netstack/tcpip/transport/tcpconntrack"
+)
+
+const (
+	// defaultMaxConnections is the default maximum number of tracked
+	// connections.
+	defaultMaxConnections = 65536
+
+	// defaultTCPConnectingTimeout is the default time a TCP connection
+	// that isn't established yet is tracked without traffic.
+	defaultTCPConnectingTimeout = 2 * time.Minute
+
+	// defaultTCPEstablishedTimeout is the default time an established TCP
+	// connection is tracked without traffic, the minimum required by RFC
+	// 5382 REQ-5 for translated connections.
+	defaultTCPEstablishedTimeout = 2*time.Hour + 4*time.Minute
+
+	// defaultTCPClosedTimeout is the default time a closed or reset TCP
+	// connection is still tracked, so that retransmissions of its last
+	// segments are recognized.
+	defaultTCPClosedTimeout = 4 * time.Minute
+
+	// defaultUDPTimeout is the default time a UDP flow is tracked without
+	// traffic, the value recommended by RFC 4787 REQ-5.
+	defaultUDPTimeout = 5 * time.Minute
+
+	// defaultICMPTimeout is the default time an ICMP echo identifier is
+	// tracked without traffic, the value required by RFC 5508 REQ-1.
+	defaultICMPTimeout = time.Minute
+
+	// defaultGenericTimeout is the default time a flow of another
+	// transport protocol is tracked without traffic.
+	defaultGenericTimeout = 10 * time.Minute
+
+	// connTrackGCInterval is the interval at which expired connections are
+	// removed.
+	connTrackGCInterval = 30 * time.Second
+
+	// earlyDropSample is the number of connections examined to find one
+	// to drop when the table is full.
+	earlyDropSample = 16
+
+	// maxTrackedHeaderSize is the number of bytes of the transport-layer
+	// part of locally generated packets that are looked at to track them,
+	// enough to hold the packets quoted by ICMP errors.
+	maxTrackedHeaderSize = header.ICMPv6ErrorHeaderSize + header.IPv4MaximumHeaderSize + 8
+)
+
+// connDirection is the direction of a packet within a connection.
+type connDirection int
+
+const (
+	// dirOriginal is the direction of the packets of the node that
+	// started the connection.
+	dirOriginal connDirection = iota
+
+	// dirReply is the direction of the packets of the other node.
+	dirReply
+)
+
+// conn is a tracked connection. Packets of each direction are received or
+// sent with the tuple of that direction; when the connection is translated,
+// they are rewritten to the reverse of the tuple of the other direction.
+type conn struct {
+	original tcpip.ConnTrackTuple
+	reply    tcpip.ConnTrackTuple
+
+	// seenReply indicates whether packets were seen in the reply
+	// direction.
+	seenReply bool
+
+	// tcb tracks the state of TCP connections.
+	tcb tcpconntrack.TCB
+
+	// expires is the time at which the connection is forgotten, unless
+	// more packets are seen.
+	expires time.Time
+
+	// counters holds the packet and byte counts of each direction.
+	counters [2]tcpip.FilterCounters
+
+	// dnat indicates whether the destination of the connection is
+	// translated.
+	dnat bool
+
+	// snatChecked indicates whether SNAT rules were evaluated against
+	// the connection, which happens when its first packet is forwarded.
+	snatChecked bool
+
+	// reserved indicates whether the destination port of reply was
+	// reserved with the port manager for source translation.
+	reserved bool
+}
+
+// tracking describes how a packet relates to the tracked connections.
+type tracking struct {
+	// conn is the connection the packet belongs to, or nil if there is
+	// none.
+	conn *conn
+
+	// dir is the direction of the packet in conn.
+	dir connDirection
+
+	// state is the connection tracking state of the packet, or zero if it
+	// isn't tracked.
+	state tcpip.ConnState
+
+	// related indicates whether the packet is an ICMP error about a packet
+	// of conn, rather than a packet of conn itself. dir is then the
+	// direction the error travels in.
+	related bool
+}
+
+// trackedPacket holds the properties of a packet that connection tracking and
+// NAT look at.
+type trackedPacket struct {
+	tuple tcpip.ConnTrackTuple
+
+	// ip is the IPv4 header of the packet, if it was parsed from an IPv4
+	// packet. Only such packets can be translated.
+	ip header.IPv4
+
+	// transport holds the start of the transport-layer part of the
+	// packet.
+	transport buffer.View
+
+	// size is the size of the network-layer payload of the packet.
+	size int
+}
+
+// parseTrackedPacket parses v, the start of a packet of the given network
+// protocol, network-layer header included. Fragments and packets whose
+// transport-layer header isn't in v can't be tracked.
+//
+// If quoted is true, v is a packet quoted by an ICMP error, of which only the
+// first 8 bytes of the transport-layer part are required.
+//
+// TODO: Track fragments.
+func parseTrackedPacket(protocol tcpip.NetworkProtocolNumber, v buffer.View, quoted bool) (trackedPacket, bool) {
+	var p trackedPacket
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if len(v) < header.IPv4MinimumSize {
+			return trackedPacket{}, false
+		}
+		ip := header.IPv4(v)
+		hlen := int(ip.HeaderLength())
+		if hlen < header.IPv4MinimumSize || hlen > len(ip) || int(ip.TotalLength()) < hlen || ip.Flags()&header.IPv4FlagMoreFragments != 0 || ip.FragmentOffset() != 0 {
+			return trackedPacket{}, false
+		}
+		p.ip = ip
+		p.tuple.Protocol = tcpip.TransportProtocolNumber(ip.Protocol())
+		p.tuple.Source = ip.SourceAddress()
+		p.tuple.Destination = ip.DestinationAddress()
+		p.transport = v[hlen:]
+		p.size = int(ip.TotalLength()) - hlen
+
+	case header.IPv6ProtocolNumber:
+		if len(v) < header.IPv6MinimumSize {
+			return trackedPacket{}, false
+		}
+		ip := header.IPv6(v)
+		if ip.NextHeader() == header.IPv6FragmentHeader {
+			return trackedPacket{}, false
+		}
+		p.tuple.Protocol = tcpip.TransportProtocolNumber(ip.NextHeader())
+		p.tuple.Source = ip.SourceAddress()
+		p.tuple.Destination = ip.DestinationAddress()
+		p.transport = v[header.IPv6MinimumSize:]
+		p.size = int(ip.PayloadLength())
+
+	default:
+		return trackedPacket{}, false
+	}
+
+	if len(p.transport) > p.size {
+		p.transport = p.transport[:p.size]
+	}
+	return p, p.parseTransport(quoted)
+}
+
+// parseTransport fills in the ports of p's tuple from its transport-layer
+// header.
+func (p *trackedPacket) parseTransport(quoted bool) bool {
+	t := p.transport
+	switch p.tuple.Protocol {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+		minSize := header.UDPMinimumSize
+		if p.tuple.Protocol == header.TCPProtocolNumber {
+			minSize = header.TCPMinimumSize
+		}
+		if quoted {
+			minSize = 4
+		}
+		if len(t) < minSize {
+			return false
+		}
+		// TCP and UDP headers both start with the ports.
+		h := header.UDP(t)
+		p.tuple.SourcePort, p.tuple.DestinationPort = h.SourcePort(), h.DestinationPort()
+
+	case header.ICMPv4ProtocolNumber:
+		if len(t) < header.ICMPv4MinimumSize {
+			return false
+		}
+		icmp := header.ICMPv4(t)
+		switch icmp.Type() {
+		case header.ICMPv4Echo, header.ICMPv4EchoReply:
+			if len(t) < header.ICMPv4EchoMinimumSize {
+				return false
+			}
+			if icmp.Type() == header.ICMPv4Echo {
+				p.tuple.SourcePort = icmp.Ident()
+			} else {
+				p.tuple.DestinationPort = icmp.Ident()
+			}
+		}
+
+	case header.ICMPv6ProtocolNumber:
+		if len(t) < header.ICMPv6MinimumSize {
+			return false
+		}
+		icmp := header.ICMPv6(t)
+		switch icmp.Type() {
+		case header.ICMPv6EchoRequest, header.ICMPv6EchoReply:
+			if len(t) < header.ICMPv6EchoMinimumSize {
+				return false
+			}
+			if icmp.Type() == header.ICMPv6EchoRequest {
+				p.tuple.SourcePort = icmp.Ident()
+			} else {
+				p.tuple.DestinationPort = icmp.Ident()
+			}
+		}
+	}
+	return true
+}
+
+// icmpKind classifies ICMP messages for connection tracking.
+type icmpKind int
+
+const (
+	// icmpNone is the kind of packets that aren't ICMP messages.
+	icmpNone icmpKind = iota
+
+	// icmpEcho is the kind of echo requests and replies, which are
+	// tracked like connections.
+	icmpEcho
+
+	// icmpError is the kind of errors, which are related to the
+	// connection of the packet they quote.
+	icmpError
+
+	// icmpOther is the kind of other messages, which aren't tracked.
+	icmpOther
+)
+
+// icmpKind returns the kind of p, if it is an ICMP message.
+func (p *trackedPacket) icmpKind() icmpKind {
+	switch p.tuple.Protocol {
+	case header.ICMPv4ProtocolNumber:
+		switch header.ICMPv4(p.transport).Type() {
+		case header.ICMPv4Echo, header.ICMPv4EchoReply:
+			return icmpEcho
+		case header.ICMPv4DstUnreachable, header.ICMPv4SrcQuench, header.ICMPv4Redirect, header.ICMPv4TimeExceeded, header.ICMPv4ParamProblem:
+			return icmpError
+		default:
+			return icmpOther
+		}
+	case header.ICMPv6ProtocolNumber:
+		switch t := header.ICMPv6(p.transport).Type(); {
+		case t == header.ICMPv6EchoRequest || t == header.ICMPv6EchoReply:
+			return icmpEcho
+		case t < header.ICMPv6EchoRequest:
+			// Types below 128 are all errors.
+			return icmpError
+		default:
+			return icmpOther
+		}
+	default:
+		return icmpNone
+	}
+}
+
+// canStart determines if p can be the first packet of a connection.
+func (p *trackedPacket) canStart() bool {
+	switch p.tuple.Protocol {
+	case header.TCPProtocolNumber:
+		return header.TCP(p.transport).Flags()&(header.TCPFlagSyn|header.TCPFlagAck) == header.TCPFlagSyn
+	case header.ICMPv4ProtocolNumber:
+		return header.ICMPv4(p.transport).Type() == header.ICMPv4Echo
+	case header.ICMPv6ProtocolNumber:
+		return header.ICMPv6(p.transport).Type() == header.ICMPv6EchoRequest
+	default:
+		return true
+	}
+}
+
+// connTrack tracks the connections of the packets received, sent and forwarded
+// by a stack. It also holds the NAT rules, which are applied to connections
+// when they start (see nat.go).
+type connTrack struct {
+	// active is nonzero when connections must be tracked, so that packets
+	// can skip tracking cheaply otherwise. It is accessed atomically.
+	active uint32
+
+	ports *ports.PortManager
+
+	mu sync.Mutex
+
+	// opts holds the options set by the user, with defaults filled in.
+	opts tcpip.ConnTrackOptions
+
+	// stateHooks indicates which filter hooks have rules that match on
+	// connection states.
+	stateHooks [tcpip.NumFilterHooks]bool
+
+	dnatRules []tcpip.DNATRule
+	snatRules []tcpip.SNATRule
+
+	// conns holds the tracked connections, indexed by the tuples of both
+	// of their directions, and count is their number.
+	conns map[tcpip.ConnTrackTuple]*conn
+	count int
+
+	// subscribers are sent connection tracking events.
+	subscribers []chan<- tcpip.ConnTrackEvent
+
+	// gcTimer removes expired connections. It is nil when there are none.
+	gcTimer *time.Timer
+}
+
+func newConnTrack(ports *ports.PortManager) *connTrack {
+	return &connTrack{
+		ports: ports,
+		opts:  withConnTrackDefaults(tcpip.ConnTrackOptions{}),
+		conns: make(map[tcpip.ConnTrackTuple]*conn),
+	}
+}
+
+// withConnTrackDefaults returns opts with its zero fields replaced by their
+// default values.
+func withConnTrackDefaults(opts tcpip.ConnTrackOptions) tcpip.ConnTrackOptions {
+	if opts.MaxConnections == 0 {
+		opts.MaxConnections = defaultMaxConnections
+	}
+	for _, f := range []struct {
+		d   *time.Duration
+		def time.Duration
+	}{
+		{&opts.TCPConnectingTimeout, defaultTCPConnectingTimeout},
+		{&opts.TCPEstablishedTimeout, defaultTCPEstablishedTimeout},
+		{&opts.TCPClosedTimeout, defaultTCPClosedTimeout},
+		{&opts.UDPTimeout, defaultUDPTimeout},
+		{&opts.ICMPTimeout, defaultICMPTimeout},
+		{&opts.GenericTimeout, defaultGenericTimeout},
+	} {
+		if *f.d == 0 {
+			*f.d = f.def
+		}
+	}
+	return opts
+}
+
+// updateActiveLocked updates ct.active after options, rules or connections
+// change.
+func (ct *connTrack) updateActiveLocked() {
+	active := ct.opts.Enabled || len(ct.dnatRules) != 0 || len(ct.snatRules) != 0 || ct.count != 0
+	for _, h := range ct.stateHooks {
+		active = active || h
+	}
+
+	var v uint32
+	if active {
+		v = 1
+	}
+	atomic.StoreUint32(&ct.active, v)
+}
+
+// setStateHook records whether the filter rules of the given hook match on
+// connection states.
+func (ct *connTrack) setStateHook(hook tcpip.FilterHook, state bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ct.stateHooks[hook] = state
+	ct.updateActiveLocked()
+}
+
+// trackReceived tracks a packet of the given network protocol received on the
+// NIC nicid, v being its start, network-layer header included. It returns
+// false if the packet must be dropped because the table is full.
+//
+// Packets that can't be tracked, such as fragments and ICMP messages other
+// than echoes and errors, have no connection state.
+func (ct *connTrack) trackReceived(nicid tcpip.NICID, protocol tcpip.NetworkProtocolNumber, v buffer.View) (tracking, bool) {
+	if atomic.LoadUint32(&ct.active) == 0 {
+		return tracking{}, true
+	}
+	p, ok := parseTrackedPacket(protocol, v, false)
+	if !ok {
+		return tracking{}, true
+	}
+	return ct.track(nicid, protocol, &p)
+}
+
+// trackSent tracks a packet about to be sent through r, made of the headers in
+// hdr and payload. It returns false if the packet must be dropped because the
+// table is full.
+func (ct *connTrack) trackSent(r *Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) (tracking, bool) {
+	if atomic.LoadUint32(&ct.active) == 0 {
+		return tracking{}, true
+	}
+
+	// Some protocols put part of their header in the payload, e.g., ICMP
+	// echo identifiers or the packets quoted by ICMP errors.
+	h := hdr.UsedBytes()
+	transport := buffer.View(h)
+	if len(h) < maxTrackedHeaderSize && len(payload) != 0 {
+		n := maxTrackedHeaderSize - len(h)
+		if n > len(payload) {
+			n = len(payload)
+		}
+		transport = make(buffer.View, len(h)+n)
+		copy(transport, h)
+		copy(transport[len(h):], payload)
+	}
+
+	p := trackedPacket{
+		tuple: tcpip.ConnTrackTuple{
+			Protocol:    protocol,
+			Source:      r.LocalAddress,
+			Destination: r.RemoteAddress,
+		},
+		transport: transport,
+		size:      len(h) + len(payload),
+	}
+	if !p.parseTransport(false) {
+		return tracking{}, true
+	}
+	return ct.track(0, r.NetProto, &p)
+}
+
+// track finds or creates the connection p belongs to. nicid is the NIC p was
+// received on, or zero if it is sent by the stack.
+func (ct *connTrack) track(nicid tcpip.NICID, protocol tcpip.NetworkProtocolNumber, p *trackedPacket) (tracking, bool) {
+	switch p.icmpKind() {
+	case icmpError:
+		return ct.related(protocol, p), true
+	case icmpOther:
+		return tracking{}, true
+	}
+
+	now := time.Now()
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if c := ct.conns[p.tuple]; c != nil {
+		if !now.After(c.expires) {
+			return ct.updateLocked(c, p, now), true
+		}
+		ct.removeLocked(c)
+	}
+
+	if !p.canStart() {
+		return tracking{state: tcpip.ConnStateInvalid}, true
+	}
+	if !ct.makeRoomLocked(now) {
+		return tracking{}, false
+	}
+
+	c := &conn{
+		original: p.tuple,
+		reply:    p.tuple.Reverse(),
+	}
+	if p.tuple.Protocol == header.TCPProtocolNumber {
+		c.tcb.Init(header.TCP(p.transport))
+		c.expires = now.Add(ct.opts.TCPConnectingTimeout)
+	} else {
+		c.expires = now.Add(ct.timeoutLocked(p.tuple.Protocol))
+	}
+	if nicid != 0 {
+		ct.dnatLocked(nicid, c)
+	}
+
+	// The reply tuple of a translated connection may already be in use.
+	if ct.conns[c.reply] != nil {
+		return tracking{}, false
+	}
+
+	c.counters[dirOriginal].Packets++
+	c.counters[dirOriginal].Bytes += uint64(p.size)
+	ct.conns[c.original] = c
+	ct.conns[c.reply] = c
+	ct.count++
+	ct.updateActiveLocked()
+	if ct.gcTimer == nil {
+		ct.gcTimer = time.AfterFunc(connTrackGCInterval, ct.gc)
+	}
+	ct.notifyLocked(tcpip.ConnTrackNew, c)
+
+	return tracking{conn: c, dir: dirOriginal, state: tcpip.ConnStateNew}, true
+}
+
+// updateLocked updates the state of c, and pushes back its expiration, after
+// the packet p was seen. It returns how p relates to c.
+func (ct *connTrack) updateLocked(c *conn, p *trackedPacket, now time.Time) tracking {
+	dir := dirOriginal
+	if p.tuple == c.reply && p.tuple != c.original {
+		dir = dirReply
+	}
+	c.counters[dir].Packets++
+	c.counters[dir].Bytes += uint64(p.size)
+
+	if dir == dirReply && !c.seenReply {
+		c.seenReply = true
+		ct.notifyLocked(tcpip.ConnTrackEstablished, c)
+	}
+
+	t := tracking{conn: c, dir: dir, state: tcpip.ConnStateNew}
+	if c.seenReply {
+		t.state = tcpip.ConnStateEstablished
+	}
+
+	if c.original.Protocol != header.TCPProtocolNumber {
+		c.expires = now.Add(ct.timeoutLocked(c.original.Protocol))
+		return t
+	}
+
+	var r tcpconntrack.Result
+	if dir == dirOriginal {
+		r = c.tcb.UpdateStateOutbound(header.TCP(p.transport))
+	} else {
+		r = c.tcb.UpdateStateInbound(header.TCP(p.transport))
+	}
+	switch r {
+	case tcpconntrack.ResultDrop:
+		// Segments outside the window don't keep the connection
+		// alive.
+		t.state = tcpip.ConnStateInvalid
+	case tcpconntrack.ResultConnecting:
+		c.expires = now.Add(ct.opts.TCPConnectingTimeout)
+	case tcpconntrack.ResultAlive:
+		c.expires = now.Add(ct.opts.TCPEstablishedTimeout)
+	default:
+		c.expires = now.Add(ct.opts.TCPClosedTimeout)
+	}
+	return t
+}
+
+// timeoutLocked returns how long connections of the given transport protocol,
+// other than TCP, are tracked without traffic.
+func (ct *connTrack) timeoutLocked(protocol tcpip.TransportProtocolNumber) time.Duration {
+	switch protocol {
+	case header.UDPProtocolNumber:
+		return ct.opts.UDPTimeout
+	case header.ICMPv4ProtocolNumber, header.ICMPv6ProtocolNumber:
+		return ct.opts.ICMPTimeout
+	default:
+		return ct.opts.GenericTimeout
+	}
+}
+
+// related returns how the ICMP error p relates to the tracked connections: it
+// is related to the connection of the packet it quotes, if any, and invalid
+// otherwise. The error travels in the direction opposite to the quoted packet,
+// which holds the tuple that packet was sent with, so that errors about
+// translated connections can be translated back along with the packets they
+// quote.
+func (ct *connTrack) related(protocol tcpip.NetworkProtocolNumber, p *trackedPacket) tracking {
+	invalid := tracking{state: tcpip.ConnStateInvalid}
+
+	// ICMPv4 and ICMPv6 errors both have an 8-byte header.
+	if len(p.transport) < header.ICMPv6ErrorHeaderSize {
+		return invalid
+	}
+	q, ok := parseTrackedPacket(protocol, p.transport[header.ICMPv6ErrorHeaderSize:], true)
+	if !ok {
+		return invalid
+	}
+
+	now := time.Now()
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	// Packets are sent with the reverse of the tuple of the other
+	// direction, so a quoted packet of the original direction has the
+	// reverse of the reply tuple, and vice versa.
+	if c := ct.conns[q.tuple.Reverse()]; c != nil && !now.After(c.expires) {
+		dir := dirOriginal
+		if q.tuple.Reverse() == c.reply {
+			dir = dirReply
+		}
+		return tracking{conn: c, dir: dir, state: tcpip.ConnStateRelated, related: true}
+	}
+
+	// Packets quoted before being translated, e.g., by errors about
+	// packets the stack forwarded, can't be translated back.
+	if c := ct.conns[q.tuple]; c != nil && !now.After(c.expires) {
+		return tracking{state: tcpip.ConnStateRelated}
+	}
+	return invalid
+}
+
+// makeRoomLocked makes room for a new connection if the table is full, by
+// dropping an expired connection or one that hasn't seen replies. It returns
+// false if none was found.
+func (ct *connTrack) makeRoomLocked(now time.Time) bool {
+	if ct.count < ct.opts.MaxConnections {
+		return true
+	}
+
+	// Map iteration order is randomized, so the connections examined are
+	// a different sample every time.
+	examined := 0
+	for _, c := range ct.conns {
+		if now.After(c.expires) || !c.seenReply {
+			ct.removeLocked(c)
+			return true
+		}
+		examined++
+		if examined == earlyDropSample {
+			break
+		}
+	}
+	return false
+}
+
+// removeLocked stops tracking c.
+func (ct *connTrack) removeLocked(c *conn) {
+	if ct.conns[c.original] != c {
+		return
+	}
+	delete(ct.conns, c.original)
+	delete(ct.conns, c.reply)
+	ct.releaseLocked(c)
+	ct.count--
+	ct.updateActiveLocked()
+	ct.notifyLocked(tcpip.ConnTrackDestroyed, c)
+}
+
+// entryLocked describes c.
+func (ct *connTrack) entryLocked(c *conn) tcpip.ConnTrackEntry {
+	return tcpip.ConnTrackEntry{
+		Original:         c.original,
+		Reply:            c.reply,
+		Established:      c.seenReply,
+		OriginalCounters: c.counters[dirOriginal],
+		ReplyCounters:    c.counters[dirReply],
+		Expires:          c.expires,
+	}
+}
+
+// notifyLocked sends an event about c to the subscribers. Subscribers that
+// aren't ready to receive it miss it.
+func (ct *connTrack) notifyLocked(typ tcpip.ConnTrackEventType, c *conn) {
+	if len(ct.subscribers) == 0 {
+		return
+	}
+	e := tcpip.ConnTrackEvent{Type: typ, Entry: ct.entryLocked(c)}
+	for _, ch := range ct.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// gc removes expired connections.
+func (ct *connTrack) gc() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range ct.conns {
+		if now.After(c.expires) {
+			ct.removeLocked(c)
+		}
+	}
+
+	if ct.count == 0 {
+		ct.gcTimer = nil
+		return
+	}
+	ct.gcTimer.Reset(connTrackGCInterval)
+}
+
+// SetConnTrackOptions configures the connection tracking of the stack. New
+// timeouts apply from the next packet of each connection on.
+func (s *Stack) SetConnTrackOptions(opts tcpip.ConnTrackOptions) error {
+	if opts.MaxConnections < 0 || opts.TCPConnectingTimeout < 0 || opts.TCPEstablishedTimeout < 0 || opts.TCPClosedTimeout < 0 || opts.UDPTimeout < 0 || opts.ICMPTimeout < 0 || opts.GenericTimeout < 0 {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	ct := s.connTrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ct.opts = withConnTrackDefaults(opts)
+	ct.updateActiveLocked()
+	return nil
+}
+
+// ConnTrackOptions returns the connection tracking options of the stack, with
+// defaults filled in.
+func (s *Stack) ConnTrackOptions() tcpip.ConnTrackOptions {
+	ct := s.connTrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	return ct.opts
+}
+
+// ConnTrackEntries returns a snapshot of the connections tracked by the stack.
+func (s *Stack) ConnTrackEntries() []tcpip.ConnTrackEntry {
+	ct := s.connTrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]tcpip.ConnTrackEntry, 0, ct.count)
+	for t, c := range ct.conns {
+		if t == c.original && !now.After(c.expires) {
+			entries = append(entries, ct.entryLocked(c))
+		}
+	}
+	return entries
+}
+
+// FlushConnTrack stops tracking all connections. Translated connections stop
+// being translated, so their packets are then treated as those of new
+// connections, or dropped by the stack or the remote nodes.
+func (s *Stack) FlushConnTrack() {
+	ct := s.connTrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	for _, c := range ct.conns {
+		ct.removeLocked(c)
+	}
+}
+
+// SubscribeConnTrack registers ch to receive connection tracking events. Events
+// are sent without blocking, so they are lost when ch isn't ready.
+func (s *Stack) SubscribeConnTrack(ch chan<- tcpip.ConnTrackEvent) {
+	ct := s.connTrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ct.subscribers = append(ct.subscribers, ch)
+}
+
+// UnsubscribeConnTrack unregisters a channel registered with
+// SubscribeConnTrack.
+func (s *Stack) UnsubscribeConnTrack(ch chan<- tcpip.ConnTrackEvent) {
+	ct := s.connTrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	for i, c := range ct.subscribers {
+		if c == ch {
+			ct.subscribers = append(ct.subscribers[:i:i], ct.subscribers[i+1:]...)
+			return
+		}
+	}
+}
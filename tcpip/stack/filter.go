@@ -0,0 +1,284 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// filterTable holds the filter rules of a hook along with their counters.
+// Tables are never modified once installed, other than their counters, so
+// that replacing the rules of a hook is atomic with respect to the packets
+// being filtered.
+type filterTable struct {
+	hook  tcpip.FilterHook
+	rules []tcpip.FilterRule
+
+	// counters holds the counters of each rule. They are updated
+	// atomically.
+	counters []tcpip.FilterCounters
+}
+
+// filterPacket holds the properties of a packet that filter rules match on.
+type filterPacket struct {
+	inputNIC  tcpip.NICID
+	outputNIC tcpip.NICID
+	src       tcpip.Address
+	dst       tcpip.Address
+	protocol  tcpip.TransportProtocolNumber
+
+	// transport holds the start of the transport-layer part of the
+	// packet. It is empty when it isn't available, e.g., in fragments
+	// other than the first one.
+	transport buffer.View
+
+	// size is the size of the network-layer payload of the packet.
+	size int
+
+	// connState is the connection tracking state of the packet, or zero
+	// if it isn't tracked.
+	connState tcpip.ConnState
+}
+
+// parseNetworkPacket fills in the properties of pkt from v, the start of a
+// packet of the given network protocol, network-layer header included.
+func (pkt *filterPacket) parseNetworkPacket(protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		h := header.IPv4(v)
+		hlen := int(h.HeaderLength())
+		if len(h) < header.IPv4MinimumSize || hlen > len(h) || int(h.TotalLength()) < hlen {
+			return
+		}
+		pkt.protocol = tcpip.TransportProtocolNumber(h.Protocol())
+		pkt.size = int(h.TotalLength()) - hlen
+		if h.FragmentOffset() == 0 {
+			pkt.transport = v[hlen:]
+		}
+
+	case header.IPv6ProtocolNumber:
+		h := header.IPv6(v)
+		if len(h) < header.IPv6MinimumSize {
+			return
+		}
+		pkt.protocol = tcpip.TransportProtocolNumber(h.NextHeader())
+		pkt.size = int(h.PayloadLength())
+		pkt.transport = v[header.IPv6MinimumSize:]
+	}
+
+	if len(pkt.transport) > pkt.size {
+		pkt.transport = pkt.transport[:pkt.size]
+	}
+}
+
+// ports returns the source and destination ports of pkt, if it is a TCP or
+// UDP packet that carries them.
+func (pkt *filterPacket) ports() (src, dst uint16, ok bool) {
+	if pkt.protocol != header.TCPProtocolNumber && pkt.protocol != header.UDPProtocolNumber {
+		return 0, 0, false
+	}
+	// TCP and UDP headers both start with the source and destination
+	// ports.
+	if len(pkt.transport) < 4 {
+		return 0, 0, false
+	}
+	h := header.UDP(pkt.transport)
+	return h.SourcePort(), h.DestinationPort(), true
+}
+
+// matchPrefix determines if addr, masked with mask, equals prefix. An empty
+// prefix matches any address.
+func matchPrefix(addr, prefix, mask tcpip.Address) bool {
+	if len(prefix) == 0 {
+		return true
+	}
+	if len(addr) != len(prefix) {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		if addr[i]&mask[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// matches determines if pkt meets all criteria of rule.
+func (pkt *filterPacket) matches(rule *tcpip.FilterRule) bool {
+	if rule.InputNIC != 0 && rule.InputNIC != pkt.inputNIC {
+		return false
+	}
+
+	if rule.OutputNIC != 0 && rule.OutputNIC != pkt.outputNIC {
+		return false
+	}
+
+	if !matchPrefix(pkt.src, rule.Source, rule.SourceMask) || !matchPrefix(pkt.dst, rule.Destination, rule.DestinationMask) {
+		return false
+	}
+
+	if rule.Protocol != 0 && rule.Protocol != pkt.protocol {
+		return false
+	}
+
+	if rule.SourcePorts != (tcpip.PortRange{}) || rule.DestinationPorts != (tcpip.PortRange{}) {
+		src, dst, ok := pkt.ports()
+		if !ok || !rule.SourcePorts.Contains(src) || !rule.DestinationPorts.Contains(dst) {
+			return false
+		}
+	}
+
+	if rule.TCPFlagsMask != 0 {
+		if pkt.protocol != header.TCPProtocolNumber || len(pkt.transport) < header.TCPMinimumSize {
+			return false
+		}
+		if header.TCP(pkt.transport).Flags()&rule.TCPFlagsMask != rule.TCPFlags {
+			return false
+		}
+	}
+
+	return rule.ConnStates == 0 || rule.ConnStates&pkt.connState != 0
+}
+
+// filter evaluates the rules of t against pkt, updating the counters of the
+// rules that match. It returns the verdict of the first matching rule that
+// doesn't just log the packet, or FilterAccept if there is none.
+func (t *filterTable) filter(pkt *filterPacket) tcpip.FilterVerdict {
+	for i := range t.rules {
+		rule := &t.rules[i]
+		if !pkt.matches(rule) {
+			continue
+		}
+
+		atomic.AddUint64(&t.counters[i].Packets, 1)
+		atomic.AddUint64(&t.counters[i].Bytes, uint64(pkt.size))
+
+		if rule.Verdict == tcpip.FilterLog {
+			t.log(rule.LogPrefix, pkt)
+			continue
+		}
+		return rule.Verdict
+	}
+
+	return tcpip.FilterAccept
+}
+
+// log logs pkt on behalf of a FilterLog rule.
+func (t *filterTable) log(prefix string, pkt *filterPacket) {
+	ports := ""
+	if src, dst, ok := pkt.ports(); ok {
+		ports = fmt.Sprintf(" sport=%d dport=%d", src, dst)
+	}
+	log.Printf("%shook=%d in=%d out=%d src=%v dst=%v proto=%d len=%d%s", prefix, t.hook, pkt.inputNIC, pkt.outputNIC, pkt.src, pkt.dst, pkt.protocol, pkt.size, ports)
+}
+
+// filter evaluates the given tables, in order, against pkt. It returns the
+// first verdict other than FilterAccept. Nil tables are skipped.
+func (pkt *filterPacket) filter(tables ...*filterTable) tcpip.FilterVerdict {
+	for _, t := range tables {
+		if t == nil {
+			continue
+		}
+		if v := t.filter(pkt); v != tcpip.FilterAccept {
+			return v
+		}
+	}
+	return tcpip.FilterAccept
+}
+
+// validPrefix determines if prefix and mask have the same length, and prefix
+// has no bits set outside mask.
+func validPrefix(prefix, mask tcpip.Address) bool {
+	if len(prefix) != len(mask) {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		if prefix[i]&^mask[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validFilterRule determines if the criteria and verdict of rule are
+// consistent.
+func validFilterRule(rule *tcpip.FilterRule) bool {
+	if !validPrefix(rule.Source, rule.SourceMask) || !validPrefix(rule.Destination, rule.DestinationMask) {
+		return false
+	}
+	if rule.SourcePorts.Start > rule.SourcePorts.End || rule.DestinationPorts.Start > rule.DestinationPorts.End {
+		return false
+	}
+	return rule.Verdict >= tcpip.FilterAccept && rule.Verdict <= tcpip.FilterLog
+}
+
+// SetFilterRules atomically replaces the filter rules of the given hook, and
+// resets their counters. Packets being filtered concurrently are evaluated
+// against either the old or the new rules, never a mix of both.
+func (s *Stack) SetFilterRules(hook tcpip.FilterHook, rules []tcpip.FilterRule) error {
+	if hook < 0 || hook >= tcpip.NumFilterHooks {
+		return tcpip.ErrInvalidFilterRule
+	}
+	for i := range rules {
+		if !validFilterRule(&rules[i]) {
+			return tcpip.ErrInvalidFilterRule
+		}
+		// Packets aren't tracked yet when they reach the prerouting
+		// hook.
+		if hook == tcpip.FilterPrerouting && rules[i].ConnStates != 0 {
+			return tcpip.ErrInvalidFilterRule
+		}
+	}
+
+	// Connections are tracked while rules match on their states.
+	state := false
+	for i := range rules {
+		state = state || rules[i].ConnStates != 0
+	}
+	s.connTrack.setStateHook(hook, state)
+
+	var t *filterTable
+	if len(rules) > 0 {
+		t = &filterTable{
+			hook:     hook,
+			rules:    append([]tcpip.FilterRule(nil), rules...),
+			counters: make([]tcpip.FilterCounters, len(rules)),
+		}
+	}
+	s.filters[hook].Store(t)
+	return nil
+}
+
+// GetFilterRules returns a copy of the filter rules of the given hook, and a
+// snapshot of their counters.
+func (s *Stack) GetFilterRules(hook tcpip.FilterHook) ([]tcpip.FilterRule, []tcpip.FilterCounters) {
+	if hook < 0 || hook >= tcpip.NumFilterHooks {
+		return nil, nil
+	}
+	t := s.filterTable(hook)
+	if t == nil {
+		return nil, nil
+	}
+
+	counters := make([]tcpip.FilterCounters, len(t.counters))
+	for i := range t.counters {
+		counters[i].Packets = atomic.LoadUint64(&t.counters[i].Packets)
+		counters[i].Bytes = atomic.LoadUint64(&t.counters[i].Bytes)
+	}
+	return append([]tcpip.FilterRule(nil), t.rules...), counters
+}
+
+// filterTable returns the filter rules of the given hook, or nil if it has
+// none.
+func (s *Stack) filterTable(hook tcpip.FilterHook) *filterTable {
+	t, _ := s.filters[hook].Load().(*filterTable)
+	return t
+}
@@ -0,0 +1,434 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// rewrite translates the source (if src is true) or the destination of p to
+// addr and port, fixing up the checksums of the packet incrementally.
+func (p *trackedPacket) rewrite(src bool, addr tcpip.Address, port uint16) {
+	oldAddr, oldPort := p.tuple.Destination, p.tuple.DestinationPort
+	if src {
+		oldAddr, oldPort = p.tuple.Source, p.tuple.SourcePort
+	}
+
+	// Find the transport-layer checksum and port fields. The checksums of
+	// TCP and UDP cover the addresses through their pseudo-header, unlike
+	// that of ICMP.
+	xsumOff, portOff, pseudo := -1, -1, true
+	switch p.tuple.Protocol {
+	case header.TCPProtocolNumber:
+		xsumOff, portOff = 16, 2
+	case header.UDPProtocolNumber:
+		// A zero UDP checksum means that there is none.
+		if len(p.transport) >= header.UDPMinimumSize && header.UDP(p.transport).Checksum() != 0 {
+			xsumOff = 6
+		}
+		portOff = 2
+	case header.ICMPv4ProtocolNumber:
+		xsumOff, pseudo = 2, false
+		switch header.ICMPv4(p.transport).Type() {
+		case header.ICMPv4Echo:
+			if src {
+				portOff = 4
+			}
+		case header.ICMPv4EchoReply:
+			if !src {
+				portOff = 4
+			}
+		}
+	}
+	if portOff == 2 && src {
+		portOff = 0
+	}
+
+	// Packets quoted by ICMP errors may be truncated after the ports.
+	if xsumOff+2 > len(p.transport) {
+		xsumOff = -1
+	}
+
+	fix := func(old, new []byte) {
+		xsum := binary.BigEndian.Uint16(p.transport[xsumOff:])
+		xsum = header.UpdateChecksum(xsum, old, new)
+		if xsum == 0 && p.tuple.Protocol == header.UDPProtocolNumber {
+			xsum = 0xffff
+		}
+		binary.BigEndian.PutUint16(p.transport[xsumOff:], xsum)
+	}
+
+	if addr != oldAddr {
+		p.ip.SetChecksum(header.UpdateChecksum(p.ip.Checksum(), []byte(oldAddr), []byte(addr)))
+		if pseudo && xsumOff >= 0 {
+			fix([]byte(oldAddr), []byte(addr))
+		}
+		if src {
+			p.ip.SetSourceAddress(addr)
+			p.tuple.Source = addr
+		} else {
+			p.ip.SetDestinationAddress(addr)
+			p.tuple.Destination = addr
+		}
+	}
+
+	if port != oldPort && portOff >= 0 {
+		var old, new [2]byte
+		binary.BigEndian.PutUint16(old[:], oldPort)
+		binary.BigEndian.PutUint16(new[:], port)
+		copy(p.transport[portOff:], new[:])
+		if xsumOff >= 0 {
+			fix(old[:], new[:])
+		}
+		if src {
+			p.tuple.SourcePort = port
+		} else {
+			p.tuple.DestinationPort = port
+		}
+	}
+}
+
+// rewriteQuoted translates the source (if src is true) or the destination of
+// the packet quoted by p, an ICMPv4 error, to addr and port, fixing up the
+// checksums of p incrementally.
+func (p *trackedPacket) rewriteQuoted(src bool, addr tcpip.Address, port uint16) {
+	// ICMPv4 and ICMPv6 errors both have an 8-byte header.
+	if len(p.transport) < header.ICMPv6ErrorHeaderSize {
+		return
+	}
+	icmp := header.ICMPv4(p.transport)
+	q, ok := parseTrackedPacket(header.IPv4ProtocolNumber, buffer.View(icmp[header.ICMPv6ErrorHeaderSize:]), true)
+	if !ok {
+		return
+	}
+
+	// Only the quoted network-layer header and the first 8 bytes after it
+	// are rewritten. An even number of them is saved to update the
+	// checksum of the error.
+	n := int(q.ip.HeaderLength()) + 8
+	if n > len(q.ip) {
+		n = len(q.ip) &^ 1
+	}
+	old := append([]byte(nil), q.ip[:n]...)
+	q.rewrite(src, addr, port)
+	icmp.SetChecksum(header.UpdateChecksum(icmp.Checksum(), old, q.ip[:n]))
+}
+
+// dnatLocked translates the destination of c, a new connection received on the
+// given NIC, according to the first DNAT rule that matches it, if any.
+func (ct *connTrack) dnatLocked(nicid tcpip.NICID, c *conn) {
+	if len(c.original.Destination) != header.IPv4AddressSize {
+		return
+	}
+
+	for i := range ct.dnatRules {
+		r := &ct.dnatRules[i]
+		if r.InputNIC != 0 && r.InputNIC != nicid {
+			continue
+		}
+		if r.Protocol != 0 && r.Protocol != c.original.Protocol {
+			continue
+		}
+		if len(r.Destination) != 0 && r.Destination != c.original.Destination {
+			continue
+		}
+		if !r.DestinationPorts.Contains(c.original.DestinationPort) {
+			continue
+		}
+
+		c.dnat = true
+		c.reply.Source = r.ToAddress
+		if r.ToPort != 0 {
+			c.reply.SourcePort = r.ToPort
+			if r.DestinationPorts != (tcpip.PortRange{}) {
+				c.reply.SourcePort += c.original.DestinationPort - r.DestinationPorts.Start
+			}
+		}
+		return
+	}
+}
+
+// translateDestination translates the destination of v, the start of an IPv4
+// packet tracked as t, if its connection is translated. It returns true if it
+// did, in which case the addresses of the packet must be parsed again.
+//
+// ICMP errors related to translated connections are translated along with the
+// source of the packet they quote.
+func (ct *connTrack) translateDestination(t *tracking, v buffer.View) bool {
+	c := t.conn
+	if c == nil {
+		return false
+	}
+
+	ct.mu.Lock()
+	translated := c.dnat || c.reserved
+	addr, port := c.reply.Source, c.reply.SourcePort
+	if t.dir == dirReply {
+		addr, port = c.original.Source, c.original.SourcePort
+	}
+	if t.related {
+		// Only the destination of packets of the original direction
+		// of DNAT connections, or of the reply direction of SNAT
+		// connections, is translated.
+		translated = c.dnat
+		if t.dir == dirReply {
+			translated = c.reserved
+		}
+	}
+	ct.mu.Unlock()
+
+	if !translated {
+		return false
+	}
+	p, ok := parseTrackedPacket(header.IPv4ProtocolNumber, v, false)
+	if !ok {
+		return false
+	}
+	if t.related {
+		p.rewriteQuoted(true, addr, port)
+		port = p.tuple.DestinationPort
+	}
+	p.rewrite(false, addr, port)
+	return true
+}
+
+// translateSource translates the source of v, the start of an IPv4 packet
+// tracked as t about to be forwarded through the NIC outputNIC, if its
+// connection is translated. localAddr is the address of that NIC used for
+// masquerading.
+//
+// When the first packet of a connection is forwarded, its source is set to be
+// translated if it matches an SNAT rule, or if its destination was translated
+// to a node reached through the NIC it was received on, so that replies go
+// through the stack again (hairpinning).
+//
+// It returns false if the packet must be dropped because no port is available
+// to translate it.
+func (ct *connTrack) translateSource(t *tracking, inputNIC, outputNIC tcpip.NICID, localAddr tcpip.Address, v buffer.View) bool {
+	c := t.conn
+	if c == nil {
+		return true
+	}
+
+	ct.mu.Lock()
+	if !c.snatChecked && t.dir == dirOriginal && !t.related {
+		c.snatChecked = true
+		if !ct.snatLocked(c, inputNIC, outputNIC, localAddr) {
+			ct.mu.Unlock()
+			return false
+		}
+	}
+	translated := c.dnat || c.reserved
+	addr, port := c.reply.Destination, c.reply.DestinationPort
+	if t.dir == dirReply {
+		addr, port = c.original.Destination, c.original.DestinationPort
+	}
+	if t.related {
+		// Only the source of packets of the original direction of
+		// SNAT connections, or of the reply direction of DNAT
+		// connections, is translated.
+		translated = c.reserved
+		if t.dir == dirReply {
+			translated = c.dnat
+		}
+	}
+	ct.mu.Unlock()
+
+	if !translated {
+		return true
+	}
+	p, ok := parseTrackedPacket(header.IPv4ProtocolNumber, v, false)
+	if !ok {
+		return true
+	}
+	if t.related {
+		p.rewriteQuoted(false, addr, port)
+		port = p.tuple.SourcePort
+	}
+	p.rewrite(true, addr, port)
+	return true
+}
+
+// snatLocked translates the source of c, if required, when its first packet is
+// forwarded from inputNIC through outputNIC.
+func (ct *connTrack) snatLocked(c *conn, inputNIC, outputNIC tcpip.NICID, localAddr tcpip.Address) bool {
+	if len(c.original.Source) != header.IPv4AddressSize {
+		return true
+	}
+
+	snat := false
+	addr := localAddr
+	if c.dnat && inputNIC == outputNIC {
+		snat = true
+	} else {
+		for i := range ct.snatRules {
+			r := &ct.snatRules[i]
+			if r.OutputNIC != 0 && r.OutputNIC != outputNIC {
+				continue
+			}
+			if !matchPrefix(c.original.Source, r.Source, r.SourceMask) {
+				continue
+			}
+			snat = true
+			if len(r.ToAddress) != 0 {
+				addr = r.ToAddress
+			}
+			break
+		}
+	}
+	if !snat {
+		return true
+	}
+
+	reply := c.reply
+	if !ct.reserveLocked(c, addr) {
+		return false
+	}
+	if ct.conns[c.reply] != nil {
+		ct.releaseLocked(c)
+		c.reply = reply
+		return false
+	}
+	delete(ct.conns, reply)
+	ct.conns[c.reply] = c
+	return true
+}
+
+// reserveLocked translates the source of c to addr, reserving a port for it.
+// The original source port (or echo identifier) is kept if it is available.
+func (ct *connTrack) reserveLocked(c *conn, addr tcpip.Address) bool {
+	protos := []tcpip.NetworkProtocolNumber{header.IPv4ProtocolNumber}
+	port, err := ct.ports.ReservePort(protos, c.original.Protocol, addr, c.original.SourcePort)
+	if err != nil {
+		port, err = ct.ports.ReservePort(protos, c.original.Protocol, addr, 0)
+		if err != nil {
+			return false
+		}
+	}
+
+	c.reply.Destination = addr
+	c.reply.DestinationPort = port
+	c.reserved = true
+	return true
+}
+
+// releaseLocked releases the port reserved for c, if any.
+func (ct *connTrack) releaseLocked(c *conn) {
+	if c.reserved {
+		ct.ports.ReleasePort([]tcpip.NetworkProtocolNumber{header.IPv4ProtocolNumber}, c.reply.Protocol, c.reply.Destination, c.reply.DestinationPort)
+		c.reserved = false
+	}
+}
+
+// validDNATRule determines if the criteria and translation of rule are
+// consistent.
+func validDNATRule(rule *tcpip.DNATRule) bool {
+	if len(rule.ToAddress) != header.IPv4AddressSize {
+		return false
+	}
+	if len(rule.Destination) != 0 && len(rule.Destination) != header.IPv4AddressSize {
+		return false
+	}
+
+	switch rule.Protocol {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+		ports := rule.DestinationPorts
+		if ports.Start > ports.End {
+			return false
+		}
+		if rule.ToPort != 0 && ports != (tcpip.PortRange{}) && int(ports.End-ports.Start) > 0xffff-int(rule.ToPort) {
+			return false
+		}
+		return true
+	case 0, header.ICMPv4ProtocolNumber:
+		return rule.DestinationPorts == (tcpip.PortRange{}) && rule.ToPort == 0
+	default:
+		return false
+	}
+}
+
+// validSNATRule determines if the criteria and translation of rule are
+// consistent.
+func validSNATRule(rule *tcpip.SNATRule) bool {
+	if len(rule.ToAddress) != 0 && len(rule.ToAddress) != header.IPv4AddressSize {
+		return false
+	}
+	return validPrefix(rule.Source, rule.SourceMask)
+}
+
+// AddDNATRule adds a destination NAT rule to the stack. Rules are evaluated in
+// the order they were added. Connections are only redirected if forwarding is
+// enabled on the stack and on the NICs they go through.
+func (s *Stack) AddDNATRule(rule tcpip.DNATRule) error {
+	if !validDNATRule(&rule) {
+		return tcpip.ErrInvalidNATRule
+	}
+
+	ct := s.connTrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ct.dnatRules = append(ct.dnatRules, rule)
+	ct.updateActiveLocked()
+	return nil
+}
+
+// RemoveDNATRule removes a destination NAT rule from the stack. Connections it
+// already redirected keep being translated until they expire.
+func (s *Stack) RemoveDNATRule(rule tcpip.DNATRule) error {
+	ct := s.connTrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	for i, r := range ct.dnatRules {
+		if r == rule {
+			ct.dnatRules = append(ct.dnatRules[:i:i], ct.dnatRules[i+1:]...)
+			ct.updateActiveLocked()
+			return nil
+		}
+	}
+	return tcpip.ErrInvalidNATRule
+}
+
+// AddSNATRule adds a source NAT rule to the stack. Rules are evaluated in the
+// order they were added. For example, the rule
+//
+//	tcpip.SNATRule{OutputNIC: nicid}
+//
+// masquerades all connections forwarded through the given NIC.
+func (s *Stack) AddSNATRule(rule tcpip.SNATRule) error {
+	if !validSNATRule(&rule) {
+		return tcpip.ErrInvalidNATRule
+	}
+
+	ct := s.connTrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ct.snatRules = append(ct.snatRules, rule)
+	ct.updateActiveLocked()
+	return nil
+}
+
+// RemoveSNATRule removes a source NAT rule from the stack. Connections it
+// already translated keep being translated until they expire.
+func (s *Stack) RemoveSNATRule(rule tcpip.SNATRule) error {
+	ct := s.connTrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	for i, r := range ct.snatRules {
+		if r == rule {
+			ct.snatRules = append(ct.snatRules[:i:i], ct.snatRules[i+1:]...)
+			ct.updateActiveLocked()
+			return nil
+		}
+	}
+	return tcpip.ErrInvalidNATRule
+}
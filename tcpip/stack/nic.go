@@ -12,6 +12,7 @@ import (
 	"github.com/google/netstack/ilist"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
 )
 
 // NIC represents a "network interface card" to which the networking stack is
@@ -25,19 +26,32 @@ type NIC struct {
 
 	mu          sync.RWMutex
 	promiscuous bool
+	forwarding  bool
 	primary     map[tcpip.NetworkProtocolNumber]*ilist.List
 	endpoints   map[NetworkEndpointID]*referencedNetworkEndpoint
 	subnets     []tcpip.Subnet
+
+	// groups holds the number of times each multicast group was joined,
+	// per network protocol.
+	groups map[tcpip.NetworkProtocolNumber]map[tcpip.Address]int
+
+	// broadcasts holds the directed broadcast addresses of the subnets n
+	// is directly attached to. It is kept up to date by the stack as its
+	// route tables change, so that looking them up on the delivery path
+	// doesn't involve the stack mutex.
+	broadcasts map[tcpip.Address]struct{}
 }
 
 func newNIC(stack *Stack, id tcpip.NICID, ep LinkEndpoint) *NIC {
 	return &NIC{
-		stack:     stack,
-		id:        id,
-		linkEP:    ep,
-		demux:     newTransportDemuxer(stack),
-		primary:   make(map[tcpip.NetworkProtocolNumber]*ilist.List),
-		endpoints: make(map[NetworkEndpointID]*referencedNetworkEndpoint),
+		stack:      stack,
+		id:         id,
+		linkEP:     ep,
+		demux:      newTransportDemuxer(stack),
+		forwarding: true,
+		primary:    make(map[tcpip.NetworkProtocolNumber]*ilist.List),
+		endpoints:  make(map[NetworkEndpointID]*referencedNetworkEndpoint),
+		groups:     make(map[tcpip.NetworkProtocolNumber]map[tcpip.Address]int),
 	}
 }
 
@@ -54,9 +68,17 @@ func (n *NIC) setPromiscuousMode(enable bool) {
 	n.mu.Unlock()
 }
 
+// setForwarding enables or disables forwarding of packets received on n.
+func (n *NIC) setForwarding(enable bool) {
+	n.mu.Lock()
+	n.forwarding = enable
+	n.mu.Unlock()
+}
+
 // primaryEndpoint returns the primary endpoint of n for the given network
-// protocol.
-func (n *NIC) primaryEndpoint(protocol tcpip.NetworkProtocolNumber) *referencedNetworkEndpoint {
+// protocol that is best suited as the source of traffic to remoteAddr, as
+// determined by the source address selection rules of RFC 6724.
+func (n *NIC) primaryEndpoint(protocol tcpip.NetworkProtocolNumber, remoteAddr tcpip.Address) *referencedNetworkEndpoint {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 
@@ -65,14 +87,85 @@ func (n *NIC) primaryEndpoint(protocol tcpip.NetworkProtocolNumber) *referencedN
 		return nil
 	}
 
-	for e := list.Front(); e != nil; e = e.Next() {
+	// Fast path for the common case of a single address.
+	if e := list.Front(); e != nil && e.Next() == nil {
 		r := e.(*referencedNetworkEndpoint)
 		if r.tryIncRef() {
 			return r
 		}
+		return nil
 	}
 
-	return nil
+	// The best candidate is found with a linear scan, as the preference
+	// rules don't define a strict order. Ties are broken by list order.
+	// Endpoints being removed are skipped, and the scan is repeated if the
+	// best one is removed before a reference to it is taken.
+	for {
+		var best *referencedNetworkEndpoint
+		for e := list.Front(); e != nil; e = e.Next() {
+			r := e.(*referencedNetworkEndpoint)
+			if atomic.LoadInt32(&r.refs) == 0 {
+				continue
+			}
+			if best == nil || preferSource(r, best, remoteAddr) {
+				best = r
+			}
+		}
+
+		if best == nil {
+			return nil
+		}
+		if best.tryIncRef() {
+			return best
+		}
+	}
+}
+
+// broadcastEndpoint returns the endpoint of n that sends and receives
+// broadcasts of the given network protocol. It is the primary endpoint of n
+// or, if n has no address yet, a temporary endpoint with the unspecified
+// address that only exists while it is referenced, which lets protocols like
+// DHCP work before an address is assigned.
+func (n *NIC) broadcastEndpoint(protocol tcpip.NetworkProtocolNumber) *referencedNetworkEndpoint {
+	if ref := n.primaryEndpoint(protocol, header.IPv4Broadcast); ref != nil {
+		return ref
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if ref := n.endpoints[NetworkEndpointID{header.IPv4Any}]; ref != nil && ref.tryIncRef() {
+		return ref
+	}
+
+	ref, _ := n.addAddressLocked(protocol, header.IPv4Any, tcpip.AddressOptions{Priority: tcpip.SecondaryAddress}, true)
+	if ref != nil {
+		ref.holdsInsertRef = false
+	}
+	return ref
+}
+
+// isLimitedBroadcast determines if addr is the limited broadcast address of the
+// given network protocol.
+func isLimitedBroadcast(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	return protocol == header.IPv4ProtocolNumber && addr == header.IPv4Broadcast
+}
+
+// isBroadcast determines if addr is a broadcast address of n: either the
+// limited broadcast address, or the directed broadcast address of a subnet n
+// is directly attached to.
+func (n *NIC) isBroadcast(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	if protocol != header.IPv4ProtocolNumber {
+		return false
+	}
+	if addr == header.IPv4Broadcast {
+		return true
+	}
+
+	n.mu.RLock()
+	_, ok := n.broadcasts[addr]
+	n.mu.RUnlock()
+	return ok
 }
 
 // findEndpoint finds the endpoint, if any, with the given address.
@@ -88,7 +181,7 @@ func (n *NIC) findEndpoint(address tcpip.Address) *referencedNetworkEndpoint {
 	return ref
 }
 
-func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, replace bool) (*referencedNetworkEndpoint, error) {
+func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, opts tcpip.AddressOptions, replace bool) (*referencedNetworkEndpoint, error) {
 	netProto, ok := n.stack.networkProtocols[protocol]
 	if !ok {
 		return nil, tcpip.ErrUnknownProtocol
@@ -110,16 +203,27 @@ func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.
 	}
 
 	ref := newReferencedNetworkEndpoint(ep, protocol, n)
+	ref.deprecated = opts.Deprecated
+	ref.prefixLen = n.prefixLenLocked(id.LocalAddress)
 
 	n.endpoints[id] = ref
 
+	if opts.Priority == tcpip.SecondaryAddress {
+		return ref, nil
+	}
+
 	l, ok := n.primary[protocol]
 	if !ok {
 		l = &ilist.List{}
 		n.primary[protocol] = l
 	}
 
-	l.PushBack(ref)
+	ref.primary = true
+	if opts.Priority == tcpip.FirstPrimaryAddress {
+		l.PushFront(ref)
+	} else {
+		l.PushBack(ref)
+	}
 
 	return ref, nil
 }
@@ -127,12 +231,201 @@ func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.
 // AddAddress adds a new address to n, so that it starts accepting packets
 // targeted at the given address (and network protocol).
 func (n *NIC) AddAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) error {
+	return n.AddAddressWithOptions(protocol, addr, tcpip.AddressOptions{})
+}
+
+// AddAddressWithOptions is like AddAddress, but the given options determine
+// how the address is used for source address selection.
+func (n *NIC) AddAddressWithOptions(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, opts tcpip.AddressOptions) error {
 	// Add the endpoint.
 	n.mu.Lock()
-	_, err := n.addAddressLocked(protocol, addr, false)
+	_, err := n.addAddressLocked(protocol, addr, opts, false)
+	n.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// Join the groups the new address implies.
+	for _, g := range n.addressGroups(protocol, addr) {
+		n.joinGroup(protocol, g)
+	}
+
+	return nil
+}
+
+// SetAddressDeprecated marks the given address of n as deprecated or not.
+func (n *NIC) SetAddressDeprecated(addr tcpip.Address, deprecated bool) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	r := n.endpoints[NetworkEndpointID{addr}]
+	if r == nil || !r.holdsInsertRef {
+		return tcpip.ErrBadLocalAddress
+	}
+
+	r.deprecated = deprecated
+	return nil
+}
+
+// multicastProtocol returns the given network protocol if it supports
+// multicast groups, and fails otherwise.
+func (n *NIC) multicastProtocol(protocol tcpip.NetworkProtocolNumber) (MulticastProtocol, error) {
+	netProto, ok := n.stack.networkProtocols[protocol]
+	if !ok {
+		return nil, tcpip.ErrUnknownProtocol
+	}
+
+	mp, ok := netProto.(MulticastProtocol)
+	if !ok {
+		return nil, tcpip.ErrNotSupported
+	}
+
+	return mp, nil
+}
+
+// joinGroup adds a reference to the membership of n in the given multicast
+// group, announcing the membership when it is new.
+func (n *NIC) joinGroup(protocol tcpip.NetworkProtocolNumber, group tcpip.Address) error {
+	mp, err := n.multicastProtocol(protocol)
+	if err != nil {
+		return err
+	}
+
+	if !mp.IsMulticastAddress(group) {
+		return tcpip.ErrBadAddress
+	}
+
+	n.mu.Lock()
+	groups := n.groups[protocol]
+	if groups == nil {
+		groups = make(map[tcpip.Address]int)
+		n.groups[protocol] = groups
+	}
+	groups[group]++
+	joined := groups[group] == 1
 	n.mu.Unlock()
 
-	return err
+	if joined && !mp.IsImplicitGroup(group) {
+		n.reportGroup(protocol, group, true)
+	}
+
+	return nil
+}
+
+// leaveGroup removes a reference to the membership of n in the given multicast
+// group, announcing that n left the group when the last one is removed.
+func (n *NIC) leaveGroup(protocol tcpip.NetworkProtocolNumber, group tcpip.Address) error {
+	mp, err := n.multicastProtocol(protocol)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	groups := n.groups[protocol]
+	if groups[group] == 0 {
+		n.mu.Unlock()
+		return tcpip.ErrBadLocalAddress
+	}
+	groups[group]--
+	left := groups[group] == 0
+	if left {
+		delete(groups, group)
+	}
+	n.mu.Unlock()
+
+	if left && !mp.IsImplicitGroup(group) {
+		n.reportGroup(protocol, group, false)
+	}
+
+	return nil
+}
+
+// reportGroup lets the group management protocol of the given network
+// protocol, if any, announce that n joined or left the given group.
+func (n *NIC) reportGroup(protocol tcpip.NetworkProtocolNumber, group tcpip.Address, joined bool) {
+	mp, err := n.multicastProtocol(protocol)
+	if err != nil {
+		return
+	}
+
+	ref := n.primaryEndpoint(protocol, mp.ReportDestination(group))
+	if ref == nil {
+		return
+	}
+
+	r := makeRoute(protocol, ref.ep.ID().LocalAddress, group, ref)
+	r.LocalLinkAddress = n.linkEP.LinkAddress()
+	r.RemoteLinkAddress, _ = n.multicastLinkAddress(protocol, group)
+	defer r.Release()
+
+	reporter, ok := ref.ep.(GroupReporter)
+	if !ok {
+		return
+	}
+
+	if joined {
+		reporter.JoinedGroup(&r)
+	} else {
+		reporter.LeftGroup(&r)
+	}
+}
+
+// addressGroups returns the multicast groups n must be a member of while it has
+// the given address.
+func (n *NIC) addressGroups(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) []tcpip.Address {
+	mp, ok := n.stack.networkProtocols[protocol].(MulticastProtocol)
+	if !ok {
+		return nil
+	}
+	return mp.AddressGroups(addr)
+}
+
+// multicastLinkAddress returns the link address that packets sent by n to the
+// given multicast group must be addressed to. Groups are only mapped to link
+// addresses on Ethernet-like links, i.e., if n has a 6-byte link address.
+func (n *NIC) multicastLinkAddress(protocol tcpip.NetworkProtocolNumber, group tcpip.Address) (tcpip.LinkAddress, bool) {
+	if len(n.linkEP.LinkAddress()) != header.EthernetAddressSize {
+		return "", false
+	}
+
+	mp, ok := n.stack.networkProtocols[protocol].(MulticastProtocol)
+	if !ok || !mp.IsMulticastAddress(group) {
+		return "", false
+	}
+
+	return mp.MulticastLinkAddress(group), true
+}
+
+// isInGroup determines if n is a member of the multicast group addr, either
+// because it was joined or because it is implicit.
+func (n *NIC) isInGroup(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	mp, ok := n.stack.networkProtocols[protocol].(MulticastProtocol)
+	if !ok || !mp.IsMulticastAddress(addr) {
+		return false
+	}
+
+	if mp.IsImplicitGroup(addr) {
+		return true
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.groups[protocol][addr] != 0
+}
+
+// multicastGroups returns the multicast groups of the given network protocol
+// that were joined on n.
+func (n *NIC) multicastGroups(protocol tcpip.NetworkProtocolNumber) []tcpip.Address {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	groups := make([]tcpip.Address, 0, len(n.groups[protocol]))
+	for g := range n.groups[protocol] {
+		groups = append(groups, g)
+	}
+	return groups
 }
 
 // AddSubnet adds a new subnet to n, so that it starts accepting packets
@@ -140,9 +433,28 @@ func (n *NIC) AddAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.Addres
 func (n *NIC) AddSubnet(protocol tcpip.NetworkProtocolNumber, subnet tcpip.Subnet) {
 	n.mu.Lock()
 	n.subnets = append(n.subnets, subnet)
+	for id, ref := range n.endpoints {
+		ref.prefixLen = n.prefixLenLocked(id.LocalAddress)
+	}
 	n.mu.Unlock()
 }
 
+// prefixLenLocked returns the length of the on-link prefix of addr, given by the
+// longest subnet of n that contains it. Without such a subnet, the whole
+// address is considered the prefix.
+func (n *NIC) prefixLenLocked(addr tcpip.Address) int {
+	l := -1
+	for _, sn := range n.subnets {
+		if sn.Contains(addr) && sn.Prefix() > l {
+			l = sn.Prefix()
+		}
+	}
+	if l < 0 {
+		return len(addr) * 8
+	}
+	return l
+}
+
 // Subnets returns the Subnets associated with this NIC.
 func (n *NIC) Subnets() []tcpip.Subnet {
 	n.mu.RLock()
@@ -174,7 +486,9 @@ func (n *NIC) removeEndpointLocked(r *referencedNetworkEndpoint) {
 	}
 
 	delete(n.endpoints, id)
-	n.primary[r.protocol].Remove(r)
+	if r.primary {
+		n.primary[r.protocol].Remove(r)
+	}
 	r.ep.Close()
 }
 
@@ -196,6 +510,10 @@ func (n *NIC) RemoveAddress(addr tcpip.Address) error {
 	r.holdsInsertRef = false
 	n.mu.Unlock()
 
+	for _, g := range n.addressGroups(r.protocol, addr) {
+		n.leaveGroup(r.protocol, g)
+	}
+
 	r.decRef()
 
 	return nil
@@ -208,9 +526,13 @@ func (n *NIC) RemoveAddress(addr tcpip.Address) error {
 // This rule applies only to the slice itself, not to the items of the slice;
 // the ownership of the items is not retained by the caller.
 func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	tapped := n.stack.packetDemux.deliverPacket(n.id, remoteLinkAddr, linkEP.LinkAddress(), protocol, vv)
+
 	netProto, ok := n.stack.networkProtocols[protocol]
 	if !ok {
-		atomic.AddUint64(&n.stack.stats.UnknownProtocolRcvdPackets, 1)
+		if !tapped {
+			atomic.AddUint64(&n.stack.stats.UnknownProtocolRcvdPackets, 1)
+		}
 		return
 	}
 
@@ -220,6 +542,35 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.Lin
 	}
 
 	src, dst := netProto.ParseAddresses(vv.First())
+
+	// The prerouting filter rules see packets before they are tracked, so
+	// that the packets they drop don't create connections.
+	if t := n.stack.filterTable(tcpip.FilterPrerouting); t != nil {
+		pkt := filterPacket{inputNIC: n.id, src: src, dst: dst}
+		pkt.parseNetworkPacket(protocol, vv.First())
+		if v := t.filter(&pkt); v != tcpip.FilterAccept {
+			var reply *Route
+			if r, ok := n.replyRoute(linkEP, remoteLinkAddr, protocol, src); ok {
+				defer r.Release()
+				reply = &r
+			}
+			n.rejectReceived(reply, netProto, &pkt, v)
+			return
+		}
+	}
+
+	tr, ok := n.stack.connTrack.trackReceived(n.id, protocol, vv.First())
+	if !ok {
+		atomic.AddUint64(&n.stack.stats.ConnTrackDroppedPackets, 1)
+		return
+	}
+
+	// Packets of translated connections may be redirected elsewhere, so
+	// their destination is translated before deciding where they go.
+	if n.stack.connTrack.translateDestination(&tr, vv.First()) {
+		src, dst = netProto.ParseAddresses(vv.First())
+	}
+
 	id := NetworkEndpointID{dst}
 
 	n.mu.RLock()
@@ -228,27 +579,56 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.Lin
 		ref = nil
 	}
 	promiscuous := n.promiscuous
+	forwarding := n.forwarding
 	subnets := n.subnets
 	n.mu.RUnlock()
 
+	// Packets sent to multicast groups n is a member of are handled by the
+	// endpoint that would be used to reply to their source, and broadcasts
+	// by the broadcast endpoint.
+	mp, ok := netProto.(MulticastProtocol)
+	multicast := ok && mp.IsMulticastAddress(dst)
+	broadcast := false
+	if ref == nil && multicast && n.isInGroup(protocol, dst) {
+		ref = n.primaryEndpoint(protocol, src)
+	} else if ref == nil && !multicast && n.isBroadcast(protocol, dst) {
+		broadcast = true
+		ref = n.broadcastEndpoint(protocol)
+	}
+
 	if ref == nil {
 		// Check if the packet is for a subnet this NIC cares about.
-		if !promiscuous {
-			for _, sn := range subnets {
-				if sn.Contains(dst) {
-					promiscuous = true
-					break
-				}
+		inSubnet := false
+		for _, sn := range subnets {
+			if sn.Contains(dst) {
+				inSubnet = true
+				break
 			}
 		}
-		if promiscuous {
+
+		// Packets that aren't addressed to us are routed towards their
+		// destination when forwarding is enabled, rather than being
+		// picked up by a temporary endpoint in promiscuous mode.
+		// Packets addressed to another NIC of the stack are delivered
+		// locally instead, through a temporary endpoint of n so that
+		// replies go back the way they came.
+		local := false
+		if !inSubnet && !multicast && !broadcast && forwarding && n.stack.Forwarding() {
+			if n.stack.CheckLocalAddress(0, dst) == 0 {
+				n.forwardPacket(linkEP, remoteLinkAddr, protocol, netProto, src, dst, vv, &tr)
+				return
+			}
+			local = true
+		}
+
+		if promiscuous || inSubnet || local {
 			// Try again with the lock in exclusive mode. If we still can't
 			// get the endpoint, create a new "temporary" one. It will only
 			// exist while there's a route through it.
 			n.mu.Lock()
 			ref = n.endpoints[id]
 			if ref == nil || !ref.tryIncRef() {
-				ref, _ = n.addAddressLocked(protocol, dst, true)
+				ref, _ = n.addAddressLocked(protocol, dst, tcpip.AddressOptions{}, true)
 				if ref != nil {
 					ref.holdsInsertRef = false
 				}
@@ -265,16 +645,142 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.Lin
 	r := makeRoute(protocol, dst, src, ref)
 	r.LocalLinkAddress = linkEP.LinkAddress()
 	r.RemoteLinkAddress = remoteLinkAddr
+	r.connState = tr.state
+
+	// Every packet handled locally goes through the input filter rules,
+	// including those answered by the network protocol itself, such as
+	// ICMP echo requests.
+	if t := n.stack.filterTable(tcpip.FilterInput); t != nil {
+		pkt := filterPacket{inputNIC: n.id, src: src, dst: dst, connState: tr.state}
+		pkt.parseNetworkPacket(protocol, vv.First())
+		if v := t.filter(&pkt); v != tcpip.FilterAccept {
+			n.rejectDelivered(&r, netProto, &pkt, v)
+			ref.decRef()
+			return
+		}
+	}
+
 	ref.ep.HandlePacket(&r, vv)
 	ref.decRef()
 }
 
+// forwardPacket routes a packet that was received on n but isn't addressed to
+// any of its endpoints out through the NIC given by the route table. tr
+// describes how the packet relates to the tracked connections.
+func (n *NIC) forwardPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, netProto NetworkProtocol, src, dst tcpip.Address, vv *buffer.VectorisedView, tr *tracking) {
+	fwd, ok := netProto.(PacketForwarder)
+	if !ok {
+		atomic.AddUint64(&n.stack.stats.UnknownNetworkEndpointRcvdPackets, 1)
+		return
+	}
+
+	// Packets sourced from a broadcast address of the subnet they were
+	// received on must not be forwarded, per RFC 1812, section 5.3.7.
+	if n.isBroadcast(protocol, src) {
+		atomic.AddUint64(&n.stack.stats.ForwardDroppedPackets, 1)
+		return
+	}
+
+	// Build a route back to the source through this NIC, so that the
+	// protocol can report errors (e.g., an expired TTL) to it.
+	var reply *Route
+	if r, ok := n.replyRoute(linkEP, remoteLinkAddr, protocol, src); ok {
+		defer r.Release()
+		reply = &r
+	}
+
+	if !fwd.ForwardPacket(reply, vv) {
+		atomic.AddUint64(&n.stack.stats.ForwardDroppedPackets, 1)
+		return
+	}
+
+	r, err := n.stack.findRoute(0, "", dst, protocol, routeKey{source: src, inputNIC: n.id})
+	if err != nil {
+		atomic.AddUint64(&n.stack.stats.UnroutablePackets, 1)
+		return
+	}
+	defer r.Release()
+
+	fwdRules, postRules := n.stack.filterTable(tcpip.FilterForward), n.stack.filterTable(tcpip.FilterPostrouting)
+	if fwdRules != nil || postRules != nil {
+		pkt := filterPacket{inputNIC: n.id, outputNIC: r.NICID(), src: src, dst: dst, connState: tr.state}
+		pkt.parseNetworkPacket(protocol, vv.First())
+		if v := pkt.filter(fwdRules, postRules); v != tcpip.FilterAccept {
+			n.rejectReceived(reply, netProto, &pkt, v)
+			return
+		}
+	}
+
+	if !n.stack.connTrack.translateSource(tr, n.id, r.NICID(), r.LocalAddress, vv.First()) {
+		atomic.AddUint64(&n.stack.stats.ForwardDroppedPackets, 1)
+		return
+	}
+
+	mtu := r.ref.nic.linkEP.MTU()
+	if r.mtu != 0 && r.mtu < mtu {
+		mtu = r.mtu
+	}
+	if uint32(vv.Size()) > mtu {
+		// TODO: Fragment the packet or report the MTU to the source.
+		atomic.AddUint64(&n.stack.stats.ForwardDroppedPackets, 1)
+		return
+	}
+
+	if err := r.writeForwardedPacket(vv.ToView()); err != nil {
+		atomic.AddUint64(&n.stack.stats.ForwardDroppedPackets, 1)
+		return
+	}
+
+	atomic.AddUint64(&n.stack.stats.ForwardedPackets, 1)
+}
+
+// replyRoute builds a route back to src, the source of a packet received by n
+// from the given link address.
+func (n *NIC) replyRoute(linkEP LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, src tcpip.Address) (Route, bool) {
+	ref := n.primaryEndpoint(protocol, src)
+	if ref == nil {
+		return Route{}, false
+	}
+
+	r := makeRoute(protocol, ref.ep.ID().LocalAddress, src, ref)
+	r.LocalLinkAddress = linkEP.LinkAddress()
+	r.RemoteLinkAddress = remoteLinkAddr
+	return r, true
+}
+
+// rejectReceived discards a packet received by n that a filter rule didn't
+// accept. If the rule rejects the packet, its source is notified through
+// reply, a route back to it, unless the packet was sent to a multicast or
+// broadcast address. TCP resets are only sent for packets delivered locally,
+// so other packets are always rejected with ICMP.
+func (n *NIC) rejectReceived(reply *Route, netProto NetworkProtocol, pkt *filterPacket, verdict tcpip.FilterVerdict) {
+	atomic.AddUint64(&n.stack.stats.FilteredPackets, 1)
+
+	if verdict == tcpip.FilterDrop || reply == nil {
+		return
+	}
+	rejecter, ok := netProto.(PacketRejecter)
+	if !ok {
+		return
+	}
+	if mp, ok := netProto.(MulticastProtocol); ok && mp.IsMulticastAddress(pkt.dst) {
+		return
+	}
+	if n.isBroadcast(reply.NetProto, pkt.dst) {
+		return
+	}
+
+	rejecter.RejectPacket(reply, pkt.src, pkt.dst, pkt.protocol, pkt.transport)
+}
+
 // DeliverTransportPacket delivers the packets to the appropriate transport
 // protocol endpoint.
 func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView) {
 	state, ok := n.stack.transportProtocols[protocol]
 	if !ok {
-		atomic.AddUint64(&n.stack.stats.UnknownProtocolRcvdPackets, 1)
+		if !n.deliverRawPacket(r, protocol, vv) {
+			atomic.AddUint64(&n.stack.stats.UnknownProtocolRcvdPackets, 1)
+		}
 		return
 	}
 
@@ -291,6 +797,30 @@ func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolN
 	}
 
 	id := TransportEndpointID{dstPort, r.LocalAddress, srcPort, r.RemoteAddress}
+
+	// Multicast packets and broadcasts are delivered to every matching
+	// endpoint, and are never answered when there is none. Only packets
+	// that aren't addressed to the endpoint that handled them can be
+	// broadcasts.
+	group := n.isInGroup(r.NetProto, r.LocalAddress) || (r.LocalAddress != r.ref.ep.ID().LocalAddress && n.isBroadcast(r.NetProto, r.LocalAddress))
+
+	if raw := n.stack.demux.rawEndpointsFor(r.NetProto, protocol); raw != nil {
+		deliverRawPacket(raw, r, vv)
+	}
+
+	if group {
+		n.demux.deliverMulticastPacket(r, protocol, vv, id)
+		n.stack.demux.deliverMulticastPacket(r, protocol, vv, id)
+		return
+	}
+
+	n.deliverUnicastPacket(r, state, protocol, vv, id)
+}
+
+// deliverUnicastPacket delivers a packet that isn't sent to a group to the
+// transport endpoint with the given id, or to the handlers of the protocol if
+// there is none.
+func (n *NIC) deliverUnicastPacket(r *Route, state *transportProtocolState, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView, id TransportEndpointID) {
 	if n.demux.deliverPacket(r, protocol, vv, id) {
 		return
 	}
@@ -307,11 +837,49 @@ func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolN
 
 	// We could not find an appropriate destination for this packet, so
 	// deliver it to the global handler.
-	if !transProto.HandleUnknownDestinationPacket(r, id, vv) {
+	if !state.proto.HandleUnknownDestinationPacket(r, id, vv) {
 		atomic.AddUint64(&n.stack.stats.MalformedRcvdPackets, 1)
 	}
 }
 
+// DeliverRawPacket implements RawTransportDispatcher.DeliverRawPacket.
+func (n *NIC) DeliverRawPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView) {
+	n.deliverRawPacket(r, protocol, vv)
+}
+
+// deliverRawPacket delivers a copy of a packet that no other transport endpoint
+// receives to the raw endpoints of its protocols. It returns false if there are
+// no such raw endpoints.
+func (n *NIC) deliverRawPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView) bool {
+	raw := n.stack.demux.rawEndpointsFor(r.NetProto, protocol)
+	if raw == nil {
+		return false
+	}
+
+	deliverRawPacket(raw, r, vv)
+	return true
+}
+
+// rejectDelivered discards a packet that was about to be handled locally when
+// a filter rule didn't accept it. If the rule rejects it with a TCP reset and
+// it is a TCP segment, the reset is sent through r, the route the packet was
+// received through; other rejected packets are handled by rejectReceived.
+func (n *NIC) rejectDelivered(r *Route, netProto NetworkProtocol, pkt *filterPacket, verdict tcpip.FilterVerdict) {
+	if verdict == tcpip.FilterRejectWithReset && pkt.protocol == header.TCPProtocolNumber && !n.isInGroup(r.NetProto, r.LocalAddress) && !n.isBroadcast(r.NetProto, r.LocalAddress) {
+		state, ok := n.stack.transportProtocols[pkt.protocol]
+		srcPort, dstPort, hasPorts := pkt.ports()
+		if ok && hasPorts && len(pkt.transport) >= state.proto.MinimumPacketSize() {
+			atomic.AddUint64(&n.stack.stats.FilteredPackets, 1)
+			v := buffer.View(pkt.transport)
+			vv := v.ToVectorisedView([1]buffer.View{})
+			state.proto.HandleUnknownDestinationPacket(r, TransportEndpointID{dstPort, r.LocalAddress, srcPort, r.RemoteAddress}, &vv)
+			return
+		}
+	}
+
+	n.rejectReceived(r, netProto, pkt, verdict)
+}
+
 // ID returns the identifier of n.
 func (n *NIC) ID() tcpip.NICID {
 	return n.id
@@ -329,6 +897,19 @@ type referencedNetworkEndpoint struct {
 	// endpoint. It is reset to false when RemoveAddress is called on the
 	// NIC.
 	holdsInsertRef bool
+
+	// primary is immutable. It indicates whether the endpoint is in the
+	// NIC's list of primary endpoints.
+	primary bool
+
+	// deprecated is protected by the NIC's mutex. Deprecated endpoints
+	// are avoided as the source of outgoing traffic.
+	deprecated bool
+
+	// prefixLen is protected by the NIC's mutex. It is the length of the
+	// on-link prefix of the endpoint's address, which limits the prefix
+	// compared by source address selection.
+	prefixLen int
 }
 
 func newReferencedNetworkEndpoint(ep NetworkEndpoint, protocol tcpip.NetworkProtocolNumber, nic *NIC) *referencedNetworkEndpoint {
@@ -0,0 +1,108 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+// packetRegistration is a packet endpoint registered with a packet demuxer,
+// along with the NIC it is bound to, if any.
+type packetRegistration struct {
+	nicID tcpip.NICID
+	ep    PacketEndpoint
+}
+
+// packetDemuxer delivers copies of the frames dispatched by NICs to the packet
+// endpoints registered for their network protocol, or for all protocols.
+type packetDemuxer struct {
+	mu sync.RWMutex
+
+	// endpoints holds the endpoints of each network protocol. Endpoints
+	// registered for all protocols are held under protocol zero.
+	endpoints map[tcpip.NetworkProtocolNumber][]packetRegistration
+}
+
+func newPacketDemuxer() *packetDemuxer {
+	return &packetDemuxer{endpoints: make(map[tcpip.NetworkProtocolNumber][]packetRegistration)}
+}
+
+// registerEndpoint registers ep to receive the frames of the given protocol
+// dispatched by the given NIC. A zero NIC or protocol matches all of them.
+func (d *packetDemuxer) registerEndpoint(nicID tcpip.NICID, protocol tcpip.NetworkProtocolNumber, ep PacketEndpoint) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, r := range d.endpoints[protocol] {
+		if r.ep == ep {
+			return tcpip.ErrDuplicateAddress
+		}
+	}
+	d.endpoints[protocol] = append(d.endpoints[protocol], packetRegistration{nicID, ep})
+
+	return nil
+}
+
+// unregisterEndpoint unregisters ep from the given protocol, such that it won't
+// receive any more of its frames.
+func (d *packetDemuxer) unregisterEndpoint(protocol tcpip.NetworkProtocolNumber, ep PacketEndpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	regs := d.endpoints[protocol]
+	for i, r := range regs {
+		if r.ep != ep {
+			continue
+		}
+
+		// Copy the remaining endpoints, as the old slice may still be
+		// in use by a delivery.
+		n := make([]packetRegistration, 0, len(regs)-1)
+		n = append(n, regs[:i]...)
+		n = append(n, regs[i+1:]...)
+		if len(n) == 0 {
+			delete(d.endpoints, protocol)
+		} else {
+			d.endpoints[protocol] = n
+		}
+		return
+	}
+}
+
+// deliverPacket delivers a copy of a frame dispatched by the given NIC to every
+// matching packet endpoint. It returns true if there was any.
+func (d *packetDemuxer) deliverPacket(nicID tcpip.NICID, remoteLinkAddr, localLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) bool {
+	d.mu.RLock()
+	if len(d.endpoints) == 0 {
+		d.mu.RUnlock()
+		return false
+	}
+	all, regs := d.endpoints[0], d.endpoints[protocol]
+	d.mu.RUnlock()
+	if protocol == 0 {
+		regs = nil
+	}
+
+	delivered := false
+	for _, l := range [...][]packetRegistration{all, regs} {
+		for _, r := range l {
+			if r.nicID != 0 && r.nicID != nicID {
+				continue
+			}
+
+			// Each endpoint consumes the view it is given, so it
+			// gets its own copy of the vectorised view.
+			var views [8]buffer.View
+			c := vv.Clone(views[:])
+			r.ep.HandlePacket(nicID, remoteLinkAddr, localLinkAddr, protocol, &c)
+			delivered = true
+		}
+	}
+
+	return delivered
+}
@@ -71,6 +71,22 @@ type TransportProtocol interface {
 	HandleUnknownDestinationPacket(r *Route, id TransportEndpointID, vv *buffer.VectorisedView) bool
 }
 
+// ConfigurableTransportProtocol is implemented by transport protocols that have
+// per-stack options, set via Stack.SetTransportProtocolOption(). Such
+// protocols are registered with RegisterTransportProtocolFactory(), so that
+// each stack gets its own instance.
+type ConfigurableTransportProtocol interface {
+	TransportProtocol
+
+	// SetOption sets a protocol option. It returns
+	// ErrUnknownProtocolOption if the option isn't supported by the
+	// protocol.
+	SetOption(option interface{}) error
+
+	// Option reads a protocol option into the value option points to.
+	Option(option interface{}) error
+}
+
 // TransportDispatcher contains the methods used by the network stack to deliver
 // packets to the appropriate transport endpoint after it has been handled by
 // the network layer.
@@ -80,6 +96,50 @@ type TransportDispatcher interface {
 	DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView)
 }
 
+// RawTransportDispatcher is implemented by the transport dispatchers that also
+// deliver packets to raw endpoints. Network endpoints check whether their
+// dispatcher implements it, so that other dispatchers needn't.
+type RawTransportDispatcher interface {
+	TransportDispatcher
+
+	// DeliverRawPacket delivers a copy of a packet that is handled by the
+	// network layer itself (e.g., ICMP) to the raw endpoints of its
+	// protocol.
+	DeliverRawPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView)
+}
+
+// RawTransportEndpoint is the interface that needs to be implemented by raw
+// endpoints, which receive a copy of every packet of a given pair of network
+// and transport protocols, whether or not another endpoint handles it.
+type RawTransportEndpoint interface {
+	// HandlePacket is called by the stack when a packet of the protocols
+	// of the endpoint arrives. r.NetworkHeader holds the network-layer
+	// header of the packet, and vv its payload.
+	HandlePacket(r *Route, vv *buffer.VectorisedView)
+}
+
+// PacketEndpoint is the interface that needs to be implemented by packet
+// endpoints, which receive a copy of the frames dispatched by NICs before the
+// network layer handles them.
+type PacketEndpoint interface {
+	// HandlePacket is called by the stack when a NIC dispatches a frame
+	// the endpoint is registered for. remoteLinkAddr and localLinkAddr are
+	// the link addresses of its source and of the NIC, and vv holds its
+	// network-layer packet.
+	HandlePacket(nicID tcpip.NICID, remoteLinkAddr, localLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView)
+}
+
+// HeaderIncludedWriter is implemented by network endpoints that can send
+// packets whose network-layer header is supplied by the caller, as done by raw
+// endpoints with IP_HDRINCL semantics.
+type HeaderIncludedWriter interface {
+	// WriteHeaderIncludedPacket writes a packet that starts with its
+	// network-layer header. The endpoint fills in the fields that
+	// depend on the packet or the route, such as its length, checksum
+	// and unspecified source address.
+	WriteHeaderIncludedPacket(r *Route, packet buffer.View) error
+}
+
 // NetworkEndpoint is the interface that needs to be implemented by endpoints
 // of network layer protocols (e.g., ipv4, ipv6).
 type NetworkEndpoint interface {
@@ -184,6 +244,68 @@ type LinkAddressResolver interface {
 	LinkAddressProtocol() tcpip.NetworkProtocolNumber
 }
 
+// A PacketForwarder is an extension to a NetworkProtocol that allows the stack
+// to forward packets of that protocol to other nodes.
+type PacketForwarder interface {
+	// ForwardPacket validates the network-layer header of a packet that is
+	// about to be forwarded and updates it in place for the next hop, for
+	// example by decrementing its TTL and fixing up its checksum.
+	//
+	// It returns false if the packet must be dropped instead. In that
+	// case, reply (if not nil) is a route back to the source of the
+	// packet through the NIC it arrived on, which the protocol may use to
+	// notify the source, e.g., with an ICMP Time Exceeded message.
+	ForwardPacket(reply *Route, vv *buffer.VectorisedView) bool
+}
+
+// A PacketRejecter is an extension to a NetworkProtocol that allows the stack
+// to notify the source of a packet that a filter rule rejected it.
+type PacketRejecter interface {
+	// RejectPacket sends an ICMP Destination Unreachable message, with the
+	// "administratively prohibited" code, about a packet of the given
+	// transport protocol sent from src to dst. transport holds the start
+	// of the transport-layer part of the packet. r is a route back to src.
+	RejectPacket(r *Route, src, dst tcpip.Address, protocol tcpip.TransportProtocolNumber, transport buffer.View)
+}
+
+// A MulticastProtocol is an extension to a NetworkProtocol that supports
+// multicast groups.
+type MulticastProtocol interface {
+	// IsMulticastAddress determines if addr is a multicast group address
+	// of the protocol.
+	IsMulticastAddress(addr tcpip.Address) bool
+
+	// IsImplicitGroup determines if addr is a group that every NIC with
+	// an address of the protocol is a member of, such as the IPv4
+	// all-hosts group. Such groups needn't be joined explicitly.
+	IsImplicitGroup(addr tcpip.Address) bool
+
+	// AddressGroups returns the groups a NIC must be a member of while it
+	// has the address addr, such as the IPv6 solicited-node group of addr.
+	AddressGroups(addr tcpip.Address) []tcpip.Address
+
+	// MulticastLinkAddress returns the Ethernet address that frames sent
+	// to the given group are addressed to.
+	MulticastLinkAddress(group tcpip.Address) tcpip.LinkAddress
+
+	// ReportDestination returns the address that membership reports about
+	// group are sent to. It determines the endpoint that sends them.
+	ReportDestination(group tcpip.Address) tcpip.Address
+}
+
+// A GroupReporter is an extension to a NetworkEndpoint of a protocol with a
+// group management protocol, such as IGMP, that announces the multicast group
+// memberships of its NIC to multicast routers.
+type GroupReporter interface {
+	// JoinedGroup is called when the NIC joins the group r.RemoteAddress.
+	// r is a route from the endpoint to the group.
+	JoinedGroup(r *Route)
+
+	// LeftGroup is called when the NIC leaves the group r.RemoteAddress.
+	// r is a route from the endpoint to the group.
+	LeftGroup(r *Route)
+}
+
 // A LinkAddressCache caches link addresses.
 type LinkAddressCache interface {
 	// CheckLocalAddress determines if the given local address exists, and if it
@@ -196,7 +318,7 @@ type LinkAddressCache interface {
 }
 
 var (
-	transportProtocols = make(map[string]TransportProtocol)
+	transportProtocols = make(map[string]func() TransportProtocol)
 	networkProtocols   = make(map[string]NetworkProtocol)
 
 	linkEPMu           sync.RWMutex
@@ -208,7 +330,14 @@ var (
 // so that it becomes available to users of the stack. This function is intended
 // to be called by init() functions of the protocols.
 func RegisterTransportProtocol(name string, p TransportProtocol) {
-	transportProtocols[name] = p
+	transportProtocols[name] = func() TransportProtocol { return p }
+}
+
+// RegisterTransportProtocolFactory is like RegisterTransportProtocol, except
+// that each stack the protocol is added to gets its own instance of it, created
+// by f. It is intended for protocols with per-stack state, such as options.
+func RegisterTransportProtocolFactory(name string, f func() TransportProtocol) {
+	transportProtocols[name] = f
 }
 
 // RegisterNetworkProtocol registers a new network protocol with the stack so
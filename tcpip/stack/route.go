@@ -5,6 +5,8 @@
 package stack
 
 import (
+	"sync/atomic"
+
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
@@ -32,9 +34,53 @@ type Route struct {
 	// NetProto is the network-layer protocol.
 	NetProto tcpip.NetworkProtocolNumber
 
+	// TTL is the TTL (or hop limit) of packets sent through the route. If
+	// zero, the default of the stack is used.
+	TTL uint8
+
+	// TOS is the type of service (or traffic class) of packets sent
+	// through the route, if HasTOS is true.
+	TOS uint8
+
+	// HasTOS indicates whether TOS is used instead of the default of the
+	// stack.
+	HasTOS bool
+
+	// ECN is the ECN codepoint of packets sent through the route. If
+	// nonzero, it replaces the ECN bits of their type of service (or
+	// traffic class).
+	ECN uint8
+
+	// ReceivedECN is the ECN codepoint of the received packet a route was
+	// built for, if any. It is set by network endpoints before delivering
+	// the packet to the transport layer.
+	ReceivedECN uint8
+
+	// NetworkHeader is the network-layer header of the received packet a
+	// route was built for, if any. It is set by network endpoints before
+	// delivering the packet to the transport layer, and must not be
+	// modified.
+	NetworkHeader buffer.View
+
+	// MulticastLoop indicates whether packets sent through the route to a
+	// multicast group its NIC is a member of are also delivered locally.
+	MulticastLoop bool
+
+	// broadcast indicates whether the remote address is a limited or
+	// directed broadcast address.
+	broadcast bool
+
 	// ref a reference to the network endpoint through which the route
 	// starts.
 	ref *referencedNetworkEndpoint
+
+	// mtu is the MTU of the route table row this route was built from, or
+	// zero if the row doesn't restrict the MTU of the NIC.
+	mtu uint32
+
+	// connState is the connection tracking state of the received packet
+	// a route was built for, if any.
+	connState tcpip.ConnState
 }
 
 // makeRoute initializes a new route. It takes ownership of the provided
@@ -53,6 +99,24 @@ func (r *Route) NICID() tcpip.NICID {
 	return r.ref.ep.NICID()
 }
 
+// DefaultTTL returns the TTL (or hop limit) of packets sent through r when
+// r.TTL is zero. It is DefaultTTL for routes that weren't built by a stack.
+func (r *Route) DefaultTTL() uint8 {
+	if r.ref == nil {
+		return DefaultTTL
+	}
+	return r.ref.nic.stack.DefaultTTL(r.NetProto)
+}
+
+// DefaultTOS returns the type of service (or traffic class) of packets sent
+// through r when r.HasTOS is false.
+func (r *Route) DefaultTOS() uint8 {
+	if r.ref == nil {
+		return 0
+	}
+	return r.ref.nic.stack.DefaultTOS(r.NetProto)
+}
+
 // MaxHeaderLength forwards the call to the network endpoint's implementation.
 func (r *Route) MaxHeaderLength() uint16 {
 	return r.ref.ep.MaxHeaderLength()
@@ -66,12 +130,152 @@ func (r *Route) PseudoHeaderChecksum(protocol tcpip.TransportProtocolNumber) uin
 
 // WritePacket writes the packet through the given route.
 func (r *Route) WritePacket(hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) error {
+	s := r.ref.nic.stack
+	tr, ok := s.connTrack.trackSent(r, hdr, payload, protocol)
+	if !ok {
+		atomic.AddUint64(&s.stats.ConnTrackDroppedPackets, 1)
+		return tcpip.ErrNotPermitted
+	}
+	if err := r.filter(hdr, payload, protocol, tr.state); err != nil {
+		return err
+	}
+	if r.MulticastLoop && r.ref.nic.isInGroup(r.NetProto, r.RemoteAddress) {
+		r.loopback(hdr, payload, protocol)
+	}
 	return r.ref.ep.WritePacket(r, hdr, payload, protocol)
 }
 
-// MTU returns the MTU of the underlying network endpoint.
+// filter evaluates the output and postrouting filter rules against a packet
+// about to be sent through r, in the given connection tracking state. It fails
+// with ErrNotPermitted if a rule drops the packet, and with
+// ErrConnectionRefused if one rejects it.
+func (r *Route) filter(hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber, state tcpip.ConnState) error {
+	h := hdr.UsedBytes()
+	return r.filterPacket(&filterPacket{
+		outputNIC: r.NICID(),
+		src:       r.LocalAddress,
+		dst:       r.RemoteAddress,
+		protocol:  protocol,
+		transport: h,
+		size:      len(h) + len(payload),
+		connState: state,
+	})
+}
+
+// filterPacket evaluates the output and postrouting filter rules against pkt,
+// which is about to be sent through r, and fails like filter.
+func (r *Route) filterPacket(pkt *filterPacket) error {
+	s := r.ref.nic.stack
+	outRules, postRules := s.filterTable(tcpip.FilterOutput), s.filterTable(tcpip.FilterPostrouting)
+	if outRules == nil && postRules == nil {
+		return nil
+	}
+
+	switch pkt.filter(outRules, postRules) {
+	case tcpip.FilterAccept:
+		return nil
+	case tcpip.FilterDrop:
+		atomic.AddUint64(&s.stats.FilteredPackets, 1)
+		return tcpip.ErrNotPermitted
+	default:
+		atomic.AddUint64(&s.stats.FilteredPackets, 1)
+		return tcpip.ErrConnectionRefused
+	}
+}
+
+// WriteHeaderIncludedPacket writes a packet that starts with its network-layer
+// header through the given route. It fails with ErrNotSupported if the network
+// endpoint of the route can't send such packets.
+func (r *Route) WriteHeaderIncludedPacket(packet buffer.View) error {
+	w, ok := r.ref.ep.(HeaderIncludedWriter)
+	if !ok {
+		return tcpip.ErrNotSupported
+	}
+
+	pkt := filterPacket{
+		outputNIC: r.NICID(),
+		src:       r.LocalAddress,
+		dst:       r.RemoteAddress,
+	}
+	pkt.parseNetworkPacket(r.NetProto, packet)
+	if err := r.filterPacket(&pkt); err != nil {
+		return err
+	}
+
+	return w.WriteHeaderIncludedPacket(r, packet)
+}
+
+// loopback delivers a copy of a multicast packet about to be sent through r to
+// the endpoints of r's NIC, as if it had been received by the NIC.
+func (r *Route) loopback(hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) {
+	h := hdr.UsedBytes()
+	v := buffer.NewView(len(h) + len(payload))
+	copy(v, h)
+	copy(v[len(h):], payload)
+
+	var views [1]buffer.View
+	vv := v.ToVectorisedView(views)
+
+	r.ref.incRef()
+	lr := makeRoute(r.NetProto, r.RemoteAddress, r.LocalAddress, r.ref)
+	lr.LocalLinkAddress = r.LocalLinkAddress
+	lr.RemoteLinkAddress = r.LocalLinkAddress
+	r.ref.nic.DeliverTransportPacket(&lr, protocol, &vv)
+	lr.Release()
+}
+
+// RedeliverTransportPacket delivers a packet received through r to the
+// transport endpoint with the given id again, as if it had just been received.
+// An endpoint uses it to hand over a packet once it stopped matching its id,
+// such as a TCP connection in TIME_WAIT giving a new connection request to the
+// listening endpoint. Raw endpoints don't receive the packet again.
+func (r *Route) RedeliverTransportPacket(protocol tcpip.TransportProtocolNumber, id TransportEndpointID, vv *buffer.VectorisedView) {
+	n := r.ref.nic
+	state, ok := n.stack.transportProtocols[protocol]
+	if !ok {
+		return
+	}
+	n.deliverUnicastPacket(r, state, protocol, vv, id)
+}
+
+// IsBroadcast determines if the route sends packets to a broadcast address.
+func (r *Route) IsBroadcast() bool {
+	return r.broadcast
+}
+
+// SetMulticastDestination makes r send packets to the given multicast group
+// instead of its current remote address, addressing them to the link address
+// of the group.
+func (r *Route) SetMulticastDestination(group tcpip.Address) {
+	r.RemoteAddress = group
+	r.RemoteLinkAddress, _ = r.ref.nic.multicastLinkAddress(r.NetProto, group)
+}
+
+// MulticastGroups returns the multicast groups of the route's network protocol
+// that were joined on the NIC the route goes through.
+func (r *Route) MulticastGroups() []tcpip.Address {
+	return r.ref.nic.multicastGroups(r.NetProto)
+}
+
+// writeForwardedPacket writes a packet that already carries its network-layer
+// header directly to the link endpoint of the NIC the route leaves through.
+func (r *Route) writeForwardedPacket(pkt buffer.View) error {
+	linkEP := r.ref.nic.linkEP
+	hdr := buffer.NewPrependable(int(linkEP.MaxHeaderLength()))
+	return linkEP.WritePacket(r, &hdr, pkt, r.NetProto)
+}
+
+// MTU returns the MTU of the underlying network endpoint, further reduced by
+// the MTU of the route table row, if any.
 func (r *Route) MTU() uint32 {
-	return r.ref.ep.MTU()
+	mtu := r.ref.ep.MTU()
+	if lmtu := r.ref.nic.linkEP.MTU(); r.mtu != 0 && r.mtu < lmtu {
+		if d := lmtu - r.mtu; d < mtu {
+			return mtu - d
+		}
+		return 0
+	}
+	return mtu
 }
 
 // Release frees all resources associated with the route.
@@ -88,3 +292,96 @@ func (r *Route) Clone() Route {
 	r.ref.incRef()
 	return *r
 }
+
+// IPOptions holds the IP header fields that an endpoint picks for the packets
+// it sends, via TTLOption, TOSOption and TrafficClassOption. The zero value
+// uses the defaults of the stack for all of them. It must be protected by the
+// mutex of the endpoint.
+type IPOptions struct {
+	// ttl is the TTL (or hop limit), or zero if it is unset.
+	ttl uint8
+
+	tos             uint8
+	hasTOS          bool
+	trafficClass    uint8
+	hasTrafficClass bool
+}
+
+// SetOption sets opt, a TTLOption, TOSOption or TrafficClassOption, for an
+// endpoint of the given network protocol. A value of -1 selects the default of
+// the stack again.
+func (o *IPOptions) SetOption(netProto tcpip.NetworkProtocolNumber, opt interface{}) error {
+	switch v := opt.(type) {
+	case tcpip.TTLOption:
+		// A TTL of zero isn't supported, as routes take it to mean the
+		// default TTL of the stack.
+		if v == -1 {
+			v = 0
+		} else if v < 1 || v > 255 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		o.ttl = uint8(v)
+
+	case tcpip.TOSOption:
+		if v < -1 || v > 255 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		o.tos, o.hasTOS = uint8(v), v != -1
+
+	case tcpip.TrafficClassOption:
+		// We only recognize this option on v6 endpoints.
+		if netProto != header.IPv6ProtocolNumber {
+			return tcpip.ErrInvalidEndpointState
+		}
+		if v < -1 || v > 255 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		o.trafficClass, o.hasTrafficClass = uint8(v), v != -1
+
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
+	return nil
+}
+
+// GetOption gets opt, a *TTLOption, *TOSOption or *TrafficClassOption, for an
+// endpoint of the given network protocol. Options that use the default of the
+// stack are -1.
+func (o *IPOptions) GetOption(netProto tcpip.NetworkProtocolNumber, opt interface{}) error {
+	switch v := opt.(type) {
+	case *tcpip.TTLOption:
+		*v = -1
+		if o.ttl != 0 {
+			*v = tcpip.TTLOption(o.ttl)
+		}
+
+	case *tcpip.TOSOption:
+		*v = -1
+		if o.hasTOS {
+			*v = tcpip.TOSOption(o.tos)
+		}
+
+	case *tcpip.TrafficClassOption:
+		// We only recognize this option on v6 endpoints.
+		if netProto != header.IPv6ProtocolNumber {
+			return tcpip.ErrInvalidEndpointState
+		}
+		*v = -1
+		if o.hasTrafficClass {
+			*v = tcpip.TrafficClassOption(o.trafficClass)
+		}
+
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
+	return nil
+}
+
+// Apply sets the IP header fields of the packets sent through r.
+func (o *IPOptions) Apply(r *Route) {
+	r.TTL = o.ttl
+	r.TOS, r.HasTOS = o.tos, o.hasTOS
+	if r.NetProto == header.IPv6ProtocolNumber {
+		r.TOS, r.HasTOS = o.trafficClass, o.hasTrafficClass
+	}
+}
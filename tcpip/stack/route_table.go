@@ -0,0 +1,327 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sort"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// routeEntry is a route stored in a routeTable.
+type routeEntry struct {
+	route tcpip.Route
+
+	// prefixLen is the number of bits set in the route's mask.
+	prefixLen int
+
+	// seq is the insertion order of the route, used to break ties
+	// between routes with the same prefix length and metric.
+	seq uint64
+}
+
+// less determines if e is preferred over o when both match a destination.
+func (e *routeEntry) less(o *routeEntry) bool {
+	if e.prefixLen != o.prefixLen {
+		return e.prefixLen > o.prefixLen
+	}
+	if e.route.Metric != o.route.Metric {
+		return e.route.Metric < o.route.Metric
+	}
+	return e.seq < o.seq
+}
+
+// routeNode is a node of the binary trie that holds routes with contiguous
+// masks. The depth of a node is the prefix length of the routes it holds.
+type routeNode struct {
+	children [2]*routeNode
+
+	// routes is sorted by preference.
+	routes []*routeEntry
+}
+
+// isDirectedBroadcast determines if addr is the directed broadcast address of
+// the subnet reached directly (i.e., without a gateway) through route r. Only
+// IPv4 subnets with at least two host bits have a broadcast address.
+func isDirectedBroadcast(r *tcpip.Route, addr tcpip.Address) bool {
+	if r.Gateway != "" || len(addr) != header.IPv4AddressSize || len(r.Mask) != len(addr) {
+		return false
+	}
+
+	hostBits := 0
+	for i := 0; i < len(addr); i++ {
+		if addr[i]|r.Mask[i] != 0xff {
+			return false
+		}
+		for b := ^r.Mask[i]; b != 0; b &= b - 1 {
+			hostBits++
+		}
+	}
+
+	return hostBits >= 2
+}
+
+// directedBroadcast returns the directed broadcast address of the subnet
+// reached directly through route r, if it has one.
+func directedBroadcast(r *tcpip.Route) (tcpip.Address, bool) {
+	if len(r.Destination) != header.IPv4AddressSize || len(r.Mask) != len(r.Destination) {
+		return "", false
+	}
+
+	b := make([]byte, len(r.Destination))
+	for i := range b {
+		b[i] = r.Destination[i] | ^r.Mask[i]
+	}
+	addr := tcpip.Address(b)
+	if !isDirectedBroadcast(r, addr) {
+		return "", false
+	}
+	return addr, true
+}
+
+// routeTable is a route table with longest-prefix-match lookups. Routes whose
+// mask is a prefix are stored in a binary trie per address length, so lookups
+// take time proportional to the address length rather than to the number of
+// routes. Routes with non-contiguous masks are rare and are kept in a list
+// that is scanned linearly.
+//
+// routeTable is not safe for concurrent use; it is protected by the stack's
+// mutex.
+type routeTable struct {
+	roots map[int]*routeNode
+	other []*routeEntry
+	seq   uint64
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{roots: make(map[int]*routeNode)}
+}
+
+// maskPrefix returns the number of bits set in mask, and whether those bits
+// are all at the front of the mask.
+func maskPrefix(mask tcpip.Address) (int, bool) {
+	n := 0
+	contiguous := true
+	end := false
+	for i := 0; i < len(mask); i++ {
+		for j := 7; j >= 0; j-- {
+			if mask[i]&(1<<uint(j)) == 0 {
+				end = true
+				continue
+			}
+			if end {
+				contiguous = false
+			}
+			n++
+		}
+	}
+	return n, contiguous
+}
+
+// addrBit returns the i-th most significant bit of addr.
+func addrBit(addr tcpip.Address, i int) int {
+	return int(addr[i/8]>>uint(7-i%8)) & 1
+}
+
+// sameRoute determines if a and b refer to the same route. Routes are
+// identified by their destination, mask, gateway and NIC; metrics and MTUs
+// are attributes of a route and aren't part of its identity.
+func sameRoute(a, b *tcpip.Route) bool {
+	return a.Destination == b.Destination && a.Mask == b.Mask && a.Gateway == b.Gateway && a.NIC == b.NIC
+}
+
+// validRoute determines if r can be inserted in a route table.
+func validRoute(r *tcpip.Route) bool {
+	if len(r.Destination) != len(r.Mask) {
+		return false
+	}
+	for i := 0; i < len(r.Destination); i++ {
+		if r.Destination[i]&^r.Mask[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// insertSorted inserts e in the sorted list of entries l.
+func insertSorted(l []*routeEntry, e *routeEntry) []*routeEntry {
+	i := sort.Search(len(l), func(i int) bool { return e.less(l[i]) })
+	l = append(l, nil)
+	copy(l[i+1:], l[i:])
+	l[i] = e
+	return l
+}
+
+// removeRoute removes the entry with the same identity as r from l, if any.
+func removeRoute(l []*routeEntry, r *tcpip.Route) ([]*routeEntry, bool) {
+	for i, e := range l {
+		if sameRoute(&e.route, r) {
+			return append(l[:i], l[i+1:]...), true
+		}
+	}
+	return l, false
+}
+
+// add inserts r in the table.
+func (t *routeTable) add(r tcpip.Route) error {
+	if !validRoute(&r) {
+		return tcpip.ErrInvalidRoute
+	}
+
+	prefixLen, contiguous := maskPrefix(r.Mask)
+	t.seq++
+	e := &routeEntry{route: r, prefixLen: prefixLen, seq: t.seq}
+
+	if !contiguous {
+		for _, o := range t.other {
+			if sameRoute(&o.route, &r) {
+				return tcpip.ErrDuplicateRoute
+			}
+		}
+		t.other = insertSorted(t.other, e)
+		return nil
+	}
+
+	n := t.roots[len(r.Destination)]
+	if n == nil {
+		n = &routeNode{}
+		t.roots[len(r.Destination)] = n
+	}
+	for i := 0; i < prefixLen; i++ {
+		b := addrBit(r.Destination, i)
+		if n.children[b] == nil {
+			n.children[b] = &routeNode{}
+		}
+		n = n.children[b]
+	}
+
+	for _, o := range n.routes {
+		if sameRoute(&o.route, &r) {
+			return tcpip.ErrDuplicateRoute
+		}
+	}
+	n.routes = insertSorted(n.routes, e)
+
+	return nil
+}
+
+// remove removes the route with the same identity as r from the table.
+func (t *routeTable) remove(r tcpip.Route) error {
+	if !validRoute(&r) {
+		return tcpip.ErrInvalidRoute
+	}
+
+	prefixLen, contiguous := maskPrefix(r.Mask)
+	if !contiguous {
+		var ok bool
+		if t.other, ok = removeRoute(t.other, &r); !ok {
+			return tcpip.ErrNoRoute
+		}
+		return nil
+	}
+
+	root := t.roots[len(r.Destination)]
+	if root == nil || !root.remove(&r, 0, prefixLen) {
+		return tcpip.ErrNoRoute
+	}
+	if root.empty() {
+		delete(t.roots, len(r.Destination))
+	}
+
+	return nil
+}
+
+// remove removes r from the subtree rooted at n, which is at the given depth,
+// pruning nodes that become empty. It returns true if r was found.
+func (n *routeNode) remove(r *tcpip.Route, depth, prefixLen int) bool {
+	if depth == prefixLen {
+		var ok bool
+		n.routes, ok = removeRoute(n.routes, r)
+		return ok
+	}
+
+	b := addrBit(r.Destination, depth)
+	c := n.children[b]
+	if c == nil || !c.remove(r, depth+1, prefixLen) {
+		return false
+	}
+	if c.empty() {
+		n.children[b] = nil
+	}
+	return true
+}
+
+// empty determines if n holds no routes and has no children.
+func (n *routeNode) empty() bool {
+	return len(n.routes) == 0 && n.children[0] == nil && n.children[1] == nil
+}
+
+// lookup returns the routes that match addr, most preferred first: longest
+// prefix, then lowest metric, then oldest.
+func (t *routeTable) lookup(addr tcpip.Address) []*routeEntry {
+	var matches []*routeEntry
+
+	// Walk down the trie, collecting the routes of every node on the
+	// path; deeper nodes have longer prefixes, so they come first.
+	if n := t.roots[len(addr)]; n != nil {
+		var path []*routeNode
+		for i := 0; n != nil; i++ {
+			if len(n.routes) != 0 {
+				path = append(path, n)
+			}
+			if i == len(addr)*8 {
+				break
+			}
+			n = n.children[addrBit(addr, i)]
+		}
+		for i := len(path) - 1; i >= 0; i-- {
+			matches = append(matches, path[i].routes...)
+		}
+	}
+
+	if len(t.other) == 0 {
+		return matches
+	}
+
+	merged := false
+	for _, e := range t.other {
+		if e.route.Match(addr) {
+			matches = append(matches, e)
+			merged = true
+		}
+	}
+	if merged {
+		sort.SliceStable(matches, func(i, j int) bool { return matches[i].less(matches[j]) })
+	}
+
+	return matches
+}
+
+// routes returns all routes in the table, most preferred first.
+func (t *routeTable) routes() []tcpip.Route {
+	var entries []*routeEntry
+	var walk func(n *routeNode)
+	walk = func(n *routeNode) {
+		if n == nil {
+			return
+		}
+		entries = append(entries, n.routes...)
+		walk(n.children[0])
+		walk(n.children[1])
+	}
+	for _, n := range t.roots {
+		walk(n)
+	}
+	entries = append(entries, t.other...)
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].less(entries[j]) })
+
+	table := make([]tcpip.Route, len(entries))
+	for i, e := range entries {
+		table[i] = e.route
+	}
+	return table
+}
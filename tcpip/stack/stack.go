@@ -14,11 +14,14 @@
 package stack
 
 import (
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/ports"
 	"github.com/google/netstack/waiter"
 )
@@ -28,6 +31,18 @@ type transportProtocolState struct {
 	defaultHandler func(*Route, TransportEndpointID, *buffer.VectorisedView) bool
 }
 
+// DefaultTTL is the TTL (or hop limit) of the packets sent by a stack, unless
+// it is configured otherwise.
+const DefaultTTL = 65
+
+// ipDefaults holds the values of the IP header fields of the packets sent with
+// a network protocol, unless their endpoint picks others. Its fields are
+// accessed atomically.
+type ipDefaults struct {
+	ttl uint32
+	tos uint32
+}
+
 // Stack is a networking stack, with all supported protocols, NICs, and route
 // table.
 type Stack struct {
@@ -37,6 +52,10 @@ type Stack struct {
 
 	demux *transportDemuxer
 
+	// packetDemux delivers the frames dispatched by NICs to the packet
+	// endpoints registered via RegisterPacketEndpoint().
+	packetDemux *packetDemuxer
+
 	stats tcpip.Stats
 
 	linkAddrCache *linkAddrCache
@@ -44,10 +63,34 @@ type Stack struct {
 	mu   sync.RWMutex
 	nics map[tcpip.NICID]*NIC
 
-	// route is the route table passed in by the user via SetRouteTable(),
-	// it is used by FindRoute() to build a route for a specific
-	// destination.
-	routeTable []tcpip.Route
+	// routeTables holds the route tables configured by the user via
+	// SetRouteTable(), AddRoute() and RemoveRoute(), indexed by name; the
+	// main table has an empty name. They are used by FindRoute() to build
+	// a route for a specific destination.
+	routeTables map[string]*routeTable
+
+	// routeRules is the routing policy configured by the user via
+	// SetRouteRules(). It determines which route tables FindRoute()
+	// consults, and in which order.
+	routeRules []tcpip.RouteRule
+
+	// forwarding indicates whether packets received on a NIC that aren't
+	// addressed to a local endpoint should be routed to their destination.
+	forwarding bool
+
+	// filters holds the filter rules of each hook, configured by the user
+	// via SetFilterRules(). Each holds a *filterTable, which is nil if the
+	// hook has no rules.
+	filters [tcpip.NumFilterHooks]atomic.Value
+
+	// connTrack tracks the connections of the stack, and holds the NAT
+	// rules configured by the user.
+	connTrack *connTrack
+
+	// ipDefaults holds the default IP header fields of each network
+	// protocol, configured by the user via SetDefaultTTL() and
+	// SetDefaultTOS().
+	ipDefaults map[tcpip.NetworkProtocolNumber]*ipDefaults
 
 	*ports.PortManager
 }
@@ -60,9 +103,13 @@ func New(network []string, transport []string) tcpip.Stack {
 		networkProtocols:   make(map[tcpip.NetworkProtocolNumber]NetworkProtocol),
 		linkAddrResolvers:  make(map[tcpip.NetworkProtocolNumber]LinkAddressResolver),
 		nics:               make(map[tcpip.NICID]*NIC),
+		routeTables:        make(map[string]*routeTable),
+		ipDefaults:         make(map[tcpip.NetworkProtocolNumber]*ipDefaults),
 		linkAddrCache:      newLinkAddrCache(1 * time.Minute),
+		packetDemux:        newPacketDemuxer(),
 		PortManager:        ports.NewPortManager(),
 	}
+	s.connTrack = newConnTrack(s.PortManager)
 
 	// Add specified network protocols.
 	for _, name := range network {
@@ -72,6 +119,7 @@ func New(network []string, transport []string) tcpip.Stack {
 		}
 
 		s.networkProtocols[netProto.Number()] = netProto
+		s.ipDefaults[netProto.Number()] = &ipDefaults{ttl: DefaultTTL}
 
 		if r, ok := netProto.(LinkAddressResolver); ok {
 			s.linkAddrResolvers[r.LinkAddressProtocol()] = r
@@ -80,10 +128,11 @@ func New(network []string, transport []string) tcpip.Stack {
 
 	// Add specified transport protocols.
 	for _, name := range transport {
-		transProto, ok := transportProtocols[name]
+		newProto, ok := transportProtocols[name]
 		if !ok {
 			continue
 		}
+		transProto := newProto()
 
 		s.transportProtocols[transProto.Number()] = &transportProtocolState{
 			proto: transProto,
@@ -108,6 +157,37 @@ func (s *Stack) SetTransportProtocolHandler(p tcpip.TransportProtocolNumber, h f
 	}
 }
 
+// SetTransportProtocolOption sets an option of the given transport protocol,
+// for this stack only. For example, ECN negotiation is enabled on new TCP
+// endpoints with:
+//
+//	s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.ECNOption(1))
+func (s *Stack) SetTransportProtocolOption(transport tcpip.TransportProtocolNumber, option interface{}) error {
+	state := s.transportProtocols[transport]
+	if state == nil {
+		return tcpip.ErrUnknownProtocol
+	}
+	p, ok := state.proto.(ConfigurableTransportProtocol)
+	if !ok {
+		return tcpip.ErrUnknownProtocolOption
+	}
+	return p.SetOption(option)
+}
+
+// TransportProtocolOption reads an option of the given transport protocol into
+// the value option points to.
+func (s *Stack) TransportProtocolOption(transport tcpip.TransportProtocolNumber, option interface{}) error {
+	state := s.transportProtocols[transport]
+	if state == nil {
+		return tcpip.ErrUnknownProtocol
+	}
+	p, ok := state.proto.(ConfigurableTransportProtocol)
+	if !ok {
+		return tcpip.ErrUnknownProtocolOption
+	}
+	return p.Option(option)
+}
+
 // Stats returns a snapshot of the current stats.
 func (s *Stack) Stats() tcpip.Stats {
 	return s.stats
@@ -121,13 +201,185 @@ func (s *Stack) MutableStats() *tcpip.Stats {
 	return &s.stats
 }
 
-// SetRouteTable assigns the route table to be used by this stack. It
-// specifies which NIC to use for a given destination address mask.
+// SetRouteTable assigns the route tables to be used by this stack. It
+// specifies which NIC to use for a given destination address mask. Each row is
+// added to the table it names, and all existing tables are replaced. Invalid
+// and duplicate rows are ignored.
 func (s *Stack) SetRouteTable(table []tcpip.Route) {
+	tables := make(map[string]*routeTable)
+	for _, r := range table {
+		t := tables[r.Table]
+		if t == nil {
+			t = newRouteTable()
+			tables[r.Table] = t
+		}
+		t.add(r)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.routeTables = tables
+	s.updateBroadcastsLocked()
+}
+
+// AddRoute adds a route to the route table it names, creating the table if
+// needed. It fails with ErrDuplicateRoute if a route with the same destination,
+// mask, gateway and NIC already exists in the table.
+func (s *Stack) AddRoute(route tcpip.Route) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.routeTables[route.Table]
+	if t == nil {
+		t = newRouteTable()
+		s.routeTables[route.Table] = t
+	}
+
+	if err := t.add(route); err != nil {
+		return err
+	}
+	s.updateBroadcastsLocked()
+	return nil
+}
+
+// RemoveRoute removes the route with the same destination, mask, gateway and
+// NIC as the given one from the route table it names. It fails with ErrNoRoute
+// if there is no such route.
+func (s *Stack) RemoveRoute(route tcpip.Route) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.routeTables[route.Table]
+	if t == nil {
+		return tcpip.ErrNoRoute
+	}
+
+	if err := t.remove(route); err != nil {
+		return err
+	}
+	s.updateBroadcastsLocked()
+	return nil
+}
+
+// GetRouteTable returns a snapshot of the route tables. Rows are grouped by
+// table, starting with the main one, with the most preferred rows of each
+// table first.
+func (s *Stack) GetRouteTable() []tcpip.Route {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.routeTables))
+	for name := range s.routeTables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var table []tcpip.Route
+	for _, name := range names {
+		table = append(table, s.routeTables[name].routes()...)
+	}
+	return table
+}
+
+// SetRouteRules assigns the route rules to be used by this stack, replacing
+// any existing ones. Rules are evaluated in order when looking up a route; if
+// no rules are set, only the main route table is consulted.
+func (s *Stack) SetRouteRules(rules []tcpip.RouteRule) {
+	rules = append([]tcpip.RouteRule(nil), rules...)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.routeTable = table
+	s.routeRules = rules
+}
+
+// GetRouteRules returns a copy of the route rules of the stack.
+func (s *Stack) GetRouteRules() []tcpip.RouteRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]tcpip.RouteRule(nil), s.routeRules...)
+}
+
+// SetForwarding enables or disables packet forwarding between NICs. When
+// enabled, packets received on a NIC with forwarding enabled that aren't
+// addressed to the stack are routed towards their destination.
+func (s *Stack) SetForwarding(enable bool) {
+	s.mu.Lock()
+	s.forwarding = enable
+	s.mu.Unlock()
+}
+
+// Forwarding returns true if packet forwarding between NICs is enabled.
+func (s *Stack) Forwarding() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.forwarding
+}
+
+// SetDefaultTTL sets the TTL (or hop limit) of the packets sent with the given
+// network protocol, unless their endpoint picks another one.
+func (s *Stack) SetDefaultTTL(protocol tcpip.NetworkProtocolNumber, ttl uint8) error {
+	d := s.ipDefaults[protocol]
+	if d == nil {
+		return tcpip.ErrUnknownProtocol
+	}
+	if ttl == 0 {
+		return tcpip.ErrInvalidOptionValue
+	}
+	atomic.StoreUint32(&d.ttl, uint32(ttl))
+	return nil
+}
+
+// DefaultTTL returns the TTL (or hop limit) of the packets sent with the given
+// network protocol, unless their endpoint picks another one.
+func (s *Stack) DefaultTTL(protocol tcpip.NetworkProtocolNumber) uint8 {
+	d := s.ipDefaults[protocol]
+	if d == nil {
+		return 0
+	}
+	return uint8(atomic.LoadUint32(&d.ttl))
+}
+
+// SetDefaultTOS sets the type of service (or traffic class) of the packets sent
+// with the given network protocol, unless their endpoint picks another one.
+// It is zero initially.
+func (s *Stack) SetDefaultTOS(protocol tcpip.NetworkProtocolNumber, tos uint8) error {
+	d := s.ipDefaults[protocol]
+	if d == nil {
+		return tcpip.ErrUnknownProtocol
+	}
+	atomic.StoreUint32(&d.tos, uint32(tos))
+	return nil
+}
+
+// DefaultTOS returns the type of service (or traffic class) of the packets sent
+// with the given network protocol, unless their endpoint picks another one.
+func (s *Stack) DefaultTOS(protocol tcpip.NetworkProtocolNumber) uint8 {
+	d := s.ipDefaults[protocol]
+	if d == nil {
+		return 0
+	}
+	return uint8(atomic.LoadUint32(&d.tos))
+}
+
+// SetNICForwarding enables or disables forwarding of packets received on the
+// given NIC. It is enabled by default, but has no effect unless forwarding is
+// also enabled stack-wide via SetForwarding.
+func (s *Stack) SetNICForwarding(id tcpip.NICID, enable bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setForwarding(enable)
+
+	return nil
 }
 
 // NewEndpoint creates a new transport layer endpoint of the given protocol.
@@ -159,6 +411,7 @@ func (s *Stack) createNIC(id tcpip.NICID, linkEP tcpip.LinkEndpointID, enabled b
 	n := newNIC(s, id, ep)
 
 	s.nics[id] = n
+	s.updateBroadcastsLocked()
 	if enabled {
 		n.attachLinkEndpoint()
 	}
@@ -220,6 +473,63 @@ func (s *Stack) AddAddress(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber,
 	return nic.AddAddress(protocol, addr)
 }
 
+// AddAddressWithOptions adds a new network-layer address to the specified NIC,
+// with options that control how it is used for source address selection.
+func (s *Stack) AddAddressWithOptions(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, opts tcpip.AddressOptions) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.AddAddressWithOptions(protocol, addr, opts)
+}
+
+// JoinGroup joins the given multicast group on the specified NIC. Memberships
+// are reference counted: the NIC stays in the group until it has been left as
+// many times as it was joined.
+func (s *Stack) JoinGroup(protocol tcpip.NetworkProtocolNumber, nicid tcpip.NICID, group tcpip.Address) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicid]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.joinGroup(protocol, group)
+}
+
+// LeaveGroup leaves the given multicast group on the specified NIC.
+func (s *Stack) LeaveGroup(protocol tcpip.NetworkProtocolNumber, nicid tcpip.NICID, group tcpip.Address) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicid]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.leaveGroup(protocol, group)
+}
+
+// SetAddressDeprecated marks an existing network-layer address of the
+// specified NIC as deprecated or not. Deprecated addresses are avoided as
+// source addresses when other addresses are available.
+func (s *Stack) SetAddressDeprecated(id tcpip.NICID, addr tcpip.Address, deprecated bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.SetAddressDeprecated(addr, deprecated)
+}
+
 // AddSubnet adds a subnet range to the specified NIC.
 func (s *Stack) AddSubnet(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber, subnet tcpip.Subnet) error {
 	s.mu.RLock()
@@ -248,40 +558,158 @@ func (s *Stack) RemoveAddress(id tcpip.NICID, addr tcpip.Address) error {
 	return nic.RemoveAddress(addr)
 }
 
+// routeKey holds the attributes of the traffic a route is looked up for that
+// route rules may match on.
+type routeKey struct {
+	source   tcpip.Address
+	inputNIC tcpip.NICID
+	protocol tcpip.TransportProtocolNumber
+	mark     uint32
+}
+
 // FindRoute creates a route to the given destination address, leaving through
 // the given nic and local address (if provided).
 func (s *Stack) FindRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) (Route, error) {
+	return s.findRoute(id, localAddr, remoteAddr, netProto, routeKey{source: localAddr})
+}
+
+// FindPolicyRoute is like FindRoute, but it also takes the transport protocol
+// and the mark of the traffic the route is for, which route rules may match on.
+func (s *Stack) FindPolicyRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, mark uint32) (Route, error) {
+	return s.findRoute(id, localAddr, remoteAddr, netProto, routeKey{
+		source:   localAddr,
+		protocol: protocol,
+		mark:     mark,
+	})
+}
+
+func (s *Stack) findRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber, key routeKey) (Route, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	for i := range s.routeTable {
-		if id != 0 && id != s.routeTable[i].NIC || !s.routeTable[i].Match(remoteAddr) {
+	// Limited broadcasts never leave the link, so they are sent through the
+	// given NIC regardless of the route table.
+	if id != 0 && isLimitedBroadcast(netProto, remoteAddr) {
+		if nic := s.nics[id]; nic != nil {
+			if r, ok := s.routeThrough(nic, localAddr, remoteAddr, netProto, true); ok {
+				return r, nil
+			}
+		}
+		return Route{}, tcpip.ErrNoRoute
+	}
+
+	if s.routeRules == nil {
+		if r, ok := s.findRouteInTable(s.routeTables[""], id, localAddr, remoteAddr, netProto); ok {
+			return r, nil
+		}
+		return Route{}, tcpip.ErrNoRoute
+	}
+
+	for i := range s.routeRules {
+		if !s.routeRules[i].Match(key.source, key.inputNIC, key.protocol, key.mark) {
 			continue
 		}
 
-		nic := s.nics[s.routeTable[i].NIC]
-		if nic == nil {
+		if r, ok := s.findRouteInTable(s.routeTables[s.routeRules[i].Table], id, localAddr, remoteAddr, netProto); ok {
+			return r, nil
+		}
+	}
+
+	return Route{}, tcpip.ErrNoRoute
+}
+
+// findRouteInTable builds a route to the given destination using the most
+// preferred viable row of table t.
+//
+// s.mu must be held by the caller.
+func (s *Stack) findRouteInTable(t *routeTable, id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) (Route, bool) {
+	if t == nil {
+		return Route{}, false
+	}
+
+	for _, e := range t.lookup(remoteAddr) {
+		if id != 0 && id != e.route.NIC {
 			continue
 		}
 
-		var ref *referencedNetworkEndpoint
-		if len(localAddr) != 0 {
-			ref = nic.findEndpoint(localAddr)
-		} else {
-			ref = nic.primaryEndpoint(netProto)
+		nic := s.nics[e.route.NIC]
+		if nic == nil {
+			continue
 		}
 
-		if ref == nil {
+		broadcast := isLimitedBroadcast(netProto, remoteAddr) || isDirectedBroadcast(&e.route, remoteAddr)
+		r, ok := s.routeThrough(nic, localAddr, remoteAddr, netProto, broadcast)
+		if !ok {
 			continue
 		}
 
-		r := makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, ref)
-		r.RemoteLinkAddress = s.linkAddrCache.get(tcpip.FullAddress{NIC: nic.ID(), Addr: remoteAddr})
-		r.NextHop = s.routeTable[i].Gateway
-		return r, nil
+		r.NextHop = e.route.Gateway
+		r.mtu = e.route.MTU
+		return r, true
 	}
 
-	return Route{}, tcpip.ErrNoRoute
+	return Route{}, false
+}
+
+// routeThrough builds a route to the given destination that leaves through
+// nic, from localAddr if provided. Broadcasts from NICs without an address are
+// sent from the unspecified address.
+//
+// s.mu must be held by the caller.
+func (s *Stack) routeThrough(nic *NIC, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber, broadcast bool) (Route, bool) {
+	var ref *referencedNetworkEndpoint
+	switch {
+	case len(localAddr) != 0:
+		ref = nic.findEndpoint(localAddr)
+	case broadcast:
+		ref = nic.broadcastEndpoint(netProto)
+	default:
+		ref = nic.primaryEndpoint(netProto, remoteAddr)
+	}
+
+	if ref == nil {
+		return Route{}, false
+	}
+
+	r := makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, ref)
+	r.broadcast = broadcast
+	r.RemoteLinkAddress = s.linkAddrCache.get(tcpip.FullAddress{NIC: nic.ID(), Addr: remoteAddr})
+	if linkAddr, ok := nic.multicastLinkAddress(netProto, remoteAddr); ok {
+		r.RemoteLinkAddress = linkAddr
+	}
+	if broadcast && len(nic.linkEP.LinkAddress()) == header.EthernetAddressSize {
+		r.RemoteLinkAddress = header.EthernetBroadcastAddress
+	}
+	return r, true
+}
+
+// updateBroadcastsLocked refreshes the directed broadcast addresses of the
+// subnets that each NIC is directly attached to, according to any of the route
+// tables. It must be called whenever the route tables or the NICs change.
+//
+// s.mu must be held by the caller.
+func (s *Stack) updateBroadcastsLocked() {
+	broadcasts := make(map[tcpip.NICID]map[tcpip.Address]struct{})
+	for _, t := range s.routeTables {
+		for _, r := range t.routes() {
+			addr, ok := directedBroadcast(&r)
+			if !ok {
+				continue
+			}
+			m := broadcasts[r.NIC]
+			if m == nil {
+				m = make(map[tcpip.Address]struct{})
+				broadcasts[r.NIC] = m
+			}
+			m[addr] = struct{}{}
+		}
+	}
+
+	for id, nic := range s.nics {
+		nic.mu.Lock()
+		nic.broadcasts = broadcasts[id]
+		nic.mu.Unlock()
+	}
 }
 
 // CheckNetworkProtocol checks if a given network protocol is enabled in the
@@ -387,3 +815,66 @@ func (s *Stack) UnregisterTransportEndpoint(nicID tcpip.NICID, netProtos []tcpip
 		nic.demux.unregisterEndpoint(netProtos, protocol, id)
 	}
 }
+
+// RegisterRawTransportEndpoint registers the given raw endpoint with the stack
+// transport dispatcher, such that it receives a copy of every packet of the
+// given network and transport protocols. The transport protocol doesn't need to
+// be registered with the stack.
+func (s *Stack) RegisterRawTransportEndpoint(netProto tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, ep RawTransportEndpoint) error {
+	if _, ok := s.networkProtocols[netProto]; !ok {
+		return tcpip.ErrUnknownProtocol
+	}
+	return s.demux.registerRawEndpoint(netProto, protocol, ep)
+}
+
+// UnregisterRawTransportEndpoint removes the given raw endpoint from the stack
+// transport dispatcher.
+func (s *Stack) UnregisterRawTransportEndpoint(netProto tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, ep RawTransportEndpoint) {
+	s.demux.unregisterRawEndpoint(netProto, protocol, ep)
+}
+
+// RegisterPacketEndpoint registers the given packet endpoint with the stack,
+// such that it receives a copy of every frame of the given network protocol
+// dispatched by the given NIC. A zero NIC ID or protocol matches all NICs or
+// protocols. The protocol doesn't need to be registered with the stack.
+func (s *Stack) RegisterPacketEndpoint(nicID tcpip.NICID, protocol tcpip.NetworkProtocolNumber, ep PacketEndpoint) error {
+	if nicID != 0 {
+		s.mu.RLock()
+		nic := s.nics[nicID]
+		s.mu.RUnlock()
+		if nic == nil {
+			return tcpip.ErrUnknownNICID
+		}
+	}
+	return s.packetDemux.registerEndpoint(nicID, protocol, ep)
+}
+
+// UnregisterPacketEndpoint removes the given packet endpoint, registered for
+// the given protocol, from the stack.
+func (s *Stack) UnregisterPacketEndpoint(protocol tcpip.NetworkProtocolNumber, ep PacketEndpoint) {
+	s.packetDemux.unregisterEndpoint(protocol, ep)
+}
+
+// WriteLinkPacket writes a network-layer packet of the given protocol directly
+// through the link endpoint of a NIC, to the given link address. It bypasses
+// routing, the network layer and the filter rules.
+func (s *Stack) WriteLinkPacket(nicID tcpip.NICID, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, payload buffer.View) error {
+	s.mu.RLock()
+	nic := s.nics[nicID]
+	s.mu.RUnlock()
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	if uint32(len(payload)) > nic.linkEP.MTU() {
+		return tcpip.ErrMessageTooLong
+	}
+
+	r := Route{
+		NetProto:          protocol,
+		LocalLinkAddress:  nic.linkEP.LinkAddress(),
+		RemoteLinkAddress: remoteLinkAddr,
+	}
+	hdr := buffer.NewPrependable(int(nic.linkEP.MaxHeaderLength()))
+	return nic.linkEP.WritePacket(&r, &hdr, payload, protocol)
+}
@@ -221,7 +221,7 @@ func TestNetworkSend(t *testing.T) {
 		t.Fatalf("NewNIC failed: %v", err)
 	}
 
-	s.SetRouteTable([]tcpip.Route{{"\x00", "\x00", "\x00", 1}})
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
 
 	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
 		t.Fatalf("AddAddress failed: %v", err)
@@ -270,8 +270,8 @@ func TestNetworkSendMultiRoute(t *testing.T) {
 	// addresses through the first NIC, and all even destination address
 	// through the second one.
 	s.SetRouteTable([]tcpip.Route{
-		{"\x01", "\x01", "\x00", 1},
-		{"\x00", "\x01", "\x00", 2},
+		{Destination: "\x01", Mask: "\x01", Gateway: "\x00", NIC: 1},
+		{Destination: "\x00", Mask: "\x01", Gateway: "\x00", NIC: 2},
 	})
 
 	// Send a packet to an odd destination.
@@ -349,8 +349,8 @@ func TestRoutes(t *testing.T) {
 	// addresses through the first NIC, and all even destination address
 	// through the second one.
 	s.SetRouteTable([]tcpip.Route{
-		{"\x01", "\x01", "\x00", 1},
-		{"\x00", "\x01", "\x00", 2},
+		{Destination: "\x01", Mask: "\x01", Gateway: "\x00", NIC: 1},
+		{Destination: "\x00", Mask: "\x01", Gateway: "\x00", NIC: 2},
 	})
 
 	// Test routes to odd address.
@@ -380,6 +380,379 @@ func TestRoutes(t *testing.T) {
 	testNoRoute(t, s, 1, "\x03", "\x06")
 }
 
+func TestRouteLongestPrefixMatch(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id1, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	id2, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(2, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	// The default route comes first, but more specific routes must still
+	// be preferred.
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00", Mask: "\x00", NIC: 1},
+		{Destination: "\x80", Mask: "\x80", NIC: 2},
+		{Destination: "\xc0", Mask: "\xc0", NIC: 1},
+	})
+
+	testRoute(t, s, 0, "", "\x05", "\x01")
+	testRoute(t, s, 0, "", "\x85", "\x02")
+	testRoute(t, s, 0, "", "\xc5", "\x01")
+
+	// A route through a specific NIC falls back to less specific routes.
+	testRoute(t, s, 1, "", "\x85", "\x01")
+
+	// Among routes with the same prefix, the lowest metric wins.
+	if err := s.AddRoute(tcpip.Route{Destination: "\x40", Mask: "\xc0", NIC: 1, Metric: 10}); err != nil {
+		t.Fatalf("AddRoute failed: %v", err)
+	}
+	if err := s.AddRoute(tcpip.Route{Destination: "\x40", Mask: "\xc0", NIC: 2, Metric: 5}); err != nil {
+		t.Fatalf("AddRoute failed: %v", err)
+	}
+	testRoute(t, s, 0, "", "\x45", "\x02")
+
+	if err := s.AddRoute(tcpip.Route{Destination: "\x40", Mask: "\xc0", NIC: 2, Metric: 1}); err != tcpip.ErrDuplicateRoute {
+		t.Fatalf("AddRoute returned unexpected error: expected %v, got %v", tcpip.ErrDuplicateRoute, err)
+	}
+
+	if err := s.AddRoute(tcpip.Route{Destination: "\x41", Mask: "\xc0", NIC: 2}); err != tcpip.ErrInvalidRoute {
+		t.Fatalf("AddRoute returned unexpected error: expected %v, got %v", tcpip.ErrInvalidRoute, err)
+	}
+
+	want := []tcpip.Route{
+		{Destination: "\xc0", Mask: "\xc0", NIC: 1},
+		{Destination: "\x40", Mask: "\xc0", NIC: 2, Metric: 5},
+		{Destination: "\x40", Mask: "\xc0", NIC: 1, Metric: 10},
+		{Destination: "\x80", Mask: "\x80", NIC: 2},
+		{Destination: "\x00", Mask: "\x00", NIC: 1},
+	}
+	got := s.GetRouteTable()
+	if len(got) != len(want) {
+		t.Fatalf("GetRouteTable() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("GetRouteTable()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	// Removing the preferred route makes the next one take over.
+	if err := s.RemoveRoute(tcpip.Route{Destination: "\x40", Mask: "\xc0", NIC: 2}); err != nil {
+		t.Fatalf("RemoveRoute failed: %v", err)
+	}
+	testRoute(t, s, 0, "", "\x45", "\x01")
+
+	if err := s.RemoveRoute(tcpip.Route{Destination: "\x40", Mask: "\xc0", NIC: 2}); err != tcpip.ErrNoRoute {
+		t.Fatalf("RemoveRoute returned unexpected error: expected %v, got %v", tcpip.ErrNoRoute, err)
+	}
+
+	for _, r := range s.GetRouteTable() {
+		if err := s.RemoveRoute(r); err != nil {
+			t.Fatalf("RemoveRoute(%v) failed: %v", r, err)
+		}
+	}
+	testNoRoute(t, s, 0, "", "\x05")
+}
+
+func TestRouteMTU(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00", Mask: "\x00", NIC: 1},
+		{Destination: "\x80", Mask: "\x80", NIC: 1, MTU: 1500},
+	})
+
+	for _, tc := range []struct {
+		addr tcpip.Address
+		mtu  uint32
+	}{
+		{"\x05", defaultMTU - fakeNetHeaderLen},
+		{"\x85", 1500 - fakeNetHeaderLen},
+	} {
+		r, err := s.FindRoute(0, "", tc.addr, fakeNetNumber)
+		if err != nil {
+			t.Fatalf("FindRoute failed: %v", err)
+		}
+		if got := r.MTU(); got != tc.mtu {
+			t.Errorf("MTU() of route to %v = %d, want %d", tc.addr, got, tc.mtu)
+		}
+		r.Release()
+	}
+}
+
+func TestPolicyRouting(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id1, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	id2, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(2, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	// The main table sends everything through NIC 1, the "nic2" table
+	// sends everything through NIC 2, and the "empty" table has no routes
+	// for the destination used below.
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00", Mask: "\x00", NIC: 1},
+		{Destination: "\x00", Mask: "\x00", NIC: 2, Table: "nic2"},
+		{Destination: "\x80", Mask: "\x80", NIC: 2, Table: "empty"},
+	})
+
+	// Without rules, only the main table is consulted.
+	testRoute(t, s, 0, "", "\x05", "\x01")
+	testNoRoute(t, s, 0, "\x02", "\x05")
+
+	s.SetRouteRules([]tcpip.RouteRule{
+		{Source: "\x02", SourceMask: "\xff", Table: "nic2"},
+		{Mark: 1, MarkMask: 1, Table: "empty"},
+		{Mark: 1, MarkMask: 1, Protocol: 17, Table: "nic2"},
+		{},
+	})
+
+	if got, want := s.GetRouteRules(), 4; len(got) != want {
+		t.Fatalf("len(GetRouteRules()) = %d, want %d", len(got), want)
+	}
+
+	// Traffic sourced from NIC 2's address leaves through NIC 2, so that
+	// multi-homed hosts reply through the interface traffic arrived on.
+	testRoute(t, s, 0, "\x02", "\x05", "\x02")
+	testRoute(t, s, 0, "", "\x05", "\x01")
+
+	for _, tc := range []struct {
+		protocol tcpip.TransportProtocolNumber
+		mark     uint32
+		nic      tcpip.NICID
+	}{
+		{6, 0, 1},
+		{17, 0, 1},
+		// The "empty" table has no route, so lookups fall through to
+		// the next rule.
+		{6, 1, 1},
+		{17, 1, 2},
+		{17, 3, 2},
+		{17, 2, 1},
+	} {
+		r, err := s.FindPolicyRoute(0, "", "\x05", fakeNetNumber, tc.protocol, tc.mark)
+		if err != nil {
+			t.Fatalf("FindPolicyRoute(protocol=%d, mark=%d) failed: %v", tc.protocol, tc.mark, err)
+		}
+		if got := r.NICID(); got != tc.nic {
+			t.Errorf("FindPolicyRoute(protocol=%d, mark=%d) went through NIC %d, want %d", tc.protocol, tc.mark, got, tc.nic)
+		}
+		r.Release()
+	}
+
+	// Tables other than the main one are reported after it.
+	want := []tcpip.Route{
+		{Destination: "\x00", Mask: "\x00", NIC: 1},
+		{Destination: "\x80", Mask: "\x80", NIC: 2, Table: "empty"},
+		{Destination: "\x00", Mask: "\x00", NIC: 2, Table: "nic2"},
+	}
+	got := s.GetRouteTable()
+	if len(got) != len(want) {
+		t.Fatalf("GetRouteTable() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("GetRouteTable()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if err := s.RemoveRoute(tcpip.Route{Destination: "\x00", Mask: "\x00", NIC: 2, Table: "nic2"}); err != nil {
+		t.Fatalf("RemoveRoute failed: %v", err)
+	}
+	if err := s.RemoveRoute(tcpip.Route{Destination: "\x00", Mask: "\x00", NIC: 2, Table: "missing"}); err != tcpip.ErrNoRoute {
+		t.Fatalf("RemoveRoute from a missing table = %v, want %v", err, tcpip.ErrNoRoute)
+	}
+
+	// With the "nic2" table empty, the catch-all rule picks the main
+	// table, whose NIC doesn't have NIC 2's address.
+	testNoRoute(t, s, 0, "\x02", "\x05")
+	testRoute(t, s, 0, "", "\x05", "\x01")
+}
+
+func TestSourceAddressSelection(t *testing.T) {
+	const (
+		v6LinkLocal  = "\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+		v6Global1    = "\x20\x01\x0d\xb8\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+		v6Global2    = "\x20\x01\x0d\xb8\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+		v6LinkPeer   = "\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"
+		v6Global2Dst = "\x20\x01\x0d\xb8\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05"
+		v6Any        = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+		v4LinkLocal = "\xa9\xfe\x01\x01"
+		v4Addr1     = "\x0a\x00\x00\x01"
+		v4Addr2     = "\x0a\x00\x00\x02"
+		v4Addr3     = "\x0a\x00\x00\x03"
+		v4LinkPeer  = "\xa9\xfe\x02\x02"
+		v4Remote    = "\x08\x08\x08\x08"
+		v4Any       = "\x00\x00\x00\x00"
+	)
+
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	// The fake protocol doesn't tell addresses of different lengths apart,
+	// so IPv6 addresses are added to NIC 1 and IPv4 ones to NIC 2.
+	id1, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	id2, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	for _, a := range []struct {
+		nic  tcpip.NICID
+		addr tcpip.Address
+		opts tcpip.AddressOptions
+	}{
+		{1, v6LinkLocal, tcpip.AddressOptions{}},
+		{1, v6Global1, tcpip.AddressOptions{}},
+		{1, v6Global2, tcpip.AddressOptions{}},
+		{2, v4LinkLocal, tcpip.AddressOptions{}},
+		{2, v4Addr1, tcpip.AddressOptions{}},
+		{2, v4Addr2, tcpip.AddressOptions{Priority: tcpip.SecondaryAddress}},
+		{2, v4Addr3, tcpip.AddressOptions{Priority: tcpip.FirstPrimaryAddress}},
+	} {
+		if err := s.AddAddressWithOptions(a.nic, fakeNetNumber, a.addr, a.opts); err != nil {
+			t.Fatalf("AddAddressWithOptions(%v) failed: %v", a.addr, err)
+		}
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: v6Any, Mask: v6Any, NIC: 1},
+		{Destination: v4Any, Mask: v4Any, NIC: 2},
+	})
+
+	// Rule 1: the destination itself is preferred.
+	testRoute(t, s, 0, "", v6Global1, v6Global1)
+
+	// Rule 2: link-local destinations use link-local sources, and global
+	// ones use global sources.
+	testRoute(t, s, 0, "", v6LinkPeer, v6LinkLocal)
+	testRoute(t, s, 0, "", v4LinkPeer, v4LinkLocal)
+
+	// Rule 8: the source sharing the longest prefix with the destination
+	// is preferred.
+	testRoute(t, s, 0, "", v6Global2Dst, v6Global2)
+
+	// Ties are broken by list order, so the address added as first primary
+	// wins, and secondary addresses are never picked.
+	testRoute(t, s, 0, "", v4Remote, v4Addr3)
+	testRoute(t, s, 0, v4Addr2, v4Remote, v4Addr2)
+
+	// Rule 3: deprecated addresses are avoided, which takes precedence over
+	// rule 8.
+	if err := s.SetAddressDeprecated(1, v6Global2, true); err != nil {
+		t.Fatalf("SetAddressDeprecated failed: %v", err)
+	}
+	testRoute(t, s, 0, "", v6Global2Dst, v6Global1)
+
+	if err := s.SetAddressDeprecated(2, v4Addr3, true); err != nil {
+		t.Fatalf("SetAddressDeprecated failed: %v", err)
+	}
+	testRoute(t, s, 0, "", v4Remote, v4Addr1)
+
+	// Deprecated addresses are still used when there is no alternative.
+	if err := s.SetAddressDeprecated(2, v4Addr1, true); err != nil {
+		t.Fatalf("SetAddressDeprecated failed: %v", err)
+	}
+	testRoute(t, s, 0, "", v4Remote, v4Addr3)
+
+	if err := s.SetAddressDeprecated(2, v4Remote, true); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("SetAddressDeprecated of unknown address = %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+}
+
+func TestSourceAddressSelectionSubnets(t *testing.T) {
+	const (
+		v4Addr1   = "\xc0\xa8\x01\x01"
+		v4Addr2   = "\x0a\x01\x00\x01"
+		v4Addr3   = "\x0a\x02\x01\x01"
+		v4Addr4   = "\x0a\x02\x02\x01"
+		v4Remote1 = "\x0a\x01\x02\x03"
+		v4Remote2 = "\x0a\x02\x01\xc8"
+		v4Any     = "\x00\x00\x00\x00"
+	)
+
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	for _, a := range []struct {
+		addr   tcpip.Address
+		subnet tcpip.Address
+		mask   tcpip.AddressMask
+	}{
+		{v4Addr1, "\xc0\xa8\x01\x00", "\xff\xff\xff\x00"},
+		{v4Addr2, "\x0a\x01\x00\x00", "\xff\xff\x00\x00"},
+		{v4Addr3, "\x0a\x00\x00\x00", "\xff\x00\x00\x00"},
+		{v4Addr4, "\x0a\x02\x02\x00", "\xff\xff\xff\x00"},
+	} {
+		if err := s.AddAddress(1, fakeNetNumber, a.addr); err != nil {
+			t.Fatalf("AddAddress(%v) failed: %v", a.addr, err)
+		}
+		subnet, err := tcpip.NewSubnet(a.subnet, a.mask)
+		if err != nil {
+			t.Fatalf("NewSubnet failed: %v", err)
+		}
+		if err := s.AddSubnet(1, fakeNetNumber, subnet); err != nil {
+			t.Fatalf("AddSubnet failed: %v", err)
+		}
+	}
+
+	s.SetRouteTable([]tcpip.Route{{Destination: v4Any, Mask: v4Any, NIC: 1}})
+
+	// The address on the subnet of the destination is preferred over the
+	// first one added.
+	testRoute(t, s, 0, "", v4Remote1, v4Addr2)
+
+	// Only the on-link prefix of the addresses is compared: the address
+	// of the /8 subnet shares more bits with the destination than the
+	// one of the /24 subnet, but only its first 8 count.
+	testRoute(t, s, 0, "", v4Remote2, v4Addr4)
+}
+
 func TestAddressRemoval(t *testing.T) {
 	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
 
@@ -435,7 +808,7 @@ func TestDelayedRemovalDueToRoute(t *testing.T) {
 	}
 
 	s.SetRouteTable([]tcpip.Route{
-		{"\x00", "\x00", "\x00", 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
 	})
 
 	var views [1]buffer.View
@@ -497,7 +870,7 @@ func TestPromiscuousMode(t *testing.T) {
 	}
 
 	s.SetRouteTable([]tcpip.Route{
-		{"\x00", "\x00", "\x00", 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
 	})
 
 	var views [1]buffer.View
@@ -553,7 +926,7 @@ func TestSubnetAcceptsMatchingPacket(t *testing.T) {
 	}
 
 	s.SetRouteTable([]tcpip.Route{
-		{"\x00", "\x00", "\x00", 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
 	})
 
 	var views [1]buffer.View
@@ -585,7 +958,7 @@ func TestSubnetRejectsNonmatchingPacket(t *testing.T) {
 	}
 
 	s.SetRouteTable([]tcpip.Route{
-		{"\x00", "\x00", "\x00", 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
 	})
 
 	var views [1]buffer.View
@@ -27,12 +27,22 @@ type transportEndpoints struct {
 // (i.e., after they've been parsed by the network layer). It does two levels
 // of demultiplexing: first based on the network and transport protocols, then
 // based on endpoints IDs.
+//
+// Raw endpoints are kept apart, as they may be registered for any transport
+// protocol and receive a copy of every packet of their protocols.
 type transportDemuxer struct {
 	protocol map[protocolIDs]*transportEndpoints
+
+	// rawMu protects rawEndpoints.
+	rawMu        sync.RWMutex
+	rawEndpoints map[protocolIDs][]RawTransportEndpoint
 }
 
 func newTransportDemuxer(stack *Stack) *transportDemuxer {
-	d := &transportDemuxer{protocol: make(map[protocolIDs]*transportEndpoints)}
+	d := &transportDemuxer{
+		protocol:     make(map[protocolIDs]*transportEndpoints),
+		rawEndpoints: make(map[protocolIDs][]RawTransportEndpoint),
+	}
 
 	// Add each network and and transport pair to the demuxer.
 	for netProto := range stack.networkProtocols {
@@ -136,3 +146,101 @@ func (d *transportDemuxer) deliverPacketLocked(r *Route, eps *transportEndpoints
 
 	return false
 }
+
+// deliverMulticastPacket delivers a packet sent to a multicast group to every
+// endpoint that matches it, rather than only to the most specific one.
+func (d *transportDemuxer) deliverMulticastPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView, id TransportEndpointID) {
+	eps, ok := d.protocol[protocolIDs{r.NetProto, protocol}]
+	if !ok {
+		return
+	}
+
+	ids := [...]TransportEndpointID{
+		id,
+		{LocalPort: id.LocalPort, RemotePort: id.RemotePort, RemoteAddress: id.RemoteAddress},
+		{LocalPort: id.LocalPort, LocalAddress: id.LocalAddress},
+		{LocalPort: id.LocalPort},
+	}
+
+	eps.mu.RLock()
+	for _, nid := range ids {
+		ep := eps.endpoints[nid]
+		if ep == nil {
+			continue
+		}
+
+		// Each endpoint consumes the view it is given, so it gets its
+		// own copy of the vectorised view.
+		var views [8]buffer.View
+		c := vv.Clone(views[:])
+		ep.HandlePacket(r, id, &c)
+	}
+	eps.mu.RUnlock()
+}
+
+// registerRawEndpoint registers the given raw endpoint with the dispatcher such
+// that it receives a copy of every packet of the given protocols.
+func (d *transportDemuxer) registerRawEndpoint(netProto tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, ep RawTransportEndpoint) error {
+	ids := protocolIDs{netProto, protocol}
+
+	d.rawMu.Lock()
+	defer d.rawMu.Unlock()
+
+	for _, e := range d.rawEndpoints[ids] {
+		if e == ep {
+			return tcpip.ErrDuplicateAddress
+		}
+	}
+	d.rawEndpoints[ids] = append(d.rawEndpoints[ids], ep)
+
+	return nil
+}
+
+// unregisterRawEndpoint unregisters the given raw endpoint such that it won't
+// receive any more packets.
+func (d *transportDemuxer) unregisterRawEndpoint(netProto tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, ep RawTransportEndpoint) {
+	ids := protocolIDs{netProto, protocol}
+
+	d.rawMu.Lock()
+	defer d.rawMu.Unlock()
+
+	eps := d.rawEndpoints[ids]
+	for i, e := range eps {
+		if e != ep {
+			continue
+		}
+
+		// Copy the remaining endpoints, as the old slice may still be
+		// in use by a delivery.
+		n := make([]RawTransportEndpoint, 0, len(eps)-1)
+		n = append(n, eps[:i]...)
+		n = append(n, eps[i+1:]...)
+		if len(n) == 0 {
+			delete(d.rawEndpoints, ids)
+		} else {
+			d.rawEndpoints[ids] = n
+		}
+		return
+	}
+}
+
+// rawEndpointsFor returns the raw endpoints registered for the given
+// protocols.
+func (d *transportDemuxer) rawEndpointsFor(netProto tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber) []RawTransportEndpoint {
+	d.rawMu.RLock()
+	eps := d.rawEndpoints[protocolIDs{netProto, protocol}]
+	d.rawMu.RUnlock()
+	return eps
+}
+
+// deliverRawPacket delivers a copy of the given packet to every raw endpoint
+// in eps.
+func deliverRawPacket(eps []RawTransportEndpoint, r *Route, vv *buffer.VectorisedView) {
+	for _, ep := range eps {
+		// Each endpoint consumes the view it is given, so it gets its
+		// own copy of the vectorised view.
+		var views [8]buffer.View
+		c := vv.Clone(views[:])
+		ep.HandlePacket(r, &c)
+	}
+}
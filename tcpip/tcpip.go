@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/waiter"
@@ -55,6 +56,17 @@ var (
 	ErrNotConnected          = errors.New("endpoint not connected")
 	ErrConnectionReset       = errors.New("connection reset by peer")
 	ErrConnectionAborted     = errors.New("connection aborted")
+	ErrDuplicateRoute        = errors.New("duplicate route")
+	ErrInvalidRoute          = errors.New("invalid route")
+	ErrBadAddress            = errors.New("bad address")
+	ErrInvalidOptionValue    = errors.New("invalid option value")
+	ErrBroadcastDisabled     = errors.New("broadcast socket option disabled")
+	ErrNotPermitted          = errors.New("operation not permitted")
+	ErrInvalidFilterRule     = errors.New("invalid filter rule")
+	ErrInvalidNATRule        = errors.New("invalid NAT rule")
+	ErrUnknownProtocolOption = errors.New("unknown option for protocol")
+	ErrMalformedHeader       = errors.New("header is malformed")
+	ErrMessageTooLong        = errors.New("message too long")
 )
 
 // Errors related to Subnet
@@ -70,6 +82,37 @@ type Address string
 // AddressMask is a bitmask for an address.
 type AddressMask string
 
+// AddressPriority determines whether and how an address of a NIC is selected
+// as the source address of outgoing traffic.
+type AddressPriority int
+
+const (
+	// PrimaryAddress addresses are candidates for source address
+	// selection. When several candidates are equally preferred for a
+	// destination, the one added first is used.
+	PrimaryAddress AddressPriority = iota
+
+	// FirstPrimaryAddress addresses are like PrimaryAddress ones, but are
+	// placed ahead of the primary addresses that already exist.
+	FirstPrimaryAddress
+
+	// SecondaryAddress addresses are never selected as source addresses;
+	// they are only used by traffic explicitly bound to them.
+	SecondaryAddress
+)
+
+// AddressOptions holds the options of an address added to a NIC.
+type AddressOptions struct {
+	// Priority determines how the address takes part in source address
+	// selection.
+	Priority AddressPriority
+
+	// Deprecated addresses remain fully usable, but other addresses are
+	// preferred as the source address of new outgoing traffic (RFC 4862,
+	// section 5.5.4).
+	Deprecated bool
+}
+
 // Subnet is a subnet defined by its address and mask.
 type Subnet struct {
 	address Address
@@ -269,8 +312,15 @@ type V6OnlyOption int
 // Nagle algorithm is on or off.
 type NoDelayOption int
 
+// CorkOption is used by SetSockOpt/GetSockOpt to specify whether TCP holds
+// back partial segments until the option is cleared, or at most 200ms, so
+// that the data of successive writes is sent in full-sized segments.
+type CorkOption int
+
 // ReuseAddressOption is used by SetSockOpt/GetSockOpt to specify whether Bind()
-// should allow reuse of local address.
+// should allow reuse of local address. On TCP endpoints, it also allows a new
+// connection request from the peer to end the TIME_WAIT of a connection early,
+// so that the new connection can reuse its address and ports.
 type ReuseAddressOption int
 
 // PasscredOption is used by SetSockOpt/GetSockOpt to specify whether
@@ -279,9 +329,247 @@ type ReuseAddressOption int
 // Only supported on Unix sockets.
 type PasscredOption int
 
+// MarkOption is used by SetSockOpt/GetSockOpt to specify the mark of an
+// endpoint. The mark is taken into account by route rules when looking up
+// routes for the endpoint's traffic.
+type MarkOption uint32
+
+// BroadcastOption is used by SetSockOpt/GetSockOpt to specify whether an
+// endpoint may send packets to broadcast addresses.
+type BroadcastOption int
+
+// MembershipOption identifies a multicast group membership of an endpoint. The
+// NIC the group is joined on is given by NIC, or else by the NIC that owns
+// InterfaceAddr; if neither is set, the route table is used to pick one.
+type MembershipOption struct {
+	NIC           NICID
+	InterfaceAddr Address
+	MulticastAddr Address
+}
+
+// AddMembershipOption is used by SetSockOpt to join a multicast group.
+type AddMembershipOption MembershipOption
+
+// RemoveMembershipOption is used by SetSockOpt to leave a multicast group.
+type RemoveMembershipOption MembershipOption
+
+// TTLOption is used by SetSockOpt/GetSockOpt to specify the TTL (or hop limit)
+// of unicast packets sent by an endpoint. -1 selects the default of the stack.
+type TTLOption int
+
+// TOSOption is used by SetSockOpt/GetSockOpt to specify the type of service of
+// IPv4 packets sent by an endpoint. -1 selects the default of the stack.
+type TOSOption int
+
+// TrafficClassOption is used by SetSockOpt/GetSockOpt to specify the traffic
+// class of IPv6 packets sent by an endpoint. -1 selects the default of the
+// stack.
+type TrafficClassOption int
+
+// ECNOption is used by SetSockOpt/GetSockOpt to specify whether a TCP endpoint
+// negotiates Explicit Congestion Notification (RFC 3168) on the connections it
+// establishes. It can also be set per stack via
+// Stack.SetTransportProtocolOption, as the initial value of new endpoints.
+type ECNOption int
+
+// SACKOption is used by Stack.SetTransportProtocolOption/TransportProtocolOption
+// to specify whether TCP negotiates selective acknowledgements (RFC 2018) on
+// the connections of a stack. It is disabled by default.
+type SACKOption int
+
+// TimestampOption is used by
+// Stack.SetTransportProtocolOption/TransportProtocolOption to specify whether
+// TCP negotiates the timestamps option (RFC 7323) on the connections of a
+// stack, to measure round-trip times and protect against wrapped sequence
+// numbers. It is enabled by default.
+type TimestampOption int
+
+// CongestionControlOption is used by SetSockOpt/GetSockOpt to specify the
+// congestion control algorithm, by name, of the connections a TCP endpoint
+// establishes. It can also be set per stack via
+// Stack.SetTransportProtocolOption, as the initial value of new endpoints.
+type CongestionControlOption string
+
+// QuickAckOption is used by SetSockOpt/GetSockOpt to specify whether a TCP
+// endpoint acknowledges the data it receives immediately, rather than delaying
+// acknowledgements as allowed by RFC 1122, section 4.2.3.2.
+type QuickAckOption int
+
+// KeepaliveEnabledOption is used by SetSockOpt/GetSockOpt to specify whether
+// TCP keepalive probes are sent on an idle connection, to detect that the peer
+// is gone.
+type KeepaliveEnabledOption int
+
+// KeepaliveIdleOption is used by SetSockOpt/GetSockOpt to specify how long a
+// TCP connection must be idle before keepalive probes are sent.
+type KeepaliveIdleOption time.Duration
+
+// KeepaliveIntervalOption is used by SetSockOpt/GetSockOpt to specify the
+// interval between TCP keepalive probes.
+type KeepaliveIntervalOption time.Duration
+
+// KeepaliveCountOption is used by SetSockOpt/GetSockOpt to specify the number
+// of unanswered TCP keepalive probes after which the connection is reset.
+type KeepaliveCountOption int
+
+// DelayedAckTimeoutOption is used by
+// Stack.SetTransportProtocolOption/TransportProtocolOption to specify how long
+// TCP may delay the acknowledgement of the data it receives on the connections
+// of a stack. It defaults to 40ms, and can't exceed 500ms.
+type DelayedAckTimeoutOption time.Duration
+
+// SendBufferSizeRangeOption is used by
+// Stack.SetTransportProtocolOption/TransportProtocolOption to specify the
+// minimum, default and maximum sizes of the send buffers of TCP endpoints, like
+// Linux's tcp_wmem. Sizes set with SendBufferSizeOption outside the range are
+// rejected with ErrInvalidOptionValue.
+type SendBufferSizeRangeOption struct {
+	Min     int
+	Default int
+	Max     int
+}
+
+// ReceiveBufferSizeRangeOption is used by
+// Stack.SetTransportProtocolOption/TransportProtocolOption to specify the
+// minimum, default and maximum sizes of the receive buffers of TCP endpoints,
+// like Linux's tcp_rmem. Sizes set with ReceiveBufferSizeOption outside the range
+// are rejected with ErrInvalidOptionValue, and auto-tuned receive buffers grow
+// up to the maximum.
+type ReceiveBufferSizeRangeOption struct {
+	Min     int
+	Default int
+	Max     int
+}
+
+// ModerateReceiveBufferOption is used by
+// Stack.SetTransportProtocolOption/TransportProtocolOption to specify whether
+// the receive buffers of TCP endpoints are auto-tuned, like Linux's
+// tcp_moderate_rcvbuf. Auto-tuned buffers grow with the rate at which the
+// application reads, unless their size is set with ReceiveBufferSizeOption. It
+// is disabled by default.
+type ModerateReceiveBufferOption int
+
+// LingerOption is used by SetSockOpt/GetSockOpt to specify how a TCP endpoint
+// is closed. If Enabled is set with a zero Timeout, Close resets the
+// connection instead of closing it gracefully. With a non-zero Timeout, the
+// connection is reset if the peer hasn't acknowledged all the data and the FIN
+// within Timeout of the endpoint being closed. Unlike SO_LINGER, Close never
+// blocks: the connection is closed, or reset, in the background.
+type LingerOption struct {
+	Enabled bool
+	Timeout time.Duration
+}
+
+// FastOpenOption is used by SetSockOpt/GetSockOpt to specify whether a
+// listening TCP endpoint accepts TCP Fast Open connections, per RFC 7413. When
+// set, it hands out cookies to the clients that request them, and connections
+// opened with a valid cookie are accepted right away, with the data of their
+// SYN segment readable.
+type FastOpenOption int
+
+// FastOpenConnectOption is used by SetSockOpt/GetSockOpt to specify whether a
+// TCP endpoint connects with TCP Fast Open, like Linux's TCP_FASTOPEN_CONNECT.
+// If the stack has a cookie for the peer, Connect completes right away and the
+// data of the first Write is sent in the SYN segment; otherwise, the SYN
+// requests a cookie for the following connections. Data the peer doesn't
+// acknowledge in its SYN-ACK is sent again once the connection is established.
+type FastOpenConnectOption int
+
+// TCPInfoOption is used by GetSockOpt to get the state of the connection of a
+// TCP endpoint, like Linux's TCP_INFO. The fields other than State are only set
+// once the connection is established.
+type TCPInfoOption struct {
+	// State is the state of the connection, named as in RFC 793 (e.g.,
+	// "ESTABLISHED" or "TIME_WAIT"), or "LISTEN" for a listening endpoint.
+	State string
+
+	// RTT and RTTVar are the smoothed round-trip time and its variation,
+	// and RTO is the retransmission timeout.
+	RTT    time.Duration
+	RTTVar time.Duration
+	RTO    time.Duration
+
+	// CongestionWindow and SlowStartThreshold are the congestion window
+	// and slow start threshold, in segments.
+	CongestionWindow   int
+	SlowStartThreshold int
+
+	// SendWindow is the window announced by the peer, and ReceiveWindow
+	// the one announced to it, in bytes. SendWindowScale and
+	// ReceiveWindowScale are their window scales.
+	SendWindow         int
+	ReceiveWindow      int
+	SendWindowScale    int
+	ReceiveWindowScale int
+
+	// MSS is the maximum size of the payload of the segments sent.
+	MSS int
+
+	// BytesSent and SegmentsSent count the data and segments sent,
+	// including the retransmissions counted by BytesRetransmitted and
+	// SegmentsRetransmitted. BytesReceived counts the data received in
+	// order, and SegmentsReceived the segments received.
+	BytesSent             uint64
+	BytesReceived         uint64
+	BytesRetransmitted    uint64
+	SegmentsSent          uint64
+	SegmentsReceived      uint64
+	SegmentsRetransmitted uint64
+
+	// FastRecovery indicates whether the sender is in fast recovery.
+	FastRecovery bool
+
+	// LastAckAge is the time since the last acknowledgement was received,
+	// or zero if none was.
+	LastAckAge time.Duration
+}
+
+// MaxSegmentLifetimeOption is used by
+// Stack.SetTransportProtocolOption/TransportProtocolOption to specify the
+// maximum segment lifetime (MSL) assumed by TCP. Connections that are closed
+// actively remain in TIME_WAIT for twice its value. It defaults to 30s.
+type MaxSegmentLifetimeOption time.Duration
+
+// FinWait2TimeoutOption is used by
+// Stack.SetTransportProtocolOption/TransportProtocolOption to specify how long
+// a closed TCP endpoint waits in FIN_WAIT_2 for the FIN of its peer before
+// resetting the connection. It defaults to 60s.
+type FinWait2TimeoutOption time.Duration
+
+// HeaderIncludedOption is used by SetSockOpt/GetSockOpt to specify whether
+// payloads written to a raw endpoint start with their network-layer header,
+// like IP_HDRINCL.
+type HeaderIncludedOption int
+
+// ReceiveHeaderOption is used by SetSockOpt/GetSockOpt to specify whether
+// payloads read from a raw endpoint start with the network-layer header of
+// their packet. It is set by default on IPv4 endpoints only.
+type ReceiveHeaderOption int
+
+// MulticastTTLOption is used by SetSockOpt/GetSockOpt to specify the TTL of
+// multicast packets sent by an endpoint.
+type MulticastTTLOption int
+
+// MulticastLoopOption is used by SetSockOpt/GetSockOpt to specify whether
+// multicast packets sent by an endpoint are also delivered locally when the
+// sending NIC is a member of the destination group.
+type MulticastLoopOption int
+
+// MulticastInterfaceOption is used by SetSockOpt/GetSockOpt to specify the NIC
+// and local address multicast packets are sent from, when the endpoint isn't
+// bound to them.
+type MulticastInterfaceOption struct {
+	NIC           NICID
+	InterfaceAddr Address
+}
+
 // Route is a row in the routing table. It specifies through which NIC (and
 // gateway) sets of packets should be routed. A row is considered viable if the
 // masked target address matches the destination adddress in the row.
+//
+// When several rows are viable for a destination, the one with the longest
+// mask (i.e., the most specific one) is preferred; among rows with equally
+// long masks, the one with the lowest metric is preferred.
 type Route struct {
 	// Destination is the address that must be matched against the masked
 	// target address to check if this row is viable.
@@ -296,6 +584,19 @@ type Route struct {
 
 	// NIC is the id of the nic to be used if this row is viable.
 	NIC NICID
+
+	// Table is the name of the route table this row belongs to. Rows
+	// with an empty name belong to the main table, which is the only
+	// table consulted unless route rules say otherwise.
+	Table string
+
+	// Metric is the cost of this row; lower metrics are preferred.
+	Metric uint32
+
+	// MTU is the maximum size of packets (including their network-layer
+	// header) sent through this row. If zero, or larger than the MTU of
+	// the NIC, the MTU of the NIC is used.
+	MTU uint32
 }
 
 // Match determines if r is viable for the given destination address.
@@ -313,6 +614,364 @@ func (r *Route) Match(addr Address) bool {
 	return true
 }
 
+// RouteRule is a rule of the routing policy. Rules are evaluated in order
+// when looking up a route: the route table named by the first matching rule
+// is consulted, and if it has no viable row for the destination, evaluation
+// continues with the next rule.
+//
+// Each criterion of a rule is ignored when it holds its zero value.
+type RouteRule struct {
+	// Source and SourceMask restrict the rule to traffic whose masked
+	// source address matches Source.
+	Source     Address
+	SourceMask Address
+
+	// InputNIC restricts the rule to packets received on the given NIC
+	// that are being forwarded.
+	InputNIC NICID
+
+	// Protocol restricts the rule to traffic of the given transport
+	// protocol.
+	Protocol TransportProtocolNumber
+
+	// Mark and MarkMask restrict the rule to traffic of endpoints whose
+	// mark, masked with MarkMask, equals Mark. A zero MarkMask matches
+	// all marks if Mark is zero too, and compares whole marks otherwise.
+	Mark     uint32
+	MarkMask uint32
+
+	// Table is the name of the route table to consult if the rule
+	// matches. The empty name refers to the main table.
+	Table string
+}
+
+// Match determines if r applies to traffic with the given source address,
+// input NIC, transport protocol and mark.
+func (r *RouteRule) Match(src Address, inputNIC NICID, protocol TransportProtocolNumber, mark uint32) bool {
+	if len(r.Source) != 0 {
+		if len(src) != len(r.Source) || len(r.SourceMask) != len(r.Source) {
+			return false
+		}
+		for i := 0; i < len(r.Source); i++ {
+			if src[i]&r.SourceMask[i] != r.Source[i] {
+				return false
+			}
+		}
+	}
+
+	if r.InputNIC != 0 && r.InputNIC != inputNIC {
+		return false
+	}
+
+	if r.Protocol != 0 && r.Protocol != protocol {
+		return false
+	}
+
+	mask := r.MarkMask
+	if mask == 0 {
+		if r.Mark == 0 {
+			return true
+		}
+		mask = 0xffffffff
+	}
+	return mark&mask == r.Mark
+}
+
+// FilterHook identifies a point of the path of packets through the stack at
+// which filter rules are evaluated.
+type FilterHook int
+
+// Filter hooks, in the order packets traverse them.
+const (
+	// FilterPrerouting sees every packet received by a NIC, before it is
+	// tracked, and delivered locally or forwarded.
+	FilterPrerouting FilterHook = iota
+
+	// FilterInput sees packets addressed to the stack, before their
+	// network protocol handles them.
+	FilterInput
+
+	// FilterForward sees packets forwarded from one NIC to another.
+	FilterForward
+
+	// FilterOutput sees packets sent by local endpoints.
+	FilterOutput
+
+	// FilterPostrouting sees every packet about to be sent by a NIC,
+	// whether it was sent locally or forwarded.
+	FilterPostrouting
+
+	// NumFilterHooks is the number of filter hooks.
+	NumFilterHooks
+)
+
+// FilterVerdict is the action taken on a packet that matches a filter rule.
+type FilterVerdict int
+
+// Filter verdicts.
+const (
+	// FilterAccept lets the packet through the hook.
+	FilterAccept FilterVerdict = iota
+
+	// FilterDrop silently discards the packet.
+	FilterDrop
+
+	// FilterReject discards the packet and notifies its source with an
+	// ICMP Destination Unreachable (administratively prohibited) message.
+	// Locally sent packets are failed with ErrConnectionRefused instead.
+	FilterReject
+
+	// FilterRejectWithReset is like FilterReject, but TCP segments
+	// delivered to local endpoints are answered with a TCP reset.
+	FilterRejectWithReset
+
+	// FilterLog logs the packet and continues with the next rule.
+	FilterLog
+)
+
+// ConnState is a set of connection tracking states.
+type ConnState uint8
+
+// Connection tracking states.
+const (
+	// ConnStateNew is the state of packets that start a new connection.
+	ConnStateNew ConnState = 1 << iota
+
+	// ConnStateEstablished is the state of packets of a connection that
+	// has seen traffic in both directions.
+	ConnStateEstablished
+
+	// ConnStateRelated is the state of packets that start a connection
+	// related to an existing one, such as ICMP errors.
+	ConnStateRelated
+
+	// ConnStateInvalid is the state of packets that don't belong to any
+	// known connection and can't start one.
+	ConnStateInvalid
+)
+
+// PortRange is an inclusive range of transport-layer ports. The zero value
+// matches any port.
+type PortRange struct {
+	Start uint16
+	End   uint16
+}
+
+// Contains determines if port is in the range.
+func (r PortRange) Contains(port uint16) bool {
+	return r == PortRange{} || r.Start <= port && port <= r.End
+}
+
+// FilterRule is a packet filter rule. Rules of a hook are evaluated in order,
+// and the verdict of the first matching rule, other than FilterLog, decides
+// what happens to the packet. Packets that match no rule are accepted.
+//
+// Each criterion of a rule is ignored when it holds its zero value.
+type FilterRule struct {
+	// InputNIC restricts the rule to packets received on the given NIC.
+	// It never matches at the output hook.
+	InputNIC NICID
+
+	// OutputNIC restricts the rule to packets sent by the given NIC. It
+	// never matches at the prerouting and input hooks.
+	OutputNIC NICID
+
+	// Source and SourceMask restrict the rule to packets whose masked
+	// source address matches Source.
+	Source     Address
+	SourceMask Address
+
+	// Destination and DestinationMask restrict the rule to packets whose
+	// masked destination address matches Destination.
+	Destination     Address
+	DestinationMask Address
+
+	// Protocol restricts the rule to packets of the given transport
+	// protocol.
+	Protocol TransportProtocolNumber
+
+	// SourcePorts and DestinationPorts restrict the rule to TCP and UDP
+	// packets with ports in the given ranges. They never match fragments
+	// other than the first one.
+	SourcePorts      PortRange
+	DestinationPorts PortRange
+
+	// TCPFlags and TCPFlagsMask restrict the rule to TCP segments whose
+	// flags, masked with TCPFlagsMask, equal TCPFlags.
+	TCPFlags     uint8
+	TCPFlagsMask uint8
+
+	// ConnStates restricts the rule to packets in one of the given
+	// connection tracking states. It can't be used at the prerouting
+	// hook, which sees packets before they are tracked.
+	ConnStates ConnState
+
+	// Verdict is the action taken on matching packets.
+	Verdict FilterVerdict
+
+	// LogPrefix is prepended to the messages logged by FilterLog rules.
+	LogPrefix string
+}
+
+// FilterCounters holds the number of packets that matched a filter rule, and
+// the total size of their network-layer payloads in bytes.
+type FilterCounters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// DNATRule is a destination NAT rule. New TCP, UDP and ICMP echo connections
+// received by the stack that match the rule are redirected to another node:
+// their destination is translated to ToAddress, and the source of the replies
+// is translated back. Only IPv4 packets that are forwarded are translated.
+//
+// Each criterion of a rule is ignored when it holds its zero value.
+type DNATRule struct {
+	// InputNIC restricts the rule to packets received on the given NIC.
+	InputNIC NICID
+
+	// Protocol restricts the rule to packets of the given transport
+	// protocol. It must be TCP or UDP if DestinationPorts or ToPort are
+	// set.
+	Protocol TransportProtocolNumber
+
+	// Destination restricts the rule to packets sent to the given
+	// address.
+	Destination Address
+
+	// DestinationPorts restricts the rule to packets sent to ports in the
+	// given range.
+	DestinationPorts PortRange
+
+	// ToAddress is the address connections are redirected to.
+	ToAddress Address
+
+	// ToPort, if not zero, is the port connections are redirected to. If
+	// DestinationPorts is set, the range is mapped to as many ports
+	// starting at ToPort; otherwise, destination ports are kept.
+	ToPort uint16
+}
+
+// SNATRule is a source NAT rule. New TCP, UDP and ICMP echo connections
+// forwarded through OutputNIC that match the rule get their source translated
+// to ToAddress, and the destination of the replies is translated back. Source
+// ports and echo identifiers are kept when possible, and are otherwise
+// replaced with ephemeral ones. Only IPv4 packets are translated.
+//
+// Each criterion of a rule is ignored when it holds its zero value.
+type SNATRule struct {
+	// OutputNIC restricts the rule to packets sent through the given NIC.
+	OutputNIC NICID
+
+	// Source and SourceMask restrict the rule to packets whose masked
+	// source address matches Source.
+	Source     Address
+	SourceMask Address
+
+	// ToAddress is the address connections are translated to. If empty,
+	// the address of the NIC packets are sent through is used, which is
+	// known as masquerading.
+	ToAddress Address
+}
+
+// ConnTrackTuple identifies the packets of one direction of a tracked
+// connection. The identifier of ICMP echo requests is stored as their source
+// port, and that of echo replies as their destination port. Ports are zero for
+// other protocols that don't have any.
+type ConnTrackTuple struct {
+	Protocol        TransportProtocolNumber
+	Source          Address
+	SourcePort      uint16
+	Destination     Address
+	DestinationPort uint16
+}
+
+// Reverse returns the tuple of the packets going the other way.
+func (t ConnTrackTuple) Reverse() ConnTrackTuple {
+	return ConnTrackTuple{t.Protocol, t.Destination, t.DestinationPort, t.Source, t.SourcePort}
+}
+
+// ConnTrackEntry describes a connection tracked by a stack.
+type ConnTrackEntry struct {
+	// Original is the tuple of the packets of the node that started the
+	// connection.
+	Original ConnTrackTuple
+
+	// Reply is the tuple of the packets of the other node, which differs
+	// from the reverse of Original when the connection is translated.
+	Reply ConnTrackTuple
+
+	// Established indicates whether packets were seen in both directions.
+	Established bool
+
+	// OriginalCounters and ReplyCounters hold the number of packets seen
+	// in each direction, and the total size of their network-layer
+	// payloads in bytes.
+	OriginalCounters FilterCounters
+	ReplyCounters    FilterCounters
+
+	// Expires is the time at which the connection is forgotten, unless
+	// more packets are seen.
+	Expires time.Time
+}
+
+// ConnTrackEventType is the type of a connection tracking event.
+type ConnTrackEventType int
+
+// Connection tracking event types.
+const (
+	// ConnTrackNew is sent when a connection starts being tracked.
+	ConnTrackNew ConnTrackEventType = iota
+
+	// ConnTrackEstablished is sent when the first reply of a connection is
+	// seen.
+	ConnTrackEstablished
+
+	// ConnTrackDestroyed is sent when a connection stops being tracked,
+	// because it expired, was dropped to make room for another one, or
+	// was flushed.
+	ConnTrackDestroyed
+)
+
+// ConnTrackEvent is a change of the connections tracked by a stack.
+type ConnTrackEvent struct {
+	Type  ConnTrackEventType
+	Entry ConnTrackEntry
+}
+
+// ConnTrackOptions configures the connection tracking of a stack. Fields left
+// to their zero value select a default.
+type ConnTrackOptions struct {
+	// Enabled enables the tracking of all connections, for example for
+	// flow accounting. Connections are tracked regardless while NAT rules,
+	// or filter rules that match on connection states, are set.
+	Enabled bool
+
+	// MaxConnections is the maximum number of tracked connections. When
+	// the table is full, a connection that hasn't seen replies is dropped
+	// to make room for a new one; if none is found, the packet starting
+	// the new connection is dropped.
+	MaxConnections int
+
+	// TCPConnectingTimeout, TCPEstablishedTimeout and TCPClosedTimeout are
+	// how long TCP connections are tracked without traffic while being
+	// established, once established, and once closed or reset.
+	TCPConnectingTimeout  time.Duration
+	TCPEstablishedTimeout time.Duration
+	TCPClosedTimeout      time.Duration
+
+	// UDPTimeout is how long UDP flows are tracked without traffic.
+	UDPTimeout time.Duration
+
+	// ICMPTimeout is how long ICMP echo identifiers are tracked without
+	// traffic.
+	ICMPTimeout time.Duration
+
+	// GenericTimeout is how long flows of other transport protocols are
+	// tracked without traffic.
+	GenericTimeout time.Duration
+}
+
 // LinkEndpointID represents a data link layer endpoint.
 type LinkEndpointID uint64
 
@@ -333,12 +992,43 @@ type Stack interface {
 	// specifies which NICs to use for given destination address ranges.
 	SetRouteTable(table []Route)
 
+	// AddRoute adds a route to the route table of the stack.
+	AddRoute(route Route) error
+
+	// RemoveRoute removes a route from the route table of the stack.
+	RemoveRoute(route Route) error
+
+	// GetRouteTable returns a snapshot of the route table of the stack.
+	GetRouteTable() []Route
+
+	// SetRouteRules assigns the route rules to be used by this stack. They
+	// specify which route tables to consult for given traffic.
+	SetRouteRules(rules []RouteRule)
+
+	// SetFilterRules atomically replaces the filter rules of the given
+	// hook.
+	SetFilterRules(hook FilterHook, rules []FilterRule) error
+
+	// SetTransportProtocolOption sets an option of the given transport
+	// protocol. option should be one of the *Option types the protocol
+	// supports.
+	SetTransportProtocolOption(transport TransportProtocolNumber, option interface{}) error
+
+	// TransportProtocolOption gets an option of the given transport
+	// protocol. option should be a pointer to one of the *Option types the
+	// protocol supports.
+	TransportProtocolOption(transport TransportProtocolNumber, option interface{}) error
+
 	// CreateNIC creates a NIC with the provided id and link-layer sender.
 	CreateNIC(id NICID, linkEndpoint LinkEndpointID) error
 
 	// AddAddress adds a new network-layer address to the specified NIC.
 	AddAddress(id NICID, protocol NetworkProtocolNumber, addr Address) error
 
+	// AddAddressWithOptions is like AddAddress, but allows the caller to
+	// control how the address is used for source address selection.
+	AddAddressWithOptions(id NICID, protocol NetworkProtocolNumber, addr Address, opts AddressOptions) error
+
 	// Stats returns a snapshot of the current stats.
 	// TODO: Make stats available in sentry for debugging/diag.
 	Stats() Stats
@@ -368,6 +1058,28 @@ type Stats struct {
 
 	// DroppedPackets is the number of packets dropped due to full queues.
 	DroppedPackets uint64
+
+	// ForwardedPackets is the number of packets received by the stack that
+	// were addressed to another node and were forwarded to it.
+	ForwardedPackets uint64
+
+	// ForwardDroppedPackets is the number of packets that were to be
+	// forwarded but were dropped instead, for example because their TTL
+	// expired or because they didn't fit in the egress link MTU.
+	ForwardDroppedPackets uint64
+
+	// UnroutablePackets is the number of packets that were to be forwarded
+	// but for which no route could be found.
+	UnroutablePackets uint64
+
+	// FilteredPackets is the number of packets dropped or rejected by
+	// filter rules.
+	FilteredPackets uint64
+
+	// ConnTrackDroppedPackets is the number of packets dropped because
+	// they started a new connection while the connection tracking table
+	// was full.
+	ConnTrackDroppedPackets uint64
 }
 
 // String implements the fmt.Stringer interface.
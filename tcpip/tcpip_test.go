@@ -128,3 +128,26 @@ func TestRouteMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestRouteRuleMatchMark(t *testing.T) {
+	tests := []struct {
+		mark     uint32
+		markMask uint32
+		a        uint32
+		want     bool
+	}{
+		{0, 0, 0, true},
+		{0, 0, 5, true},
+		{5, 0, 5, true},
+		{5, 0, 7, false},
+		{5, 0, 0, false},
+		{1, 1, 3, true},
+		{1, 1, 2, false},
+	}
+	for _, tt := range tests {
+		r := RouteRule{Mark: tt.mark, MarkMask: tt.markMask}
+		if got := r.Match("", 0, 0, tt.a); got != tt.want {
+			t.Errorf("RouteRule(%+v).Match(mark=%d) = %v, want %v", r, tt.a, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datagram
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// membership is a multicast group joined by an endpoint.
+type membership struct {
+	nicID    tcpip.NICID
+	netProto tcpip.NetworkProtocolNumber
+	group    tcpip.Address
+}
+
+// Options holds the socket options that datagram endpoints of IP protocols
+// share, such as their mark and their IP and multicast options, along with the
+// multicast groups they joined. It must be protected by the mutex of the
+// endpoint.
+type Options struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the options.
+	stack     *stack.Stack
+	netProto  tcpip.NetworkProtocolNumber
+	dualStack bool
+
+	// mark is the mark set via MarkOption, used by route rules to select
+	// routes for the endpoint's traffic.
+	mark uint32
+
+	// broadcast indicates whether the endpoint may send to broadcast
+	// addresses, as set via BroadcastOption.
+	broadcast bool
+
+	// ipOpts holds the IP options of the endpoint.
+	ipOpts stack.IPOptions
+
+	// The following fields hold the multicast options of the endpoint.
+	multicastTTL         uint8
+	multicastLoop        bool
+	multicastNICID       tcpip.NICID
+	multicastAddr        tcpip.Address
+	multicastMemberships []membership
+}
+
+// NewOptions creates the options of an endpoint of the given network protocol.
+// dualStack indicates whether IPv6 endpoints also send and receive IPv4
+// traffic, through IPv4-mapped addresses.
+func NewOptions(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, dualStack bool) *Options {
+	return &Options{
+		stack:         s,
+		netProto:      netProto,
+		dualStack:     dualStack,
+		multicastTTL:  1,
+		multicastLoop: true,
+	}
+}
+
+// Mark returns the mark of the endpoint, to be passed to
+// Stack.FindPolicyRoute.
+func (o *Options) Mark() uint32 {
+	return o.mark
+}
+
+// SetOption sets a socket option shared by datagram endpoints. Options it
+// doesn't know are ignored. Apply must be called again for the routes of the
+// endpoint to reflect the change.
+func (o *Options) SetOption(opt interface{}) error {
+	switch v := opt.(type) {
+	case tcpip.MarkOption:
+		o.mark = uint32(v)
+
+	case tcpip.BroadcastOption:
+		o.broadcast = v != 0
+
+	case tcpip.TTLOption, tcpip.TOSOption, tcpip.TrafficClassOption:
+		return o.ipOpts.SetOption(o.netProto, opt)
+
+	case tcpip.AddMembershipOption:
+		m, err := o.membership(tcpip.MembershipOption(v))
+		if err != nil {
+			return err
+		}
+
+		for _, j := range o.multicastMemberships {
+			if j == m {
+				return tcpip.ErrDuplicateAddress
+			}
+		}
+
+		if err := o.stack.JoinGroup(m.netProto, m.nicID, m.group); err != nil {
+			return err
+		}
+		o.multicastMemberships = append(o.multicastMemberships, m)
+
+	case tcpip.RemoveMembershipOption:
+		m, err := o.membership(tcpip.MembershipOption(v))
+		if err != nil {
+			return err
+		}
+
+		for i, j := range o.multicastMemberships {
+			if j == m {
+				o.multicastMemberships = append(o.multicastMemberships[:i], o.multicastMemberships[i+1:]...)
+				return o.stack.LeaveGroup(m.netProto, m.nicID, m.group)
+			}
+		}
+		return tcpip.ErrBadLocalAddress
+
+	case tcpip.MulticastTTLOption:
+		// A TTL of zero isn't supported, as routes take it to mean the
+		// default TTL of the stack.
+		if v < 1 || v > 255 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		o.multicastTTL = uint8(v)
+
+	case tcpip.MulticastLoopOption:
+		o.multicastLoop = v != 0
+
+	case tcpip.MulticastInterfaceOption:
+		if v.InterfaceAddr != "" {
+			nicid := o.stack.CheckLocalAddress(v.NIC, v.InterfaceAddr)
+			if nicid == 0 {
+				return tcpip.ErrBadLocalAddress
+			}
+			v.NIC = nicid
+		}
+
+		o.multicastNICID = v.NIC
+		o.multicastAddr = v.InterfaceAddr
+	}
+	return nil
+}
+
+// GetOption gets a socket option shared by datagram endpoints. It fails with
+// ErrInvalidEndpointState for options it doesn't know.
+func (o *Options) GetOption(opt interface{}) error {
+	switch v := opt.(type) {
+	case *tcpip.MarkOption:
+		*v = tcpip.MarkOption(o.mark)
+
+	case *tcpip.BroadcastOption:
+		*v = 0
+		if o.broadcast {
+			*v = 1
+		}
+
+	case *tcpip.TTLOption, *tcpip.TOSOption, *tcpip.TrafficClassOption:
+		return o.ipOpts.GetOption(o.netProto, opt)
+
+	case *tcpip.MulticastTTLOption:
+		*v = tcpip.MulticastTTLOption(o.multicastTTL)
+
+	case *tcpip.MulticastLoopOption:
+		*v = 0
+		if o.multicastLoop {
+			*v = 1
+		}
+
+	case *tcpip.MulticastInterfaceOption:
+		*v = tcpip.MulticastInterfaceOption{
+			NIC:           o.multicastNICID,
+			InterfaceAddr: o.multicastAddr,
+		}
+
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
+	return nil
+}
+
+// IsMulticastAddress determines if addr is a multicast group address.
+func IsMulticastAddress(addr tcpip.Address) bool {
+	return header.IsV4MulticastAddress(addr) || header.IsV6MulticastAddress(addr)
+}
+
+// membership validates a membership option and returns the membership it
+// refers to.
+func (o *Options) membership(m tcpip.MembershipOption) (membership, error) {
+	group := m.MulticastAddr
+	if o.dualStack && header.IsV4MappedAddress(group) {
+		group = group[header.IPv6AddressSize-header.IPv4AddressSize:]
+	}
+
+	if !IsMulticastAddress(group) {
+		return membership{}, tcpip.ErrInvalidOptionValue
+	}
+	netProto := header.IPv4ProtocolNumber
+	if len(group) == header.IPv6AddressSize {
+		netProto = header.IPv6ProtocolNumber
+	}
+	if netProto != o.netProto && !(o.dualStack && o.netProto == header.IPv6ProtocolNumber) {
+		// Endpoints only receive traffic of their own network
+		// protocol, and dual-stack IPv6 endpoints IPv4 traffic too.
+		return membership{}, tcpip.ErrInvalidOptionValue
+	}
+
+	nicid := m.NIC
+	switch {
+	case m.InterfaceAddr != "":
+		nicid = o.stack.CheckLocalAddress(m.NIC, m.InterfaceAddr)
+		if nicid == 0 {
+			return membership{}, tcpip.ErrBadLocalAddress
+		}
+
+	case nicid == 0:
+		// Use the NIC traffic to the group would be sent through.
+		r, err := o.stack.FindRoute(0, "", group, netProto)
+		if err != nil {
+			return membership{}, err
+		}
+		nicid = r.NICID()
+		r.Release()
+	}
+
+	return membership{nicID: nicid, netProto: netProto, group: group}, nil
+}
+
+// LeaveGroups leaves the multicast groups joined by the endpoint, when it is
+// closed.
+func (o *Options) LeaveGroups() {
+	for _, m := range o.multicastMemberships {
+		o.stack.LeaveGroup(m.netProto, m.nicID, m.group)
+	}
+	o.multicastMemberships = nil
+}
+
+// RouteSource returns the NIC and local address to use when looking up a route
+// to dst for an endpoint bound to bindAddr, given the NIC the caller is
+// restricted to, if any.
+func (o *Options) RouteSource(nicid tcpip.NICID, bindAddr, dst tcpip.Address) (tcpip.NICID, tcpip.Address) {
+	localAddr := bindAddr
+	if IsMulticastAddress(localAddr) || localAddr == header.IPv4Broadcast {
+		// Endpoints bound to a multicast group or to the broadcast
+		// address send from one of the addresses of the NIC.
+		localAddr = ""
+	}
+
+	if IsMulticastAddress(dst) {
+		if nicid == 0 {
+			nicid = o.multicastNICID
+		}
+		if localAddr == "" && len(o.multicastAddr) == len(dst) {
+			localAddr = o.multicastAddr
+		}
+	}
+
+	return nicid, localAddr
+}
+
+// Apply applies the IP options of the endpoint to r, and its multicast options
+// if r goes to a multicast group.
+func (o *Options) Apply(r *stack.Route) {
+	o.ipOpts.Apply(r)
+
+	if !IsMulticastAddress(r.RemoteAddress) {
+		return
+	}
+
+	r.TTL = o.multicastTTL
+	r.MulticastLoop = o.multicastLoop
+}
+
+// CheckRoute fails with ErrBroadcastDisabled if r goes to a broadcast address,
+// unless the endpoint may send to broadcast addresses.
+func (o *Options) CheckRoute(r *stack.Route) error {
+	if r.IsBroadcast() && !o.broadcast {
+		return tcpip.ErrBroadcastDisabled
+	}
+	return nil
+}
@@ -3,7 +3,7 @@
 // license that can be found in the LICENSE file.
 
 // Package ilist provides the implementation of intrusive linked lists.
-package udp
+package datagram
 
 // List is an intrusive list. Entries can be added to or removed from the list
 // in O(1) time and with no additional memory allocations.
@@ -14,34 +14,34 @@ package udp
 //      for e := l.Front(); e != nil; e = e.Next() {
 // 		// do something with e.
 //      }
-type udpPacketList struct {
-	head *udpPacket
-	tail *udpPacket
+type packetList struct {
+	head *Packet
+	tail *Packet
 }
 
 // Reset resets list l to the empty state.
-func (l *udpPacketList) Reset() {
+func (l *packetList) Reset() {
 	l.head = nil
 	l.tail = nil
 }
 
 // Empty returns true iff the list is empty.
-func (l *udpPacketList) Empty() bool {
+func (l *packetList) Empty() bool {
 	return l.head == nil
 }
 
 // Front returns the first element of list l or nil.
-func (l *udpPacketList) Front() *udpPacket {
+func (l *packetList) Front() *Packet {
 	return l.head
 }
 
 // Back returns the last element of list l or nil.
-func (l *udpPacketList) Back() *udpPacket {
+func (l *packetList) Back() *Packet {
 	return l.tail
 }
 
 // PushFront inserts the element e at the front of list l.
-func (l *udpPacketList) PushFront(e *udpPacket) {
+func (l *packetList) PushFront(e *Packet) {
 	e.SetNext(l.head)
 	e.SetPrev(nil)
 
@@ -55,7 +55,7 @@ func (l *udpPacketList) PushFront(e *udpPacket) {
 }
 
 // PushBack inserts the element e at the back of list l.
-func (l *udpPacketList) PushBack(e *udpPacket) {
+func (l *packetList) PushBack(e *Packet) {
 	e.SetNext(nil)
 	e.SetPrev(l.tail)
 
@@ -69,7 +69,7 @@ func (l *udpPacketList) PushBack(e *udpPacket) {
 }
 
 // PushBackList inserts list m at the end of list l, emptying m.
-func (l *udpPacketList) PushBackList(m *udpPacketList) {
+func (l *packetList) PushBackList(m *packetList) {
 	if l.head == nil {
 		l.head = m.head
 		l.tail = m.tail
@@ -85,7 +85,7 @@ func (l *udpPacketList) PushBackList(m *udpPacketList) {
 }
 
 // InsertAfter inserts e after b.
-func (l *udpPacketList) InsertAfter(b, e *udpPacket) {
+func (l *packetList) InsertAfter(b, e *Packet) {
 	a := b.Next()
 	e.SetNext(a)
 	e.SetPrev(b)
@@ -99,7 +99,7 @@ func (l *udpPacketList) InsertAfter(b, e *udpPacket) {
 }
 
 // InsertBefore inserts e before a.
-func (l *udpPacketList) InsertBefore(a, e *udpPacket) {
+func (l *packetList) InsertBefore(a, e *Packet) {
 	b := a.Prev()
 	e.SetNext(a)
 	e.SetPrev(b)
@@ -113,7 +113,7 @@ func (l *udpPacketList) InsertBefore(a, e *udpPacket) {
 }
 
 // Remove removes e from l.
-func (l *udpPacketList) Remove(e *udpPacket) {
+func (l *packetList) Remove(e *Packet) {
 	prev := e.Prev()
 	next := e.Next()
 
@@ -133,27 +133,27 @@ func (l *udpPacketList) Remove(e *udpPacket) {
 // Entry is a default implementation of Linker. Users can add anonymous fields
 // of this type to their structs to make them automatically implement the
 // methods needed by List.
-type udpPacketEntry struct {
-	next *udpPacket
-	prev *udpPacket
+type packetEntry struct {
+	next *Packet
+	prev *Packet
 }
 
 // Next returns the entry that follows e in the list.
-func (e *udpPacketEntry) Next() *udpPacket {
+func (e *packetEntry) Next() *Packet {
 	return e.next
 }
 
 // Prev returns the entry that precedes e in the list.
-func (e *udpPacketEntry) Prev() *udpPacket {
+func (e *packetEntry) Prev() *Packet {
 	return e.prev
 }
 
 // SetNext assigns 'entry' as the entry that follows e in the list.
-func (e *udpPacketEntry) SetNext(entry *udpPacket) {
+func (e *packetEntry) SetNext(entry *Packet) {
 	e.next = entry
 }
 
 // SetPrev assigns 'entry' as the entry that precedes e in the list.
-func (e *udpPacketEntry) SetPrev(entry *udpPacket) {
+func (e *packetEntry) SetPrev(entry *Packet) {
 	e.prev = entry
 }
@@ -0,0 +1,173 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package datagram provides the receive queue and the socket options shared by
+// the endpoints that send and receive whole packets: UDP, ICMP echo, raw IP and
+// packet endpoints.
+package datagram
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/waiter"
+)
+
+// SendBufferSize is the send buffer size reported by datagram endpoints. Their
+// writes aren't buffered, so it doesn't limit them.
+const SendBufferSize = 32 * 1024
+
+// ReceiveBufferSize is the size of the receive queues of datagram endpoints.
+const ReceiveBufferSize = 32 * 1024
+
+// Packet is a packet held by a receive queue.
+type Packet struct {
+	packetEntry
+
+	// SenderAddress is the address of the node that sent the packet.
+	SenderAddress tcpip.FullAddress
+
+	// data holds the contents of the packet, and owned indicates whether
+	// its single view belongs to the packet. Otherwise its views may be
+	// shared with other endpoints, so they are copied when read.
+	data  buffer.VectorisedView
+	owned bool
+
+	// views is used as buffer for data when its length is large enough to
+	// store its views.
+	views [8]buffer.View
+}
+
+// SetData makes p hold a clone of vv, which shares its views rather than
+// copying them, so that queueing the packet doesn't allocate its contents.
+func (p *Packet) SetData(vv *buffer.VectorisedView) {
+	p.data = vv.Clone(p.views[:])
+	p.owned = false
+}
+
+// SetView makes p hold v, which must not be shared, as it's handed out as is to
+// the reader of the packet.
+func (p *Packet) SetView(v buffer.View) {
+	p.views[0] = v
+	p.data = buffer.NewVectorisedView(len(v), p.views[:1])
+	p.owned = true
+}
+
+// ReceiveQueue holds the packets received by a datagram endpoint until they are
+// read. It is safe for concurrent use.
+type ReceiveQueue struct {
+	waiterQueue *waiter.Queue
+
+	mu     sync.Mutex
+	ready  bool
+	list   packetList
+	size   int
+	limit  int
+	closed bool
+}
+
+// NewReceiveQueue creates a receive queue that holds up to limit bytes, and
+// notifies waiterQueue when it becomes readable. It drops the packets it gets
+// until SetReady is called.
+func NewReceiveQueue(waiterQueue *waiter.Queue, limit int) *ReceiveQueue {
+	return &ReceiveQueue{waiterQueue: waiterQueue, limit: limit}
+}
+
+// SetReady makes q accept packets, typically once its endpoint is bound.
+func (q *ReceiveQueue) SetReady() {
+	q.mu.Lock()
+	q.ready = true
+	q.mu.Unlock()
+}
+
+// Enqueue adds p to the queue, unless it is closed, not ready yet or full.
+func (q *ReceiveQueue) Enqueue(p *Packet) {
+	q.mu.Lock()
+
+	// Drop the packet if our buffer is currently full.
+	if !q.ready || q.closed || q.size >= q.limit {
+		q.mu.Unlock()
+		return
+	}
+
+	wasEmpty := q.list.Empty()
+	q.list.PushBack(p)
+	q.size += p.data.Size()
+
+	q.mu.Unlock()
+
+	// Notify any waiters that there's data to be read now.
+	if wasEmpty {
+		q.waiterQueue.Notify(waiter.EventIn)
+	}
+}
+
+// Read removes the first packet from the queue, and returns its contents and
+// the address of its sender. It doesn't block if the queue is empty.
+func (q *ReceiveQueue) Read(addr *tcpip.FullAddress) (buffer.View, error) {
+	q.mu.Lock()
+
+	if q.list.Empty() {
+		err := tcpip.ErrWouldBlock
+		if q.closed {
+			err = tcpip.ErrClosedForReceive
+		}
+		q.mu.Unlock()
+		return buffer.View{}, err
+	}
+
+	p := q.list.Front()
+	q.list.Remove(p)
+	q.size -= p.data.Size()
+
+	q.mu.Unlock()
+
+	if addr != nil {
+		*addr = p.SenderAddress
+	}
+
+	if p.owned {
+		return p.data.First(), nil
+	}
+	return p.data.ToView(), nil
+}
+
+// IsReadable determines if the queue holds packets or is closed.
+func (q *ReceiveQueue) IsReadable() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.closed || !q.list.Empty()
+}
+
+// Limit returns the number of bytes the queue can hold.
+func (q *ReceiveQueue) Limit() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.limit
+}
+
+// Shutdown stops the queue from accepting packets. The packets it holds can
+// still be read.
+func (q *ReceiveQueue) Shutdown() {
+	q.mu.Lock()
+	wasClosed := q.closed
+	q.closed = true
+	q.mu.Unlock()
+
+	if !wasClosed {
+		q.waiterQueue.Notify(waiter.EventIn)
+	}
+}
+
+// Close stops the queue from accepting packets, and drops the packets it holds.
+func (q *ReceiveQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.size = 0
+	q.list.Reset()
+	q.mu.Unlock()
+}
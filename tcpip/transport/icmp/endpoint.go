@@ -0,0 +1,517 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icmp
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/datagram"
+	"github.com/google/netstack/waiter"
+)
+
+// echoHeaderSize is the size of the header of echo requests and replies, which
+// is the same for ICMPv4 and ICMPv6: type, code, checksum, identifier and
+// sequence number.
+const echoHeaderSize = 8
+
+type endpointState int
+
+const (
+	stateInitial endpointState = iota
+	stateBound
+	stateConnected
+	stateClosed
+)
+
+var errRetryPrepare = errors.New("prepare operation must be retried")
+
+// endpoint represents an icmp endpoint. This struct serves as the interface
+// between users of the endpoint and the protocol implementation; it is legal to
+// have concurrent goroutines make calls into the endpoint, they are properly
+// synchronized.
+type endpoint struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the endpoint.
+	stack       *stack.Stack
+	netProto    tcpip.NetworkProtocolNumber
+	transProto  tcpip.TransportProtocolNumber
+	waiterQueue *waiter.Queue
+	rcv         *datagram.ReceiveQueue
+
+	// The following fields are protected by the mu mutex. The local port
+	// of id is the identifier of the endpoint.
+	mu        sync.RWMutex
+	id        stack.TransportEndpointID
+	state     endpointState
+	bindNICID tcpip.NICID
+	bindAddr  tcpip.Address
+	regNICID  tcpip.NICID
+	route     stack.Route
+	opts      *datagram.Options
+}
+
+func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
+	return &endpoint{
+		stack:       stack,
+		netProto:    netProto,
+		transProto:  transProto,
+		waiterQueue: waiterQueue,
+		rcv:         datagram.NewReceiveQueue(waiterQueue, datagram.ReceiveBufferSize),
+		opts:        datagram.NewOptions(stack, netProto, false),
+	}
+}
+
+// Close puts the endpoint in a closed state and frees all resources
+// associated with it.
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch e.state {
+	case stateBound, stateConnected:
+		e.stack.UnregisterTransportEndpoint(e.regNICID, []tcpip.NetworkProtocolNumber{e.netProto}, e.transProto, e.id)
+	}
+
+	e.opts.LeaveGroups()
+	e.rcv.Close()
+
+	e.route.Release()
+
+	// Update the state.
+	e.state = stateClosed
+}
+
+// Read reads an echo reply from the endpoint, including its ICMP header. This
+// method does not block if there is no reply pending.
+func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, error) {
+	return e.rcv.Read(addr)
+}
+
+// prepareForWrite prepares the endpoint for sending data. In particular, it
+// binds it if it's still in the initial state, which picks its identifier. To
+// do so, it must first reacquire the mutex in exclusive mode.
+//
+// Returns errRetryPrepare if preparation should be retried.
+func (e *endpoint) prepareForWrite(to *tcpip.FullAddress) error {
+	switch e.state {
+	case stateInitial:
+	case stateConnected:
+		return nil
+
+	case stateBound:
+		if to == nil {
+			return tcpip.ErrDestinationRequired
+		}
+		return nil
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	e.mu.RUnlock()
+	defer e.mu.RLock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// The state changed when we released the shared locked and re-acquired
+	// it in exclusive mode. Try again.
+	if e.state != stateInitial {
+		return errRetryPrepare
+	}
+
+	// The state is still 'initial', so try to bind the endpoint.
+	if err := e.bindLocked(tcpip.FullAddress{}, nil); err != nil {
+		return err
+	}
+
+	return errRetryPrepare
+}
+
+// Write sends an echo request to the endpoint's peer, or to the address given
+// by to, whose port is ignored. v holds the request, starting with its ICMP
+// header, whose identifier and checksum are filled in by the endpoint. This
+// method does not block if the request cannot be written.
+func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error) {
+	if !e.isEchoRequest(v) {
+		return 0, tcpip.ErrMalformedHeader
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	// Prepare for write.
+	for {
+		err := e.prepareForWrite(to)
+		if err == nil {
+			break
+		}
+
+		if err != errRetryPrepare {
+			return 0, err
+		}
+	}
+
+	route := &e.route
+	if to != nil {
+		// Reject destination address if it goes through a different
+		// NIC than the endpoint was bound to.
+		nicid := to.NIC
+		if e.bindNICID != 0 {
+			if nicid != 0 && nicid != e.bindNICID {
+				return 0, tcpip.ErrNoRoute
+			}
+
+			nicid = e.bindNICID
+		}
+
+		// Find the enpoint.
+		nicid, localAddr := e.opts.RouteSource(nicid, e.bindAddr, to.Addr)
+		r, err := e.stack.FindPolicyRoute(nicid, localAddr, to.Addr, e.netProto, e.transProto, e.opts.Mark())
+		if err != nil {
+			return 0, err
+		}
+		defer r.Release()
+		e.opts.Apply(&r)
+
+		route = &r
+	}
+
+	if err := e.opts.CheckRoute(route); err != nil {
+		return 0, err
+	}
+
+	if err := e.sendEcho(route, v, e.id.LocalPort); err != nil {
+		return 0, err
+	}
+	return uintptr(len(v)), nil
+}
+
+// isEchoRequest determines if v holds an echo request of the network protocol
+// of the endpoint.
+func (e *endpoint) isEchoRequest(v buffer.View) bool {
+	if len(v) < echoHeaderSize {
+		return false
+	}
+	if e.netProto == header.IPv4ProtocolNumber {
+		h := header.ICMPv4(v)
+		return h.Type() == header.ICMPv4Echo && h.Code() == 0
+	}
+	h := header.ICMPv6(v)
+	return h.Type() == header.ICMPv6EchoRequest && h.Code() == 0
+}
+
+// sendEcho sends the echo request held by v via the provided route, with the
+// given identifier.
+func (e *endpoint) sendEcho(r *stack.Route, v buffer.View, ident uint16) error {
+	// Allocate a buffer for the ICMP header, into which the one of the
+	// request is copied, so that v isn't modified.
+	hdr := buffer.NewPrependable(echoHeaderSize + int(r.MaxHeaderLength()))
+	h := hdr.Prepend(echoHeaderSize)
+	copy(h, v)
+	data := v[echoHeaderSize:]
+
+	if e.netProto == header.IPv4ProtocolNumber {
+		icmpv4 := header.ICMPv4(h)
+		icmpv4.SetIdent(ident)
+		icmpv4.SetChecksum(0)
+		icmpv4.SetChecksum(^header.Checksum(icmpv4, header.Checksum(data, 0)))
+	} else {
+		icmpv6 := header.ICMPv6(h)
+		icmpv6.SetIdent(ident)
+		icmpv6.SetChecksum(0)
+		icmpv6.SetChecksum(header.ICMPv6Checksum(icmpv6, r.LocalAddress, r.RemoteAddress, data))
+	}
+
+	return r.WritePacket(&hdr, data, e.transProto)
+}
+
+// Peek only returns data from a single echo reply, so do nothing here.
+func (e *endpoint) Peek(io.Writer) (uintptr, error) {
+	return 0, nil
+}
+
+// SetSockOpt sets a socket option.
+func (e *endpoint) SetSockOpt(opt interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.opts.SetOption(opt)
+	e.opts.Apply(&e.route)
+	return err
+}
+
+// GetSockOpt implements tcpip.Endpoint.GetSockOpt.
+func (e *endpoint) GetSockOpt(opt interface{}) error {
+	switch o := opt.(type) {
+	case tcpip.ErrorOption:
+		return nil
+
+	case *tcpip.SendBufferSizeOption:
+		*o = datagram.SendBufferSize
+		return nil
+
+	case *tcpip.ReceiveBufferSizeOption:
+		*o = tcpip.ReceiveBufferSizeOption(e.rcv.Limit())
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.opts.GetOption(opt)
+}
+
+// Connect connects the endpoint to its peer, such that it only receives the
+// replies it sends. The port is ignored. Specifying a NIC is optional.
+func (e *endpoint) Connect(addr tcpip.FullAddress) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	nicid := addr.NIC
+	ident := uint16(0)
+	switch e.state {
+	case stateInitial:
+	case stateBound, stateConnected:
+		ident = e.id.LocalPort
+		if e.bindNICID == 0 {
+			break
+		}
+
+		if nicid != 0 && nicid != e.bindNICID {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+		nicid = e.bindNICID
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	// Find a route to the desired destination.
+	nicid, localAddr := e.opts.RouteSource(nicid, e.bindAddr, addr.Addr)
+	r, err := e.stack.FindPolicyRoute(nicid, localAddr, addr.Addr, e.netProto, e.transProto, e.opts.Mark())
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+
+	if err := e.opts.CheckRoute(&r); err != nil {
+		return err
+	}
+
+	id := stack.TransportEndpointID{
+		LocalAddress:  r.LocalAddress,
+		LocalPort:     ident,
+		RemoteAddress: addr.Addr,
+	}
+	id, err = e.registerWithStack(nicid, id)
+	if err != nil {
+		return err
+	}
+
+	// Remove the old registration.
+	if e.id.LocalPort != 0 {
+		e.stack.UnregisterTransportEndpoint(e.regNICID, []tcpip.NetworkProtocolNumber{e.netProto}, e.transProto, e.id)
+	}
+
+	e.id = id
+	e.route = r.Clone()
+	e.opts.Apply(&e.route)
+	e.regNICID = nicid
+
+	e.state = stateConnected
+
+	e.rcv.SetReady()
+
+	return nil
+}
+
+// ConnectEndpoint is not supported.
+func (*endpoint) ConnectEndpoint(tcpip.Endpoint) error {
+	return tcpip.ErrInvalidEndpointState
+}
+
+// Shutdown closes the read and/or write end of the endpoint connection
+// to its peer.
+func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return tcpip.ErrNotConnected
+	}
+
+	if flags&tcpip.ShutdownRead != 0 {
+		e.rcv.Shutdown()
+	}
+
+	return nil
+}
+
+// Listen is not supported by icmp, it just fails.
+func (*endpoint) Listen(int) error {
+	return tcpip.ErrNotSupported
+}
+
+// Accept is not supported by icmp, it just fails.
+func (*endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, error) {
+	return nil, nil, tcpip.ErrNotSupported
+}
+
+// registerWithStack registers the endpoint with the given id, picking its
+// identifier first if it doesn't have one yet.
+func (e *endpoint) registerWithStack(nicid tcpip.NICID, id stack.TransportEndpointID) (stack.TransportEndpointID, error) {
+	netProtos := []tcpip.NetworkProtocolNumber{e.netProto}
+	if id.LocalPort != 0 {
+		// The endpoint already has an identifier, just attempt to
+		// register it.
+		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, e.transProto, id, e)
+		return id, err
+	}
+
+	// We need to find an identifier for the endpoint.
+	_, err := e.stack.PickEphemeralPort(func(p uint16) (bool, error) {
+		id.LocalPort = p
+		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, e.transProto, id, e)
+		switch err {
+		case nil:
+			return true, nil
+		case tcpip.ErrDuplicateAddress:
+			return false, nil
+		default:
+			return false, err
+		}
+	})
+
+	return id, err
+}
+
+func (e *endpoint) bindLocked(addr tcpip.FullAddress, commit func() error) error {
+	// Don't allow binding once endpoint is not in the initial state
+	// anymore.
+	if e.state != stateInitial {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	if len(addr.Addr) != 0 {
+		// A local address was specified, verify that it's valid.
+		if e.stack.CheckLocalAddress(addr.NIC, addr.Addr) == 0 {
+			return tcpip.ErrBadLocalAddress
+		}
+	}
+
+	id := stack.TransportEndpointID{
+		LocalPort:    addr.Port,
+		LocalAddress: addr.Addr,
+	}
+	id, err := e.registerWithStack(addr.NIC, id)
+	if err != nil {
+		return err
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			// Unregister, the commit failed.
+			e.stack.UnregisterTransportEndpoint(addr.NIC, []tcpip.NetworkProtocolNumber{e.netProto}, e.transProto, id)
+			return err
+		}
+	}
+
+	e.id = id
+	e.regNICID = addr.NIC
+
+	// Mark endpoint as bound.
+	e.state = stateBound
+
+	e.rcv.SetReady()
+
+	return nil
+}
+
+// Bind binds the endpoint to a specific local address and identifier, given
+// as the port. A zero port picks an identifier. Specifying a NIC is optional.
+func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.bindLocked(addr, commit)
+	if err != nil {
+		return err
+	}
+
+	e.bindNICID = addr.NIC
+	e.bindAddr = addr.Addr
+
+	return nil
+}
+
+// GetLocalAddress returns the address to which the endpoint is bound, with its
+// identifier as the port.
+func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return tcpip.FullAddress{
+		NIC:  e.regNICID,
+		Addr: e.id.LocalAddress,
+		Port: e.id.LocalPort,
+	}, nil
+}
+
+// GetRemoteAddress returns the address to which the endpoint is connected.
+func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return tcpip.FullAddress{}, tcpip.ErrInvalidEndpointState
+	}
+
+	return tcpip.FullAddress{
+		NIC:  e.regNICID,
+		Addr: e.id.RemoteAddress,
+	}, nil
+}
+
+// Readiness returns the current readiness of the endpoint. For example, if
+// waiter.EventIn is set, the endpoint is immediately readable.
+func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	// The endpoint is always writable.
+	result := waiter.EventOut & mask
+
+	// Determine if the endpoint is readable if requested.
+	if (mask&waiter.EventIn) != 0 && e.rcv.IsReadable() {
+		result |= waiter.EventIn
+	}
+
+	return result
+}
+
+// HandlePacket is called by the stack when echo replies carrying the identifier
+// of the endpoint arrive.
+func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv *buffer.VectorisedView) {
+	v := vv.ToView()
+
+	// Drop replies with a bad checksum.
+	if e.netProto == header.IPv4ProtocolNumber {
+		if header.Checksum(v, 0) != 0xffff {
+			return
+		}
+	} else if header.ICMPv6Checksum(header.ICMPv6(v), r.RemoteAddress, r.LocalAddress, nil) != 0 {
+		return
+	}
+
+	p := &datagram.Packet{
+		SenderAddress: tcpip.FullAddress{
+			NIC:  r.NICID(),
+			Addr: id.RemoteAddress,
+		},
+	}
+	p.SetView(v)
+	e.rcv.Enqueue(p)
+}
@@ -0,0 +1,376 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icmp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/checker"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/sniffer"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/icmp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	stackAddr   = "\x0a\x00\x00\x01"
+	testAddr    = "\x0a\x00\x00\x02"
+	stackV6Addr = "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+)
+
+type testContext struct {
+	t      *testing.T
+	linkEP *channel.Endpoint
+	s      *stack.Stack
+}
+
+func newTestContext(t *testing.T) *testContext {
+	s := stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{icmp.ProtocolName4, icmp.ProtocolName6})
+
+	const defaultMTU = 65536
+	id, linkEP := channel.New(256, defaultMTU, "")
+	if testing.Verbose() {
+		id = sniffer.New(id)
+	}
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv6.ProtocolNumber, stackV6Addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{
+			Destination: "\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00",
+			NIC:         1,
+		},
+		{
+			Destination: "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+			NIC:         1,
+		},
+	})
+
+	// Discard the MLD report announcing the solicited-node group of the
+	// IPv6 address.
+	linkEP.Drain()
+
+	return &testContext{
+		t:      t,
+		s:      s.(*stack.Stack),
+		linkEP: linkEP,
+	}
+}
+
+func (c *testContext) cleanup() {
+	close(c.linkEP.C)
+}
+
+// loopback injects every packet written by the stack back into it, except for
+// those that drop, if not nil, reports should be dropped.
+func (c *testContext) loopback(drop func(pkt channel.PacketInfo) bool) {
+	go func() {
+		for pkt := range c.linkEP.C {
+			if drop != nil && drop(pkt) {
+				continue
+			}
+			v := make(buffer.View, len(pkt.Header)+len(pkt.Payload))
+			copy(v, pkt.Header)
+			copy(v[len(pkt.Header):], pkt.Payload)
+			vv := v.ToVectorisedView([1]buffer.View{})
+			c.linkEP.Inject(pkt.Proto, &vv)
+		}
+	}()
+}
+
+func (c *testContext) getPacket() []byte {
+	select {
+	case p := <-c.linkEP.C:
+		b := make([]byte, len(p.Header)+len(p.Payload))
+		copy(b, p.Header)
+		copy(b[len(p.Header):], p.Payload)
+		return b
+
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Packet wasn't written out")
+	}
+
+	return nil
+}
+
+func (c *testContext) newEndpoint(transProto tcpip.TransportProtocolNumber, netProto tcpip.NetworkProtocolNumber) tcpip.Endpoint {
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(transProto, netProto, &wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	return ep
+}
+
+// injectEchoReply injects an echo reply from testAddr with the given identifier
+// and sequence number.
+func (c *testContext) injectEchoReply(ident, seq uint16) {
+	v := buffer.NewView(header.IPv4MinimumSize + 8)
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     testAddr,
+		DstAddr:     stackAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	icmpv4 := header.ICMPv4(ip.Payload())
+	icmpv4.SetType(header.ICMPv4EchoReply)
+	icmpv4.SetIdent(ident)
+	icmpv4.SetSequence(seq)
+	icmpv4.SetChecksum(^header.Checksum(icmpv4, 0))
+
+	vv := v.ToVectorisedView([1]buffer.View{})
+	c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+}
+
+func echoRequest(size int) buffer.View {
+	v := buffer.NewView(8 + size)
+	header.ICMPv4(v).SetType(header.ICMPv4Echo)
+	return v
+}
+
+func TestNewEndpointWrongNetworkProtocol(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	var wq waiter.Queue
+	if _, err := c.s.NewEndpoint(icmp.ProtocolNumber4, ipv6.ProtocolNumber, &wq); err != tcpip.ErrUnknownProtocol {
+		t.Fatalf("NewEndpoint got %v, want %v", err, tcpip.ErrUnknownProtocol)
+	}
+}
+
+func TestWriteAndReceive(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	ep := c.newEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber)
+	defer ep.Close()
+
+	const ident = 1234
+	if err := ep.Bind(tcpip.FullAddress{Port: ident}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// Only echo requests can be written.
+	v := buffer.NewView(8)
+	if _, err := ep.Write(v, &tcpip.FullAddress{Addr: testAddr}); err != tcpip.ErrMalformedHeader {
+		t.Fatalf("Write got %v, want %v", err, tcpip.ErrMalformedHeader)
+	}
+
+	v = echoRequest(4)
+	header.ICMPv4(v).SetSequence(7)
+	copy(v[8:], "ping")
+	if _, err := ep.Write(v, &tcpip.FullAddress{Addr: testAddr}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	b := c.getPacket()
+	checker.IPv4(t, b, checker.SrcAddr(stackAddr), checker.DstAddr(testAddr))
+	icmpv4 := header.ICMPv4(header.IPv4(b).Payload())
+	if icmpv4.Type() != header.ICMPv4Echo || icmpv4.Ident() != ident || icmpv4.Sequence() != 7 {
+		t.Fatalf("Got type %v, ident %v, sequence %v, want %v, %v, 7", icmpv4.Type(), icmpv4.Ident(), icmpv4.Sequence(), header.ICMPv4Echo, ident)
+	}
+	if header.Checksum(icmpv4, 0) != 0xffff {
+		t.Fatalf("Bad ICMP checksum")
+	}
+	if string(icmpv4[8:]) != "ping" {
+		t.Fatalf("Got data %q, want %q", icmpv4[8:], "ping")
+	}
+
+	// Only replies carrying the identifier of the endpoint are received.
+	c.injectEchoReply(ident+1, 1)
+	c.injectEchoReply(ident, 2)
+
+	var addr tcpip.FullAddress
+	r, err := ep.Read(&addr)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got := header.ICMPv4(r); got.Type() != header.ICMPv4EchoReply || got.Sequence() != 2 {
+		t.Fatalf("Read got type %v, sequence %v, want %v, 2", got.Type(), got.Sequence(), header.ICMPv4EchoReply)
+	}
+	if want := (tcpip.FullAddress{NIC: 1, Addr: testAddr}); addr != want {
+		t.Fatalf("Read got address %+v, want %+v", addr, want)
+	}
+	if _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read got %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestWriteTTL(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	ep := c.newEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber)
+	defer ep.Close()
+
+	if err := ep.SetSockOpt(tcpip.TTLOption(3)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := ep.Connect(tcpip.FullAddress{Addr: testAddr}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if _, err := ep.Write(echoRequest(0), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	checker.IPv4(t, c.getPacket(), checker.TTL(3))
+}
+
+func TestEcho(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+	c.loopback(nil)
+
+	ch := make(chan icmp.PingReply, 1)
+	p := icmp.Pinger{
+		Stack:    c.s,
+		NICID:    1,
+		Addr:     stackAddr,
+		Interval: 10 * time.Millisecond,
+		Count:    1, // one ping only
+	}
+	if _, err := p.Ping(context.Background(), ch); err != nil {
+		t.Fatalf("icmp.Ping failed: %v", err)
+	}
+
+	ping := <-ch
+	if ping.Error != nil {
+		t.Errorf("bad ping response: %v", ping.Error)
+	}
+	if ping.Size != icmp.DefaultPayloadSize {
+		t.Errorf("Size=%d, want %d", ping.Size, icmp.DefaultPayloadSize)
+	}
+}
+
+func TestEchoSequence(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+	c.loopback(nil)
+
+	const numPings = 3
+	ch := make(chan icmp.PingReply, numPings)
+	p := icmp.Pinger{
+		Stack:    c.s,
+		NICID:    1,
+		Addr:     stackAddr,
+		Interval: 10 * time.Millisecond,
+		Count:    numPings,
+	}
+	stats, err := p.Ping(context.Background(), ch)
+	if err != nil {
+		t.Fatalf("icmp.Ping failed: %v", err)
+	}
+
+	for i := uint16(0); i < numPings; i++ {
+		ping := <-ch
+		if ping.Error != nil {
+			t.Errorf("i=%d bad ping response: %v", i, ping.Error)
+		}
+		if ping.SeqNumber != i {
+			t.Errorf("SeqNumber=%d, want %d", ping.SeqNumber, i)
+		}
+	}
+
+	if stats.Sent != numPings || stats.Received != numPings || stats.Loss() != 0 {
+		t.Errorf("Got %d sent, %d received, loss %v, want %d, %d, 0", stats.Sent, stats.Received, stats.Loss(), numPings, numPings)
+	}
+	if stats.Min <= 0 || stats.Min > stats.Avg || stats.Avg > stats.Max {
+		t.Errorf("Got min/avg/max %v/%v/%v, want 0 < min <= avg <= max", stats.Min, stats.Avg, stats.Max)
+	}
+}
+
+func TestEchoV6(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+	c.loopback(nil)
+
+	ch := make(chan icmp.PingReply, 1)
+	p := icmp.Pinger{
+		Stack:       c.s,
+		NICID:       1,
+		Addr:        stackV6Addr,
+		Interval:    10 * time.Millisecond,
+		Count:       1,
+		PayloadSize: 100,
+	}
+	stats, err := p.Ping(context.Background(), ch)
+	if err != nil {
+		t.Fatalf("icmp.Ping failed: %v", err)
+	}
+
+	ping := <-ch
+	if ping.Error != nil || ping.Size != 100 {
+		t.Errorf("Got ping response %+v, want no error and size 100", ping)
+	}
+	if stats.Received != 1 {
+		t.Errorf("Received=%d, want 1", stats.Received)
+	}
+}
+
+func TestEchoLoss(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	// Drop the second request, and check the TTL of all of them.
+	ttlOK := make(chan bool, 3)
+	c.loopback(func(pkt channel.PacketInfo) bool {
+		ip := header.IPv4(pkt.Header)
+		icmpv4 := header.ICMPv4(pkt.Header[ip.HeaderLength():])
+		if icmpv4.Type() != header.ICMPv4Echo {
+			return false
+		}
+		ttlOK <- ip.TTL() == 5
+		return icmpv4.Sequence() == 1
+	})
+
+	p := icmp.Pinger{
+		Stack:    c.s,
+		NICID:    1,
+		Addr:     stackAddr,
+		Interval: 10 * time.Millisecond,
+		Timeout:  50 * time.Millisecond,
+		Count:    3,
+		TTL:      5,
+	}
+	stats, err := p.Ping(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("icmp.Ping failed: %v", err)
+	}
+
+	if stats.Sent != 3 || stats.Received != 2 {
+		t.Errorf("Got %d sent, %d received, want 3, 2", stats.Sent, stats.Received)
+	}
+	if got, want := stats.Loss(), 1.0/3; got != want {
+		t.Errorf("Loss()=%v, want %v", got, want)
+	}
+	for i := 0; i < 3; i++ {
+		if !<-ttlOK {
+			t.Errorf("Request sent with bad TTL")
+		}
+	}
+}
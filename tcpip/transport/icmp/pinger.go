@@ -0,0 +1,244 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icmp
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+// DefaultPayloadSize is the default size of the data of the echo requests sent
+// by a Pinger.
+const DefaultPayloadSize = 56
+
+// A Pinger can send echo requests to an address, through an icmp endpoint. The
+// icmp protocol of the network protocol of the address must be enabled on the
+// stack.
+type Pinger struct {
+	Stack       *stack.Stack
+	NICID       tcpip.NICID
+	Addr        tcpip.Address // IPv4 or IPv6
+	LocalAddr   tcpip.Address // optional
+	Interval    time.Duration // between requests; if zero, defaults to 1 second
+	Timeout     time.Duration // for replies after the last request; if zero, defaults to Interval
+	Count       uint16        // if zero, defaults to MaxUint16
+	PayloadSize int           // if zero, defaults to DefaultPayloadSize
+	TTL         uint8         // if zero, defaults to the stack default
+}
+
+// PingReply summarizes an ICMP echo reply.
+type PingReply struct {
+	Error     error         // reports any errors sending a ping request
+	Duration  time.Duration // round-trip time of the request
+	SeqNumber uint16
+	Size      int // size of the data of the reply
+}
+
+// PingStats summarizes the replies received by a Pinger. Round-trip times are
+// computed over the received replies; duplicates are ignored.
+type PingStats struct {
+	Sent     int
+	Received int
+	Min      time.Duration
+	Avg      time.Duration
+	Max      time.Duration
+	Mdev     time.Duration // standard deviation of the round-trip times
+}
+
+// Loss returns the fraction of requests which got no reply, between 0 and 1.
+func (s *PingStats) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Received) / float64(s.Sent)
+}
+
+// Ping sends echo requests to p.Addr, every p.Interval, until p.Count requests
+// have been sent and either all of them got a reply or p.Timeout expired, or
+// until ctx is done. Replies are streamed to the channel ch, if not nil, along
+// with any errors sending requests. It returns the statistics of the replies.
+func (p *Pinger) Ping(ctx context.Context, ch chan<- PingReply) (PingStats, error) {
+	var stats PingStats
+
+	count := int(p.Count)
+	if count == 0 {
+		count = 1<<16 - 1
+	}
+	interval := p.Interval
+	if interval == 0 {
+		interval = 1 * time.Second
+	}
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = interval
+	}
+	size := p.PayloadSize
+	if size == 0 {
+		size = DefaultPayloadSize
+	}
+
+	transProto, netProto := ProtocolNumber4, header.IPv4ProtocolNumber
+	if len(p.Addr) == header.IPv6AddressSize {
+		transProto, netProto = ProtocolNumber6, header.IPv6ProtocolNumber
+	}
+
+	var wq waiter.Queue
+	ep, err := p.Stack.NewEndpoint(transProto, netProto, &wq)
+	if err != nil {
+		return stats, err
+	}
+	defer ep.Close()
+
+	if p.TTL != 0 {
+		if err := ep.SetSockOpt(tcpip.TTLOption(p.TTL)); err != nil {
+			return stats, err
+		}
+	}
+	if p.NICID != 0 || p.LocalAddr != "" {
+		if err := ep.Bind(tcpip.FullAddress{NIC: p.NICID, Addr: p.LocalAddr}, nil); err != nil {
+			return stats, err
+		}
+	}
+	if err := ep.Connect(tcpip.FullAddress{NIC: p.NICID, Addr: p.Addr}); err != nil {
+		return stats, err
+	}
+
+	entry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&entry, waiter.EventIn)
+	defer wq.EventUnregister(&entry)
+
+	req := buffer.NewView(echoHeaderSize + size)
+	if netProto == header.IPv4ProtocolNumber {
+		header.ICMPv4(req).SetType(header.ICMPv4Echo)
+	} else {
+		header.ICMPv6(req).SetType(header.ICMPv6EchoRequest)
+	}
+	for i := echoHeaderSize; i < len(req); i++ {
+		req[i] = byte(i)
+	}
+
+	report := func(r PingReply) {
+		if ch == nil {
+			return
+		}
+		select {
+		case ch <- r:
+		case <-ctx.Done():
+		}
+	}
+
+	// sent holds the time each request was sent at, indexed by sequence
+	// number, and received whether it got a reply. Requests which couldn't
+	// be sent count as answered.
+	var sent []time.Time
+	var received []bool
+	answered := 0
+	var sum time.Duration
+	var sumSquares float64
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var timer *time.Timer
+	var timeoutC <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	send := func() {
+		seq := uint16(len(sent))
+		// The sequence number is at the same offset in ICMPv4 and
+		// ICMPv6.
+		header.ICMPv4(req).SetSequence(seq)
+		sent = append(sent, time.Now())
+		received = append(received, false)
+		stats.Sent++
+		if _, err := ep.Write(req, nil); err != nil {
+			answered++
+			report(PingReply{
+				Error:     err,
+				Duration:  time.Since(sent[seq]),
+				SeqNumber: seq,
+			})
+		}
+
+		if len(sent) == count {
+			ticker.Stop()
+			timer = time.NewTimer(timeout)
+			timeoutC = timer.C
+		}
+	}
+
+	send()
+	for len(sent) < count || answered < count {
+		select {
+		case <-ticker.C:
+			send()
+			continue
+		case <-notifyCh:
+		case <-timeoutC:
+			return p.finish(stats, sum, sumSquares), nil
+		case <-ctx.Done():
+			return p.finish(stats, sum, sumSquares), nil
+		}
+
+		for {
+			v, err := ep.Read(nil)
+			if err != nil {
+				break
+			}
+
+			seq := header.ICMPv4(v).Sequence()
+			if int(seq) >= len(sent) || received[seq] {
+				continue
+			}
+			received[seq] = true
+			answered++
+
+			rtt := time.Since(sent[seq])
+			if stats.Received == 0 || rtt < stats.Min {
+				stats.Min = rtt
+			}
+			if rtt > stats.Max {
+				stats.Max = rtt
+			}
+			stats.Received++
+			sum += rtt
+			sumSquares += float64(rtt) * float64(rtt)
+
+			report(PingReply{
+				Duration:  rtt,
+				SeqNumber: seq,
+				Size:      len(v) - echoHeaderSize,
+			})
+		}
+	}
+
+	return p.finish(stats, sum, sumSquares), nil
+}
+
+// finish computes the average and standard deviation of the round-trip times of
+// stats, given their sum and the sum of their squares.
+func (*Pinger) finish(stats PingStats, sum time.Duration, sumSquares float64) PingStats {
+	if stats.Received == 0 {
+		return stats
+	}
+
+	n := float64(stats.Received)
+	avg := float64(sum) / n
+	stats.Avg = time.Duration(avg)
+	if v := sumSquares/n - avg*avg; v > 0 {
+		stats.Mdev = time.Duration(math.Sqrt(v))
+	}
+	return stats
+}
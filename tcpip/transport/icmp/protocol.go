@@ -0,0 +1,84 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package icmp contains the implementation of ICMP echo (ping) endpoints for
+// IPv4 and IPv6. To use it in the networking stack, this package must be added
+// to the project, and activated on the stack by passing icmp.ProtocolName4 (or
+// "icmp4") and/or icmp.ProtocolName6 (or "icmp6") as transport protocols when
+// calling stack.New(). Then endpoints can be created by passing
+// icmp.ProtocolNumber4 or icmp.ProtocolNumber6, along with the matching network
+// protocol number, when calling Stack.NewEndpoint().
+//
+// Endpoints send echo requests and receive the echo replies carrying their
+// identifier, which plays the role of a local port: it can be chosen with Bind
+// and is otherwise picked when the endpoint first sends. Echo requests sent to
+// the stack are answered by the network layer, not by these endpoints.
+package icmp
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// ProtocolName4 is the string representation of the icmp protocol
+	// name for IPv4.
+	ProtocolName4 = "icmp4"
+
+	// ProtocolNumber4 is the icmp protocol number for IPv4.
+	ProtocolNumber4 = header.ICMPv4ProtocolNumber
+
+	// ProtocolName6 is the string representation of the icmp protocol
+	// name for IPv6.
+	ProtocolName6 = "icmp6"
+
+	// ProtocolNumber6 is the icmp protocol number for IPv6.
+	ProtocolNumber6 = header.ICMPv6ProtocolNumber
+)
+
+// protocol is the icmp protocol of a network protocol.
+type protocol struct {
+	number   tcpip.TransportProtocolNumber
+	netProto tcpip.NetworkProtocolNumber
+}
+
+// Number returns the icmp protocol number.
+func (p *protocol) Number() tcpip.TransportProtocolNumber {
+	return p.number
+}
+
+// NewEndpoint creates a new icmp endpoint. It fails unless netProto is the
+// network protocol the icmp protocol belongs to.
+func (p *protocol) NewEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	if netProto != p.netProto {
+		return nil, tcpip.ErrUnknownProtocol
+	}
+	return newEndpoint(stack, netProto, p.number, waiterQueue), nil
+}
+
+// MinimumPacketSize returns the minimum valid icmp echo packet size.
+func (*protocol) MinimumPacketSize() int {
+	return echoHeaderSize
+}
+
+// ParsePorts returns the identifier stored in the given echo reply as its
+// destination port. Replies have no source port.
+func (*protocol) ParsePorts(v buffer.View) (src, dst uint16, err error) {
+	// The identifier is at the same offset in ICMPv4 and ICMPv6.
+	return 0, header.ICMPv4(v).Ident(), nil
+}
+
+// HandleUnknownDestinationPacket handles packets targeted at this protocol but
+// that don't match any existing endpoint.
+func (*protocol) HandleUnknownDestinationPacket(*stack.Route, stack.TransportEndpointID, *buffer.VectorisedView) bool {
+	return true
+}
+
+func init() {
+	stack.RegisterTransportProtocol(ProtocolName4, &protocol{ProtocolNumber4, header.IPv4ProtocolNumber})
+	stack.RegisterTransportProtocol(ProtocolName6, &protocol{ProtocolNumber6, header.IPv6ProtocolNumber})
+}
@@ -0,0 +1,308 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package packet provides packet endpoints, which work at the link layer like
+// AF_PACKET sockets. They receive a copy of every frame the NICs of the stack
+// dispatch, optionally only those of a NIC or of a network protocol, and send
+// frames directly through the link endpoint of a NIC, bypassing routing and
+// the network layer.
+//
+// The addresses used by packet endpoints describe frames rather than transport
+// nodes: the NIC field holds the NIC the frame goes through, the Addr field
+// holds the link address of its peer, and the Port field holds its network
+// protocol number (its EtherType).
+//
+// Cooked endpoints send and receive network-layer packets. Others send and
+// receive them preceded by an Ethernet header, which holds their link
+// addresses and network protocol.
+package packet
+
+import (
+	"io"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/datagram"
+	"github.com/google/netstack/waiter"
+)
+
+// zeroLinkAddress is the Ethernet address of frames written to links without
+// link addresses.
+const zeroLinkAddress tcpip.LinkAddress = "\x00\x00\x00\x00\x00\x00"
+
+// endpoint represents a packet endpoint. This struct serves as the interface
+// between users of the endpoint and the stack; it is legal to have concurrent
+// goroutines make calls into the endpoint, they are properly synchronized.
+type endpoint struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the endpoint.
+	stack       *stack.Stack
+	cooked      bool
+	waiterQueue *waiter.Queue
+	rcv         *datagram.ReceiveQueue
+
+	// The following fields are protected by the mu mutex.
+	mu     sync.RWMutex
+	closed bool
+
+	// nicID and protocol are the NIC and network protocol the endpoint is
+	// bound to. Zero matches every NIC or protocol.
+	nicID    tcpip.NICID
+	protocol tcpip.NetworkProtocolNumber
+}
+
+// NewEndpoint creates a packet endpoint for the given network protocol, zero
+// meaning all protocols, and registers it with the stack so that it receives a
+// copy of every frame of that protocol dispatched by any NIC. Bind restricts it
+// to a NIC, or changes its protocol.
+func NewEndpoint(s *stack.Stack, cooked bool, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	e := &endpoint{
+		stack:       s,
+		cooked:      cooked,
+		waiterQueue: waiterQueue,
+		rcv:         datagram.NewReceiveQueue(waiterQueue, datagram.ReceiveBufferSize),
+		protocol:    netProto,
+	}
+	e.rcv.SetReady()
+
+	if err := s.RegisterPacketEndpoint(0, netProto, e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Close puts the endpoint in a closed state and frees all resources
+// associated with it.
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return
+	}
+
+	e.stack.UnregisterPacketEndpoint(e.protocol, e)
+
+	e.rcv.Close()
+
+	e.closed = true
+}
+
+// Read reads a frame from the endpoint. This method does not block if there is
+// no frame pending.
+func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, error) {
+	return e.rcv.Read(addr)
+}
+
+// Write writes a frame through the NIC given by to, or the one the endpoint is
+// bound to. Cooked endpoints send it to the link address and network protocol
+// given by to, others to those given by the Ethernet header of v. This method
+// does not block if the frame cannot be written.
+func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error) {
+	e.mu.RLock()
+	closed := e.closed
+	nicID := e.nicID
+	protocol := e.protocol
+	e.mu.RUnlock()
+
+	if closed {
+		return 0, tcpip.ErrInvalidEndpointState
+	}
+
+	var remote tcpip.LinkAddress
+	if to != nil {
+		if to.NIC != 0 {
+			nicID = to.NIC
+		}
+		if to.Port != 0 {
+			protocol = tcpip.NetworkProtocolNumber(to.Port)
+		}
+		remote = tcpip.LinkAddress(to.Addr)
+	}
+
+	payload := v
+	if e.cooked {
+		if to == nil {
+			return 0, tcpip.ErrDestinationRequired
+		}
+	} else {
+		if len(v) < header.EthernetMinimumSize {
+			return 0, tcpip.ErrMalformedHeader
+		}
+		eth := header.Ethernet(v)
+		remote = eth.DestinationAddress()
+		if remote == zeroLinkAddress {
+			remote = ""
+		}
+		protocol = eth.Type()
+		payload = v[header.EthernetMinimumSize:]
+	}
+
+	if nicID == 0 || protocol == 0 {
+		return 0, tcpip.ErrDestinationRequired
+	}
+
+	if err := e.stack.WriteLinkPacket(nicID, remote, protocol, payload); err != nil {
+		return 0, err
+	}
+	return uintptr(len(v)), nil
+}
+
+// Peek only returns data from a single frame, so do nothing here.
+func (e *endpoint) Peek(io.Writer) (uintptr, error) {
+	return 0, nil
+}
+
+// SetSockOpt sets a socket option. Currently not supported.
+func (e *endpoint) SetSockOpt(opt interface{}) error {
+	return nil
+}
+
+// GetSockOpt implements tcpip.Endpoint.GetSockOpt.
+func (e *endpoint) GetSockOpt(opt interface{}) error {
+	switch o := opt.(type) {
+	case tcpip.ErrorOption:
+		return nil
+
+	case *tcpip.SendBufferSizeOption:
+		*o = datagram.SendBufferSize
+		return nil
+
+	case *tcpip.ReceiveBufferSizeOption:
+		*o = tcpip.ReceiveBufferSizeOption(e.rcv.Limit())
+		return nil
+	}
+
+	return tcpip.ErrInvalidEndpointState
+}
+
+// Connect is not supported by packet endpoints, it just fails.
+func (*endpoint) Connect(tcpip.FullAddress) error {
+	return tcpip.ErrNotSupported
+}
+
+// ConnectEndpoint is not supported.
+func (*endpoint) ConnectEndpoint(tcpip.Endpoint) error {
+	return tcpip.ErrInvalidEndpointState
+}
+
+// Shutdown is not supported by packet endpoints, it just fails.
+func (*endpoint) Shutdown(tcpip.ShutdownFlags) error {
+	return tcpip.ErrNotSupported
+}
+
+// Listen is not supported by packet endpoints, it just fails.
+func (*endpoint) Listen(int) error {
+	return tcpip.ErrNotSupported
+}
+
+// Accept is not supported by packet endpoints, it just fails.
+func (*endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, error) {
+	return nil, nil, tcpip.ErrNotSupported
+}
+
+// Bind restricts the endpoint to the frames dispatched by the given NIC, zero
+// meaning all NICs, and to the given network protocol if the port is nonzero.
+// The address is ignored.
+func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	protocol := e.protocol
+	if addr.Port != 0 {
+		protocol = tcpip.NetworkProtocolNumber(addr.Port)
+	}
+
+	// The old binding is restored if the new one is invalid.
+	e.stack.UnregisterPacketEndpoint(e.protocol, e)
+	if err := e.stack.RegisterPacketEndpoint(addr.NIC, protocol, e); err != nil {
+		e.stack.RegisterPacketEndpoint(e.nicID, e.protocol, e)
+		return err
+	}
+
+	if commit != nil {
+		if err := commit(); err != nil {
+			// Restore the old binding, the commit failed.
+			e.stack.UnregisterPacketEndpoint(protocol, e)
+			e.stack.RegisterPacketEndpoint(e.nicID, e.protocol, e)
+			return err
+		}
+	}
+
+	e.nicID = addr.NIC
+	e.protocol = protocol
+
+	return nil
+}
+
+// GetLocalAddress returns the NIC and network protocol the endpoint is bound
+// to.
+func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return tcpip.FullAddress{
+		NIC:  e.nicID,
+		Port: uint16(e.protocol),
+	}, nil
+}
+
+// GetRemoteAddress is not supported by packet endpoints, as they can't be
+// connected.
+func (*endpoint) GetRemoteAddress() (tcpip.FullAddress, error) {
+	return tcpip.FullAddress{}, tcpip.ErrNotConnected
+}
+
+// Readiness returns the current readiness of the endpoint. For example, if
+// waiter.EventIn is set, the endpoint is immediately readable.
+func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	// The endpoint is always writable.
+	result := waiter.EventOut & mask
+
+	// Determine if the endpoint is readable if requested.
+	if (mask&waiter.EventIn) != 0 && e.rcv.IsReadable() {
+		result |= waiter.EventIn
+	}
+
+	return result
+}
+
+// HandlePacket implements stack.PacketEndpoint.HandlePacket.
+func (e *endpoint) HandlePacket(nicID tcpip.NICID, remoteLinkAddr, localLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	// Queue a copy of the frame, as other endpoints share its views.
+	size := vv.Size()
+	if !e.cooked {
+		size += header.EthernetMinimumSize
+	}
+	data := buffer.NewView(size)
+	n := 0
+	if !e.cooked {
+		header.Ethernet(data).Encode(&header.EthernetFields{
+			SrcAddr: remoteLinkAddr,
+			DstAddr: localLinkAddr,
+			Type:    protocol,
+		})
+		n = header.EthernetMinimumSize
+	}
+	for _, v := range vv.Views() {
+		n += copy(data[n:], v)
+	}
+	p := &datagram.Packet{
+		SenderAddress: tcpip.FullAddress{
+			NIC:  nicID,
+			Addr: tcpip.Address(remoteLinkAddr),
+			Port: uint16(protocol),
+		},
+	}
+	p.SetView(data)
+	e.rcv.Enqueue(p)
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/packet"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	stackAddr = "\x0a\x00\x00\x01"
+	testAddr  = "\x0a\x00\x00\x02"
+
+	stackLinkAddr = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	testLinkAddr  = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+
+	// lldpProtocolNumber is the EtherType of LLDP, which isn't registered
+	// with the stack.
+	lldpProtocolNumber tcpip.NetworkProtocolNumber = 0x88cc
+)
+
+type testContext struct {
+	t       *testing.T
+	s       *stack.Stack
+	linkEPs []*channel.Endpoint
+}
+
+// newTestContext creates a stack with two NICs, with IDs 1 and 2.
+func newTestContext(t *testing.T) *testContext {
+	s := stack.New([]string{ipv4.ProtocolName}, nil).(*stack.Stack)
+	c := &testContext{t: t, s: s}
+
+	for i := 1; i <= 2; i++ {
+		id, linkEP := channel.New(256, 1500, stackLinkAddr)
+		if err := s.CreateNIC(tcpip.NICID(i), id); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+		c.linkEPs = append(c.linkEPs, linkEP)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	return c
+}
+
+func (c *testContext) newEndpoint(cooked bool, netProto tcpip.NetworkProtocolNumber) tcpip.Endpoint {
+	var wq waiter.Queue
+	ep, err := packet.NewEndpoint(c.s, cooked, netProto, &wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	return ep
+}
+
+// inject injects a frame through the NIC with the given ID.
+func (c *testContext) inject(nicID tcpip.NICID, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	vv := v.ToVectorisedView([1]buffer.View{})
+	c.linkEPs[nicID-1].InjectLinkAddr(protocol, testLinkAddr, &vv)
+}
+
+func (c *testContext) getPacket(nicID tcpip.NICID) channel.PacketInfo {
+	select {
+	case p := <-c.linkEPs[nicID-1].C:
+		return p
+
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Packet wasn't written out")
+	}
+
+	return channel.PacketInfo{}
+}
+
+func ipv4Packet() buffer.View {
+	v := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize)
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     testAddr,
+		DstAddr:     stackAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	return v
+}
+
+func TestReceiveCooked(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(true, ipv4.ProtocolNumber)
+	defer ep.Close()
+
+	pkt := ipv4Packet()
+	c.inject(1, ipv4.ProtocolNumber, pkt)
+	c.inject(1, lldpProtocolNumber, buffer.View("lldp"))
+
+	var addr tcpip.FullAddress
+	v, err := ep.Read(&addr)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(v, pkt) {
+		t.Fatalf("Read got %v, want %v", v, pkt)
+	}
+	want := tcpip.FullAddress{NIC: 1, Addr: tcpip.Address(testLinkAddr), Port: uint16(ipv4.ProtocolNumber)}
+	if addr != want {
+		t.Fatalf("Read got address %+v, want %+v", addr, want)
+	}
+
+	// Frames of other protocols aren't received. Both frames still count
+	// as unknown, as the stack has no UDP.
+	if _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read got %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+	if got := c.s.Stats().UnknownProtocolRcvdPackets; got != 2 {
+		t.Fatalf("UnknownProtocolRcvdPackets = %v, want 2", got)
+	}
+}
+
+func TestReceiveRawAllProtocols(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(false, 0)
+	defer ep.Close()
+
+	payload := buffer.View("lldp")
+	c.inject(1, lldpProtocolNumber, payload)
+
+	v, err := ep.Read(nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(v) != header.EthernetMinimumSize+len(payload) {
+		t.Fatalf("Read got %d bytes, want %d", len(v), header.EthernetMinimumSize+len(payload))
+	}
+	eth := header.Ethernet(v)
+	if eth.SourceAddress() != testLinkAddr || eth.DestinationAddress() != stackLinkAddr || eth.Type() != lldpProtocolNumber {
+		t.Fatalf("Got Ethernet header %v -> %v type %#x, want %v -> %v type %#x", eth.SourceAddress(), eth.DestinationAddress(), eth.Type(), testLinkAddr, stackLinkAddr, lldpProtocolNumber)
+	}
+	if !bytes.Equal(v[header.EthernetMinimumSize:], payload) {
+		t.Fatalf("Read got payload %v, want %v", v[header.EthernetMinimumSize:], payload)
+	}
+
+	// Frames taken by a packet endpoint don't count as unknown.
+	if got := c.s.Stats().UnknownProtocolRcvdPackets; got != 0 {
+		t.Fatalf("UnknownProtocolRcvdPackets = %v, want 0", got)
+	}
+}
+
+func TestBindNIC(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(true, 0)
+	defer ep.Close()
+
+	if err := ep.Bind(tcpip.FullAddress{NIC: 3}, nil); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("Bind got %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+	if err := ep.Bind(tcpip.FullAddress{NIC: 2, Port: uint16(lldpProtocolNumber)}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	c.inject(1, lldpProtocolNumber, buffer.View("nic 1"))
+	c.inject(2, ipv4.ProtocolNumber, ipv4Packet())
+	c.inject(2, lldpProtocolNumber, buffer.View("nic 2"))
+
+	var addr tcpip.FullAddress
+	v, err := ep.Read(&addr)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(v) != "nic 2" || addr.NIC != 2 {
+		t.Fatalf("Read got %q from NIC %v, want %q from NIC 2", v, addr.NIC, "nic 2")
+	}
+	if _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read got %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestWriteCooked(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(true, lldpProtocolNumber)
+	defer ep.Close()
+
+	payload := buffer.View("lldp")
+	if _, err := ep.Write(payload, nil); err != tcpip.ErrDestinationRequired {
+		t.Fatalf("Write got %v, want %v", err, tcpip.ErrDestinationRequired)
+	}
+	if _, err := ep.Write(payload, &tcpip.FullAddress{Addr: tcpip.Address(testLinkAddr)}); err != tcpip.ErrDestinationRequired {
+		t.Fatalf("Write got %v, want %v", err, tcpip.ErrDestinationRequired)
+	}
+
+	// The protocol defaults to the one of the endpoint.
+	if _, err := ep.Write(payload, &tcpip.FullAddress{NIC: 2, Addr: tcpip.Address(testLinkAddr)}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	p := c.getPacket(2)
+	if p.Proto != lldpProtocolNumber || p.RemoteLinkAddress != testLinkAddr || !bytes.Equal(p.Payload, payload) {
+		t.Fatalf("Got packet %+v, want protocol %#x to %v with payload %v", p, lldpProtocolNumber, testLinkAddr, payload)
+	}
+}
+
+func TestWriteRaw(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(false, 0)
+	defer ep.Close()
+
+	if err := ep.Bind(tcpip.FullAddress{NIC: 1}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	if _, err := ep.Write(buffer.View("short"), nil); err != tcpip.ErrMalformedHeader {
+		t.Fatalf("Write got %v, want %v", err, tcpip.ErrMalformedHeader)
+	}
+
+	payload := ipv4Packet()
+	v := buffer.NewView(header.EthernetMinimumSize + len(payload))
+	header.Ethernet(v).Encode(&header.EthernetFields{
+		SrcAddr: stackLinkAddr,
+		DstAddr: header.EthernetBroadcastAddress,
+		Type:    ipv4.ProtocolNumber,
+	})
+	copy(v[header.EthernetMinimumSize:], payload)
+	if _, err := ep.Write(v, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	p := c.getPacket(1)
+	if p.Proto != ipv4.ProtocolNumber || p.RemoteLinkAddress != header.EthernetBroadcastAddress || !bytes.Equal(p.Payload, payload) {
+		t.Fatalf("Got packet %+v, want protocol %#x to %v with payload %v", p, ipv4.ProtocolNumber, header.EthernetBroadcastAddress, payload)
+	}
+}
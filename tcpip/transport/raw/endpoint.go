@@ -0,0 +1,518 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package raw provides raw IP endpoints, which send and receive the payloads of
+// an arbitrary IP protocol, optionally along with their IP header. Unlike the
+// endpoints of transport protocols, they aren't created with
+// Stack.NewEndpoint, but with NewEndpoint, for any protocol number. They
+// receive a copy of every inbound packet of their protocol, whether or not
+// another endpoint or the network layer itself also handles it.
+package raw
+
+import (
+	"io"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/datagram"
+	"github.com/google/netstack/waiter"
+)
+
+type endpointState int
+
+const (
+	stateInitial endpointState = iota
+	stateBound
+	stateConnected
+	stateClosed
+)
+
+// endpoint represents a raw IP endpoint. This struct serves as the interface
+// between users of the endpoint and the stack; it is legal to have concurrent
+// goroutines make calls into the endpoint, they are properly synchronized.
+type endpoint struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the endpoint.
+	stack       *stack.Stack
+	netProto    tcpip.NetworkProtocolNumber
+	transProto  tcpip.TransportProtocolNumber
+	waiterQueue *waiter.Queue
+	rcv         *datagram.ReceiveQueue
+
+	// rcvMu protects rcvHeader, which indicates whether received payloads
+	// start with their network-layer header, as set via
+	// ReceiveHeaderOption.
+	rcvMu     sync.Mutex
+	rcvHeader bool
+
+	// The following fields are protected by the mu mutex. bindNICID,
+	// bindAddr and remoteAddr select the packets the endpoint receives,
+	// so they are also protected by rcvMu, which must be held along with
+	// mu to modify them.
+	mu         sync.RWMutex
+	state      endpointState
+	bindNICID  tcpip.NICID
+	bindAddr   tcpip.Address
+	remoteAddr tcpip.Address
+	route      stack.Route
+	opts       *datagram.Options
+
+	// hdrIncl indicates whether written payloads start with their
+	// network-layer header, as set via HeaderIncludedOption.
+	hdrIncl bool
+}
+
+// NewEndpoint creates a raw endpoint for the given network and transport
+// protocols, and registers it with the stack so that it receives a copy of
+// every packet of those protocols. The transport protocol doesn't need to be
+// registered with the stack. Received payloads start with their network-layer
+// header on IPv4 endpoints only, unless ReceiveHeaderOption says otherwise.
+func NewEndpoint(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	e := &endpoint{
+		stack:       s,
+		netProto:    netProto,
+		transProto:  transProto,
+		waiterQueue: waiterQueue,
+		rcv:         datagram.NewReceiveQueue(waiterQueue, datagram.ReceiveBufferSize),
+		rcvHeader:   netProto == header.IPv4ProtocolNumber,
+		opts:        datagram.NewOptions(s, netProto, false),
+	}
+	e.rcv.SetReady()
+
+	if err := s.RegisterRawTransportEndpoint(netProto, transProto, e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Close puts the endpoint in a closed state and frees all resources
+// associated with it.
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state == stateClosed {
+		return
+	}
+
+	e.stack.UnregisterRawTransportEndpoint(e.netProto, e.transProto, e)
+
+	e.opts.LeaveGroups()
+	e.rcv.Close()
+
+	e.route.Release()
+
+	// Update the state.
+	e.state = stateClosed
+}
+
+// Read reads data from the endpoint. This method does not block if
+// there is no data pending.
+func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, error) {
+	return e.rcv.Read(addr)
+}
+
+// Write writes data to the endpoint's peer, or to the destination in the
+// network-layer header of the data if HeaderIncludedOption is set. This method
+// does not block if the data cannot be written.
+func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state == stateClosed {
+		return 0, tcpip.ErrInvalidEndpointState
+	}
+
+	if e.hdrIncl {
+		if err := e.writeHeaderIncluded(v); err != nil {
+			return 0, err
+		}
+		return uintptr(len(v)), nil
+	}
+
+	route := &e.route
+	if to == nil {
+		if e.state != stateConnected {
+			return 0, tcpip.ErrDestinationRequired
+		}
+	} else {
+		// Reject destination address if it goes through a different
+		// NIC than the endpoint was bound to.
+		nicid := to.NIC
+		if e.bindNICID != 0 {
+			if nicid != 0 && nicid != e.bindNICID {
+				return 0, tcpip.ErrNoRoute
+			}
+
+			nicid = e.bindNICID
+		}
+
+		nicid, localAddr := e.opts.RouteSource(nicid, e.bindAddr, to.Addr)
+		r, err := e.stack.FindPolicyRoute(nicid, localAddr, to.Addr, e.netProto, e.transProto, e.opts.Mark())
+		if err != nil {
+			return 0, err
+		}
+		defer r.Release()
+		e.opts.Apply(&r)
+
+		route = &r
+	}
+
+	if err := e.opts.CheckRoute(route); err != nil {
+		return 0, err
+	}
+
+	hdr := buffer.NewPrependable(int(route.MaxHeaderLength()))
+	if err := route.WritePacket(&hdr, v, e.transProto); err != nil {
+		return 0, err
+	}
+	return uintptr(len(v)), nil
+}
+
+// writeHeaderIncluded sends v, which starts with its network-layer header, to
+// the destination address in that header. The source address is filled in
+// when the header leaves it unspecified.
+//
+// e.mu must be held by the caller.
+func (e *endpoint) writeHeaderIncluded(v buffer.View) error {
+	// The network layer fills in parts of the header, so it gets its own
+	// copy of the packet.
+	pkt := buffer.NewView(len(v))
+	copy(pkt, v)
+
+	var src, dst tcpip.Address
+	var setSource func(tcpip.Address)
+	switch e.netProto {
+	case header.IPv4ProtocolNumber:
+		if len(pkt) < header.IPv4MinimumSize {
+			return tcpip.ErrMalformedHeader
+		}
+		h := header.IPv4(pkt)
+		src, dst, setSource = h.SourceAddress(), h.DestinationAddress(), h.SetSourceAddress
+		if src == header.IPv4Any {
+			src = ""
+		}
+
+	case header.IPv6ProtocolNumber:
+		if len(pkt) < header.IPv6MinimumSize {
+			return tcpip.ErrMalformedHeader
+		}
+		h := header.IPv6(pkt)
+		src, dst, setSource = h.SourceAddress(), h.DestinationAddress(), h.SetSourceAddress
+		if src == header.IPv6Any {
+			src = ""
+		}
+
+	default:
+		return tcpip.ErrNotSupported
+	}
+
+	// The source address in the header is sent as is, even if it isn't
+	// one of the addresses of the stack, so it doesn't select the route.
+	nicid, localAddr := e.opts.RouteSource(e.bindNICID, e.bindAddr, dst)
+	r, err := e.stack.FindPolicyRoute(nicid, localAddr, dst, e.netProto, e.transProto, e.opts.Mark())
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+
+	if err := e.opts.CheckRoute(&r); err != nil {
+		return err
+	}
+
+	if src == "" {
+		setSource(r.LocalAddress)
+	}
+
+	return r.WriteHeaderIncludedPacket(pkt)
+}
+
+// Peek only returns data from a single datagram, so do nothing here.
+func (e *endpoint) Peek(io.Writer) (uintptr, error) {
+	return 0, nil
+}
+
+// SetSockOpt sets a socket option.
+func (e *endpoint) SetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case tcpip.HeaderIncludedOption:
+		e.mu.Lock()
+		e.hdrIncl = v != 0
+		e.mu.Unlock()
+
+	case tcpip.ReceiveHeaderOption:
+		e.rcvMu.Lock()
+		e.rcvHeader = v != 0
+		e.rcvMu.Unlock()
+
+	case tcpip.TOSOption:
+		// We only recognize this option on v4 endpoints.
+		if e.netProto != header.IPv4ProtocolNumber {
+			return tcpip.ErrInvalidEndpointState
+		}
+		return e.setOption(opt)
+
+	default:
+		return e.setOption(opt)
+	}
+	return nil
+}
+
+// setOption sets one of the options shared by datagram endpoints.
+func (e *endpoint) setOption(opt interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.opts.SetOption(opt)
+	e.opts.Apply(&e.route)
+	return err
+}
+
+// GetSockOpt implements tcpip.Endpoint.GetSockOpt.
+func (e *endpoint) GetSockOpt(opt interface{}) error {
+	switch o := opt.(type) {
+	case tcpip.ErrorOption:
+		return nil
+
+	case *tcpip.SendBufferSizeOption:
+		*o = datagram.SendBufferSize
+		return nil
+
+	case *tcpip.ReceiveBufferSizeOption:
+		*o = tcpip.ReceiveBufferSizeOption(e.rcv.Limit())
+		return nil
+
+	case *tcpip.HeaderIncludedOption:
+		e.mu.Lock()
+		v := e.hdrIncl
+		e.mu.Unlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.ReceiveHeaderOption:
+		e.rcvMu.Lock()
+		v := e.rcvHeader
+		e.rcvMu.Unlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.TOSOption:
+		// We only recognize this option on v4 endpoints.
+		if e.netProto != header.IPv4ProtocolNumber {
+			return tcpip.ErrInvalidEndpointState
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.opts.GetOption(opt)
+}
+
+// Connect restricts the endpoint to packets from the given address, and makes
+// it the default destination of the data written to it. Ports are ignored, and
+// specifying a NIC is optional.
+func (e *endpoint) Connect(addr tcpip.FullAddress) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	nicid := addr.NIC
+	switch e.state {
+	case stateInitial:
+	case stateBound, stateConnected:
+		if e.bindNICID == 0 {
+			break
+		}
+
+		if nicid != 0 && nicid != e.bindNICID {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+		nicid = e.bindNICID
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	// Find a route to the desired destination.
+	nicid, localAddr := e.opts.RouteSource(nicid, e.bindAddr, addr.Addr)
+	r, err := e.stack.FindPolicyRoute(nicid, localAddr, addr.Addr, e.netProto, e.transProto, e.opts.Mark())
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+
+	if err := e.opts.CheckRoute(&r); err != nil {
+		return err
+	}
+
+	e.route.Release()
+	e.route = r.Clone()
+	e.opts.Apply(&e.route)
+
+	e.rcvMu.Lock()
+	e.remoteAddr = addr.Addr
+	e.rcvMu.Unlock()
+
+	e.state = stateConnected
+
+	return nil
+}
+
+// ConnectEndpoint is not supported.
+func (*endpoint) ConnectEndpoint(tcpip.Endpoint) error {
+	return tcpip.ErrInvalidEndpointState
+}
+
+// Shutdown closes the read and/or write end of the endpoint connection
+// to its peer.
+func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return tcpip.ErrNotConnected
+	}
+
+	if flags&tcpip.ShutdownRead != 0 {
+		e.rcv.Shutdown()
+	}
+
+	return nil
+}
+
+// Listen is not supported by raw endpoints, it just fails.
+func (*endpoint) Listen(int) error {
+	return tcpip.ErrNotSupported
+}
+
+// Accept is not supported by raw endpoints, it just fails.
+func (*endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, error) {
+	return nil, nil, tcpip.ErrNotSupported
+}
+
+// Bind restricts the endpoint to packets sent to the given address, and makes
+// it the source address of the data written to it. The port is ignored, and
+// specifying a NIC is optional.
+func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Don't allow binding once endpoint is not in the initial state
+	// anymore.
+	if e.state != stateInitial {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	if len(addr.Addr) != 0 && !datagram.IsMulticastAddress(addr.Addr) && addr.Addr != header.IPv4Broadcast {
+		// A local address was specified, verify that it's valid.
+		if e.stack.CheckLocalAddress(addr.NIC, addr.Addr) == 0 {
+			return tcpip.ErrBadLocalAddress
+		}
+	}
+
+	if commit != nil {
+		if err := commit(); err != nil {
+			return err
+		}
+	}
+
+	e.rcvMu.Lock()
+	e.bindNICID = addr.NIC
+	e.bindAddr = addr.Addr
+	e.rcvMu.Unlock()
+
+	// Mark endpoint as bound.
+	e.state = stateBound
+
+	return nil
+}
+
+// GetLocalAddress returns the address to which the endpoint is bound.
+func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return tcpip.FullAddress{
+		NIC:  e.bindNICID,
+		Addr: e.bindAddr,
+	}, nil
+}
+
+// GetRemoteAddress returns the address to which the endpoint is connected.
+func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return tcpip.FullAddress{}, tcpip.ErrInvalidEndpointState
+	}
+
+	return tcpip.FullAddress{
+		NIC:  e.route.NICID(),
+		Addr: e.remoteAddr,
+	}, nil
+}
+
+// Readiness returns the current readiness of the endpoint. For example, if
+// waiter.EventIn is set, the endpoint is immediately readable.
+func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	// The endpoint is always writable.
+	result := waiter.EventOut & mask
+
+	// Determine if the endpoint is readable if requested.
+	if (mask&waiter.EventIn) != 0 && e.rcv.IsReadable() {
+		result |= waiter.EventIn
+	}
+
+	return result
+}
+
+// HandlePacket implements stack.RawTransportEndpoint.HandlePacket.
+func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
+	e.rcvMu.Lock()
+
+	// Drop the packet if it isn't for us.
+	if (e.bindNICID != 0 && e.bindNICID != r.NICID()) ||
+		(e.bindAddr != "" && e.bindAddr != r.LocalAddress) ||
+		(e.remoteAddr != "" && e.remoteAddr != r.RemoteAddress) {
+		e.rcvMu.Unlock()
+		return
+	}
+
+	// Queue a copy of the packet, as other endpoints share its views.
+	size := vv.Size()
+	if e.rcvHeader {
+		size += len(r.NetworkHeader)
+	}
+	data := buffer.NewView(size)
+	n := 0
+	if e.rcvHeader {
+		n = copy(data, r.NetworkHeader)
+	}
+
+	e.rcvMu.Unlock()
+
+	for _, v := range vv.Views() {
+		n += copy(data[n:], v)
+	}
+	p := &datagram.Packet{
+		SenderAddress: tcpip.FullAddress{
+			NIC:  r.NICID(),
+			Addr: r.RemoteAddress,
+		},
+	}
+	p.SetView(data)
+	e.rcv.Enqueue(p)
+}
@@ -0,0 +1,359 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package raw_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/checker"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/raw"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	stackAddr   = "\x0a\x00\x00\x01"
+	testAddr    = "\x0a\x00\x00\x02"
+	otherAddr   = "\x0a\x00\x00\x03"
+	stackV6Addr = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+	testV6Addr  = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"
+
+	// ospfProtocolNumber is the protocol number of OSPF, which isn't
+	// registered with the stack.
+	ospfProtocolNumber tcpip.TransportProtocolNumber = 89
+)
+
+type testContext struct {
+	t      *testing.T
+	s      *stack.Stack
+	linkEP *channel.Endpoint
+}
+
+func newTestContext(t *testing.T) *testContext {
+	s := stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, nil).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv6.ProtocolNumber, stackV6Addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{
+			Destination: "\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00",
+			NIC:         1,
+		},
+		{
+			Destination: "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+			NIC:         1,
+		},
+	})
+
+	// Discard the MLD report announcing the solicited-node group of the
+	// IPv6 address.
+	linkEP.Drain()
+
+	return &testContext{t: t, s: s, linkEP: linkEP}
+}
+
+func (c *testContext) newEndpoint(netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber) tcpip.Endpoint {
+	var wq waiter.Queue
+	ep, err := raw.NewEndpoint(c.s, netProto, transProto, &wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	return ep
+}
+
+// buildV4Packet builds an IPv4 packet of the given protocol from src to the
+// stack.
+func buildV4Packet(src tcpip.Address, protocol tcpip.TransportProtocolNumber, payload []byte) buffer.View {
+	v := buffer.NewView(header.IPv4MinimumSize + len(payload))
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         64,
+		Protocol:    uint8(protocol),
+		SrcAddr:     src,
+		DstAddr:     stackAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	copy(v[header.IPv4MinimumSize:], payload)
+	return v
+}
+
+func (c *testContext) injectV4(v buffer.View) {
+	vv := v.ToVectorisedView([1]buffer.View{})
+	c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+}
+
+func (c *testContext) read(ep tcpip.Endpoint) (buffer.View, tcpip.FullAddress) {
+	var addr tcpip.FullAddress
+	v, err := ep.Read(&addr)
+	if err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	return v, addr
+}
+
+func (c *testContext) getPacket() []byte {
+	select {
+	case p := <-c.linkEP.C:
+		b := make([]byte, len(p.Header)+len(p.Payload))
+		copy(b, p.Header)
+		copy(b[len(p.Header):], p.Payload)
+		return b
+
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Packet wasn't written out")
+	}
+
+	return nil
+}
+
+func TestReceiveUnknownProtocol(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(ipv4.ProtocolNumber, ospfProtocolNumber)
+	defer ep.Close()
+
+	payload := []byte("hello ospf")
+	pkt := buildV4Packet(testAddr, ospfProtocolNumber, payload)
+	c.injectV4(pkt)
+
+	// IPv4 endpoints receive the header by default.
+	v, addr := c.read(ep)
+	if !bytes.Equal(v, pkt) {
+		t.Fatalf("Read got %v, want %v", v, pkt)
+	}
+	if want := (tcpip.FullAddress{NIC: 1, Addr: testAddr}); addr != want {
+		t.Fatalf("Read got address %+v, want %+v", addr, want)
+	}
+	if got := c.s.Stats().UnknownProtocolRcvdPackets; got != 0 {
+		t.Fatalf("UnknownProtocolRcvdPackets = %v, want 0", got)
+	}
+
+	if err := ep.SetSockOpt(tcpip.ReceiveHeaderOption(0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	c.injectV4(buildV4Packet(testAddr, ospfProtocolNumber, payload))
+	if v, _ := c.read(ep); !bytes.Equal(v, payload) {
+		t.Fatalf("Read got %v, want %v", v, payload)
+	}
+
+	// Packets of other protocols aren't received, and still count as
+	// unknown.
+	c.injectV4(buildV4Packet(testAddr, ospfProtocolNumber+1, payload))
+	if _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read got %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+	if got := c.s.Stats().UnknownProtocolRcvdPackets; got != 1 {
+		t.Fatalf("UnknownProtocolRcvdPackets = %v, want 1", got)
+	}
+
+	// Packets aren't received after close.
+	ep.Close()
+	c.injectV4(buildV4Packet(testAddr, ospfProtocolNumber, payload))
+	if got := c.s.Stats().UnknownProtocolRcvdPackets; got != 2 {
+		t.Fatalf("UnknownProtocolRcvdPackets = %v, want 2", got)
+	}
+}
+
+func TestReceiveICMPCopy(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(ipv4.ProtocolNumber, header.ICMPv4ProtocolNumber)
+	defer ep.Close()
+	if err := ep.SetSockOpt(tcpip.ReceiveHeaderOption(0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	icmp := header.ICMPv4(buffer.NewView(header.ICMPv4EchoMinimumSize + 2))
+	icmp.SetType(header.ICMPv4Echo)
+	icmp.SetIdent(1)
+	icmp.SetChecksum(^header.Checksum(icmp, 0))
+	c.injectV4(buildV4Packet(testAddr, header.ICMPv4ProtocolNumber, icmp))
+
+	// The raw endpoint gets a copy of the request, and the stack still
+	// answers it.
+	if v, _ := c.read(ep); !bytes.Equal(v, icmp) {
+		t.Fatalf("Read got %v, want %v", v, icmp)
+	}
+	b := c.getPacket()
+	checker.IPv4(t, b, checker.SrcAddr(stackAddr), checker.DstAddr(testAddr))
+	if typ := header.ICMPv4(header.IPv4(b).Payload()).Type(); typ != header.ICMPv4EchoReply {
+		t.Fatalf("Got ICMP type %v, want %v", typ, header.ICMPv4EchoReply)
+	}
+}
+
+func TestReceiveV6WithoutHeader(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(ipv6.ProtocolNumber, ospfProtocolNumber)
+	defer ep.Close()
+
+	payload := []byte("hello ospfv3")
+	v := buffer.NewView(header.IPv6MinimumSize + len(payload))
+	header.IPv6(v).Encode(&header.IPv6Fields{
+		PayloadLength: uint16(len(payload)),
+		NextHeader:    uint8(ospfProtocolNumber),
+		HopLimit:      64,
+		SrcAddr:       testV6Addr,
+		DstAddr:       stackV6Addr,
+	})
+	copy(v[header.IPv6MinimumSize:], payload)
+	vv := v.ToVectorisedView([1]buffer.View{})
+	c.linkEP.Inject(ipv6.ProtocolNumber, &vv)
+
+	got, addr := c.read(ep)
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("Read got %v, want %v", got, payload)
+	}
+	if addr.Addr != testV6Addr {
+		t.Fatalf("Read got address %v, want %v", addr.Addr, testV6Addr)
+	}
+}
+
+func TestConnectFiltersSource(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(ipv4.ProtocolNumber, ospfProtocolNumber)
+	defer ep.Close()
+
+	if err := ep.Connect(tcpip.FullAddress{Addr: testAddr}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	c.injectV4(buildV4Packet(otherAddr, ospfProtocolNumber, []byte("other")))
+	if _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read got %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+
+	c.injectV4(buildV4Packet(testAddr, ospfProtocolNumber, []byte("peer")))
+	if _, addr := c.read(ep); addr.Addr != testAddr {
+		t.Fatalf("Read got address %v, want %v", addr.Addr, testAddr)
+	}
+
+	// Data is sent to the peer by default.
+	payload := []byte("to peer")
+	if _, err := ep.Write(payload, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checker.IPv4(t, c.getPacket(), checker.DstAddr(testAddr), checker.Raw(payload))
+}
+
+func TestWrite(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(ipv4.ProtocolNumber, ospfProtocolNumber)
+	defer ep.Close()
+
+	payload := []byte("hello ospf")
+	if _, err := ep.Write(payload, nil); err != tcpip.ErrDestinationRequired {
+		t.Fatalf("Write got %v, want %v", err, tcpip.ErrDestinationRequired)
+	}
+
+	if err := ep.SetSockOpt(tcpip.TTLOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if _, err := ep.Write(payload, &tcpip.FullAddress{Addr: testAddr}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	b := c.getPacket()
+	checker.IPv4(t, b,
+		checker.SrcAddr(stackAddr),
+		checker.DstAddr(testAddr),
+		checker.TTL(1),
+		checker.Raw(payload),
+	)
+	if p := header.IPv4(b).TransportProtocol(); p != ospfProtocolNumber {
+		t.Fatalf("Got protocol %v, want %v", p, ospfProtocolNumber)
+	}
+}
+
+func TestWriteHeaderIncluded(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(ipv4.ProtocolNumber, ospfProtocolNumber)
+	defer ep.Close()
+
+	if err := ep.SetSockOpt(tcpip.HeaderIncludedOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	if _, err := ep.Write(buffer.View{0x45}, nil); err != tcpip.ErrMalformedHeader {
+		t.Fatalf("Write got %v, want %v", err, tcpip.ErrMalformedHeader)
+	}
+
+	// The stack fills in the source address, length and checksum.
+	payload := []byte("hello ospf")
+	v := buffer.NewView(header.IPv4MinimumSize + len(payload))
+	header.IPv4(v).Encode(&header.IPv4Fields{
+		IHL:      header.IPv4MinimumSize,
+		TOS:      0xc0,
+		TTL:      7,
+		Protocol: uint8(ospfProtocolNumber),
+		DstAddr:  testAddr,
+	})
+	copy(v[header.IPv4MinimumSize:], payload)
+	if _, err := ep.Write(v, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	checker.IPv4(t, c.getPacket(),
+		checker.SrcAddr(stackAddr),
+		checker.DstAddr(testAddr),
+		checker.TTL(7),
+		checker.TOS(0xc0, 0),
+		checker.Raw(payload),
+	)
+
+	// Source addresses given by the user are kept.
+	header.IPv4(v).SetSourceAddress(otherAddr)
+	if _, err := ep.Write(v, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checker.IPv4(t, c.getPacket(), checker.SrcAddr(otherAddr), checker.DstAddr(testAddr))
+}
+
+func TestWriteHeaderIncludedV6(t *testing.T) {
+	c := newTestContext(t)
+	ep := c.newEndpoint(ipv6.ProtocolNumber, ospfProtocolNumber)
+	defer ep.Close()
+
+	if err := ep.SetSockOpt(tcpip.HeaderIncludedOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	payload := []byte("hello ospfv3")
+	v := buffer.NewView(header.IPv6MinimumSize + len(payload))
+	header.IPv6(v).Encode(&header.IPv6Fields{
+		NextHeader: uint8(ospfProtocolNumber),
+		HopLimit:   1,
+		DstAddr:    testV6Addr,
+	})
+	copy(v[header.IPv6MinimumSize:], payload)
+	if _, err := ep.Write(v, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	checker.IPv6(t, c.getPacket(),
+		checker.SrcAddr(stackV6Addr),
+		checker.DstAddr(testV6Addr),
+		checker.TTL(1),
+		checker.Raw(payload),
+	)
+}
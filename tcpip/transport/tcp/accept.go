@@ -37,6 +37,18 @@ const (
 	// timestamp and the current timestamp. If the difference is greater
 	// than maxTSDiff, the cookie is expired.
 	maxTSDiff = 2
+
+	// synOptsMask is the mask of the low bits of the TSval of the SYN-ACK
+	// segments sent with a cookie, which encode the options of the SYN
+	// segment that don't fit in the cookie. The window scale is stored in
+	// the bits of synOptsWSMask, where synOptsNoWS means that the SYN had
+	// no WS option, and synOptsSACK and synOptsECN indicate whether SACK
+	// and ECN were agreed on.
+	synOptsMask   = 0x3f
+	synOptsWSMask = 0xf
+	synOptsNoWS   = 0xf
+	synOptsSACK   = 1 << 4
+	synOptsECN    = 1 << 5
 )
 
 var (
@@ -83,6 +95,55 @@ type listenContext struct {
 	hasher   hash.Hash
 	v6only   bool
 	netProto tcpip.NetworkProtocolNumber
+
+	// ipOpts holds the IP options of the listening endpoint, inherited
+	// by the endpoints it accepts.
+	ipOpts stack.IPOptions
+
+	// ecn indicates whether ECN is agreed on when requested by SYN
+	// segments.
+	ecn bool
+
+	// sack indicates whether selective acknowledgements are agreed on
+	// when offered by SYN segments.
+	sack bool
+
+	// timestamps indicates whether the timestamps option is agreed on when
+	// offered by SYN segments.
+	timestamps bool
+
+	// cc is the name of the congestion control algorithm of the accepted
+	// connections.
+	cc tcpip.CongestionControlOption
+
+	// rcvAutoTune indicates whether the receive buffers of the accepted
+	// connections are auto-tuned.
+	rcvAutoTune bool
+
+	// fastOpen indicates whether Fast Open connections are accepted.
+	fastOpen bool
+
+	// mark is the mark of the listening endpoint, inherited by the
+	// endpoints it accepts.
+	mark uint32
+
+	// noDelay, cork and quickAck are the options of the listening
+	// endpoint which determine when the accepted connections send
+	// segments and acknowledgements.
+	noDelay  bool
+	cork     bool
+	quickAck bool
+
+	// The following fields are the keepalive options of the listening
+	// endpoint, inherited by the endpoints it accepts.
+	keepaliveEnabled  bool
+	keepaliveIdle     time.Duration
+	keepaliveInterval time.Duration
+	keepaliveCount    int
+
+	// linger is the LingerOption of the listening endpoint, inherited by
+	// the endpoints it accepts.
+	linger tcpip.LingerOption
 }
 
 // timeStamp returns an 8-bit timestamp with a granularity of 64 seconds.
@@ -124,6 +185,11 @@ func newListenContext(stack *stack.Stack, rcvWnd seqnum.Size, v6only bool, netPr
 		hasher:   sha1.New(),
 		v6only:   v6only,
 		netProto: netProto,
+		noDelay:  true,
+
+		keepaliveIdle:     defaultKeepaliveIdle,
+		keepaliveInterval: defaultKeepaliveInterval,
+		keepaliveCount:    defaultKeepaliveCount,
 	}
 
 	rand.Read(l.nonce[0][:])
@@ -158,6 +224,49 @@ func (l *listenContext) cookieHash(id stack.TransportEndpointID, ts uint32, nonc
 	return binary.BigEndian.Uint32(h[:])
 }
 
+// tsClockOffset returns the offset of the timestamp clock of the connection
+// with the given id. It is derived from the id so that SYN-ACK segments sent
+// with a cookie and the endpoints created when the cookie is returned use the
+// same clock.
+func (l *listenContext) tsClockOffset(id stack.TransportEndpointID) uint32 {
+	// Cookie timestamps never exceed tsMask, so this hash isn't used by
+	// cookies.
+	return l.cookieHash(id, tsMask+1, 0)
+}
+
+// encodeSynOptions returns the TSval of a SYN-ACK segment sent with a cookie, at
+// time now of the timestamp clock, encoding the window scale ws of the SYN
+// segment (negative if it had no WS option), and whether SACK and ECN are
+// agreed on. The TSval doesn't exceed now, so that the following timestamps of
+// the connection don't go backwards.
+func encodeSynOptions(now uint32, ws int, sack, ecn bool) uint32 {
+	opts := uint32(synOptsNoWS)
+	if ws >= 0 {
+		opts = uint32(ws)
+	}
+	if sack {
+		opts |= synOptsSACK
+	}
+	if ecn {
+		opts |= synOptsECN
+	}
+
+	tsVal := now&^synOptsMask | opts
+	if int32(tsVal-now) > 0 {
+		tsVal -= synOptsMask + 1
+	}
+	return tsVal
+}
+
+// decodeSynOptions returns the options encoded by encodeSynOptions in tsVal.
+func decodeSynOptions(tsVal uint32) (ws int, sack, ecn bool) {
+	ws = int(tsVal & synOptsWSMask)
+	if ws == synOptsNoWS {
+		ws = -1
+	}
+	return ws, tsVal&synOptsSACK != 0, tsVal&synOptsECN != 0
+}
+
 // createCookie creates a SYN cookie for the given id and incoming sequence
 // number.
 func (l *listenContext) createCookie(id stack.TransportEndpointID, seq seqnum.Value, data uint32) seqnum.Value {
@@ -182,8 +291,9 @@ func (l *listenContext) isCookieValid(id stack.TransportEndpointID, cookie seqnu
 }
 
 // createConnectedEndpoint creates a new connected endpoint, with the connection
-// parameters given by the arguments.
-func (l *listenContext) createConnectedEndpoint(s *segment, iss seqnum.Value, irs seqnum.Value, mss uint16, sndWndScale int) (*endpoint, error) {
+// parameters given by the arguments. Only the MSS and window scale of opts are
+// used.
+func (l *listenContext) createConnectedEndpoint(s *segment, iss seqnum.Value, irs seqnum.Value, opts synOptions) (*endpoint, error) {
 	// Create a new endpoint.
 	netProto := l.netProto
 	if netProto == 0 {
@@ -193,9 +303,25 @@ func (l *listenContext) createConnectedEndpoint(s *segment, iss seqnum.Value, ir
 	n.v6only = l.v6only
 	n.id = s.id
 	n.boundNICID = s.route.NICID()
+	n.ipOpts = l.ipOpts
 	n.route = s.route.Clone()
+	n.ipOpts.Apply(&n.route)
+	n.ecn = l.ecn
+	n.sack = l.sack
+	n.timestamps = l.timestamps
+	n.cc = l.cc
 	n.effectiveNetProtos = []tcpip.NetworkProtocolNumber{s.route.NetProto}
 	n.rcvBufSize = int(l.rcvWnd)
+	n.rcvAutoTune = l.rcvAutoTune
+	n.mark = l.mark
+	n.noDelay = l.noDelay
+	n.cork = l.cork
+	n.quickAck = l.quickAck
+	n.keepalive.enabled = l.keepaliveEnabled
+	n.keepalive.idle = l.keepaliveIdle
+	n.keepalive.interval = l.keepaliveInterval
+	n.keepalive.count = l.keepaliveCount
+	n.linger = l.linger
 
 	// Register new endpoint so that packets are routed to it.
 	if err := n.stack.RegisterTransportEndpoint(n.boundNICID, n.effectiveNetProtos, ProtocolNumber, n.id, n); err != nil {
@@ -210,7 +336,7 @@ func (l *listenContext) createConnectedEndpoint(s *segment, iss seqnum.Value, ir
 	//
 	// The receiver at least temporarily has a zero receive window scale,
 	// but the caller may change it (before starting the protocol loop).
-	n.snd = newSender(n, iss, irs, s.window, mss, sndWndScale)
+	n.snd = newSender(n, iss, irs, s.window, opts.mss, opts.ws, l.cc)
 	n.rcv = newReceiver(n, irs, l.rcvWnd, 0)
 
 	return n, nil
@@ -218,36 +344,59 @@ func (l *listenContext) createConnectedEndpoint(s *segment, iss seqnum.Value, ir
 
 // createEndpoint creates a new endpoint in connected state and then performs
 // the TCP 3-way handshake.
-func (l *listenContext) createEndpointAndPerformHandshake(s *segment, mss uint16, sndWndScale int) (*endpoint, error) {
+func (l *listenContext) createEndpointAndPerformHandshake(s *segment, opts synOptions) (*endpoint, error) {
 	// Create new endpoint.
 	irs := s.sequenceNumber
-	cookie := l.createCookie(s.id, irs, encodeMSS(mss))
-	ep, err := l.createConnectedEndpoint(s, cookie, irs, mss, sndWndScale)
+	cookie := l.createCookie(s.id, irs, encodeMSS(opts.mss))
+	ep, err := l.createConnectedEndpoint(s, cookie, irs, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	// Perform the 3-way handshake.
+	// Perform the 3-way handshake. ECN is used if the SYN requests it with
+	// both ECE and CWR set, per RFC 3168, section 6.1.1.
 	h, err := newHandshake(ep, l.rcvWnd)
 	if err != nil {
 		ep.Close()
 		return nil, err
 	}
 
-	h.resetToSynRcvd(cookie, irs, mss, sndWndScale)
+	ecn := l.ecn && s.flagIsSet(flagEce) && s.flagIsSet(flagCwr)
+	opts.sackPermitted = l.sack && opts.sackPermitted
+	opts.ts = l.timestamps && opts.ts
+	h.resetToSynRcvd(cookie, irs, opts, ecn)
+
+	// Hand out a Fast Open cookie if the SYN requests one, or carries an
+	// invalid one, in which case its data isn't acknowledged.
+	if l.fastOpen && opts.fastOpen {
+		h.fastOpen = true
+		h.fastOpenCookie = l.fastOpenCookie(s.id.RemoteAddress)
+	}
+
 	if err := h.execute(); err != nil {
 		ep.Close()
 		return nil, err
 	}
 
-	// Update the receive window scaling. We can't do it before the
-	// handshake because it's possible that the peer doesn't support window
-	// scaling.
-	ep.rcv.rcvWndScale = h.effectiveRcvWndScale()
+	ep.applyHandshake(&h)
 
 	return ep, nil
 }
 
+// applyHandshake updates the sender and receiver of an endpoint created by a
+// listener with the options agreed on by its completed handshake h. The receive
+// window scaling can't be updated before the handshake, because it's possible
+// that the peer doesn't support window scaling.
+func (e *endpoint) applyHandshake(h *handshake) {
+	e.rcv.rcvWndScale = h.effectiveRcvWndScale()
+	e.snd.ecn = h.ecn
+	e.snd.sackPermitted = h.sackPermitted
+	if h.ts {
+		e.snd.enableTimestamps(h.tsClockOffset)
+		e.rcv.updateTSRecent(h.tsRecent)
+	}
+}
+
 // deliverAccepted delivers the newly-accepted endpoint to the listener. If the
 // endpoint has transitioned out of the listen state, the new endpoint is
 // closed instead.
@@ -268,11 +417,11 @@ func (e *endpoint) deliverAccepted(n *endpoint) {
 //
 // A limited number of these goroutines are allowed before TCP starts using
 // SYN cookies to accept connections.
-func (e *endpoint) handleSynSegment(ctx *listenContext, s *segment, mss uint16, sndWndScale int) {
+func (e *endpoint) handleSynSegment(ctx *listenContext, s *segment, opts synOptions) {
 	defer decSynRcvdCount()
 	defer s.decRef()
 
-	n, err := ctx.createEndpointAndPerformHandshake(s, mss, sndWndScale)
+	n, err := ctx.createEndpointAndPerformHandshake(s, opts)
 	if err != nil {
 		return
 	}
@@ -280,30 +429,95 @@ func (e *endpoint) handleSynSegment(ctx *listenContext, s *segment, mss uint16,
 	e.deliverAccepted(n)
 }
 
+// sendCookie replies to the SYN segment s, with options opts, with a SYN-ACK
+// segment carrying a SYN cookie. The MSS is encoded in the cookie. If the
+// timestamps option is agreed on, the window scale and whether SACK and ECN are
+// agreed on are encoded in the TSval; otherwise, they are disabled.
+func (l *listenContext) sendCookie(s *segment, opts synOptions) {
+	cookie := l.createCookie(s.id, s.sequenceNumber, encodeMSS(opts.mss))
+	flags := uint8(flagSyn | flagAck)
+	synOpts := synOptions{ws: -1}
+	if l.timestamps && opts.ts {
+		if opts.ws >= 0 {
+			synOpts.ws = findRcvWndScale(l.stack, l.rcvWnd, l.rcvAutoTune)
+		}
+		synOpts.sackPermitted = l.sack && opts.sackPermitted
+		ecn := l.ecn && s.flagIsSet(flagEce) && s.flagIsSet(flagCwr)
+		if ecn {
+			flags |= flagEce
+		}
+		synOpts.ts = true
+		synOpts.tsVal = encodeSynOptions(tsClock(l.tsClockOffset(s.id)), opts.ws, synOpts.sackPermitted, ecn)
+		synOpts.tsEcr = opts.tsVal
+	}
+
+	sendSynTCP(&s.route, s.id, nil, flags, cookie, s.sequenceNumber+1, l.rcvWnd, synOpts)
+}
+
+// createCookieEndpoint creates a new connected endpoint for the ACK segment s,
+// which returned a valid SYN cookie encoding the given MSS. The other options
+// are decoded from the timestamp it echoes, if any.
+func (l *listenContext) createCookieEndpoint(s *segment, mss uint16) (*endpoint, error) {
+	opts := synOptions{mss: mss, ws: -1}
+	var sack, ecn bool
+	ts := l.timestamps && s.hasTimestamp
+	if ts {
+		opts.ws, sack, ecn = decodeSynOptions(s.tsEcr)
+	}
+
+	n, err := l.createConnectedEndpoint(s, s.ackNumber-1, s.sequenceNumber-1, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if ts {
+		if opts.ws >= 0 {
+			n.rcv.rcvWndScale = uint8(findRcvWndScale(l.stack, l.rcvWnd, l.rcvAutoTune))
+			n.snd.sndWnd <<= n.snd.sndWndScale
+		}
+		n.snd.sackPermitted = sack
+		n.snd.ecn = ecn
+		n.snd.enableTimestamps(l.tsClockOffset(s.id))
+		n.rcv.updateTSRecent(s.tsVal)
+	}
+
+	return n, nil
+}
+
 // handleListenSegment is called when a listening endpoint receives a segment
 // and needs to handle it.
 func (e *endpoint) handleListenSegment(ctx *listenContext, s *segment) {
-	switch s.flags {
+	// The ECN flags of SYN segments are only looked at once a handshake is
+	// started.
+	switch s.flags &^ (flagEce | flagCwr) {
 	case flagSyn:
-		mss, sws, ok := parseSynOptions(s)
+		opts, ok := parseSynOptions(s)
 		if !ok {
 			return
 		}
+
+		// A SYN with a valid Fast Open cookie is accepted right away,
+		// unless the accept queue is full.
+		if ctx.fastOpen && len(opts.fastOpenCookie) > 0 && len(e.acceptedChan) < cap(e.acceptedChan) && ctx.isFastOpenCookieValid(s.id.RemoteAddress, opts.fastOpenCookie) {
+			n, err := ctx.createFastOpenEndpoint(s, opts)
+			if err == nil {
+				e.deliverAccepted(n)
+			}
+			return
+		}
+
 		if incSynRcvdCount() {
 			s.incRef()
-			go e.handleSynSegment(ctx, s, mss, sws)
+			go e.handleSynSegment(ctx, s, opts)
 		} else {
-			cookie := ctx.createCookie(s.id, s.sequenceNumber, encodeMSS(mss))
-			// Send SYN with window scaling disabled because we
-			// currently can't encode this information in the
-			// cookie.
-			sendSynTCP(&s.route, s.id, flagSyn|flagAck, cookie, s.sequenceNumber+1, ctx.rcvWnd, -1)
+			ctx.ipOpts.Apply(&s.route)
+			ctx.sendCookie(s, opts)
 		}
 
 	case flagAck:
 		if data, ok := ctx.isCookieValid(s.id, s.ackNumber-1, s.sequenceNumber-1); ok && int(data) < len(mssTable) {
 			// Create newly accepted endpoint and deliver it.
-			n, err := ctx.createConnectedEndpoint(s, s.ackNumber-1, s.sequenceNumber-1, mssTable[data], -1)
+			n, err := ctx.createCookieEndpoint(s, mssTable[data])
 			if err == nil {
 				e.deliverAccepted(n)
 			}
@@ -327,13 +541,55 @@ func (e *endpoint) protocolListenLoop(rcvWnd seqnum.Size) error {
 
 		// Do cleanup if needed.
 		e.completeWorker()
+		e.answerInfoRequests()
 	}()
 
 	e.mu.Lock()
 	v6only := e.v6only
+	ipOpts := e.ipOpts
+	ecn := e.ecn
+	sack := e.sack
+	timestamps := e.timestamps
+	cc := e.cc
+	fastOpen := e.fastOpen
+	mark := e.mark
+	quickAck := e.quickAck
+	linger := e.linger
 	e.mu.Unlock()
 
+	e.sndBufMu.Lock()
+	noDelay := e.noDelay
+	cork := e.cork
+	e.sndBufMu.Unlock()
+
+	e.keepalive.Lock()
+	keepaliveEnabled := e.keepalive.enabled
+	keepaliveIdle := e.keepalive.idle
+	keepaliveInterval := e.keepalive.interval
+	keepaliveCount := e.keepalive.count
+	e.keepalive.Unlock()
+
+	e.rcvListMu.Lock()
+	rcvAutoTune := e.rcvAutoTune
+	e.rcvListMu.Unlock()
+
 	ctx := newListenContext(e.stack, rcvWnd, v6only, e.netProto)
+	ctx.ipOpts = ipOpts
+	ctx.ecn = ecn
+	ctx.sack = sack
+	ctx.timestamps = timestamps
+	ctx.cc = cc
+	ctx.rcvAutoTune = rcvAutoTune
+	ctx.fastOpen = fastOpen
+	ctx.mark = mark
+	ctx.noDelay = noDelay
+	ctx.cork = cork
+	ctx.quickAck = quickAck
+	ctx.keepaliveEnabled = keepaliveEnabled
+	ctx.keepaliveIdle = keepaliveIdle
+	ctx.keepaliveInterval = keepaliveInterval
+	ctx.keepaliveCount = keepaliveCount
+	ctx.linger = linger
 
 	s := sleep.Sleeper{}
 	s.AddWaker(&e.notificationWaker, wakerForNotification)
@@ -345,6 +601,9 @@ func (e *endpoint) protocolListenLoop(rcvWnd seqnum.Size) error {
 			if n&notifyClose != 0 {
 				return nil
 			}
+			if n&notifyInfoRequested != 0 {
+				e.answerInfoRequests()
+			}
 
 		case wakerForNewSegment:
 			// Process at most maxSegmentsPerWake segments.
@@ -0,0 +1,76 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	// Reno is the name of the Reno congestion control algorithm (RFC
+	// 5681), which is the default.
+	Reno tcpip.CongestionControlOption = "reno"
+
+	// Cubic is the name of the CUBIC congestion control algorithm (RFC
+	// 8312).
+	Cubic tcpip.CongestionControlOption = "cubic"
+)
+
+// congestionControl is implemented by the congestion control algorithms. They
+// update the congestion window and slow start threshold of the sender they
+// belong to, which calls them from its protocol goroutine.
+type congestionControl interface {
+	// onAck is called when packetsAcked packets are acknowledged, to grow
+	// the congestion window.
+	onAck(packetsAcked int)
+
+	// onLoss is called when congestion is detected, either because a
+	// segment is considered lost or because the peer echoed a congestion
+	// notification. It updates the slow start threshold, which the sender
+	// then uses as its congestion window.
+	onLoss()
+
+	// onRTO is called when the retransmit timer expires, after onLoss if
+	// the sender wasn't already recovering. It resets the congestion
+	// window.
+	onRTO()
+
+	// onRecoveryExit is called when fast recovery ends, to deflate the
+	// congestion window.
+	onRecoveryExit()
+}
+
+// congestionControls holds the constructors of the congestion control
+// algorithms, by name.
+var congestionControls = map[tcpip.CongestionControlOption]func(*sender) congestionControl{
+	Reno:  newRenoCC,
+	Cubic: newCubicCC,
+}
+
+// validCongestionControl returns whether there is a congestion control
+// algorithm with the given name.
+func validCongestionControl(name tcpip.CongestionControlOption) bool {
+	_, ok := congestionControls[name]
+	return ok
+}
+
+// slowStart grows the congestion window of s by one packet per packet
+// acknowledged, per RFC 5681, section 3.1, without letting it cross into
+// congestion avoidance. It returns the number of acknowledged packets left to
+// be consumed by congestion avoidance.
+func (s *sender) slowStart(packetsAcked int) int {
+	if s.sndCwnd >= s.sndSsthresh {
+		return packetsAcked
+	}
+
+	newcwnd := s.sndCwnd + packetsAcked
+	if newcwnd > s.sndSsthresh {
+		newcwnd = s.sndSsthresh
+	}
+
+	packetsAcked -= newcwnd - s.sndCwnd
+	s.sndCwnd = newcwnd
+	return packetsAcked
+}
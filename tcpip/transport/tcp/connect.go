@@ -6,6 +6,7 @@ package tcp
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"time"
 
 	"github.com/google/netstack/sleep"
@@ -39,6 +40,9 @@ const (
 	wakerForNotification = iota
 	wakerForNewSegment
 	wakerForResend
+	wakerForTimeWait
+	wakerForSend
+	wakerForSendClose
 )
 
 const (
@@ -73,19 +77,86 @@ type handshake struct {
 
 	// rcvWndScale is the receive window scale, as defined in RFC 1323.
 	rcvWndScale int
+
+	// ecn indicates whether ECN is requested by the SYN segment of an
+	// active handshake, or agreed on in a passive one. Once the handshake
+	// is completed, it indicates whether the connection uses ECN.
+	ecn bool
+
+	// sackPermitted indicates whether selective acknowledgements are
+	// offered by the SYN segment of an active handshake, or agreed on in a
+	// passive one. Once the handshake is completed, it indicates whether
+	// the connection uses them.
+	sackPermitted bool
+
+	// ts indicates whether the timestamps option is offered by the SYN
+	// segment of an active handshake, or agreed on in a passive one. Once
+	// the handshake is completed, it indicates whether the connection uses
+	// it.
+	ts bool
+
+	// tsRecent is the last timestamp received from the peer, to be echoed
+	// in the segments sent, and tsClockOffset is the offset of the
+	// timestamp clock of the connection. They're only used if ts is true.
+	tsRecent      uint32
+	tsClockOffset uint32
+
+	// fastOpen indicates whether the SYN or SYN-ACK segment carries a Fast
+	// Open option, with fastOpenCookie as its cookie. In an active
+	// handshake, an empty cookie requests one, and synData is the data
+	// sent along with a cookie.
+	fastOpen       bool
+	fastOpenCookie []byte
+	synData        buffer.View
+
+	// synDataAcked is the number of bytes of synData acknowledged by the
+	// SYN-ACK segment. The peer may acknowledge only part of it.
+	synDataAcked int
+
+	// synRetransmitted indicates whether the SYN segment was retransmitted.
+	// Retransmitted SYN segments of an active handshake don't carry
+	// synData, per RFC 7413, section 4.2.1, in case the network dropped
+	// the SYN segment because of it.
+	synRetransmitted bool
+
+	// synSent indicates whether the SYN-ACK segment of a passive handshake
+	// was sent before it's executed, in which case it's only sent again
+	// when the retransmission timer fires.
+	synSent bool
 }
 
 func newHandshake(ep *endpoint, rcvWnd seqnum.Size) (handshake, error) {
+	ep.mu.RLock()
+	ecn := ep.ecn
+	sack := ep.sack
+	ts := ep.timestamps
+	ep.mu.RUnlock()
+
+	ep.rcvListMu.Lock()
+	autoTune := ep.rcvAutoTune
+	ep.rcvListMu.Unlock()
+
 	h := handshake{
-		ep:          ep,
-		active:      true,
-		rcvWnd:      rcvWnd,
-		rcvWndScale: findWndScale(rcvWnd),
+		ep:            ep,
+		active:        true,
+		rcvWnd:        rcvWnd,
+		rcvWndScale:   findRcvWndScale(ep.stack, rcvWnd, autoTune),
+		ecn:           ecn,
+		sackPermitted: sack,
+		ts:            ts,
 	}
 	if err := h.resetState(); err != nil {
 		return handshake{}, err
 	}
 
+	// Start the timestamp clock of the connection at a random offset, as
+	// recommended by RFC 7323, section 5.4.
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return handshake{}, err
+	}
+	h.tsClockOffset = binary.BigEndian.Uint32(b[:])
+
 	return h, nil
 }
 
@@ -106,6 +177,19 @@ func findWndScale(wnd seqnum.Size) int {
 	return s
 }
 
+// findRcvWndScale determines the window scale to use for a receive window of
+// rcvWnd bytes. If the receive buffer is auto-tuned, the scale allows for a
+// window as large as the largest receive buffer of stack s.
+func findRcvWndScale(s *stack.Stack, rcvWnd seqnum.Size, autoTune bool) int {
+	if autoTune {
+		var rs tcpip.ReceiveBufferSizeRangeOption
+		if err := s.TransportProtocolOption(ProtocolNumber, &rs); err == nil && seqnum.Size(rs.Max) > rcvWnd {
+			rcvWnd = seqnum.Size(rs.Max)
+		}
+	}
+	return findWndScale(rcvWnd)
+}
+
 // resetState resets the state of the handshake object such that it becomes
 // ready for a new 3-way handshake.
 func (h *handshake) resetState() error {
@@ -116,6 +200,11 @@ func (h *handshake) resetState() error {
 
 	h.state = handshakeSynSent
 	h.flags = flagSyn
+	if h.ecn {
+		// Request ECN with an ECN-setup SYN, per RFC 3168, section
+		// 6.1.1.
+		h.flags |= flagEce | flagCwr
+	}
 	h.ackNum = 0
 	h.mss = 0
 	h.iss = seqnum.Value(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24)
@@ -134,22 +223,30 @@ func (h *handshake) effectiveRcvWndScale() uint8 {
 }
 
 // resetToSynRcvd resets the state of the handshake object to the SYN-RCVD
-// state.
-func (h *handshake) resetToSynRcvd(iss seqnum.Value, irs seqnum.Value, mss uint16, sndWndScale int) {
+// state. opts are the options of the SYN segment, restricted to the ones the
+// SYN-ACK agrees to use, and ecn indicates whether it agrees to use ECN.
+func (h *handshake) resetToSynRcvd(iss seqnum.Value, irs seqnum.Value, opts synOptions, ecn bool) {
 	h.active = false
 	h.state = handshakeSynRcvd
 	h.flags = flagSyn | flagAck
+	h.ecn = ecn
+	if ecn {
+		h.flags |= flagEce
+	}
+	h.sackPermitted = opts.sackPermitted
+	h.ts = opts.ts
+	h.tsRecent = opts.tsVal
 	h.iss = iss
 	h.ackNum = irs + 1
-	h.mss = mss
-	h.sndWndScale = sndWndScale
+	h.mss = opts.mss
+	h.sndWndScale = opts.ws
 }
 
 // checkAck checks if the ACK number, if present, of a segment received during
 // a TCP 3-way handshake is valid. If it's not, a RST segment is sent back in
 // response.
 func (h *handshake) checkAck(s *segment) bool {
-	if s.flagIsSet(flagAck) && s.ackNumber != h.iss+1 {
+	if s.flagIsSet(flagAck) && !h.acceptableAck(s.ackNumber) {
 		// RFC 793, page 36, states that a reset must be generated when
 		// the connection is in any non-synchronized state and an
 		// incoming segment acknowledges something not yet sent. The
@@ -162,13 +259,19 @@ func (h *handshake) checkAck(s *segment) bool {
 	return true
 }
 
+// acceptableAck checks if ack acknowledges the SYN segment of the handshake,
+// and possibly some or all of the data it carries.
+func (h *handshake) acceptableAck(ack seqnum.Value) bool {
+	return ack.InRange(h.iss+1, h.iss.Add(seqnum.Size(2+len(h.synData))))
+}
+
 // synSentState handles a segment received when the TCP 3-way handshake is in
 // the SYN-SENT state.
 func (h *handshake) synSentState(s *segment) error {
 	// RFC 793, page 37, states that in the SYN-SENT state, a reset is
 	// acceptable if the ack field acknowledges the SYN.
 	if s.flagIsSet(flagRst) {
-		if s.flagIsSet(flagAck) && s.ackNumber == h.iss+1 {
+		if s.flagIsSet(flagAck) && h.acceptableAck(s.ackNumber) {
 			return tcpip.ErrConnectionRefused
 		}
 		return nil
@@ -185,22 +288,37 @@ func (h *handshake) synSentState(s *segment) error {
 	}
 
 	// Parse the SYN options. Ignore the segment if it's invalid.
-	mss, sws, ok := parseSynOptions(s)
+	opts, ok := parseSynOptions(s)
 	if !ok {
 		return nil
 	}
 
-	// Remember the sequence we'll ack from now on.
+	// Remember the sequence we'll ack from now on. ECN is only used if
+	// the peer agrees with an ECN-setup SYN-ACK, which has ECE set but
+	// not CWR; in a simultaneous open, it isn't used at all.
 	h.ackNum = s.sequenceNumber + 1
-	h.flags |= flagAck
-	h.mss = mss
-	h.sndWndScale = sws
+	h.flags = h.flags&^(flagEce|flagCwr) | flagAck
+	h.ecn = h.ecn && s.flags&(flagAck|flagEce|flagCwr) == flagAck|flagEce
+	h.mss = opts.mss
+	h.sndWndScale = opts.ws
+	h.sackPermitted = h.sackPermitted && opts.sackPermitted
+	h.ts = h.ts && opts.ts
+	h.tsRecent = opts.tsVal
 
 	// If this is a SYN ACK response, we only need to acknowledge the SYN
 	// and the handshake is completed.
 	if s.flagIsSet(flagAck) {
 		h.state = handshakeCompleted
-		h.ep.sendRaw(nil, flagAck, h.iss+1, h.ackNum, h.rcvWnd>>h.effectiveRcvWndScale())
+		seq := h.iss + 1
+		if h.fastOpen {
+			h.completeFastOpen(s, opts)
+			seq = seq.Add(seqnum.Size(h.synDataAcked))
+		}
+		var tsOpt []byte
+		if h.ts {
+			tsOpt = header.AppendTimestampOption(nil, tsClock(h.tsClockOffset), h.tsRecent)
+		}
+		sendTCPWithOptions(&h.ep.route, h.ep.id, nil, flagAck, seq, h.ackNum, h.rcvWnd>>h.effectiveRcvWndScale(), tsOpt)
 		return nil
 	}
 
@@ -208,7 +326,8 @@ func (h *handshake) synSentState(s *segment) error {
 	// but resend our own SYN and wait for it to be acknowledged in the
 	// SYN-RCVD state.
 	h.state = handshakeSynRcvd
-	sendSynTCP(&s.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, h.rcvWndScale)
+	h.synRetransmitted = true
+	h.sendSyn(&s.route)
 
 	return nil
 }
@@ -248,13 +367,16 @@ func (h *handshake) synRcvdState(s *segment) error {
 			return err
 		}
 
-		sendSynTCP(&s.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, h.rcvWndScale)
+		h.sendSyn(&s.route)
 		return nil
 	}
 
 	// We have previously received (and acknowledged) the peer's SYN. If the
 	// peer acknowledges our SYN, the handshake is completed.
 	if s.flagIsSet(flagAck) {
+		if h.ts && s.hasTimestamp {
+			h.tsRecent = s.tsVal
+		}
 		h.state = handshakeCompleted
 		return nil
 	}
@@ -322,9 +444,11 @@ func (h *handshake) execute() error {
 	s.AddWaker(&h.ep.newSegmentWaker, wakerForNewSegment)
 	defer s.Done()
 
-	// Send the initial SYN segment and loop until the handshake is
-	// completed.
-	sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, h.rcvWndScale)
+	// Send the initial SYN segment, unless already sent, and loop until
+	// the handshake is completed.
+	if !h.synSent {
+		h.sendSyn(&h.ep.route)
+	}
 	for h.state != handshakeCompleted {
 		switch index, _ := s.Fetch(true); index {
 		case wakerForResend:
@@ -333,13 +457,17 @@ func (h *handshake) execute() error {
 				return tcpip.ErrTimeout
 			}
 			rt.Reset(timeOut)
-			sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, h.rcvWndScale)
+			h.synRetransmitted = true
+			h.sendSyn(&h.ep.route)
 
 		case wakerForNotification:
 			n := h.ep.fetchNotifications()
 			if n&notifyClose != 0 {
 				return tcpip.ErrAborted
 			}
+			if n&notifyInfoRequested != 0 {
+				h.ep.answerInfoRequests()
+			}
 
 		case wakerForNewSegment:
 			if err := h.processSegments(); err != nil {
@@ -351,15 +479,64 @@ func (h *handshake) execute() error {
 	return nil
 }
 
+// sendSyn sends the SYN or SYN-ACK segment of the handshake through r.
+func (h *handshake) sendSyn(r *stack.Route) {
+	data := h.synData
+	if h.synRetransmitted {
+		data = nil
+	}
+	sendSynTCP(r, h.ep.id, data, h.flags, h.iss, h.ackNum, h.rcvWnd, synOptions{
+		ws:             h.rcvWndScale,
+		sackPermitted:  h.sackPermitted,
+		ts:             h.ts,
+		tsVal:          tsClock(h.tsClockOffset),
+		tsEcr:          h.tsRecent,
+		fastOpen:       h.fastOpen,
+		fastOpenCookie: h.fastOpenCookie,
+	})
+}
+
+// synOptions holds the options of a syn segment.
+type synOptions struct {
+	// mss is the maximum segment size announced by the peer. It is not
+	// used when sending, as the MSS is derived from the MTU of the route.
+	mss uint16
+
+	// ws is the window scale announced by the peer, or -1 if it didn't
+	// send the option; this is because the absence of the option
+	// indicates that we cannot use window scaling on the receive end
+	// either.
+	ws int
+
+	// sackPermitted indicates whether selective acknowledgements are
+	// offered.
+	sackPermitted bool
+
+	// ts indicates whether the timestamps option is present, in which
+	// case tsVal and tsEcr hold its fields.
+	ts    bool
+	tsVal uint32
+	tsEcr uint32
+
+	// fastOpen indicates whether the Fast Open option is present, in which
+	// case fastOpenCookie holds its cookie, if any. A received cookie of
+	// invalid size is ignored.
+	fastOpen       bool
+	fastOpenCookie []byte
+}
+
 // parseSynOptions parses the options received in a syn segment and returns the
-// relevant ones. If no window scale option is specified, ws is returned as -1;
-// this is because the absence of the option indicates that the we cannot use
-// window scaling on the receive end either.
-func parseSynOptions(s *segment) (mss uint16, ws int, ok bool) {
+// relevant ones.
+func parseSynOptions(s *segment) (synOptions, bool) {
 	// Per RFC 1122, page 85: "If an MSS option is not received at
 	// connection setup, TCP MUST assume a default send MSS of 536."
-	mss = 536
-	ws = -1
+	mss := uint16(536)
+	ws := -1
+	sackPermitted := false
+	ts := false
+	var tsVal, tsEcr uint32
+	fastOpen := false
+	var fastOpenCookie []byte
 	opts := s.options
 	limit := len(opts)
 	for i := 0; i < limit; {
@@ -370,17 +547,17 @@ func parseSynOptions(s *segment) (mss uint16, ws int, ok bool) {
 			i++
 		case header.TCPOptionMSS:
 			if i+4 > limit || opts[i+1] != 4 {
-				return 0, -1, false
+				return synOptions{}, false
 			}
 			mss = uint16(opts[i+2])<<8 | uint16(opts[i+3])
 			if mss == 0 {
-				return 0, -1, false
+				return synOptions{}, false
 			}
 			i += 4
 
 		case header.TCPOptionWS:
 			if i+3 > limit || opts[i+1] != 3 {
-				return 0, -1, false
+				return synOptions{}, false
 			}
 			ws = int(opts[i+2])
 			if ws > maxWndScale {
@@ -388,39 +565,83 @@ func parseSynOptions(s *segment) (mss uint16, ws int, ok bool) {
 			}
 			i += 3
 
+		case header.TCPOptionSACKPermitted:
+			if i+2 > limit || opts[i+1] != 2 {
+				return synOptions{}, false
+			}
+			sackPermitted = true
+			i += 2
+
+		case header.TCPOptionTS:
+			if i+10 > limit || opts[i+1] != 10 {
+				return synOptions{}, false
+			}
+			ts = true
+			tsVal = binary.BigEndian.Uint32(opts[i+2:])
+			tsEcr = binary.BigEndian.Uint32(opts[i+6:])
+			i += 10
+
+		case header.TCPOptionFastOpen:
+			if i+2 > limit || opts[i+1] < 2 || i+int(opts[i+1]) > limit {
+				return synOptions{}, false
+			}
+			fastOpen = true
+			// The cookie is copied, as it may outlive the segment.
+			if l := int(opts[i+1]) - 2; l >= header.TCPFastOpenCookieMinimumSize && l <= header.TCPFastOpenCookieMaximumSize {
+				fastOpenCookie = append([]byte(nil), opts[i+2:i+2+l]...)
+			}
+			i += int(opts[i+1])
+
 		default:
 			// We don't recognize this option, just skip over it.
 			if i+2 > limit {
-				return 0, -1, false
+				return synOptions{}, false
 			}
 			l := int(opts[i+1])
 			if i < 2 || i+l > limit {
-				return 0, -1, false
+				return synOptions{}, false
 			}
 			i += l
 		}
 	}
 
-	return mss, ws, true
+	return synOptions{
+		mss:            mss,
+		ws:             ws,
+		sackPermitted:  sackPermitted,
+		ts:             ts,
+		tsVal:          tsVal,
+		tsEcr:          tsEcr,
+		fastOpen:       fastOpen,
+		fastOpenCookie: fastOpenCookie,
+	}, true
 }
 
-func sendSynTCP(r *stack.Route, id stack.TransportEndpointID, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, rcvWndScale int) error {
+// sendSynTCP sends a SYN segment with the MSS option, along with the WS option
+// unless opts.ws is negative (disabled), and the SACK-permitted, timestamps and
+// Fast Open options if enabled in opts. data is only sent with Fast Open.
+func sendSynTCP(r *stack.Route, id stack.TransportEndpointID, data buffer.View, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts synOptions) error {
 	// Initialize the options.
 	mss := r.MTU() - header.TCPMinimumSize
-	options := []byte{
-		// Initialize the MSS option.
-		header.TCPOptionMSS, 4, byte(mss >> 8), byte(mss),
+	options := []byte{header.TCPOptionMSS, 4, byte(mss >> 8), byte(mss)}
 
-		// Initialize the WS option. It must be the last one so that it
-		// can be removed if rcvWndScale is negative (disabled).
-		header.TCPOptionWS, 3, uint8(rcvWndScale), header.TCPOptionNOP,
+	if opts.ws >= 0 {
+		options = append(options, header.TCPOptionWS, 3, uint8(opts.ws), header.TCPOptionNOP)
 	}
 
-	if rcvWndScale < 0 {
-		options = options[:len(options)-4]
+	if opts.sackPermitted {
+		options = append(options, header.TCPOptionNOP, header.TCPOptionNOP, header.TCPOptionSACKPermitted, 2)
 	}
 
-	return sendTCPWithOptions(r, id, nil, flags, seq, ack, rcvWnd, options)
+	if opts.ts {
+		options = header.AppendTimestampOption(options, opts.tsVal, opts.tsEcr)
+	}
+
+	if opts.fastOpen {
+		options = appendFastOpenOption(options, opts.fastOpenCookie)
+	}
+
+	return sendTCPWithOptions(r, id, data, flags, seq, ack, rcvWnd, options)
 }
 
 // sendTCPWithOptions sends a TCP segment with the provided options via the
@@ -516,6 +737,9 @@ func (e *endpoint) handleWrite() bool {
 		e.sndBufInQueue = 0
 	}
 
+	e.snd.nagle = !e.noDelay
+	e.snd.cork = e.cork
+
 	e.sndBufMu.Unlock()
 
 	// Initialize the next segment to write if it's currently nil.
@@ -540,6 +764,7 @@ func (e *endpoint) handleClose() bool {
 
 	// Queue the FIN packet and mark send side as closed.
 	e.snd.closed = true
+	e.snd.activeClose = !e.rcv.closed
 	e.snd.sndNxtList++
 
 	// Push out the FIN packet.
@@ -560,6 +785,57 @@ func (e *endpoint) resetConnection(err error) {
 	e.mu.Unlock()
 }
 
+// resetKeepaliveTimer restarts the keepalive timer, or stops it if keepalive is
+// disabled. The count of unanswered probes is reset if receivedData is true.
+func (e *endpoint) resetKeepaliveTimer(receivedData bool) {
+	e.keepalive.Lock()
+	defer e.keepalive.Unlock()
+
+	if receivedData {
+		e.keepalive.unacked = 0
+	}
+
+	if !e.keepalive.enabled {
+		e.keepalive.timer.Stop()
+		return
+	}
+
+	// Probes are sent after the connection has been idle for a while, and
+	// then at regular intervals until the peer answers.
+	if e.keepalive.unacked == 0 {
+		e.keepalive.timer.Reset(e.keepalive.idle)
+	} else {
+		e.keepalive.timer.Reset(e.keepalive.interval)
+	}
+}
+
+// keepaliveTimerExpired is called when the keepalive timer expires, to send a
+// probe. It returns ErrTimeout if too many probes were left unanswered.
+func (e *endpoint) keepaliveTimerExpired() error {
+	e.keepalive.Lock()
+	if !e.keepalive.enabled {
+		e.keepalive.Unlock()
+		return nil
+	}
+
+	if e.keepalive.unacked >= e.keepalive.count {
+		e.keepalive.Unlock()
+		return tcpip.ErrTimeout
+	}
+
+	// RFC 1122, section 4.2.3.6, recommends probes with a sequence number
+	// one less than the next one, which the peer answers with an ACK.
+	// Outstanding data is probed by retransmissions instead.
+	if e.snd.sndUna == e.snd.sndNxt {
+		e.keepalive.unacked++
+		e.snd.sendSegment(nil, flagAck, e.snd.sndNxt-1)
+	}
+	e.keepalive.Unlock()
+
+	e.resetKeepaliveTimer(false)
+	return nil
+}
+
 // completeWorker is called by the worker goroutine when it's about to exit. It
 // marks the worker as completed and performs cleanup work if requested by
 // Close().
@@ -577,12 +853,15 @@ func (e *endpoint) completeWorker() {
 // true if the protocol loop should continue, false otherwise.
 func (e *endpoint) handleSegments() bool {
 	checkRequeue := true
+	received := false
 	for i := 0; i < maxSegmentsPerWake; i++ {
 		s := e.segmentQueue.dequeue()
 		if s == nil {
 			checkRequeue = false
 			break
 		}
+		received = true
+		e.rcv.segmentsReceived++
 
 		if s.flagIsSet(flagRst) {
 			if e.rcv.acceptable(s.sequenceNumber, 0) {
@@ -604,9 +883,14 @@ func (e *endpoint) handleSegments() bool {
 
 			// RFC 793, page 41 states that "once in the ESTABLISHED
 			// state all segments must carry current acknowledgment
-			// information."
-			e.rcv.handleRcvdSegment(s)
-			e.snd.handleRcvdSegment(s)
+			// information." Segments failing the PAWS check of RFC
+			// 7323, section 5.3, are only acknowledged.
+			if e.snd.timestamps && !e.rcv.checkTimestamp(s) {
+				e.snd.sendAck()
+			} else {
+				e.rcv.handleRcvdSegment(s)
+				e.snd.handleRcvdSegment(s)
+			}
 		}
 		s.decRef()
 	}
@@ -617,31 +901,71 @@ func (e *endpoint) handleSegments() bool {
 		e.newSegmentWaker.Assert()
 	}
 
-	// Send an ACK for all processed packets if needed.
+	// The peer is alive, so keepalive probes only resume once the
+	// connection is idle again.
+	if received {
+		e.resetKeepaliveTimer(true)
+	}
+
+	// Send an ACK for all processed packets if needed, unless it can be
+	// delayed.
 	if e.rcv.rcvNxt != e.snd.maxSentAck {
-		e.snd.sendAck()
+		if e.rcv.ackNow {
+			e.snd.sendAck()
+		} else {
+			e.rcv.delayAck()
+		}
 	}
 
 	return true
 }
 
+// handshakeFailed puts the endpoint in an error state after its handshake
+// failed with err.
+func (e *endpoint) handshakeFailed(err error) {
+	e.lastErrorMu.Lock()
+	e.lastError = err
+	e.lastErrorMu.Unlock()
+
+	e.mu.Lock()
+	e.state = stateError
+	e.hardError = err
+	e.fastOpenPending = false
+	e.mu.Unlock()
+}
+
 // protocolMainLoop is the main loop of the TCP protocol. It runs in its own
 // goroutine and is responsible for sending segments and handling received
 // segments.
 func (e *endpoint) protocolMainLoop(passive bool) error {
-	var closeTimer *time.Timer
-	var closeWaker sleep.Waker
+	var closed bool
+	var lingerTimer, finWait2Timer *time.Timer
+	var lingerWaker, finWait2Waker sleep.Waker
 
 	defer func() {
 		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
 		e.completeWorker()
+		e.answerInfoRequests()
 
 		if e.snd != nil {
 			e.snd.resendTimer.Stop()
+			e.snd.corkTimer.Stop()
+		}
+
+		if e.rcv != nil {
+			e.rcv.ackTimer.Stop()
 		}
 
-		if closeTimer != nil {
-			closeTimer.Stop()
+		if e.keepalive.timer != nil {
+			e.keepalive.timer.Stop()
+		}
+
+		if lingerTimer != nil {
+			lingerTimer.Stop()
+		}
+
+		if finWait2Timer != nil {
+			finWait2Timer.Stop()
 		}
 	}()
 
@@ -650,39 +974,81 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 		// handshake, and then inform potential waiters about its
 		// completion.
 		h, err := newHandshake(e, seqnum.Size(e.receiveBufferAvailable()))
+		if err == nil {
+			err = e.prepareFastOpen(&h)
+		}
 		if err == nil {
 			err = h.execute()
 		}
 		if err != nil {
-			e.lastErrorMu.Lock()
-			e.lastError = err
-			e.lastErrorMu.Unlock()
-
-			e.mu.Lock()
-			e.state = stateError
-			e.hardError = err
-			e.mu.Unlock()
-
+			e.handshakeFailed(err)
 			return err
 		}
 
+		// Data sent in the SYN segment and acknowledged by the peer is
+		// removed from the send queue, and the sender starts after it.
+		// Unacknowledged data, and any other data written during the
+		// handshake, is sent once the main loop starts.
+		iss := h.iss
+		if h.synDataAcked > 0 {
+			e.dropSynData(h.synDataAcked)
+			iss = iss.Add(seqnum.Size(h.synDataAcked))
+		}
+		if h.fastOpen {
+			e.sndWaker.Assert()
+		}
+
 		// Transfer handshake state to TCP connection. We disable
 		// receive window scaling if the peer doesn't support it
 		// (indicated by a negative send window scale).
-		e.snd = newSender(e, h.iss, h.ackNum-1, h.sndWnd, h.mss, h.sndWndScale)
+		e.mu.RLock()
+		cc := e.cc
+		e.mu.RUnlock()
+		e.snd = newSender(e, iss, h.ackNum-1, h.sndWnd, h.mss, h.sndWndScale, cc)
+		e.snd.ecn = h.ecn
+		e.snd.sackPermitted = h.sackPermitted
+		if h.ts {
+			e.snd.enableTimestamps(h.tsClockOffset)
+		}
 
 		e.rcvListMu.Lock()
 		e.rcv = newReceiver(e, h.ackNum-1, h.rcvWnd, h.effectiveRcvWndScale())
+		e.rcv.updateTSRecent(h.tsRecent)
+		e.rcvListMu.Unlock()
+	} else if h := e.synRcvd; h != nil {
+		// This connection was accepted with Fast Open, so its
+		// handshake must be completed first. It is reported as
+		// SYN-RCVD until then.
+		err := h.execute()
+		e.synRcvd = nil
+		if err != nil {
+			e.handshakeFailed(err)
+			return err
+		}
+
+		e.rcvListMu.Lock()
+		e.applyHandshake(h)
 		e.rcvListMu.Unlock()
 	}
 
-	// Tell waiters that the endpoint is connected and writable.
+	// Tell waiters that the endpoint is connected and writable. IP options
+	// set during the handshake are applied to the route at this point.
 	e.mu.Lock()
 	e.state = stateConnected
+	e.fastOpenPending = false
+	e.ipOpts.Apply(&e.route)
+	e.rcv.quickAck = e.quickAck
 	e.mu.Unlock()
 
 	e.waiterQueue.Notify(waiter.EventOut)
 
+	// Start probing the peer once the connection is idle, if keepalive
+	// is enabled.
+	e.keepalive.timer = time.AfterFunc(time.Hour, func() {
+		e.keepalive.waker.Assert()
+	})
+	e.resetKeepaliveTimer(true)
+
 	// Set up the functions that will be called when the main protocol loop
 	// wakes up.
 	funcs := []struct {
@@ -702,7 +1068,19 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 			f: e.handleSegments,
 		},
 		{
-			w: &closeWaker,
+			w: &lingerWaker,
+			f: func() bool {
+				// Nothing to do if the peer acknowledged our
+				// FIN in time.
+				if e.snd.closed && e.snd.sndUna == e.snd.sndNxtList {
+					return true
+				}
+				e.resetConnection(tcpip.ErrConnectionAborted)
+				return false
+			},
+		},
+		{
+			w: &finWait2Waker,
 			f: func() bool {
 				e.resetConnection(tcpip.ErrConnectionAborted)
 				return false
@@ -718,6 +1096,30 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 				return true
 			},
 		},
+		{
+			w: &e.keepalive.waker,
+			f: func() bool {
+				if err := e.keepaliveTimerExpired(); err != nil {
+					e.resetConnection(err)
+					return false
+				}
+				return true
+			},
+		},
+		{
+			w: &e.rcv.ackWaker,
+			f: func() bool {
+				e.rcv.ackTimerExpired()
+				return true
+			},
+		},
+		{
+			w: &e.snd.corkWaker,
+			f: func() bool {
+				e.snd.corkTimerExpired()
+				return true
+			},
+		},
 		{
 			w: &e.notificationWaker,
 			f: func() bool {
@@ -730,12 +1132,44 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 					e.rcv.pendingBufSize = seqnum.Size(e.receiveBufferSize())
 				}
 
-				if n&notifyClose != 0 && closeTimer == nil {
-					// Reset the connection 3 seconds after the
-					// endpoint has been closed.
-					closeTimer = time.AfterFunc(3*time.Second, func() {
-						closeWaker.Assert()
-					})
+				if n&notifyIPOptionsChanged != 0 {
+					e.mu.Lock()
+					e.ipOpts.Apply(&e.route)
+					e.mu.Unlock()
+				}
+
+				if n&notifyKeepaliveChanged != 0 {
+					e.resetKeepaliveTimer(false)
+				}
+
+				if n&notifyQuickAckChanged != 0 {
+					e.mu.RLock()
+					e.rcv.quickAck = e.quickAck
+					e.mu.RUnlock()
+				}
+
+				if n&notifyInfoRequested != 0 {
+					e.answerInfoRequests()
+				}
+
+				if n&notifyAbort != 0 {
+					e.resetConnection(tcpip.ErrConnectionAborted)
+					return false
+				}
+
+				if n&notifyClose != 0 && !closed {
+					closed = true
+
+					// Bound the time it takes to close the
+					// connection if the endpoint lingers.
+					e.mu.RLock()
+					linger := e.linger
+					e.mu.RUnlock()
+					if linger.Enabled {
+						lingerTimer = time.AfterFunc(linger.Timeout, func() {
+							lingerWaker.Assert()
+						})
+					}
 				}
 				return true
 			},
@@ -757,12 +1191,172 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 		if !funcs[v].f() {
 			return nil
 		}
+
+		// Once our FIN is acknowledged, a closed endpoint only waits
+		// for the FIN of the peer for a limited time.
+		if closed && finWait2Timer == nil && e.snd.closed && e.snd.sndUna == e.snd.sndNxtList && !e.rcv.closed {
+			var timeout tcpip.FinWait2TimeoutOption
+			if err := e.stack.TransportProtocolOption(ProtocolNumber, &timeout); err != nil {
+				timeout = tcpip.FinWait2TimeoutOption(defaultFinWait2Timeout)
+			}
+			finWait2Timer = time.AfterFunc(time.Duration(timeout), func() {
+				finWait2Waker.Assert()
+			})
+		}
 	}
 
-	// Mark endpoint as closed.
+	// Mark endpoint as closed, unless it has been closed by the
+	// application already.
 	e.mu.Lock()
-	e.state = stateClosed
+	if e.state == stateConnected {
+		e.state = stateClosed
+	}
 	e.mu.Unlock()
 
+	// The endpoint that closed the connection first holds on to it in
+	// TIME_WAIT.
+	if e.snd.activeClose {
+		e.doTimeWait()
+	}
+
 	return nil
 }
+
+// doTimeWait keeps the connection in TIME_WAIT for twice the maximum segment
+// lifetime, per RFC 793, so that delayed segments of the connection can't be
+// mistaken for segments of a new connection between the same ports. The FINs
+// retransmitted by the peer are acknowledged in the meantime, and a new
+// connection request ends TIME_WAIT early if it may reuse the ports.
+func (e *endpoint) doTimeWait() {
+	e.timeWait = true
+
+	var msl tcpip.MaxSegmentLifetimeOption
+	if err := e.stack.TransportProtocolOption(ProtocolNumber, &msl); err != nil {
+		msl = tcpip.MaxSegmentLifetimeOption(defaultMSL)
+	}
+	timeout := 2 * time.Duration(msl)
+
+	var timeWaitWaker sleep.Waker
+	timeWaitTimer := time.AfterFunc(timeout, func() {
+		timeWaitWaker.Assert()
+	})
+	defer timeWaitTimer.Stop()
+
+	s := sleep.Sleeper{}
+	s.AddWaker(&e.notificationWaker, wakerForNotification)
+	s.AddWaker(&e.newSegmentWaker, wakerForNewSegment)
+	s.AddWaker(&timeWaitWaker, wakerForTimeWait)
+	defer s.Done()
+
+	for {
+		e.workMu.Unlock()
+		v, _ := s.Fetch(true)
+		e.workMu.Lock()
+		switch v {
+		case wakerForNotification:
+			// The connection is closed already, so there is
+			// nothing left to do on notifications other than
+			// info requests.
+			if n := e.fetchNotifications(); n&notifyInfoRequested != 0 {
+				e.answerInfoRequests()
+			}
+
+		case wakerForNewSegment:
+			restart, syn := e.handleTimeWaitSegments()
+			if syn != nil {
+				e.handOverSyn(syn)
+				return
+			}
+			if restart {
+				timeWaitTimer.Reset(timeout)
+			}
+
+		case wakerForTimeWait:
+			return
+		}
+	}
+}
+
+// handleTimeWaitSegments handles the segments received in TIME_WAIT. It
+// returns whether the peer retransmitted its FIN, which restarts the TIME_WAIT
+// timer, and the new connection request which ends TIME_WAIT early, if any.
+func (e *endpoint) handleTimeWaitSegments() (restart bool, syn *segment) {
+	e.mu.RLock()
+	reuseAddr := e.reuseAddr
+	e.mu.RUnlock()
+
+	for {
+		s := e.segmentQueue.dequeue()
+		if s == nil {
+			return restart, nil
+		}
+
+		switch {
+		case s.flagIsSet(flagRst):
+			// Resets are ignored so that old duplicates can't
+			// cut TIME_WAIT short, per RFC 1337.
+
+		case s.flagIsSet(flagSyn):
+			// A new connection request may end TIME_WAIT early
+			// and be accepted, per RFC 1122, section 4.2.2.13, if
+			// it can't be an old duplicate of the connection.
+			if reuseAddr && e.isNewConnectionRequest(s) {
+				return restart, s
+			}
+			e.snd.sendAck()
+
+		case s.flagIsSet(flagFin):
+			// Our ACK of the FIN was lost, so acknowledge it again
+			// and restart the timer, per RFC 793, page 73.
+			e.snd.sendAck()
+			restart = true
+
+		case s.logicalLen() > 0:
+			e.snd.sendAck()
+		}
+		s.decRef()
+	}
+}
+
+// isNewConnectionRequest determines if the SYN segment s, received in
+// TIME_WAIT, belongs to a new connection, per RFC 6191: its timestamp must be
+// newer than the last one of the connection if both use timestamps, and its
+// sequence number must be beyond the end of the connection otherwise.
+func (e *endpoint) isNewConnectionRequest(s *segment) bool {
+	if e.snd.timestamps && s.hasTimestamp {
+		return int32(s.tsVal-e.rcv.tsRecent) > 0
+	}
+	return e.rcv.rcvNxt.LessThan(s.sequenceNumber)
+}
+
+// handOverSyn ends TIME_WAIT to accept the new connection request syn: the
+// endpoint stops receiving the segments of the connection, and syn is delivered
+// again, to the listening endpoint if there is one.
+func (e *endpoint) handOverSyn(syn *segment) {
+	e.mu.Lock()
+	if e.isRegistered {
+		e.stack.UnregisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id)
+		e.isRegistered = false
+	}
+	e.mu.Unlock()
+
+	// Recreate the packet of the segment, whose header has been parsed
+	// already. Received checksums aren't verified, so it isn't computed.
+	hdrLen := header.TCPMinimumSize + len(syn.options)
+	v := buffer.NewView(hdrLen + syn.data.Size())
+	header.TCP(v).Encode(&header.TCPFields{
+		SrcPort:    syn.id.RemotePort,
+		DstPort:    syn.id.LocalPort,
+		SeqNum:     uint32(syn.sequenceNumber),
+		AckNum:     uint32(syn.ackNumber),
+		DataOffset: uint8(hdrLen),
+		Flags:      syn.flags,
+		WindowSize: uint16(syn.window),
+	})
+	copy(v[header.TCPMinimumSize:], syn.options)
+	copy(v[hdrLen:], syn.data.ToView())
+
+	vv := v.ToVectorisedView([1]buffer.View{})
+	syn.route.RedeliverTransportPacket(ProtocolNumber, syn.id, &vv)
+	syn.decRef()
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// cubicC is the scaling constant of the cubic function, in packets per
+	// cubic second, per RFC 8312, section 5.
+	cubicC = 0.4
+
+	// cubicBeta is the multiplicative decrease factor, per RFC 8312,
+	// section 4.5.
+	cubicBeta = 0.7
+
+	// cubicAlpha is the additive increase factor of the TCP-friendly
+	// window estimate, per RFC 8312, section 4.2.
+	cubicAlpha = 3 * (1 - cubicBeta) / (1 + cubicBeta)
+)
+
+// cubicState holds the state of the CUBIC congestion control algorithm, as
+// defined in RFC 8312. Windows are counted in packets.
+type cubicState struct {
+	s *sender
+
+	// wMax is the window just before the last reduction, and wLastMax the
+	// one before the reduction preceding it, used for fast convergence.
+	wMax     float64
+	wLastMax float64
+
+	// epoch is the time when the current congestion avoidance period
+	// started, or zero if it hasn't started yet. k is the time, since
+	// epoch, it takes for the window to grow back to wMax.
+	epoch time.Time
+	k     float64
+
+	// wEst is the estimate of the window Reno would have, to keep CUBIC
+	// TCP-friendly on short round trips.
+	wEst float64
+
+	// cnt accumulates the fractional window increases until they add up
+	// to a packet.
+	cnt float64
+}
+
+func newCubicCC(s *sender) congestionControl {
+	return &cubicState{s: s}
+}
+
+// onAck implements congestionControl.onAck.
+func (c *cubicState) onAck(packetsAcked int) {
+	s := c.s
+
+	// The window is set once recovery ends.
+	if s.fr.active {
+		return
+	}
+
+	if s.sndCwnd < s.sndSsthresh {
+		packetsAcked = s.slowStart(packetsAcked)
+		if packetsAcked == 0 {
+			return
+		}
+	}
+
+	cwnd := float64(s.sndCwnd)
+	now := time.Now()
+	if c.epoch.IsZero() {
+		c.epoch = now
+		c.cnt = 0
+		c.wEst = cwnd
+		if cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - cwnd) / cubicC)
+		} else {
+			c.k = 0
+			c.wMax = cwnd
+		}
+	}
+
+	// The window aims at the value of the cubic function one round trip
+	// from now, per RFC 8312, section 4.1, but no less than the
+	// TCP-friendly estimate, per section 4.2.
+	t := (now.Sub(c.epoch) + s.srtt).Seconds() - c.k
+	target := cubicC*t*t*t + c.wMax
+	c.wEst += cubicAlpha * float64(packetsAcked) / cwnd
+	if target < c.wEst {
+		target = c.wEst
+	}
+
+	// Don't grow by more than half the window per round trip.
+	if target > 1.5*cwnd {
+		target = 1.5 * cwnd
+	}
+
+	if target > cwnd {
+		c.cnt += (target - cwnd) / cwnd * float64(packetsAcked)
+		if c.cnt >= 1 {
+			n := math.Floor(c.cnt)
+			s.sndCwnd += int(n)
+			c.cnt -= n
+		}
+	}
+}
+
+// onLoss implements congestionControl.onLoss. It applies the multiplicative
+// decrease of RFC 8312, section 4.5, with fast convergence, per section 4.6.
+func (c *cubicState) onLoss() {
+	s := c.s
+	cwnd := float64(s.sndCwnd)
+
+	c.wMax = cwnd
+	if c.wMax < c.wLastMax {
+		c.wLastMax = c.wMax
+		c.wMax = c.wMax * (1 + cubicBeta) / 2
+	} else {
+		c.wLastMax = c.wMax
+	}
+	c.epoch = time.Time{}
+
+	s.sndSsthresh = int(cwnd * cubicBeta)
+	if s.sndSsthresh < 2 {
+		s.sndSsthresh = 2
+	}
+}
+
+// onRTO implements congestionControl.onRTO. The window restarts from slow
+// start, and a new congestion avoidance period starts when it ends, per RFC
+// 8312, section 4.7.
+func (c *cubicState) onRTO() {
+	c.s.sndCwnd = 1
+	c.epoch = time.Time{}
+}
+
+// onRecoveryExit implements congestionControl.onRecoveryExit.
+func (c *cubicState) onRecoveryExit() {
+	c.s.sndCwnd = c.s.sndSsthresh
+}
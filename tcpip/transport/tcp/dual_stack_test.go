@@ -64,6 +64,10 @@ func newDualTestContext(t *testing.T, mtu uint32) *testContext {
 		},
 	})
 
+	// Discard the MLD report announcing the solicited-node group of the
+	// IPv6 address.
+	linkEP.Drain()
+
 	return &testContext{
 		t:      t,
 		s:      s,
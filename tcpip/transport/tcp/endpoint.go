@@ -9,6 +9,7 @@ import (
 	"math"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
@@ -37,10 +38,51 @@ const (
 	notifyNonZeroReceiveWindow = 1 << iota
 	notifyReceiveWindowChanged
 	notifyClose
+	notifyIPOptionsChanged
+	notifyQuickAckChanged
+	notifyKeepaliveChanged
+	notifyAbort
+	notifyInfoRequested
 )
 
-// defaultBufferSize is the default size of the receive and send buffers.
-const defaultBufferSize = 208 * 1024
+// Default sizes of the receive and send buffers.
+const (
+	// minBufferSize is the smallest size of the buffers. Applications may
+	// choose any size by default, down to a single byte.
+	minBufferSize = 1
+
+	// defaultBufferSize is the default size of the buffers.
+	defaultBufferSize = 208 * 1024
+
+	// maxBufferSize is the largest size of the buffers, which auto-tuned
+	// receive buffers may grow to.
+	maxBufferSize = 4 << 20
+)
+
+// Default keepalive options, as recommended by RFC 1122, section 4.2.3.6, for
+// the idle time.
+const (
+	defaultKeepaliveIdle     = 2 * time.Hour
+	defaultKeepaliveInterval = 75 * time.Second
+	defaultKeepaliveCount    = 9
+)
+
+// keepalive holds the keepalive options of an endpoint, and the state of the
+// probes sent on its connection.
+type keepalive struct {
+	sync.Mutex
+	enabled  bool
+	idle     time.Duration
+	interval time.Duration
+	count    int
+
+	// unacked is the number of probes sent without receiving anything from
+	// the peer. It is only used by the protocol goroutine, as are timer
+	// and waker.
+	unacked int
+	timer   *time.Timer
+	waker   sleep.Waker
+}
 
 // endpoint represents a TCP endpoint. This struct serves as the interface
 // between users of the endpoint and the protocol implementation; it is legal to
@@ -77,6 +119,11 @@ type endpoint struct {
 	rcvBufSize int
 	rcvBufUsed int
 
+	// rcvAutoTune indicates whether the receive buffer grows with the
+	// rate at which the application reads. It is cleared when the size of
+	// the buffer is set by the application. It is protected by rcvListMu.
+	rcvAutoTune bool
+
 	// The following fields are protected by the mutex.
 	mu             sync.RWMutex
 	id             stack.TransportEndpointID
@@ -87,6 +134,62 @@ type endpoint struct {
 	route          stack.Route
 	v6only         bool
 
+	// mark is the mark set via MarkOption, used by route rules to select
+	// routes for the endpoint's traffic.
+	mark uint32
+
+	// ipOpts holds the IP options of the endpoint.
+	ipOpts stack.IPOptions
+
+	// ecn indicates whether ECN is negotiated on the connections the
+	// endpoint establishes. Whether it is in use on the current
+	// connection is recorded by the sender.
+	ecn bool
+
+	// sack indicates whether selective acknowledgements are negotiated on
+	// the connections the endpoint establishes. It is set from the
+	// protocol options when the endpoint is created.
+	sack bool
+
+	// timestamps indicates whether the timestamps option is negotiated on
+	// the connections the endpoint establishes. It is set from the
+	// protocol options when the endpoint is created.
+	timestamps bool
+
+	// cc is the name of the congestion control algorithm of the
+	// connections the endpoint establishes.
+	cc tcpip.CongestionControlOption
+
+	// quickAck indicates whether received data is acknowledged immediately.
+	// The receiver is notified when it changes.
+	quickAck bool
+
+	// keepalive manages the probes sent on an idle connection.
+	keepalive keepalive
+
+	// linger determines how the connection is closed by Close.
+	linger tcpip.LingerOption
+
+	// reuseAddr indicates whether the port of the endpoint may be reused
+	// by other endpoints, and whether a new connection request from the
+	// peer ends the TIME_WAIT of the endpoint's connection early.
+	reuseAddr bool
+
+	// fastOpen indicates whether a listening endpoint accepts Fast Open
+	// connections, and fastOpenConnect whether the endpoint connects with
+	// Fast Open.
+	fastOpen        bool
+	fastOpenConnect bool
+
+	// fastOpenPending indicates whether the endpoint is connecting with a
+	// cached Fast Open cookie. Until it's connected, such an endpoint can
+	// be written to and shut down for writing, but has nothing to read.
+	fastOpenPending bool
+
+	// fastOpenCache is the Fast Open cookie cache of the stack, used when
+	// connecting. It is nil for accepted endpoints.
+	fastOpenCache *fastOpenCache
+
 	// effectiveNetProtos contains the network protocols actually in use. In
 	// most cases it will only contain "netProto", but in cases like IPv6
 	// endpoints with v6only set to false, this could include multiple
@@ -100,6 +203,11 @@ type endpoint struct {
 	// endpoint is in this state.
 	hardError error
 
+	// closing indicates that Close was called while the endpoint was
+	// connected. Its connection goes through the closing states in the
+	// background, but it can't be read from or written to anymore.
+	closing bool
+
 	// workerRunning specifies if a worker goroutine is running.
 	workerRunning bool
 
@@ -108,12 +216,6 @@ type endpoint struct {
 	// also true, and they're both protected by the mutex.
 	workerCleanup bool
 
-	// The options below aren't implemented, but we remember the user
-	// settings because applications expect to be able to set/query these
-	// options.
-	noDelay   bool
-	reuseAddr bool
-
 	// segmentQueue is used to hand received segments to the protocol
 	// goroutine. Segments are queued as long as the queue is not full,
 	// and dropped when it is.
@@ -125,6 +227,9 @@ type endpoint struct {
 	//
 	// When the send side is closed, the protocol goroutine is notified via
 	// sndCloseWaker, and sndBufSize is set to -1.
+	//
+	// noDelay and cork determine whether partial segments are held back,
+	// and are picked up by the sender whenever it is signaled.
 	sndBufMu      sync.Mutex
 	sndBufSize    int
 	sndBufUsed    int
@@ -132,6 +237,8 @@ type endpoint struct {
 	sndQueue      segmentList
 	sndWaker      sleep.Waker
 	sndCloseWaker sleep.Waker
+	noDelay       bool
+	cork          bool
 
 	// newSegmentWaker is used to indicate to the protocol goroutine that
 	// it needs to wake up and handle new segments queued to it.
@@ -154,6 +261,18 @@ type endpoint struct {
 	// therefore don't need locks to protect them.
 	rcv *receiver
 	snd *sender
+
+	// synRcvd is the handshake of a connection accepted with Fast Open,
+	// which the protocol goroutine completes once it starts.
+	synRcvd *handshake
+
+	// timeWait indicates whether the connection is in TIME_WAIT.
+	timeWait bool
+
+	// infoRequests are the channels of the TCPInfoOption requests the
+	// protocol goroutine must answer.
+	infoMu       sync.Mutex
+	infoRequests []chan tcpip.TCPInfoOption
 }
 
 func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
@@ -166,7 +285,28 @@ func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waite
 		sndBufSize:  defaultBufferSize,
 		noDelay:     true,
 		reuseAddr:   true,
+		keepalive: keepalive{
+			idle:     defaultKeepaliveIdle,
+			interval: defaultKeepaliveInterval,
+			count:    defaultKeepaliveCount,
+		},
+	}
+
+	var rs tcpip.ReceiveBufferSizeRangeOption
+	if err := stack.TransportProtocolOption(ProtocolNumber, &rs); err == nil {
+		e.rcvBufSize = rs.Default
 	}
+
+	var ss tcpip.SendBufferSizeRangeOption
+	if err := stack.TransportProtocolOption(ProtocolNumber, &ss); err == nil {
+		e.sndBufSize = ss.Default
+	}
+
+	var moderate tcpip.ModerateReceiveBufferOption
+	if err := stack.TransportProtocolOption(ProtocolNumber, &moderate); err == nil {
+		e.rcvAutoTune = moderate != 0
+	}
+
 	e.segmentQueue.setLimit(2 * e.rcvBufSize)
 	e.workMu.Init()
 	e.workMu.Lock()
@@ -182,9 +322,19 @@ func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 	defer e.mu.RUnlock()
 
 	switch e.state {
-	case stateInitial, stateBound, stateConnecting:
+	case stateInitial, stateBound:
 		// Ready for nothing.
 
+	case stateConnecting:
+		// Only endpoints connecting with Fast Open may be written to.
+		if e.fastOpenPending && (mask&waiter.EventOut) != 0 {
+			e.sndBufMu.Lock()
+			if e.sndBufSize < 0 || e.sndBufUsed <= e.sndBufSize {
+				result |= waiter.EventOut
+			}
+			e.sndBufMu.Unlock()
+		}
+
 	case stateClosed, stateError:
 		// Ready for anything.
 		result = mask
@@ -198,6 +348,12 @@ func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 		}
 
 	case stateConnected:
+		if e.closing {
+			// Reads and writes fail right away.
+			result = mask
+			break
+		}
+
 		// Determine if the endpoint is writable if requested.
 		if (mask & waiter.EventOut) != 0 {
 			e.sndBufMu.Lock()
@@ -248,28 +404,66 @@ func (e *endpoint) notifyProtocolGoroutine(n uint32) {
 // with it. It must be called only once and with no other concurrent calls to
 // the endpoint.
 func (e *endpoint) Close() {
-	// Issue a shutdown so that the peer knows we won't send any more data
-	// if we're connected, or stop accepting if we're listening.
-	e.Shutdown(tcpip.ShutdownWrite | tcpip.ShutdownRead)
+	// Reset the connection if we're connected and it can't be closed
+	// gracefully. Otherwise issue a shutdown so that the peer knows we
+	// won't send any more data if we're connected, or stop accepting if
+	// we're listening.
+	abort := e.abortOnClose()
+	if !abort {
+		e.Shutdown(tcpip.ShutdownWrite | tcpip.ShutdownRead)
+	}
 
 	// While we hold the lock, determine if the cleanup should happen
 	// inline or if we should tell the worker (if any) to do the cleanup.
+	// The worker finishes closing the connection in the background, going
+	// through the closing states of the connection.
 	e.mu.Lock()
 	worker := e.workerRunning
 	if worker {
 		e.workerCleanup = true
 	}
+	closing := e.state == stateConnected
+	e.closing = closing
 	e.mu.Unlock()
 
+	// Wake up pending reads and writes, which fail from now on.
+	if closing {
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+	}
+
 	// Now that we don't hold the lock anymore, either perform the local
 	// cleanup or kick the worker to make sure it knows it needs to cleanup.
 	if !worker {
 		e.cleanup()
+	} else if abort {
+		e.notifyProtocolGoroutine(notifyAbort | notifyClose)
 	} else {
 		e.notifyProtocolGoroutine(notifyClose)
 	}
 }
 
+// abortOnClose determines whether Close must reset the connection rather than
+// close it gracefully. This is the case when received data hasn't been read by
+// the application, per RFC 2525, section 2.17, or when lingering is enabled
+// with a zero timeout.
+func (e *endpoint) abortOnClose() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return false
+	}
+
+	if e.linger.Enabled && e.linger.Timeout == 0 {
+		return true
+	}
+
+	e.rcvListMu.Lock()
+	defer e.rcvListMu.Unlock()
+
+	return e.rcvBufUsed > 0
+}
+
 // cleanup frees all resources associated with the endpoint. It is called after
 // Close() is called and the worker goroutine (if any) is done with its work.
 func (e *endpoint) cleanup() {
@@ -299,9 +493,17 @@ func (e *endpoint) Read(*tcpip.FullAddress) (buffer.View, error) {
 	e.mu.RLock()
 
 	// The endpoint cannot be read from if it's not connected.
-	if s := e.state; s != stateConnected {
+	if s := e.state; s != stateConnected || e.closing {
+		pending := e.fastOpenPending
 		e.mu.RUnlock()
 		switch s {
+		case stateConnecting:
+			if pending {
+				return buffer.View{}, tcpip.ErrWouldBlock
+			}
+			return buffer.View{}, tcpip.ErrInvalidEndpointState
+		case stateConnected:
+			return buffer.View{}, tcpip.ErrConnectionAborted
 		case stateClosed:
 			return buffer.View{}, tcpip.ErrClosedForReceive
 		case stateError:
@@ -357,9 +559,12 @@ func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error)
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
-	// The endpoint cannot be written to if it's not connected.
-	if e.state != stateConnected {
+	// The endpoint cannot be written to if it's not connected, unless it's
+	// connecting with Fast Open.
+	if (e.state != stateConnected || e.closing) && !e.fastOpenPending {
 		switch e.state {
+		case stateConnected:
+			return 0, tcpip.ErrConnectionAborted
 		case stateError:
 			return 0, e.hardError
 		default:
@@ -414,8 +619,15 @@ func (e *endpoint) Peek(w io.Writer) (uintptr, error) {
 	defer e.mu.RUnlock()
 
 	// The endpoint cannot be read from if it's not connected.
-	if e.state != stateConnected {
+	if e.state != stateConnected || e.closing {
 		switch e.state {
+		case stateConnecting:
+			if e.fastOpenPending {
+				return 0, tcpip.ErrWouldBlock
+			}
+			return 0, tcpip.ErrInvalidEndpointState
+		case stateConnected:
+			return 0, tcpip.ErrConnectionAborted
 		case stateClosed:
 			return 0, tcpip.ErrClosedForReceive
 		case stateError:
@@ -466,9 +678,25 @@ func (e *endpoint) zeroReceiveWindow(scale uint8) bool {
 func (e *endpoint) SetSockOpt(opt interface{}) error {
 	switch v := opt.(type) {
 	case tcpip.NoDelayOption:
-		e.mu.Lock()
+		e.sndBufMu.Lock()
 		e.noDelay = v != 0
-		e.mu.Unlock()
+		e.sndBufMu.Unlock()
+
+		// Send the data held back by Nagle's algorithm.
+		if v != 0 {
+			e.sndWaker.Assert()
+		}
+		return nil
+
+	case tcpip.CorkOption:
+		e.sndBufMu.Lock()
+		e.cork = v != 0
+		e.sndBufMu.Unlock()
+
+		// Send the data held back while corked.
+		if v == 0 {
+			e.sndWaker.Assert()
+		}
 		return nil
 
 	case tcpip.ReuseAddressOption:
@@ -477,11 +705,118 @@ func (e *endpoint) SetSockOpt(opt interface{}) error {
 		e.mu.Unlock()
 		return nil
 
+	case tcpip.MarkOption:
+		e.mu.Lock()
+		e.mark = uint32(v)
+		e.mu.Unlock()
+		return nil
+
+	case tcpip.ECNOption:
+		e.mu.Lock()
+		e.ecn = v != 0
+		e.mu.Unlock()
+		return nil
+
+	case tcpip.CongestionControlOption:
+		if !validCongestionControl(v) {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		e.mu.Lock()
+		e.cc = v
+		e.mu.Unlock()
+		return nil
+
+	case tcpip.KeepaliveEnabledOption:
+		e.keepalive.Lock()
+		e.keepalive.enabled = v != 0
+		e.keepalive.Unlock()
+		e.notifyProtocolGoroutine(notifyKeepaliveChanged)
+		return nil
+
+	case tcpip.KeepaliveIdleOption:
+		if v <= 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		e.keepalive.Lock()
+		e.keepalive.idle = time.Duration(v)
+		e.keepalive.Unlock()
+		e.notifyProtocolGoroutine(notifyKeepaliveChanged)
+		return nil
+
+	case tcpip.KeepaliveIntervalOption:
+		if v <= 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		e.keepalive.Lock()
+		e.keepalive.interval = time.Duration(v)
+		e.keepalive.Unlock()
+		e.notifyProtocolGoroutine(notifyKeepaliveChanged)
+		return nil
+
+	case tcpip.KeepaliveCountOption:
+		if v <= 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		e.keepalive.Lock()
+		e.keepalive.count = int(v)
+		e.keepalive.Unlock()
+		e.notifyProtocolGoroutine(notifyKeepaliveChanged)
+		return nil
+
+	case tcpip.QuickAckOption:
+		e.mu.Lock()
+		e.quickAck = v != 0
+		e.mu.Unlock()
+
+		if e.workMu.TryLock() {
+			// Update the receiver inline.
+			if e.rcv != nil {
+				e.rcv.quickAck = v != 0
+			}
+			e.workMu.Unlock()
+		} else {
+			// Let the protocol goroutine update it.
+			e.notifyProtocolGoroutine(notifyQuickAckChanged)
+		}
+		return nil
+
+	case tcpip.LingerOption:
+		if v.Timeout < 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		e.mu.Lock()
+		e.linger = v
+		e.mu.Unlock()
+		return nil
+
+	case tcpip.FastOpenOption:
+		e.mu.Lock()
+		e.fastOpen = v != 0
+		e.mu.Unlock()
+		return nil
+
+	case tcpip.FastOpenConnectOption:
+		e.mu.Lock()
+		e.fastOpenConnect = v != 0
+		e.mu.Unlock()
+		return nil
+
 	case tcpip.ReceiveBufferSizeOption:
 		mask := uint32(notifyReceiveWindowChanged)
 
+		// The receive buffer size must be within the range of the
+		// stack.
+		var rs tcpip.ReceiveBufferSizeRangeOption
+		if err := e.stack.TransportProtocolOption(ProtocolNumber, &rs); err == nil && (int(v) < rs.Min || int(v) > rs.Max) {
+			return tcpip.ErrInvalidOptionValue
+		}
+
 		e.rcvListMu.Lock()
 
+		// The size is chosen by the application from now on.
+		e.rcvAutoTune = false
+
 		// Make sure the receive buffer size allows us to send a
 		// non-zero window size.
 		scale := uint8(0)
@@ -509,6 +844,35 @@ func (e *endpoint) SetSockOpt(opt interface{}) error {
 		e.notifyProtocolGoroutine(mask)
 		return nil
 
+	case tcpip.SendBufferSizeOption:
+		// The send buffer size must be within the range of the stack.
+		var ss tcpip.SendBufferSizeRangeOption
+		if err := e.stack.TransportProtocolOption(ProtocolNumber, &ss); err == nil && (int(v) < ss.Min || int(v) > ss.Max) {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		e.sndBufMu.Lock()
+
+		// The size can't change once the send side is closed.
+		if e.sndBufSize < 0 {
+			e.sndBufMu.Unlock()
+			return nil
+		}
+
+		wasFull := e.sndBufUsed > e.sndBufSize
+		e.sndBufSize = int(v)
+		notify := wasFull && e.sndBufUsed <= e.sndBufSize
+		e.sndBufMu.Unlock()
+
+		// Let writers know they may write again.
+		if notify {
+			e.waiterQueue.Notify(waiter.EventOut)
+		}
+		return nil
+
+	case tcpip.TTLOption, tcpip.TOSOption, tcpip.TrafficClassOption:
+		return e.setIPOption(opt)
+
 	case tcpip.V6OnlyOption:
 		// We only recognize this option on v6 endpoints.
 		if e.netProto != header.IPv6ProtocolNumber {
@@ -529,6 +893,29 @@ func (e *endpoint) SetSockOpt(opt interface{}) error {
 	return nil
 }
 
+// setIPOption sets an IP option of the endpoint, and updates the route of
+// connected endpoints.
+func (e *endpoint) setIPOption(opt interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.ipOpts.SetOption(e.netProto, opt); err != nil {
+		return err
+	}
+
+	if e.state == stateConnected {
+		if e.workMu.TryLock() {
+			// Update the route inline.
+			e.ipOpts.Apply(&e.route)
+			e.workMu.Unlock()
+		} else {
+			// Let the protocol goroutine update it.
+			e.notifyProtocolGoroutine(notifyIPOptionsChanged)
+		}
+	}
+	return nil
+}
+
 // readyReceiveSize returns the number of bytes ready to be received.
 func (e *endpoint) readyReceiveSize() (int, error) {
 	e.mu.RLock()
@@ -577,9 +964,20 @@ func (e *endpoint) GetSockOpt(opt interface{}) error {
 		return nil
 
 	case *tcpip.NoDelayOption:
-		e.mu.RLock()
+		e.sndBufMu.Lock()
 		v := e.noDelay
-		e.mu.RUnlock()
+		e.sndBufMu.Unlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.CorkOption:
+		e.sndBufMu.Lock()
+		v := e.cork
+		e.sndBufMu.Unlock()
 
 		*o = 0
 		if v {
@@ -598,6 +996,106 @@ func (e *endpoint) GetSockOpt(opt interface{}) error {
 		}
 		return nil
 
+	case *tcpip.MarkOption:
+		e.mu.RLock()
+		*o = tcpip.MarkOption(e.mark)
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.ECNOption:
+		e.mu.RLock()
+		v := e.ecn
+		e.mu.RUnlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.CongestionControlOption:
+		e.mu.RLock()
+		*o = e.cc
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.KeepaliveEnabledOption:
+		e.keepalive.Lock()
+		v := e.keepalive.enabled
+		e.keepalive.Unlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.KeepaliveIdleOption:
+		e.keepalive.Lock()
+		*o = tcpip.KeepaliveIdleOption(e.keepalive.idle)
+		e.keepalive.Unlock()
+		return nil
+
+	case *tcpip.KeepaliveIntervalOption:
+		e.keepalive.Lock()
+		*o = tcpip.KeepaliveIntervalOption(e.keepalive.interval)
+		e.keepalive.Unlock()
+		return nil
+
+	case *tcpip.KeepaliveCountOption:
+		e.keepalive.Lock()
+		*o = tcpip.KeepaliveCountOption(e.keepalive.count)
+		e.keepalive.Unlock()
+		return nil
+
+	case *tcpip.QuickAckOption:
+		e.mu.RLock()
+		v := e.quickAck
+		e.mu.RUnlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.LingerOption:
+		e.mu.RLock()
+		*o = e.linger
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.TCPInfoOption:
+		*o = e.info()
+		return nil
+
+	case *tcpip.FastOpenOption:
+		e.mu.RLock()
+		v := e.fastOpen
+		e.mu.RUnlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.FastOpenConnectOption:
+		e.mu.RLock()
+		v := e.fastOpenConnect
+		e.mu.RUnlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.TTLOption, *tcpip.TOSOption, *tcpip.TrafficClassOption:
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.ipOpts.GetOption(e.netProto, opt)
+
 	case *tcpip.V6OnlyOption:
 		// We only recognize this option on v6 endpoints.
 		if e.netProto != header.IPv6ProtocolNumber {
@@ -685,7 +1183,7 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) error {
 	}
 
 	// Find a route to the desired destination.
-	r, err := e.stack.FindRoute(nicid, e.id.LocalAddress, addr.Addr, netProto)
+	r, err := e.stack.FindPolicyRoute(nicid, e.id.LocalAddress, addr.Addr, netProto, ProtocolNumber, e.mark)
 	if err != nil {
 		return err
 	}
@@ -733,6 +1231,7 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) error {
 	e.isRegistered = true
 	e.state = stateConnecting
 	e.route = r.Clone()
+	e.ipOpts.Apply(&e.route)
 	e.boundNICID = nicid
 	e.effectiveNetProtos = netProtos
 	e.workerRunning = true
@@ -754,6 +1253,14 @@ func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) error {
 	defer e.mu.Unlock()
 
 	switch e.state {
+	case stateConnecting:
+		// Endpoints connecting with Fast Open send the SYN segment
+		// once shut down for writing.
+		if !e.fastOpenPending {
+			return tcpip.ErrInvalidEndpointState
+		}
+		fallthrough
+
 	case stateConnected:
 		// Close for write.
 		if (flags & tcpip.ShutdownWrite) != 0 {
@@ -951,7 +1458,7 @@ func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, error) {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
-	if e.state != stateConnected {
+	if e.state != stateConnected && !e.fastOpenPending {
 		return tcpip.FullAddress{}, tcpip.ErrInvalidEndpointState
 	}
 
@@ -965,6 +1472,12 @@ func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, error) {
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
 func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv *buffer.VectorisedView) {
+	// TCP is a unicast protocol, so segments sent to multicast groups are
+	// ignored.
+	if header.IsV4MulticastAddress(r.LocalAddress) || header.IsV6MulticastAddress(r.LocalAddress) {
+		return
+	}
+
 	s := newSegment(r, id, vv)
 	if !s.parse() {
 		atomic.AddUint64(&e.stack.MutableStats().MalformedRcvdPackets, 1)
@@ -1037,3 +1550,35 @@ func (e *endpoint) receiveBufferSize() int {
 
 	return size
 }
+
+// receiveBufferUsed returns how many bytes of the receive buffer hold data
+// that hasn't been read yet.
+func (e *endpoint) receiveBufferUsed() int {
+	e.rcvListMu.Lock()
+	used := e.rcvBufUsed
+	e.rcvListMu.Unlock()
+
+	return used
+}
+
+// growReceiveBuffer grows the receive buffer to size bytes, up to the maximum
+// size of the stack, if it's auto-tuned. It returns the size of the buffer.
+func (e *endpoint) growReceiveBuffer(size int) int {
+	var rs tcpip.ReceiveBufferSizeRangeOption
+	if err := e.stack.TransportProtocolOption(ProtocolNumber, &rs); err == nil && size > rs.Max {
+		size = rs.Max
+	}
+
+	e.rcvListMu.Lock()
+	if !e.rcvAutoTune || size <= e.rcvBufSize {
+		size = e.rcvBufSize
+		e.rcvListMu.Unlock()
+		return size
+	}
+	e.rcvBufSize = size
+	e.rcvListMu.Unlock()
+
+	e.segmentQueue.setLimit(2 * size)
+
+	return size
+}
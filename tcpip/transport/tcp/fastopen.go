@@ -0,0 +1,270 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"crypto/subtle"
+	"io"
+	"sync"
+
+	"github.com/google/netstack/sleep"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/seqnum"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// fastOpenCookieSize is the size of the Fast Open cookies handed out
+	// by listening endpoints.
+	fastOpenCookieSize = 8
+
+	// fastOpenMaxCachedCookieSize is the size of the largest cookie kept
+	// by the cookie cache. Larger cookies wouldn't fit in a SYN segment
+	// along with all the other options.
+	fastOpenMaxCachedCookieSize = 12
+
+	// fastOpenCacheSize is the maximum number of peers the cookie cache of
+	// a stack holds cookies for.
+	fastOpenCacheSize = 1024
+)
+
+// fastOpenEntry is the cached Fast Open cookie of a peer, along with the MSS it
+// announced, which limits the data sent in SYN segments.
+type fastOpenEntry struct {
+	cookie []byte
+	mss    uint16
+}
+
+// fastOpenCache is the cache of the Fast Open cookies handed out to the
+// endpoints of a stack, per RFC 7413, section 4.1.3. Cookies are kept per
+// remote address.
+type fastOpenCache struct {
+	mu      sync.Mutex
+	entries map[tcpip.Address]fastOpenEntry
+}
+
+// lookup returns the cached cookie of the peer with the given address.
+func (c *fastOpenCache) lookup(addr tcpip.Address) (fastOpenEntry, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[addr]
+	c.mu.Unlock()
+	return entry, ok
+}
+
+// update caches the cookie handed out by the peer with the given address, which
+// announced mss. When the cache is full, an arbitrary entry is evicted.
+func (c *fastOpenCache) update(addr tcpip.Address, cookie []byte, mss uint16) {
+	if len(cookie) > fastOpenMaxCachedCookieSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[tcpip.Address]fastOpenEntry)
+	}
+	if _, ok := c.entries[addr]; !ok && len(c.entries) >= fastOpenCacheSize {
+		for a := range c.entries {
+			delete(c.entries, a)
+			break
+		}
+	}
+	c.entries[addr] = fastOpenEntry{cookie: cookie, mss: mss}
+}
+
+// remove forgets the cookie of the peer with the given address.
+func (c *fastOpenCache) remove(addr tcpip.Address) {
+	c.mu.Lock()
+	delete(c.entries, addr)
+	c.mu.Unlock()
+}
+
+// fastOpenCookie returns the Fast Open cookie of the client with the given
+// address. It is a MAC of the address keyed by the nonce of the listener, per
+// RFC 7413, section 4.1.2.
+func (l *listenContext) fastOpenCookie(addr tcpip.Address) []byte {
+	l.hasherMu.Lock()
+	l.hasher.Reset()
+	l.hasher.Write(l.nonce[1][:])
+	io.WriteString(l.hasher, string(addr))
+	h := l.hasher.Sum(nil)
+	l.hasherMu.Unlock()
+
+	return h[:fastOpenCookieSize]
+}
+
+// isFastOpenCookieValid checks if the supplied cookie is the one handed out to
+// the client with the given address.
+func (l *listenContext) isFastOpenCookieValid(addr tcpip.Address, cookie []byte) bool {
+	return subtle.ConstantTimeCompare(cookie, l.fastOpenCookie(addr)) == 1
+}
+
+// createFastOpenEndpoint creates a new connected endpoint for the SYN segment
+// s, which carries a valid Fast Open cookie. Its SYN-ACK is sent right away,
+// acknowledging the data of the SYN segment, which is readable once the
+// endpoint is accepted. The handshake is completed by the protocol goroutine of
+// the endpoint.
+func (l *listenContext) createFastOpenEndpoint(s *segment, opts synOptions) (*endpoint, error) {
+	irs := s.sequenceNumber
+	iss := l.createCookie(s.id, irs, encodeMSS(opts.mss))
+	n, err := l.createConnectedEndpoint(s, iss, irs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := newHandshake(n, l.rcvWnd)
+	if err != nil {
+		n.Close()
+		return nil, err
+	}
+
+	ecn := l.ecn && s.flagIsSet(flagEce) && s.flagIsSet(flagCwr)
+	opts.sackPermitted = l.sack && opts.sackPermitted
+	opts.ts = l.timestamps && opts.ts
+	h.resetToSynRcvd(iss, irs, opts, ecn)
+
+	// The endpoint isn't shared yet, so the data is queued without locks.
+	if size := s.data.Size(); size > 0 {
+		s.incRef()
+		n.rcvList.PushBack(s)
+		n.rcvBufUsed = size
+		n.rcv.bytesReceived = uint64(size)
+		n.rcv.rcvNxt = n.rcv.rcvNxt.Add(seqnum.Size(size))
+		h.ackNum = h.ackNum.Add(seqnum.Size(size))
+	}
+
+	h.sendSyn(&n.route)
+	h.synSent = true
+	n.synRcvd = &h
+
+	return n, nil
+}
+
+// prepareFastOpen prepares the SYN segment of the active handshake h to use
+// Fast Open, if enabled on the endpoint. Without a cached cookie for the peer,
+// the SYN segment requests one. With a cookie, the endpoint is reported as
+// writable right away, and the SYN segment is only sent once data is written,
+// carrying the cookie and the first data, or when the endpoint is shut down for
+// writing. The endpoint is only connected once the handshake completes.
+func (e *endpoint) prepareFastOpen(h *handshake) error {
+	e.mu.RLock()
+	enabled := e.fastOpenConnect
+	e.mu.RUnlock()
+
+	if !enabled || e.fastOpenCache == nil {
+		return nil
+	}
+
+	h.fastOpen = true
+	entry, ok := e.fastOpenCache.lookup(e.id.RemoteAddress)
+	if !ok {
+		return nil
+	}
+	h.fastOpenCookie = entry.cookie
+
+	e.mu.Lock()
+	e.fastOpenPending = true
+	e.mu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventOut)
+
+	// The data in the SYN segment must fit in a segment of the MSS of the
+	// peer, along with the SYN options.
+	max := int(e.route.MTU()) - header.TCPMinimumSize
+	if int(entry.mss) < max {
+		max = int(entry.mss)
+	}
+	max -= header.TCPOptionsMaximumSize
+
+	s := sleep.Sleeper{}
+	s.AddWaker(&e.notificationWaker, wakerForNotification)
+	s.AddWaker(&e.sndWaker, wakerForSend)
+	s.AddWaker(&e.sndCloseWaker, wakerForSendClose)
+	defer s.Done()
+
+	for {
+		switch index, _ := s.Fetch(true); index {
+		case wakerForNotification:
+			n := e.fetchNotifications()
+			if n&notifyClose != 0 {
+				return tcpip.ErrAborted
+			}
+			if n&notifyInfoRequested != 0 {
+				e.answerInfoRequests()
+			}
+
+		case wakerForSend:
+			e.sndBufMu.Lock()
+			if seg := e.sndQueue.Front(); seg != nil && max > 0 {
+				h.synData = seg.data.First()
+				if len(h.synData) > max {
+					h.synData = h.synData[:max]
+				}
+			}
+			e.sndBufMu.Unlock()
+			return nil
+
+		case wakerForSendClose:
+			// Let the protocol goroutine close the connection once
+			// it's established.
+			e.sndCloseWaker.Assert()
+			return nil
+		}
+	}
+}
+
+// completeFastOpen records the outcome of the Fast Open handshake h, which
+// received the SYN-ACK segment s with options opts. A new cookie handed out by
+// the peer is cached, while a cookie the peer rejected, by not acknowledging
+// the data sent with it, is forgotten. The SYN-ACK segment may acknowledge only
+// part of the data, in which case the rest is sent after the handshake, per RFC
+// 7413, section 4.2.2.
+func (h *handshake) completeFastOpen(s *segment, opts synOptions) {
+	h.synDataAcked = int(s.ackNumber - h.iss - 1)
+
+	// Once the SYN segment was retransmitted without data, an
+	// acknowledgement of the SYN alone doesn't tell whether the cookie
+	// was rejected.
+	addr := h.ep.id.RemoteAddress
+	switch {
+	case len(opts.fastOpenCookie) > 0:
+		h.ep.fastOpenCache.update(addr, opts.fastOpenCookie, opts.mss)
+	case len(h.synData) > 0 && h.synDataAcked == 0 && !h.synRetransmitted:
+		h.ep.fastOpenCache.remove(addr)
+	}
+}
+
+// dropSynData removes the first n bytes of the send queue, which were
+// acknowledged as the data of the SYN segment of a Fast Open handshake.
+func (e *endpoint) dropSynData(n int) {
+	e.sndBufMu.Lock()
+	for left := n; left > 0; {
+		seg := e.sndQueue.Front()
+		size := seg.data.Size()
+		if size > left {
+			seg.data.TrimFront(left)
+			break
+		}
+		e.sndQueue.Remove(seg)
+		seg.decRef()
+		left -= size
+	}
+	e.sndBufInQueue -= seqnum.Size(n)
+	e.sndBufMu.Unlock()
+
+	e.updateSndBufferUsage(n)
+}
+
+// appendFastOpenOption appends to b the Fast Open option with the given cookie,
+// preceded by NOP options so that its end is 4-byte aligned.
+func appendFastOpenOption(b []byte, cookie []byte) []byte {
+	for i := (2 + len(cookie)) % 4; i != 0 && i < 4; i++ {
+		b = append(b, header.TCPOptionNOP)
+	}
+	b = append(b, header.TCPOptionFastOpen, byte(2+len(cookie)))
+	return append(b, cookie...)
+}
@@ -33,17 +33,45 @@ type Forwarder struct {
 // maximum number of in-flight connection attempts. Once the maximum is reached
 // new incoming connection requests will be ignored.
 //
-// If rcvWnd is set to zero, the default buffer size is used instead.
+// If rcvWnd is set to zero, the default receive buffer size of the stack is
+// used instead, and the receive buffers are auto-tuned if the stack's
+// ModerateReceiveBufferOption is set. ECN, selective acknowledgements and
+// timestamps are agreed on if the stack's ECNOption, SACKOption and
+// TimestampOption are set when the forwarder is created, and its
+// CongestionControlOption is used by the connections.
 func NewForwarder(s *stack.Stack, rcvWnd, maxInFlight int, handler func(*ForwarderRequest)) *Forwarder {
+	autoTune := false
 	if rcvWnd == 0 {
 		rcvWnd = defaultBufferSize
+		var rs tcpip.ReceiveBufferSizeRangeOption
+		if err := s.TransportProtocolOption(ProtocolNumber, &rs); err == nil {
+			rcvWnd = rs.Default
+		}
+		var moderate tcpip.ModerateReceiveBufferOption
+		s.TransportProtocolOption(ProtocolNumber, &moderate)
+		autoTune = moderate != 0
 	}
-	return &Forwarder{
+	var ecn tcpip.ECNOption
+	s.TransportProtocolOption(ProtocolNumber, &ecn)
+	var sack tcpip.SACKOption
+	s.TransportProtocolOption(ProtocolNumber, &sack)
+	var timestamps tcpip.TimestampOption
+	s.TransportProtocolOption(ProtocolNumber, &timestamps)
+	var cc tcpip.CongestionControlOption
+	s.TransportProtocolOption(ProtocolNumber, &cc)
+
+	f := &Forwarder{
 		maxInFlight: maxInFlight,
 		handler:     handler,
 		inFlight:    make(map[stack.TransportEndpointID]struct{}),
 		listen:      newListenContext(s, seqnum.Size(rcvWnd), true, 0),
 	}
+	f.listen.ecn = ecn != 0
+	f.listen.sack = sack != 0
+	f.listen.timestamps = timestamps != 0
+	f.listen.cc = cc
+	f.listen.rcvAutoTune = autoTune
+	return f
 }
 
 // HandlePacket handles a packet if it is of interest to the forwarder (i.e., if
@@ -57,11 +85,11 @@ func (f *Forwarder) HandlePacket(r *stack.Route, id stack.TransportEndpointID, v
 	defer s.decRef()
 
 	// We only care about well-formed SYN packets.
-	if !s.parse() || s.flags != flagSyn {
+	if !s.parse() || s.flags&^(flagEce|flagCwr) != flagSyn {
 		return false
 	}
 
-	mss, sws, ok := parseSynOptions(s)
+	opts, ok := parseSynOptions(s)
 	if !ok {
 		return false
 	}
@@ -83,10 +111,9 @@ func (f *Forwarder) HandlePacket(r *stack.Route, id stack.TransportEndpointID, v
 	f.inFlight[id] = struct{}{}
 	s.incRef()
 	go f.handler(&ForwarderRequest{
-		forwarder:   f,
-		segment:     s,
-		mss:         mss,
-		sndWndScale: sws,
+		forwarder:  f,
+		segment:    s,
+		synOptions: opts,
 	})
 
 	return true
@@ -96,11 +123,10 @@ func (f *Forwarder) HandlePacket(r *stack.Route, id stack.TransportEndpointID, v
 // and passed to the client. Clients must eventually call Complete() on it, and
 // may optionally create an endpoint to represent it via CreateEndpoint.
 type ForwarderRequest struct {
-	mu          sync.Mutex
-	forwarder   *Forwarder
-	segment     *segment
-	mss         uint16
-	sndWndScale int
+	mu         sync.Mutex
+	forwarder  *Forwarder
+	segment    *segment
+	synOptions synOptions
 }
 
 // ID returns the 4-tuple (src address, src port, dst address, dst port) that
@@ -146,7 +172,7 @@ func (r *ForwarderRequest) CreateEndpoint(queue *waiter.Queue) (tcpip.Endpoint,
 	}
 
 	f := r.forwarder
-	ep, err := f.listen.createEndpointAndPerformHandshake(r.segment, r.mss, r.sndWndScale)
+	ep, err := f.listen.createEndpointAndPerformHandshake(r.segment, r.synOptions)
 	if err != nil {
 		return nil, err
 	}
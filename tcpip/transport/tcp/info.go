@@ -0,0 +1,147 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// info returns the TCPInfoOption of the endpoint. The state of the connection
+// is only accessed by the protocol goroutine, so the option is gathered inline
+// when the work lock can be taken, or when the protocol goroutine isn't
+// running. Otherwise the protocol goroutine is asked to gather it.
+func (e *endpoint) info() tcpip.TCPInfoOption {
+	if e.workMu.TryLock() {
+		defer e.workMu.Unlock()
+
+		e.mu.RLock()
+		state := e.state
+		e.mu.RUnlock()
+
+		return e.infoLocked(state)
+	}
+
+	// The mutex is held while the info is gathered, so that no protocol
+	// goroutine starts meanwhile.
+	e.mu.RLock()
+	if !e.workerRunning {
+		defer e.mu.RUnlock()
+		return e.infoLocked(e.state)
+	}
+
+	// The request is queued while the mutex is held, so that it's answered
+	// even if the protocol goroutine is about to complete.
+	ch := make(chan tcpip.TCPInfoOption, 1)
+	e.infoMu.Lock()
+	e.infoRequests = append(e.infoRequests, ch)
+	e.infoMu.Unlock()
+	e.mu.RUnlock()
+
+	e.notifyProtocolGoroutine(notifyInfoRequested)
+
+	return <-ch
+}
+
+// answerInfoRequests answers the pending TCPInfoOption requests. It must only
+// be called from the protocol goroutine.
+func (e *endpoint) answerInfoRequests() {
+	e.infoMu.Lock()
+	requests := e.infoRequests
+	e.infoRequests = nil
+	e.infoMu.Unlock()
+
+	if len(requests) == 0 {
+		return
+	}
+
+	e.mu.RLock()
+	state := e.state
+	e.mu.RUnlock()
+
+	info := e.infoLocked(state)
+	for _, ch := range requests {
+		ch <- info
+	}
+}
+
+// infoLocked gathers the TCPInfoOption of the endpoint, which is in the given
+// state. It must only be called by the protocol goroutine, or while it can't
+// access the connection state.
+func (e *endpoint) infoLocked(state endpointState) tcpip.TCPInfoOption {
+	var info tcpip.TCPInfoOption
+	switch state {
+	case stateListen:
+		info.State = "LISTEN"
+	case stateConnecting:
+		info.State = "SYN_SENT"
+	case stateConnected:
+		info.State = e.connectedState()
+	case stateClosed:
+		info.State = "CLOSED"
+		if e.timeWait {
+			info.State = "TIME_WAIT"
+		}
+	default:
+		info.State = "CLOSED"
+	}
+
+	// The sender and receiver only exist once the connection is
+	// established, or being established by a listener.
+	if state != stateConnected && state != stateClosed || e.snd == nil || e.rcv == nil {
+		return info
+	}
+
+	s := e.snd
+	info.RTT = s.srtt
+	info.RTTVar = s.rttvar
+	info.RTO = s.rto
+	info.CongestionWindow = s.sndCwnd
+	info.SlowStartThreshold = s.sndSsthresh
+	info.SendWindow = int(s.sndWnd)
+	info.SendWindowScale = int(s.sndWndScale)
+	info.MSS = s.maxPayloadSize
+	info.BytesSent = s.bytesSent
+	info.SegmentsSent = s.segmentsSent
+	info.BytesRetransmitted = s.bytesRetransmitted
+	info.SegmentsRetransmitted = s.segmentsRetransmitted
+	info.FastRecovery = s.fr.active
+	if !s.lastAckTime.IsZero() {
+		info.LastAckAge = time.Since(s.lastAckTime)
+	}
+
+	r := e.rcv
+	info.ReceiveWindow = int(r.rcvNxt.Size(r.rcvAcc))
+	info.ReceiveWindowScale = int(r.rcvWndScale)
+	info.BytesReceived = r.bytesReceived
+	info.SegmentsReceived = r.segmentsReceived
+
+	return info
+}
+
+// connectedState returns the name of the state of a connected endpoint, per RFC
+// 793, which depends on the handshake and on which sides of the connection are
+// closed.
+func (e *endpoint) connectedState() string {
+	switch s, r := e.snd, e.rcv; {
+	case s == nil:
+		return "SYN_SENT"
+	case e.synRcvd != nil:
+		return "SYN_RCVD"
+	case !s.closed && !r.closed:
+		return "ESTABLISHED"
+	case !s.closed:
+		return "CLOSE_WAIT"
+	case !r.closed && s.sndUna == s.sndNxtList:
+		return "FIN_WAIT_2"
+	case !r.closed:
+		return "FIN_WAIT_1"
+	case s.activeClose:
+		return "CLOSING"
+	default:
+		return "LAST_ACK"
+	}
+}
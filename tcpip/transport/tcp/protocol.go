@@ -11,6 +11,10 @@
 package tcp
 
 import (
+	"math"
+	"sync"
+	"time"
+
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
@@ -25,9 +29,43 @@ const (
 
 	// ProtocolNumber is the tcp protocol number.
 	ProtocolNumber = header.TCPProtocolNumber
+
+	// defaultDelayedAckTimeout is the default maximum time the
+	// acknowledgement of received data is delayed.
+	defaultDelayedAckTimeout = 40 * time.Millisecond
+
+	// maxDelayedAckTimeout is the maximum time the acknowledgement of
+	// received data may be delayed, per RFC 1122, section 4.2.3.2.
+	maxDelayedAckTimeout = 500 * time.Millisecond
+
+	// defaultMSL is the default maximum segment lifetime. Connections
+	// that are closed actively remain in TIME_WAIT for twice its value.
+	defaultMSL = 30 * time.Second
+
+	// defaultFinWait2Timeout is the default time a closed endpoint waits
+	// for the FIN of its peer in FIN_WAIT_2.
+	defaultFinWait2Timeout = 60 * time.Second
 )
 
-type protocol struct{}
+// protocol is the TCP protocol of a stack. It holds the options set on the
+// stack via Stack.SetTransportProtocolOption().
+type protocol struct {
+	mu         sync.Mutex
+	ecn        bool
+	sack       bool
+	timestamps bool
+	cc         tcpip.CongestionControlOption
+	ackDelay   time.Duration
+	msl        time.Duration
+	finWait2   time.Duration
+	sndBufSize tcpip.SendBufferSizeRangeOption
+	rcvBufSize tcpip.ReceiveBufferSizeRangeOption
+	moderate   bool
+
+	// fastOpenCache holds the Fast Open cookies of the peers the
+	// endpoints of the stack connected to.
+	fastOpenCache fastOpenCache
+}
 
 // Number returns the tcp protocol number.
 func (*protocol) Number() tcpip.TransportProtocolNumber {
@@ -35,8 +73,16 @@ func (*protocol) Number() tcpip.TransportProtocolNumber {
 }
 
 // NewEndpoint creates a new tcp endpoint.
-func (*protocol) NewEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
-	return newEndpoint(stack, netProto, waiterQueue), nil
+func (p *protocol) NewEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	e := newEndpoint(stack, netProto, waiterQueue)
+	p.mu.Lock()
+	e.ecn = p.ecn
+	e.sack = p.sack
+	e.timestamps = p.timestamps
+	e.cc = p.cc
+	p.mu.Unlock()
+	e.fastOpenCache = &p.fastOpenCache
+	return e, nil
 }
 
 // MinimumPacketSize returns the minimum valid tcp packet size.
@@ -75,6 +121,191 @@ func (*protocol) HandleUnknownDestinationPacket(r *stack.Route, id stack.Transpo
 	return true
 }
 
+// SetOption implements stack.ConfigurableTransportProtocol.SetOption.
+func (p *protocol) SetOption(option interface{}) error {
+	switch v := option.(type) {
+	case tcpip.ECNOption:
+		p.mu.Lock()
+		p.ecn = v != 0
+		p.mu.Unlock()
+		return nil
+
+	case tcpip.SACKOption:
+		p.mu.Lock()
+		p.sack = v != 0
+		p.mu.Unlock()
+		return nil
+
+	case tcpip.TimestampOption:
+		p.mu.Lock()
+		p.timestamps = v != 0
+		p.mu.Unlock()
+		return nil
+
+	case tcpip.CongestionControlOption:
+		if !validCongestionControl(v) {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		p.mu.Lock()
+		p.cc = v
+		p.mu.Unlock()
+		return nil
+
+	case tcpip.DelayedAckTimeoutOption:
+		if v <= 0 || time.Duration(v) > maxDelayedAckTimeout {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		p.mu.Lock()
+		p.ackDelay = time.Duration(v)
+		p.mu.Unlock()
+		return nil
+
+	case tcpip.MaxSegmentLifetimeOption:
+		if v <= 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		p.mu.Lock()
+		p.msl = time.Duration(v)
+		p.mu.Unlock()
+		return nil
+
+	case tcpip.FinWait2TimeoutOption:
+		if v <= 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		p.mu.Lock()
+		p.finWait2 = time.Duration(v)
+		p.mu.Unlock()
+		return nil
+
+	case tcpip.SendBufferSizeRangeOption:
+		if !validBufferSizeRange(v.Min, v.Default, v.Max) {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		p.mu.Lock()
+		p.sndBufSize = v
+		p.mu.Unlock()
+		return nil
+
+	case tcpip.ReceiveBufferSizeRangeOption:
+		if !validBufferSizeRange(v.Min, v.Default, v.Max) {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		p.mu.Lock()
+		p.rcvBufSize = v
+		p.mu.Unlock()
+		return nil
+
+	case tcpip.ModerateReceiveBufferOption:
+		p.mu.Lock()
+		p.moderate = v != 0
+		p.mu.Unlock()
+		return nil
+	}
+
+	return tcpip.ErrUnknownProtocolOption
+}
+
+// Option implements stack.ConfigurableTransportProtocol.Option.
+func (p *protocol) Option(option interface{}) error {
+	switch o := option.(type) {
+	case *tcpip.ECNOption:
+		p.mu.Lock()
+		v := p.ecn
+		p.mu.Unlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.SACKOption:
+		p.mu.Lock()
+		v := p.sack
+		p.mu.Unlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.TimestampOption:
+		p.mu.Lock()
+		v := p.timestamps
+		p.mu.Unlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.CongestionControlOption:
+		p.mu.Lock()
+		*o = p.cc
+		p.mu.Unlock()
+		return nil
+
+	case *tcpip.DelayedAckTimeoutOption:
+		p.mu.Lock()
+		*o = tcpip.DelayedAckTimeoutOption(p.ackDelay)
+		p.mu.Unlock()
+		return nil
+
+	case *tcpip.MaxSegmentLifetimeOption:
+		p.mu.Lock()
+		*o = tcpip.MaxSegmentLifetimeOption(p.msl)
+		p.mu.Unlock()
+		return nil
+
+	case *tcpip.FinWait2TimeoutOption:
+		p.mu.Lock()
+		*o = tcpip.FinWait2TimeoutOption(p.finWait2)
+		p.mu.Unlock()
+		return nil
+
+	case *tcpip.SendBufferSizeRangeOption:
+		p.mu.Lock()
+		*o = p.sndBufSize
+		p.mu.Unlock()
+		return nil
+
+	case *tcpip.ReceiveBufferSizeRangeOption:
+		p.mu.Lock()
+		*o = p.rcvBufSize
+		p.mu.Unlock()
+		return nil
+
+	case *tcpip.ModerateReceiveBufferOption:
+		p.mu.Lock()
+		v := p.moderate
+		p.mu.Unlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+	}
+
+	return tcpip.ErrUnknownProtocolOption
+}
+
+// validBufferSizeRange checks that the sizes of a buffer size range are
+// positive and ordered. The maximum is limited so that twice the size of a
+// receive buffer doesn't overflow.
+func validBufferSizeRange(min, def, max int) bool {
+	return 0 < min && min <= def && def <= max && max <= math.MaxInt32/2
+}
+
 // replyWithReset replies to the given segment with a reset segment.
 func replyWithReset(s *segment) {
 	// Get the seqnum from the packet if the ack flag is set.
@@ -89,5 +320,23 @@ func replyWithReset(s *segment) {
 }
 
 func init() {
-	stack.RegisterTransportProtocol(ProtocolName, &protocol{})
+	stack.RegisterTransportProtocolFactory(ProtocolName, func() stack.TransportProtocol {
+		return &protocol{
+			timestamps: true,
+			cc:         Reno,
+			ackDelay:   defaultDelayedAckTimeout,
+			msl:        defaultMSL,
+			finWait2:   defaultFinWait2Timeout,
+			sndBufSize: tcpip.SendBufferSizeRangeOption{
+				Min:     minBufferSize,
+				Default: defaultBufferSize,
+				Max:     maxBufferSize,
+			},
+			rcvBufSize: tcpip.ReceiveBufferSizeRangeOption{
+				Min:     minBufferSize,
+				Default: defaultBufferSize,
+				Max:     maxBufferSize,
+			},
+		}
+	})
 }
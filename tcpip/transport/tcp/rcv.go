@@ -6,7 +6,11 @@ package tcp
 
 import (
 	"container/heap"
+	"time"
 
+	"github.com/google/netstack/sleep"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/seqnum"
 )
 
@@ -29,19 +33,172 @@ type receiver struct {
 
 	closed bool
 
+	// ecnEcho indicates whether ECE must be set on the segments sent to the
+	// peer, because a segment marked as having experienced congestion was
+	// received and the peer hasn't reduced its congestion window since.
+	// It is only used if the connection uses ECN.
+	ecnEcho bool
+
+	// sackBlocks are the blocks of out-of-order data held by the receiver,
+	// reported to the peer in SACK options if the connection uses
+	// selective acknowledgements. Per RFC 2018, section 4, the first block
+	// is the one holding the most recently received segment, and the
+	// others are the most recently reported ones.
+	sackBlocks []header.SACKBlock
+
+	// tsRecent is the timestamp to echo to the peer, TS.Recent as defined
+	// in RFC 7323, and tsRecentTime is when it was last updated. They are
+	// only used if the connection uses the timestamps option.
+	tsRecent     uint32
+	tsRecentTime time.Time
+
+	// quickAck indicates whether received data is acknowledged
+	// immediately. Otherwise, per RFC 1122, section 4.2.3.2, and RFC 5681,
+	// section 4.2, acknowledgements are delayed until a second full-sized
+	// segment is received or the ack timer expires, and ackNow indicates
+	// that the data received must be acknowledged without delay.
+	quickAck   bool
+	ackNow     bool
+	fullSegs   int
+	ackDelay   time.Duration
+	ackTimer   *time.Timer
+	ackTimerEn bool
+	ackWaker   sleep.Waker
+
+	// rcvMSS is the size of the largest segment received, which is taken
+	// as the full segment size of the peer.
+	rcvMSS int
+
+	// The following fields are used for the dynamic right-sizing of
+	// auto-tuned receive buffers. The round-trip time, rcvRTT, is
+	// estimated as the time it takes the peer to send a window of data,
+	// from rttMeasureTime until rttMeasureSeq is received. Once per
+	// round-trip time, the amount of data the application read since
+	// spaceTime, when rcvNxt was spaceSeq and spaceUsed bytes of the
+	// buffer were used, is compared to space, the most data read in a
+	// round-trip time so far. The buffer grows to twice that amount, so
+	// that the window doesn't limit the throughput of the peer.
+	rcvRTT         time.Duration
+	rttMeasureSeq  seqnum.Value
+	rttMeasureTime time.Time
+	space          int
+	spaceTime      time.Time
+	spaceSeq       seqnum.Value
+	spaceUsed      int
+
 	pendingRcvdSegments segmentHeap
 	pendingBufUsed      seqnum.Size
 	pendingBufSize      seqnum.Size
+
+	// bytesReceived counts the data received in order, and
+	// segmentsReceived the segments received. They are reported by
+	// TCPInfoOption.
+	bytesReceived    uint64
+	segmentsReceived uint64
 }
 
 func newReceiver(ep *endpoint, irs seqnum.Value, rcvWnd seqnum.Size, rcvWndScale uint8) *receiver {
-	return &receiver{
+	var ackDelay tcpip.DelayedAckTimeoutOption
+	if err := ep.stack.TransportProtocolOption(ProtocolNumber, &ackDelay); err != nil {
+		ackDelay = tcpip.DelayedAckTimeoutOption(defaultDelayedAckTimeout)
+	}
+
+	r := &receiver{
 		ep:             ep,
 		rcvNxt:         irs + 1,
 		rcvAcc:         irs.Add(rcvWnd + 1),
 		rcvWndScale:    rcvWndScale,
+		ackDelay:       time.Duration(ackDelay),
 		pendingBufSize: rcvWnd,
 	}
+
+	r.ackTimer = time.AfterFunc(time.Hour, func() {
+		r.ackWaker.Assert()
+	})
+	r.ackTimer.Stop()
+
+	return r
+}
+
+// scheduleAck decides when to acknowledge s, a segment of in-order data. The
+// data is acknowledged immediately when it fills a gap, so that the peer learns
+// about it quickly, and when it is a partial segment with PSH set, which ends a
+// write the peer may not follow with more data until it is acknowledged, as
+// with Nagle's algorithm.
+func (r *receiver) scheduleAck(s *segment, filledGap bool) {
+	size := s.data.Size()
+	if size > r.rcvMSS {
+		r.rcvMSS = size
+	}
+
+	switch {
+	case r.quickAck || filledGap:
+		r.ackNow = true
+	case size < r.rcvMSS:
+		if s.flagIsSet(flagPsh) {
+			r.ackNow = true
+		}
+	default:
+		r.fullSegs++
+		if r.fullSegs >= 2 {
+			r.ackNow = true
+		}
+	}
+}
+
+// delayAck starts the ack timer, unless it's already running, to acknowledge
+// the data received when it expires.
+func (r *receiver) delayAck() {
+	if !r.ackTimerEn {
+		r.ackTimerEn = true
+		r.ackTimer.Reset(r.ackDelay)
+	}
+}
+
+// ackSent is called when a segment is sent, acknowledging all the data
+// received so far.
+func (r *receiver) ackSent() {
+	r.ackNow = false
+	r.fullSegs = 0
+	stopAndDrainTimer(r.ackTimer, &r.ackTimerEn)
+}
+
+// ackTimerExpired is called when the ack timer expires, to acknowledge the
+// data received since the last ack.
+func (r *receiver) ackTimerExpired() {
+	r.ackTimerEn = false
+	if r.rcvNxt != r.ep.snd.maxSentAck {
+		r.ep.snd.sendAck()
+	}
+}
+
+// pawsIdleTimeout is the time after which TS.Recent is considered too old to be
+// used for the PAWS check, per RFC 7323, section 5.5.
+const pawsIdleTimeout = 24 * 24 * time.Hour
+
+// updateTSRecent sets the timestamp to echo to the peer.
+func (r *receiver) updateTSRecent(tsVal uint32) {
+	r.tsRecent = tsVal
+	r.tsRecentTime = time.Now()
+}
+
+// checkTimestamp implements the PAWS check of RFC 7323, section 5.3: it returns
+// false if the segment carries a timestamp older than TS.Recent, in which case
+// the segment must be dropped. Otherwise, TS.Recent is updated as described in
+// section 4.3 if the segment doesn't start beyond the last ack sent.
+func (r *receiver) checkTimestamp(s *segment) bool {
+	if !s.hasTimestamp {
+		return true
+	}
+
+	if int32(s.tsVal-r.tsRecent) < 0 && time.Since(r.tsRecentTime) < pawsIdleTimeout {
+		return false
+	}
+
+	if !r.ep.snd.maxSentAck.LessThan(s.sequenceNumber) {
+		r.updateTSRecent(s.tsVal)
+	}
+	return true
 }
 
 // acceptable checks if the segment sequence number range is acceptable
@@ -108,6 +265,7 @@ func (r *receiver) consumeSegment(s *segment, segSeq seqnum.Value, segLen seqnum
 		}
 
 		// Move segment to ready-to-deliver list. Wakeup any waiters.
+		r.bytesReceived += uint64(segLen)
 		r.ep.readyToRead(s)
 
 	} else if segSeq != r.rcvNxt {
@@ -119,8 +277,10 @@ func (r *receiver) consumeSegment(s *segment, segSeq seqnum.Value, segLen seqnum
 	if s.flagIsSet(flagFin) {
 		r.rcvNxt++
 
-		// Send ACK immediately.
-		r.ep.snd.sendAck()
+		// Acknowledge the FIN without delay: no more data will come
+		// to trigger the ACK, and the peer waits for it to complete
+		// its close.
+		r.ackNow = true
 
 		// Tell any readers that no more data will come.
 		r.closed = true
@@ -138,14 +298,66 @@ func (r *receiver) consumeSegment(s *segment, segSeq seqnum.Value, segLen seqnum
 			r.pendingRcvdSegments[i].decRef()
 		}
 		r.pendingRcvdSegments = r.pendingRcvdSegments[:first]
+		r.sackBlocks = nil
 	}
 
 	return true
 }
 
+// updateSACKBlocks records that the out-of-order data in [start, end) was
+// received, merging it with the blocks it overlaps or is adjacent to, and
+// moving the resulting block first.
+func (r *receiver) updateSACKBlocks(start, end seqnum.Value) {
+	blocks := make([]header.SACKBlock, 1, header.TCPMaxSACKBlocks)
+	for _, b := range r.sackBlocks {
+		if end.LessThan(b.Start) || b.End.LessThan(start) {
+			if len(blocks) < cap(blocks) {
+				blocks = append(blocks, b)
+			}
+			continue
+		}
+
+		if b.Start.LessThan(start) {
+			start = b.Start
+		}
+		if end.LessThan(b.End) {
+			end = b.End
+		}
+	}
+	blocks[0] = header.SACKBlock{Start: start, End: end}
+	r.sackBlocks = blocks
+}
+
+// trimSACKBlocks removes the parts of the SACK blocks that are no longer out
+// of order, once rcvNxt moves forward.
+func (r *receiver) trimSACKBlocks() {
+	blocks := r.sackBlocks[:0]
+	for _, b := range r.sackBlocks {
+		if !r.rcvNxt.LessThan(b.End) {
+			continue
+		}
+		if b.Start.LessThan(r.rcvNxt) {
+			b.Start = r.rcvNxt
+		}
+		blocks = append(blocks, b)
+	}
+	r.sackBlocks = blocks
+}
+
 // handleRcvdSegment handles TCP segments directed at the connection managed by
 // r as they arrive. It is called by the protocol main loop.
 func (r *receiver) handleRcvdSegment(s *segment) {
+	// Per RFC 3168, section 6.1.3, congestion marks are echoed until the
+	// peer sets CWR.
+	if r.ep.snd.ecn {
+		if s.flagIsSet(flagCwr) {
+			r.ecnEcho = false
+		}
+		if s.route.ReceivedECN == header.ECNCE {
+			r.ecnEcho = true
+		}
+	}
+
 	// We don't care about receive processing anymore if the receive side
 	// is closed.
 	if r.closed {
@@ -171,6 +383,10 @@ func (r *receiver) handleRcvdSegment(s *segment) {
 				r.pendingBufUsed += s.logicalLen()
 				s.incRef()
 				heap.Push(&r.pendingRcvdSegments, s)
+
+				if r.ep.snd.sackPermitted && segLen > 0 {
+					r.updateSACKBlocks(segSeq, segSeq.Add(segLen))
+				}
 			}
 
 			// Immediately send an ack so that the peer knows it may
@@ -180,6 +396,10 @@ func (r *receiver) handleRcvdSegment(s *segment) {
 		return
 	}
 
+	if segLen > 0 {
+		r.scheduleAck(s, r.pendingRcvdSegments.Len() > 0)
+	}
+
 	// By consuming the current segment, we may have filled a gap in the
 	// sequence number domain that allows pending segments to be consumed
 	// now. So try to do it.
@@ -198,4 +418,56 @@ func (r *receiver) handleRcvdSegment(s *segment) {
 		r.pendingBufUsed -= s.logicalLen()
 		s.decRef()
 	}
+
+	r.trimSACKBlocks()
+
+	if segLen > 0 {
+		r.adjustReceiveBuffer()
+	}
+}
+
+// adjustReceiveBuffer updates the round-trip time estimate when a window of data
+// has been received, and grows the receive buffer once per round-trip time
+// according to the rate at which the application reads. It is called when
+// data is received.
+func (r *receiver) adjustReceiveBuffer() {
+	now := time.Now()
+	if r.rttMeasureTime.IsZero() {
+		r.rttMeasureTime = now
+		r.rttMeasureSeq = r.rcvAcc
+		r.spaceTime = now
+		r.spaceSeq = r.rcvNxt
+		r.spaceUsed = r.ep.receiveBufferUsed()
+		return
+	}
+
+	if !r.rcvNxt.LessThan(r.rttMeasureSeq) {
+		// Keep the estimate close to the smallest samples, which are
+		// the closest to the actual round-trip time.
+		rtt := now.Sub(r.rttMeasureTime)
+		if r.rcvRTT == 0 || rtt < r.rcvRTT {
+			r.rcvRTT = rtt
+		} else {
+			r.rcvRTT = (7*r.rcvRTT + rtt) / 8
+		}
+		r.rttMeasureTime = now
+		r.rttMeasureSeq = r.rcvAcc
+	}
+
+	if r.rcvRTT == 0 || now.Sub(r.spaceTime) < r.rcvRTT {
+		return
+	}
+
+	// The data received since the start of the measurement is either
+	// still in the buffer or has been read.
+	used := r.ep.receiveBufferUsed()
+	copied := int(r.spaceSeq.Size(r.rcvNxt)) - (used - r.spaceUsed)
+	if copied > r.space {
+		r.space = copied
+		r.pendingBufSize = seqnum.Size(r.ep.growReceiveBuffer(2 * copied))
+	}
+
+	r.spaceTime = now
+	r.spaceSeq = r.rcvNxt
+	r.spaceUsed = used
 }
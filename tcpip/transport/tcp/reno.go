@@ -0,0 +1,63 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+// renoState holds the state of the Reno congestion control algorithm.
+type renoState struct {
+	s *sender
+
+	// caAckCount is the number of packets acknowledged during congestion
+	// avoidance. When enough packets have been ack'd (typically cwnd
+	// packets), the congestion window is incremented by one.
+	caAckCount int
+}
+
+func newRenoCC(s *sender) congestionControl {
+	return &renoState{s: s}
+}
+
+// onAck implements congestionControl.onAck.
+func (r *renoState) onAck(packetsAcked int) {
+	s := r.s
+	if s.sndCwnd < s.sndSsthresh {
+		packetsAcked = s.slowStart(packetsAcked)
+		if s.sndCwnd >= s.sndSsthresh {
+			r.caAckCount = 0
+		}
+		if packetsAcked == 0 {
+			// We've consumed all ack'd packets.
+			return
+		}
+	}
+
+	// Consume the packets in congestion avoidance mode.
+	r.caAckCount += packetsAcked
+	if r.caAckCount >= s.sndCwnd {
+		s.sndCwnd += r.caAckCount / s.sndCwnd
+		r.caAckCount = r.caAckCount % s.sndCwnd
+	}
+}
+
+// onLoss implements congestionControl.onLoss. It reduces the slow-start
+// threshold per RFC 5681, page 6, eq. 4.
+func (r *renoState) onLoss() {
+	s := r.s
+	s.sndSsthresh = s.outstanding / 2
+	if s.sndSsthresh < 2 {
+		s.sndSsthresh = 2
+	}
+}
+
+// onRTO implements congestionControl.onRTO.
+func (r *renoState) onRTO() {
+	// Reduce the congestion window to 1, i.e., enter slow-start.
+	r.s.sndCwnd = 1
+}
+
+// onRecoveryExit implements congestionControl.onRecoveryExit.
+func (r *renoState) onRecoveryExit() {
+	// Deflate cwnd. It had been artifically inflated when new dups arrived.
+	r.s.sndCwnd = r.s.sndSsthresh
+}
@@ -21,6 +21,8 @@ const (
 	flagPsh
 	flagAck
 	flagUrg
+	flagEce
+	flagCwr
 )
 
 // segment represents a TCP segment. It holds the payload and parsed TCP segment
@@ -43,6 +45,19 @@ type segment struct {
 	flags          uint8
 	window         seqnum.Size
 	options        []byte
+
+	// hasTimestamp indicates whether the segment carries a timestamps
+	// option, in which case tsVal and tsEcr hold its fields.
+	hasTimestamp bool
+	tsVal        uint32
+	tsEcr        uint32
+
+	// sacked and retransmitted are used by the sender for the segments in
+	// its write list: they indicate whether the segment was reported as
+	// received in a SACK option, and whether it was retransmitted during
+	// loss recovery.
+	sacked        bool
+	retransmitted bool
 }
 
 func newSegment(r *stack.Route, id stack.TransportEndpointID, vv *buffer.VectorisedView) *segment {
@@ -97,8 +112,8 @@ func (s *segment) logicalLen() seqnum.Size {
 	return l
 }
 
-// parse populates the sequence & ack numbers, flags, and window fields of the
-// segment from the TCP header stored in the data. It then updates the view to
+// parse populates the sequence & ack numbers, flags, window and timestamp fields
+// of the segment from the TCP header stored in the data. It then updates the view to
 // skip the data. Returns boolean indicating if the parsing was successful.
 func (s *segment) parse() bool {
 	h := header.TCP(s.data.First())
@@ -125,6 +140,7 @@ func (s *segment) parse() bool {
 	s.ackNumber = seqnum.Value(h.AckNumber())
 	s.flags = h.Flags()
 	s.window = seqnum.Size(h.WindowSize())
+	s.tsVal, s.tsEcr, s.hasTimestamp = header.ParseTimestampOption(s.options)
 
 	return true
 }
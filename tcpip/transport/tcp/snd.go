@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/google/netstack/sleep"
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/seqnum"
@@ -21,8 +22,27 @@ const (
 	// initalCwnd is the initial congestion window. We use the conservative
 	// value of 1.
 	initialCwnd = 1
+
+	// dupAckThreshold is the number of duplicate acks that trigger a fast
+	// retransmit. When selective acknowledgements are in use, it is also
+	// the number of segments that must be SACKed above a segment for it to
+	// be considered lost, per RFC 6675, section 2.
+	dupAckThreshold = 3
+
+	// corkTimeout is the maximum time partial segments are held back while
+	// the connection is corked.
+	corkTimeout = 200 * time.Millisecond
 )
 
+// tsEpoch is the origin of the timestamp clock.
+var tsEpoch = time.Now()
+
+// tsClock returns the current value, in milliseconds, of the timestamp clock of
+// a connection whose clock starts at the given offset.
+func tsClock(offset uint32) uint32 {
+	return uint32(time.Since(tsEpoch)/time.Millisecond) + offset
+}
+
 // sender holds the state necessary to send TCP segments.
 type sender struct {
 	ep *endpoint
@@ -44,10 +64,9 @@ type sender struct {
 	// avoidance.
 	sndSsthresh int
 
-	// sndCAAckCount is the number of packets acknowledged during congestion
-	// avoidance. When enough packets have been ack'd (typically cwnd
-	// packets), the congestion window is incremented by one.
-	sndCAAckCount int
+	// cc is the congestion control algorithm, which updates sndCwnd and
+	// sndSsthresh.
+	cc congestionControl
 
 	// outstanding is the number of outstanding packets, that is, packets
 	// that have been sent but not yet acknowledged.
@@ -73,6 +92,11 @@ type sender struct {
 	// rttMeasureTime is the time when the rttMeasureSeqNum was sent.
 	rttMeasureTime time.Time
 
+	// activeClose indicates whether the send side was closed before the
+	// FIN of the peer was received, in which case the connection goes
+	// through TIME_WAIT once it's closed.
+	activeClose bool
+
 	closed        bool
 	writeNext     *segment
 	writeList     segmentList
@@ -80,6 +104,21 @@ type sender struct {
 	resendTimerEn bool
 	resendWaker   sleep.Waker
 
+	// nagle indicates whether partial segments are held back while data is
+	// unacknowledged, per Nagle's algorithm (RFC 896), and cork whether
+	// they are held back until the connection is uncorked or the cork
+	// timer expires. They're updated from the endpoint's options whenever
+	// data is written.
+	nagle       bool
+	cork        bool
+	corkTimer   *time.Timer
+	corkTimerEn bool
+	corkWaker   sleep.Waker
+
+	// corkExpired indicates that partial segments held back while corked
+	// must be sent.
+	corkExpired bool
+
 	// srtt, rttvar & rto are the "smoothed round-trip time", "round-trip
 	// time variation" and "retransmit timeout", as defined in section 2 of
 	// RFC 6298.
@@ -98,6 +137,62 @@ type sender struct {
 
 	// maxSentAck is the maxium acknowledgement actually sent.
 	maxSentAck seqnum.Value
+
+	// ecn indicates whether the connection uses ECN, as defined in RFC
+	// 3168. When it does, new data segments are marked ECN-capable.
+	ecn bool
+
+	// ecnRecover is the value of sndNxt when the congestion window was
+	// last reduced in response to an ECE flag. Further ECE flags are
+	// ignored until it is acknowledged, so that the window is reduced at
+	// most once per round trip.
+	ecnRecover seqnum.Value
+
+	// ecnCwr indicates whether CWR must be set on the next new data
+	// segment, to tell the peer that the congestion window was reduced.
+	ecnCwr bool
+
+	// sackPermitted indicates whether the connection uses selective
+	// acknowledgements. When it does, the segments of the write list
+	// reported in SACK options are marked as such, and form the scoreboard
+	// used for loss recovery as described in RFC 6675.
+	sackPermitted bool
+
+	// sackedSegs is the number of segments of the write list marked as
+	// SACKed, and highSacked the end of the highest of them, or sndUna if
+	// there's none. They're kept up to date as acks arrive, so that the
+	// scoreboard isn't scanned to query them, as suggested by RFC 6675,
+	// section 6.
+	sackedSegs int
+	highSacked seqnum.Value
+
+	// During SACK recovery, lossNext is the first segment not known to be
+	// lost: all the segments before it were either SACKed or are lost.
+	// lossSackedBefore is the number of SACKed segments before it. rtxNext
+	// is the next candidate for retransmission: all the segments before
+	// it were SACKed or retransmitted. Both only move forward, so that
+	// each segment is visited once per recovery. They're nil outside of
+	// SACK recovery, until the first ack handled in it sets them up.
+	lossNext         *segment
+	lossSackedBefore int
+	rtxNext          *segment
+
+	// timestamps indicates whether the connection uses the timestamps
+	// option of RFC 7323. When it does, every segment sent carries the
+	// timestamp clock, offset by tsClockOffset, and every ack of new data
+	// provides an RTT measurement.
+	timestamps    bool
+	tsClockOffset uint32
+
+	// The following count the data and segments sent, including
+	// retransmissions, and the retransmitted data and segments. They are
+	// reported by TCPInfoOption, along with lastAckTime, the time the last
+	// ack was received.
+	bytesSent             uint64
+	segmentsSent          uint64
+	bytesRetransmitted    uint64
+	segmentsRetransmitted uint64
+	lastAckTime           time.Time
 }
 
 // fastRecovery holds information related to fast recovery from a packet loss.
@@ -134,7 +229,7 @@ func stopAndDrainTimer(t *time.Timer, enabled *bool) {
 	}
 }
 
-func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint16, sndWndScale int) *sender {
+func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint16, sndWndScale int, cc tcpip.CongestionControlOption) *sender {
 	s := &sender{
 		ep:               ep,
 		sndCwnd:          initialCwnd,
@@ -148,7 +243,15 @@ func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint
 		lastSendTime:     time.Now(),
 		maxPayloadSize:   int(mss),
 		maxSentAck:       irs + 1,
+		ecnRecover:       iss,
+		highSacked:       iss + 1,
+	}
+
+	newCC, ok := congestionControls[cc]
+	if !ok {
+		newCC = newRenoCC
 	}
+	s.cc = newCC(s)
 
 	// A negative sndWndScale means that no scaling is in use, otherwise we
 	// store the scaling value.
@@ -166,9 +269,25 @@ func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint
 	})
 	s.resendTimer.Stop()
 
+	s.corkTimer = time.AfterFunc(time.Hour, func() {
+		s.corkWaker.Assert()
+	})
+	s.corkTimer.Stop()
+
 	return s
 }
 
+// enableTimestamps makes the sender stamp the segments it sends with the
+// timestamp clock starting at the given offset, reducing their maximum payload
+// to leave room for the option.
+func (s *sender) enableTimestamps(clockOffset uint32) {
+	s.timestamps = true
+	s.tsClockOffset = clockOffset
+	if s.maxPayloadSize > header.TCPTimestampOptionSize {
+		s.maxPayloadSize -= header.TCPTimestampOptionSize
+	}
+}
+
 // sendAck sends an ACK segment.
 func (s *sender) sendAck() {
 	s.sendSegment(nil, flagAck, s.sndNxt)
@@ -216,19 +335,11 @@ func (s *sender) resendSegment() {
 	if seg := s.writeList.Front(); seg == nil {
 		s.sendSegment(nil, flagAck|flagFin, s.sndUna)
 	} else {
+		seg.retransmitted = true
 		s.sendSegment(&seg.data, flagAck|flagPsh, s.sndUna)
 	}
 }
 
-// reduceSlowStartThreshold reduces the slow-start threshold per RFC 5681,
-// page 6, eq. 4. It is called when we detect congestion in the network.
-func (s *sender) reduceSlowStartThreshold() {
-	s.sndSsthresh = s.outstanding / 2
-	if s.sndSsthresh < 2 {
-		s.sndSsthresh = 2
-	}
-}
-
 // retransmitTimerExpired is called when the retransmit timer expires, and
 // unacknowledged segments are assumed lost, and thus need to be resent.
 // Returns true if the connection is still usable, or false if the connection
@@ -251,11 +362,22 @@ func (s *sender) retransmitTimerExpired() bool {
 		s.leaveFastRecovery()
 	} else {
 		// We lost a packet, so reduce ssthresh.
-		s.reduceSlowStartThreshold()
+		s.cc.onLoss()
 	}
 
-	// Reduce the congestion window to 1, i.e., enter slow-start.
-	s.sndCwnd = 1
+	// Restart from slow start.
+	s.cc.onRTO()
+
+	// Forget the SACK information, as the peer may have discarded the
+	// data it reported, per RFC 2018, section 8.
+	if s.sackPermitted {
+		for seg := s.writeList.Front(); seg != nil; seg = seg.Next() {
+			seg.sacked = false
+			seg.retransmitted = false
+		}
+		s.sackedSegs = 0
+		s.highSacked = s.sndUna
+	}
 
 	// Mark the next segment to be sent as the first unacknowledged one and
 	// start sending again. Set the number of outstanding packets to 0 so
@@ -285,9 +407,6 @@ func (s *sender) sendData() {
 		}
 	}
 
-	// TODO: We currently don't merge multiple send buffers
-	// into one segment if they happen to fit. We should do that
-	// eventually.
 	var seg *segment
 	end := s.sndUna.Add(s.sndWnd)
 	for seg = s.writeNext; seg != nil && s.outstanding < s.sndCwnd; seg = seg.Next() {
@@ -307,6 +426,15 @@ func (s *sender) sendData() {
 			available = limit
 		}
 
+		// New data is sent in segments as large as possible, and
+		// partial ones may have to wait for more data.
+		if !seg.sequenceNumber.LessThan(s.sndNxt) {
+			s.coalesce(seg, available)
+			if seg.data.Size() < limit && s.holdPartialSegment(seg) {
+				break
+			}
+		}
+
 		if seg.data.Size() > available {
 			// Split this segment up.
 			nSeg := seg.clone()
@@ -339,9 +467,79 @@ func (s *sender) sendData() {
 	s.enableResendTimer()
 }
 
+// coalesce appends to seg, a segment of new data, the data of the segments of
+// new data that follow it in the write list, until it reaches size bytes.
+func (s *sender) coalesce(seg *segment, size int) {
+	n := 0
+	for next := seg.Next(); next != nil && next.flags == 0 && seg.data.Size()+n < size; next = next.Next() {
+		n += next.data.Size()
+	}
+	if n == 0 {
+		return
+	}
+	if seg.data.Size()+n > size {
+		n = size - seg.data.Size()
+	}
+
+	// The send path takes payloads in a single view, so the data is
+	// copied into a new one.
+	v := buffer.NewView(seg.data.Size() + n)
+	b := v
+	for _, w := range seg.data.Views() {
+		b = b[copy(b, w):]
+	}
+	for len(b) > 0 {
+		next := seg.Next()
+		left := len(b)
+		for _, w := range next.data.Views() {
+			b = b[copy(b, w):]
+		}
+		if copied := left - len(b); copied < next.data.Size() {
+			// Only part of the next segment fits.
+			next.data.TrimFront(copied)
+		} else {
+			s.writeList.Remove(next)
+			next.decRef()
+		}
+	}
+
+	seg.views[0] = v
+	seg.data = buffer.NewVectorisedView(len(v), seg.views[:1])
+}
+
+// holdPartialSegment returns whether seg, a partial segment of new data, must
+// be held back, either per Nagle's algorithm or because the connection is
+// corked. The last segment is never held back once the send side is closed.
+func (s *sender) holdPartialSegment(seg *segment) bool {
+	if s.closed && seg.Next() == nil {
+		return false
+	}
+
+	if s.cork && !s.corkExpired {
+		if !s.corkTimerEn {
+			s.corkTimerEn = true
+			s.corkTimer.Reset(corkTimeout)
+		}
+		return true
+	}
+
+	// Nagle's algorithm only allows one partial segment to be
+	// unacknowledged at any time, per RFC 1122, section 4.2.3.4.
+	return s.nagle && s.sndUna != s.sndNxt
+}
+
+// corkTimerExpired is called when the cork timer expires, to send the partial
+// segments that were held back.
+func (s *sender) corkTimerExpired() {
+	s.corkTimerEn = false
+	s.corkExpired = true
+	s.sendData()
+	s.corkExpired = false
+}
+
 func (s *sender) enterFastRecovery() {
 	// Save state to reflect we're now in fast recovery.
-	s.reduceSlowStartThreshold()
+	s.cc.onLoss()
 	s.sndCwnd = s.sndSsthresh
 	s.fr.first = s.sndUna
 	s.fr.last = s.sndNxt - 1
@@ -353,12 +551,200 @@ func (s *sender) leaveFastRecovery() {
 	s.fr.active = false
 
 	// Deflate cwnd. It had been artifically inflated when new dups arrived.
-	s.sndCwnd = s.sndSsthresh
+	s.cc.onRecoveryExit()
+
+	// During SACK recovery, the number of outstanding packets tracks the
+	// pipe, which excludes SACKed and lost segments. Count all of them
+	// again, as they're removed from the count when acknowledged.
+	if s.sackPermitted {
+		s.outstanding = 0
+		for seg := s.writeList.Front(); s.isSent(seg); seg = seg.Next() {
+			s.outstanding++
+		}
+		s.lossNext = nil
+		s.rtxNext = nil
+	}
+}
+
+// isSent returns whether seg, a segment of the write list, was sent at least
+// once. It returns false if seg is nil.
+func (s *sender) isSent(seg *segment) bool {
+	return seg != nil && seg.flags != 0 && seg.sequenceNumber.LessThan(s.sndNxt)
+}
+
+// updateScoreboard marks the sent segments covered by the SACK blocks of the
+// received segment as SACKed. During SACK recovery, the segments that are
+// SACKed, or that become lost as a result, are removed from the pipe.
+func (s *sender) updateScoreboard(rcvd *segment) {
+	blocks := header.ParseSACKBlocks(rcvd.options)
+	if len(blocks) == 0 {
+		return
+	}
+
+	// Segments beyond the highest block can't be covered by any of them.
+	high := blocks[0].End
+	for _, b := range blocks[1:] {
+		if high.LessThan(b.End) {
+			high = b.End
+		}
+	}
+
+	recovery := s.fr.active && s.lossNext != nil
+	for seg := s.writeList.Front(); s.isSent(seg) && seg.sequenceNumber.LessThan(high); seg = seg.Next() {
+		if seg.sacked {
+			continue
+		}
+
+		start := seg.sequenceNumber
+		end := start.Add(seqnum.Size(seg.data.Size()))
+		for _, b := range blocks {
+			if start.LessThan(b.Start) || b.End.LessThan(end) {
+				continue
+			}
+
+			seg.sacked = true
+			s.sackedSegs++
+			if s.highSacked.LessThan(end) {
+				s.highSacked = end
+			}
+
+			if recovery {
+				// Lost segments were already removed from the
+				// pipe, unless they were retransmitted.
+				if start.LessThan(s.lossNext.sequenceNumber) {
+					s.lossSackedBefore++
+				} else {
+					s.outstanding--
+				}
+				if seg.retransmitted {
+					s.outstanding--
+				}
+			}
+			break
+		}
+	}
+
+	if recovery {
+		s.updateLoss()
+	}
+}
+
+// updateLoss moves lossNext forward past the segments that became lost, per the
+// IsLost procedure of RFC 6675, section 4: segments which weren't SACKed but
+// have enough SACKed segments above them. Those are removed from the pipe.
+func (s *sender) updateLoss() {
+	for seg := s.lossNext; s.isSent(seg) && seg.Next() != nil; seg = seg.Next() {
+		if seg.sacked {
+			s.lossSackedBefore++
+		} else if s.sackedSegs-s.lossSackedBefore < dupAckThreshold {
+			return
+		} else {
+			s.outstanding--
+		}
+		s.lossNext = seg.Next()
+	}
+}
+
+// startSACKRecovery sets up the state of SACK recovery, and estimates the
+// number of segments in flight, as done by the SetPipe procedure of RFC 6675,
+// section 4: segments which weren't SACKed count once unless they are
+// considered lost, and once more if they were retransmitted. The estimate is
+// then kept up to date as acks arrive.
+func (s *sender) startSACKRecovery() {
+	s.outstanding = 0
+	for seg := s.writeList.Front(); s.isSent(seg); seg = seg.Next() {
+		if seg.sacked {
+			continue
+		}
+		s.outstanding++
+		if seg.retransmitted {
+			s.outstanding++
+		}
+	}
+
+	s.lossNext = s.writeList.Front()
+	s.lossSackedBefore = 0
+	s.rtxNext = s.writeList.Front()
+	s.updateLoss()
+}
+
+// removeFromScoreboard is called when seg, the first segment of the write list,
+// is acknowledged and about to be removed.
+func (s *sender) removeFromScoreboard(seg *segment) {
+	if seg.sacked {
+		s.sackedSegs--
+	}
+
+	if !s.fr.active || s.lossNext == nil {
+		s.outstanding--
+		return
+	}
+
+	// The segment is before lossNext unless it's lossNext itself, as it's
+	// the first one.
+	if seg == s.lossNext {
+		s.lossNext = seg.Next()
+		if !seg.sacked {
+			s.outstanding--
+		}
+	} else if seg.sacked {
+		s.lossSackedBefore--
+	}
+	if !seg.sacked && seg.retransmitted {
+		s.outstanding--
+	}
+	if seg == s.rtxNext {
+		s.rtxNext = seg.Next()
+	}
+}
+
+// nextSeg returns the next segment to retransmit during SACK recovery, as
+// chosen by the NextSeg procedure of RFC 6675, section 4: the first segment
+// considered lost that wasn't retransmitted yet (rule 1) or, if rescue is
+// true because no new data can be sent, the first one that wasn't SACKed
+// but has SACKed segments above it (rule 3). It returns nil if there is none.
+func (s *sender) nextSeg(rescue bool) *segment {
+	seg := s.rtxNext
+	for s.isSent(seg) && (seg.sacked || seg.retransmitted) && seg.Next() != nil {
+		seg = seg.Next()
+	}
+	s.rtxNext = seg
+
+	if !s.isSent(seg) || seg.sacked || seg.retransmitted {
+		return nil
+	}
+	if seg.sequenceNumber.LessThan(s.lossNext.sequenceNumber) {
+		return seg
+	}
+	if rescue && seg.sequenceNumber.LessThan(s.highSacked) {
+		return seg
+	}
+	return nil
+}
+
+// retransmitSACKRecovery retransmits segments chosen by nextSeg as long as the
+// congestion window allows it, as done in step (C) of RFC 6675, section 5.
+func (s *sender) retransmitSACKRecovery(rescue bool) {
+	for s.outstanding < s.sndCwnd {
+		seg := s.nextSeg(rescue)
+		if seg == nil {
+			return
+		}
+
+		// Don't use any segments we already sent to measure RTT as
+		// they may have been affected by packets being lost.
+		s.rttMeasureSeqNum = s.sndNxt
+
+		seg.retransmitted = true
+		s.outstanding++
+		s.sendSegment(&seg.data, flagAck|flagPsh, seg.sequenceNumber)
+	}
 }
 
 // checkDuplicateAck is called when an ack is received. It manages the state
 // related to duplicate acks and determines if a retransmit is needed according
-// to the rules in RFC 6582 (NewReno).
+// to the rules in RFC 6582 (NewReno), or in RFC 6675 when selective
+// acknowledgements are in use.
 func (s *sender) checkDuplicateAck(seg *segment) bool {
 	ack := seg.ackNumber
 	if s.fr.active {
@@ -375,6 +761,12 @@ func (s *sender) checkDuplicateAck(seg *segment) bool {
 			return false
 		}
 
+		// With SACK, retransmissions are driven by the scoreboard
+		// rather than by duplicate and partial acks.
+		if s.sackPermitted {
+			return false
+		}
+
 		// Don't count this as a duplicate if it is carrying data or
 		// updating the window.
 		if seg.logicalLen() != 0 || s.sndWnd != seg.window {
@@ -411,9 +803,11 @@ func (s *sender) checkDuplicateAck(seg *segment) bool {
 		return false
 	}
 
-	// Enter fast recovery when we reach 3 dups.
+	// Enter fast recovery when we reach 3 dups or, with SACK, when the
+	// first unacknowledged segment is considered lost because enough
+	// segments were SACKed above it.
 	s.dupAckCount++
-	if s.dupAckCount != 3 {
+	if s.dupAckCount < dupAckThreshold && (!s.sackPermitted || s.sackedSegs < dupAckThreshold) {
 		return false
 	}
 
@@ -422,43 +816,47 @@ func (s *sender) checkDuplicateAck(seg *segment) bool {
 	return true
 }
 
-// updateCwnd updates the congestion window based on the number of packets that
-// were acknowledged.
-func (s *sender) updateCwnd(packetsAcked int) {
-	if s.sndCwnd < s.sndSsthresh {
-		// Don't let the congestion window cross into the congestion
-		// avoidance range.
-		newcwnd := s.sndCwnd + packetsAcked
-		if newcwnd >= s.sndSsthresh {
-			newcwnd = s.sndSsthresh
-			s.sndCAAckCount = 0
-		}
-
-		packetsAcked -= newcwnd - s.sndCwnd
-		s.sndCwnd = newcwnd
-		if packetsAcked == 0 {
-			// We've consumed all ack'd packets.
-			return
-		}
+// reduceCwndForECN reduces the congestion window in response to an ECE flag
+// received in an ack, as described in RFC 3168, section 6.1.2. Nothing is
+// retransmitted, as no segment was lost.
+func (s *sender) reduceCwndForECN(ack seqnum.Value) {
+	// The congestion window was already reduced for this round trip,
+	// either by a previous ECE flag or by fast recovery.
+	if s.fr.active || !s.ecnRecover.LessThan(ack) {
+		return
 	}
 
-	// Consume the packets in congestion avoidance mode.
-	s.sndCAAckCount += packetsAcked
-	if s.sndCAAckCount >= s.sndCwnd {
-		s.sndCwnd += s.sndCAAckCount / s.sndCwnd
-		s.sndCAAckCount = s.sndCAAckCount % s.sndCwnd
-	}
+	s.cc.onLoss()
+	s.sndCwnd = s.sndSsthresh
+	s.ecnRecover = s.sndNxt
+	s.ecnCwr = true
 }
 
 // handleRcvdSegment is called when a segment is received; it is responsible for
 // updating the send-related state.
 func (s *sender) handleRcvdSegment(seg *segment) {
-	// Check if we can extract an RTT measurement from this ack.
-	if s.rttMeasureSeqNum.LessThan(seg.ackNumber) {
+	s.lastAckTime = time.Now()
+
+	// Check if we can extract an RTT measurement from this ack. With the
+	// timestamps option, every ack of new data provides one, from the
+	// timestamp it echoes (RFC 7323, section 4.1).
+	if s.timestamps {
+		if seg.hasTimestamp && seg.tsEcr != 0 && (seg.ackNumber-1).InRange(s.sndUna, s.sndNxt) {
+			s.updateRTO(time.Duration(tsClock(s.tsClockOffset)-seg.tsEcr) * time.Millisecond)
+		}
+	} else if s.rttMeasureSeqNum.LessThan(seg.ackNumber) {
 		s.updateRTO(time.Now().Sub(s.rttMeasureTime))
 		s.rttMeasureSeqNum = s.sndNxt
 	}
 
+	if s.ecn && seg.flagIsSet(flagEce) {
+		s.reduceCwndForECN(seg.ackNumber)
+	}
+
+	if s.sackPermitted {
+		s.updateScoreboard(seg)
+	}
+
 	// Count the duplicates and do the fast retransmit if needed.
 	rtx := s.checkDuplicateAck(seg)
 
@@ -475,6 +873,9 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 		// Remove all acknowledged data from the write list.
 		acked := s.sndUna.Size(ack)
 		s.sndUna = ack
+		if s.highSacked.LessThan(ack) {
+			s.highSacked = ack
+		}
 
 		ackLeft := acked
 		originalOutsanding := s.outstanding
@@ -484,14 +885,15 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 
 			if datalen > ackLeft {
 				seg.data.TrimFront(int(ackLeft))
+				seg.sequenceNumber.UpdateForward(ackLeft)
 				break
 			}
 
 			if s.writeNext == seg {
 				s.writeNext = seg.Next()
 			}
+			s.removeFromScoreboard(seg)
 			s.writeList.Remove(seg)
-			s.outstanding--
 			seg.decRef()
 			ackLeft -= datalen
 		}
@@ -500,8 +902,11 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 		s.ep.updateSndBufferUsage(int(acked))
 
 		// Update the congestion window based on the number of
-		// acknowledged packets.
-		s.updateCwnd(originalOutsanding - s.outstanding)
+		// acknowledged packets. It isn't updated during SACK recovery,
+		// where the pipe alone limits what is sent.
+		if !s.fr.active || !s.sackPermitted {
+			s.cc.onAck(originalOutsanding - s.outstanding)
+		}
 
 		// It is possible for s.outstanding to drop below zero if we get
 		// a retransmit timeout, reset outstanding to zero but later
@@ -517,11 +922,26 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 		s.resendSegment()
 	}
 
+	// During SACK recovery, estimate the pipe once it starts, and
+	// retransmit the segments considered lost before sending new data,
+	// and the other holes of the scoreboard if no new data could be sent.
+	sackRecovery := s.fr.active && s.sackPermitted
+	if sackRecovery {
+		if s.lossNext == nil {
+			s.startSACKRecovery()
+		}
+		s.retransmitSACKRecovery(false)
+	}
+
 	// Send more data now that some of the pending data has been ack'd, or
 	// that the window opened up, or the congestion window was inflated due
 	// to a duplicate ack during fast recovery. This will also re-enable
 	// the retransmit timer if needed.
 	s.sendData()
+
+	if sackRecovery {
+		s.retransmitSACKRecovery(true)
+	}
 }
 
 // sendSegment sends a new segment containing the given payload, flags and
@@ -532,18 +952,72 @@ func (s *sender) sendSegment(data *buffer.VectorisedView, flags byte, seq seqnum
 		s.rttMeasureTime = s.lastSendTime
 	}
 
+	s.segmentsSent++
+	if data != nil && data.Size() > 0 {
+		s.bytesSent += uint64(data.Size())
+		if seq.LessThan(s.sndNxt) {
+			s.segmentsRetransmitted++
+			s.bytesRetransmitted += uint64(data.Size())
+		}
+	}
+
 	rcvNxt, rcvWnd := s.ep.rcv.getSendParams()
 
 	// Remember the max sent ack.
 	s.maxSentAck = rcvNxt
+	s.ep.rcv.ackSent()
+
+	// Echo congestion experienced by the peer's segments, per RFC 3168,
+	// section 6.1.3.
+	if s.ecn && s.ep.rcv.ecnEcho {
+		flags |= flagEce
+	}
+
+	// Stamp the segment, and report the out-of-order data held by the
+	// receiver. Data segments only carry the blocks that fit along with
+	// their payload.
+	var opts []byte
+	if s.timestamps {
+		opts = header.AppendTimestampOption(opts, tsClock(s.tsClockOffset), s.ep.rcv.tsRecent)
+	}
+	if blocks := s.ep.rcv.sackBlocks; s.sackPermitted && len(blocks) != 0 {
+		n := (header.TCPOptionsMaximumSize - len(opts) - 4) / 8
+		if data != nil {
+			if m := (s.maxPayloadSize - data.Size() - 4) / 8; m < n {
+				n = m
+			}
+		}
+		if n < 0 {
+			n = 0
+		}
+		if n < len(blocks) {
+			blocks = blocks[:n]
+		}
+		if len(blocks) != 0 {
+			opts = header.AppendSACKOption(opts, blocks)
+		}
+	}
 
 	if data == nil {
-		return s.ep.sendRaw(nil, flags, seq, rcvNxt, rcvWnd)
+		return sendTCPWithOptions(&s.ep.route, s.ep.id, nil, flags, seq, rcvNxt, rcvWnd, opts)
 	}
 
 	if len(data.Views()) > 1 {
 		panic("send path does not support views with multiple buffers")
 	}
 
-	return s.ep.sendRaw(data.First(), flags, seq, rcvNxt, rcvWnd)
+	// Only new data segments are marked ECN-capable; retransmissions
+	// aren't, per RFC 3168, section 6.1.5. The route is copied so that
+	// the mark doesn't apply to other segments.
+	if s.ecn && !seq.LessThan(s.sndNxt) {
+		if s.ecnCwr {
+			flags |= flagCwr
+			s.ecnCwr = false
+		}
+		r := s.ep.route
+		r.ECN = header.ECNECT0
+		return sendTCPWithOptions(&r, s.ep.id, data.First(), flags, seq, rcvNxt, rcvWnd, opts)
+	}
+
+	return sendTCPWithOptions(&s.ep.route, s.ep.id, data.First(), flags, seq, rcvNxt, rcvWnd, opts)
 }
@@ -37,6 +37,7 @@ type headers struct {
 	flags   int
 	rcvWnd  seqnum.Size
 	tcpOpts []byte
+	tos     uint8
 }
 
 type testContext struct {
@@ -62,6 +63,16 @@ const (
 func newTestContext(t *testing.T, mtu uint32) *testContext {
 	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
 
+	// Allow tests to use tiny receive buffers.
+	var rs tcpip.ReceiveBufferSizeRangeOption
+	if err := s.TransportProtocolOption(tcp.ProtocolNumber, &rs); err != nil {
+		t.Fatalf("TransportProtocolOption failed: %v", err)
+	}
+	rs.Min = 1
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, rs); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+
 	id, linkEP := channel.New(256, mtu, "")
 	if testing.Verbose() {
 		id = sniffer.New(id)
@@ -139,6 +150,7 @@ func (c *testContext) sendPacket(payload []byte, h *headers) {
 	ip := header.IPv4(buf)
 	ip.Encode(&header.IPv4Fields{
 		IHL:         header.IPv4MinimumSize,
+		TOS:         h.tos,
 		TotalLength: uint16(len(buf)),
 		TTL:         65,
 		Protocol:    uint8(tcp.ProtocolNumber),
@@ -334,6 +346,10 @@ func TestConnectResetAfterClose(t *testing.T) {
 	c := newTestContext(t, defaultMTU)
 	defer c.cleanup()
 
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.FinWait2TimeoutOption(time.Second)); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+
 	c.createConnected(789, 30000, nil)
 	ep := c.ep
 	c.ep = nil
@@ -354,12 +370,356 @@ func TestConnectResetAfterClose(t *testing.T) {
 		dstPort: c.port,
 		flags:   header.TCPFlagAck,
 		seqNum:  790,
-		ackNum:  c.irs.Add(1),
+		ackNum:  c.irs.Add(2),
 		rcvWnd:  30000,
 	})
 
 	// Wait for the ep to give up waiting for a FIN, and send a RST.
-	time.Sleep(3 * time.Second)
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+2),
+			checker.AckNum(790),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+		),
+	)
+}
+
+// closeToTimeWait closes the connected endpoint of c, acknowledges its FIN and
+// sends a FIN, which puts the connection in TIME_WAIT.
+func closeToTimeWait(c *testContext) {
+	ep := c.ep
+	c.ep = nil
+
+	ep.Close()
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+1),
+			checker.AckNum(790),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagFin),
+		),
+	)
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck | header.TCPFlagFin,
+		seqNum:  790,
+		ackNum:  c.irs.Add(2),
+		rcvWnd:  30000,
+	})
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+2),
+			checker.AckNum(791),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+}
+
+func TestCloseTimeoutOptions(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var msl tcpip.MaxSegmentLifetimeOption
+	if err := c.s.TransportProtocolOption(tcp.ProtocolNumber, &msl); err != nil || time.Duration(msl) != 30*time.Second {
+		t.Errorf("TransportProtocolOption(%T) = %v, %v, want 30s, nil", msl, time.Duration(msl), err)
+	}
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.MaxSegmentLifetimeOption(0)); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetTransportProtocolOption(%T(0)) = %v, want %v", msl, err, tcpip.ErrInvalidOptionValue)
+	}
+
+	var finWait2 tcpip.FinWait2TimeoutOption
+	if err := c.s.TransportProtocolOption(tcp.ProtocolNumber, &finWait2); err != nil || time.Duration(finWait2) != 60*time.Second {
+		t.Errorf("TransportProtocolOption(%T) = %v, %v, want 60s, nil", finWait2, time.Duration(finWait2), err)
+	}
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.FinWait2TimeoutOption(0)); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetTransportProtocolOption(%T(0)) = %v, want %v", finWait2, err, tcpip.ErrInvalidOptionValue)
+	}
+}
+
+func TestTimeWait(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.MaxSegmentLifetimeOption(500*time.Millisecond)); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+
+	c.createConnected(789, 30000, nil)
+	closeToTimeWait(c)
+
+	// A reset must not end TIME_WAIT, and a retransmitted FIN must be
+	// acknowledged again.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagRst,
+		seqNum:  791,
+		rcvWnd:  30000,
+	})
+	for i := 0; i < 2; i++ {
+		c.sendPacket(nil, &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck | header.TCPFlagFin,
+			seqNum:  790,
+			ackNum:  c.irs.Add(2),
+			rcvWnd:  30000,
+		})
+		checker.IPv4(c.t, c.getPacket(),
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.SeqNum(uint32(c.irs)+2),
+				checker.AckNum(791),
+				checker.TCPFlags(header.TCPFlagAck),
+			),
+		)
+	}
+
+	// Once TIME_WAIT is over, the connection doesn't exist anymore, so the
+	// FIN is answered with a reset.
+	time.Sleep(1500 * time.Millisecond)
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck | header.TCPFlagFin,
+		seqNum:  790,
+		ackNum:  c.irs.Add(2),
+		rcvWnd:  30000,
+	})
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+2),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+		),
+	)
+}
+
+func TestTimeWaitReuse(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		reuse int
+	}{
+		{"NoReuse", 0},
+		{"Reuse", 1},
+	} {
+		reuse := test.reuse
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createConnected(789, 30000, nil)
+			if err := c.ep.SetSockOpt(tcpip.ReuseAddressOption(reuse)); err != nil {
+				t.Fatalf("SetSockOpt failed: %v", err)
+			}
+			closeToTimeWait(c)
+
+			// A new connection request ends TIME_WAIT only when
+			// reuse is allowed, in which case the SYN is handed
+			// over right away and finds no listening endpoint.
+			syn := &headers{
+				srcPort: testPort,
+				dstPort: c.port,
+				flags:   header.TCPFlagSyn,
+				seqNum:  100000,
+				rcvWnd:  30000,
+			}
+			if reuse != 0 {
+				c.sendPacket(nil, syn)
+				checker.IPv4(c.t, c.getPacket(),
+					checker.TCP(
+						checker.DstPort(testPort),
+						checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+					),
+				)
+				return
+			}
+			for i := 0; i < 2; i++ {
+				c.sendPacket(nil, syn)
+				checker.IPv4(c.t, c.getPacket(),
+					checker.TCP(
+						checker.DstPort(testPort),
+						checker.SeqNum(uint32(c.irs)+2),
+						checker.AckNum(791),
+						checker.TCPFlags(header.TCPFlagAck),
+					),
+				)
+			}
+		})
+	}
+}
+
+func TestTimeWaitAcceptSyn(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	wq := &waiter.Queue{}
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	// Use a deterministic window scale.
+	if err := ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(65535 * 3)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	passiveConnect(c, 100, 2, defaultMTU)
+
+	c.ep, _, err = ep.Accept()
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+			c.ep, _, err = ep.Accept()
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+	}
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	closeToTimeWait(c)
+
+	// A SYN of a new connection, beyond the end of the one in TIME_WAIT,
+	// is accepted by the listening endpoint, per RFC 6191.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+		flags:   header.TCPFlagSyn,
+		seqNum:  100000,
+		rcvWnd:  30000,
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.SrcPort(stackPort),
+			checker.DstPort(testPort),
+			checker.AckNum(100001),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagSyn),
+		),
+	)
+
+}
+
+func TestResetOnCloseWithUnreadData(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventIn)
+	defer c.wq.EventUnregister(&we)
+
+	data := []byte{1, 2, 3}
+	c.sendPacket(data, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000,
+	})
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for data to arrive")
+	}
+
+	// Close without reading the data, which must reset the connection
+	// instead of sending a FIN.
+	c.ep.Close()
+	c.ep = nil
+	for {
+		b := c.getPacket()
+		tcp := header.TCP(header.IPv4(b).Payload())
+		if tcp.Flags() == header.TCPFlagAck && len(tcp.Payload()) == 0 {
+			// Skip the acknowledgement of the data.
+			continue
+		}
+		checker.IPv4(c.t, b,
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.SeqNum(uint32(c.irs)+1),
+				checker.AckNum(uint32(790+len(data))),
+				checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+			),
+		)
+		break
+	}
+}
+
+func TestLinger(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	if err := c.ep.SetSockOpt(tcpip.LingerOption{Timeout: -1}); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("SetSockOpt(LingerOption{Timeout: -1}) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+
+	want := tcpip.LingerOption{Enabled: true, Timeout: time.Second}
+	if err := c.ep.SetSockOpt(want); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var got tcpip.LingerOption
+	if err := c.ep.GetSockOpt(&got); err != nil {
+		t.Fatalf("GetSockOpt failed: %v", err)
+	}
+	if got != want {
+		t.Fatalf("Got LingerOption %+v, want %+v", got, want)
+	}
+
+	// The FIN isn't acknowledged, so the connection is reset once the
+	// linger timeout expires.
+	c.ep.Close()
+	c.ep = nil
+	for {
+		b := c.getPacket()
+		tcp := header.TCP(header.IPv4(b).Payload())
+		if tcp.Flags() == header.TCPFlagAck|header.TCPFlagFin {
+			continue
+		}
+		checker.IPv4(c.t, b,
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.SeqNum(uint32(c.irs)+1),
+				checker.AckNum(790),
+				checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+			),
+		)
+		break
+	}
+}
+
+func TestLingerZero(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	if err := c.ep.SetSockOpt(tcpip.LingerOption{Enabled: true}); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	// The connection is reset right away instead of being closed.
+	c.ep.Close()
+	c.ep = nil
 	checker.IPv4(c.t, c.getPacket(),
 		checker.TCP(
 			checker.DstPort(testPort),
@@ -1270,13 +1630,9 @@ func passiveConnectWithOptions(c *testContext, maxPayload, wndScale int, mtu uin
 	c.port = stackPort
 }
 
-func TestPassiveSendMSSLessThanMTU(t *testing.T) {
-	const maxPayload = 100
-	const mtu = 1200
-	c := newTestContext(t, mtu)
-	defer c.cleanup()
-
-	// Create EP and start listening.
+// createAccepted creates a listening endpoint, configured by setOpts, and
+// stores in c.ep the endpoint it accepts for a passive connection.
+func (c *testContext) createAccepted(setOpts func(ep tcpip.Endpoint)) {
 	wq := &waiter.Queue{}
 	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
 	if err != nil {
@@ -1284,37 +1640,84 @@ func TestPassiveSendMSSLessThanMTU(t *testing.T) {
 	}
 	defer ep.Close()
 
-	// Set the buffer size to a deterministic size so that we can check the
-	// window scaling option.
-	const rcvBufferSize = 0x20000
-	const wndScale = 2
-	if err := ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(rcvBufferSize)); err != nil {
-		c.t.Fatalf("SetSockOpt failed failed: %v", err)
+	// Use a deterministic window scale.
+	if err := ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(65535 * 3)); err != nil {
+		c.t.Fatalf("SetSockOpt failed: %v", err)
 	}
+	setOpts(ep)
 
 	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
 		c.t.Fatalf("Bind failed: %v", err)
 	}
-
 	if err := ep.Listen(10); err != nil {
 		c.t.Fatalf("Listen failed: %v", err)
 	}
 
-	// Do 3-way handshake.
-	passiveConnect(c, maxPayload, wndScale, mtu)
-
-	// Try to accept the connection.
 	we, ch := waiter.NewChannelEntry(nil)
 	wq.EventRegister(&we, waiter.EventIn)
 	defer wq.EventUnregister(&we)
 
+	passiveConnect(c, 100, 2, defaultMTU)
+
 	c.ep, _, err = ep.Accept()
 	if err == tcpip.ErrWouldBlock {
-		// Wait for connection to be established.
 		select {
 		case <-ch:
 			c.ep, _, err = ep.Accept()
-			if err != nil {
+		case <-time.After(1 * time.Second):
+			c.t.Fatalf("Timed out waiting for accept")
+		}
+	}
+	if err != nil {
+		c.t.Fatalf("Accept failed: %v", err)
+	}
+}
+
+func TestPassiveSendMSSLessThanMTU(t *testing.T) {
+	const maxPayload = 100
+	const mtu = 1200
+	c := newTestContext(t, mtu)
+	defer c.cleanup()
+
+	// Create EP and start listening.
+	wq := &waiter.Queue{}
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	// Set the buffer size to a deterministic size so that we can check the
+	// window scaling option.
+	const rcvBufferSize = 0x20000
+	const wndScale = 2
+	if err := ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(rcvBufferSize)); err != nil {
+		c.t.Fatalf("SetSockOpt failed failed: %v", err)
+	}
+
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	if err := ep.Listen(10); err != nil {
+		c.t.Fatalf("Listen failed: %v", err)
+	}
+
+	// Do 3-way handshake.
+	passiveConnect(c, maxPayload, wndScale, mtu)
+
+	// Try to accept the connection.
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	c.ep, _, err = ep.Accept()
+	if err == tcpip.ErrWouldBlock {
+		// Wait for connection to be established.
+		select {
+		case <-ch:
+			c.ep, _, err = ep.Accept()
+			if err != nil {
 				c.t.Fatalf("Accept failed: %v", err)
 			}
 
@@ -2218,3 +2621,2295 @@ func TestReceivedSegmentQueuing(t *testing.T) {
 		}
 	}
 }
+
+func TestIPOptions(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Options set on connected endpoints apply to their next segments.
+	c.createConnected(789, 30000, nil)
+	if err := c.ep.SetSockOpt(tcpip.TTLOption(9)); err != nil {
+		t.Fatalf("SetSockOpt(TTLOption) failed: %v", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.TOSOption(0x40)); err != nil {
+		t.Fatalf("SetSockOpt(TOSOption) failed: %v", err)
+	}
+	if _, err := c.ep.Write(buffer.NewView(10), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checker.IPv4(t, c.getPacket(),
+		checker.TTL(9),
+		checker.TOS(0x40, 0),
+		checker.PayloadLen(10+header.TCPMinimumSize),
+	)
+
+	var tos tcpip.TOSOption
+	if err := c.ep.GetSockOpt(&tos); err != nil || tos != 0x40 {
+		t.Errorf("GetSockOpt(TOSOption) = %v, %v, want 64, nil", tos, err)
+	}
+
+	// Options set before connecting apply to the SYN.
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.SetSockOpt(tcpip.TTLOption(20)); err != nil {
+		t.Fatalf("SetSockOpt(TTLOption) failed: %v", err)
+	}
+	if err := ep.SetSockOpt(tcpip.TOSOption(0x10)); err != nil {
+		t.Fatalf("SetSockOpt(TOSOption) failed: %v", err)
+	}
+	if err := ep.SetSockOpt(tcpip.TrafficClassOption(0x10)); err != tcpip.ErrInvalidEndpointState {
+		t.Errorf("SetSockOpt(TrafficClassOption) on IPv4 endpoint = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+	if err := ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	checker.IPv4(t, c.getPacket(),
+		checker.TTL(20),
+		checker.TOS(0x10, 0),
+		checker.TCP(checker.TCPFlags(header.TCPFlagSyn)),
+	)
+}
+
+func TestECN(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.ECNOption(1)); err != nil {
+		t.Fatalf("SetTransportProtocolOption(ECNOption) failed: %v", err)
+	}
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.TTLOption(1)); err != tcpip.ErrUnknownProtocolOption {
+		t.Errorf("SetTransportProtocolOption(TTLOption) = %v, want %v", err, tcpip.ErrUnknownProtocolOption)
+	}
+
+	// New endpoints request ECN in their SYN.
+	var err error
+	c.ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	var ecn tcpip.ECNOption
+	if err := c.ep.GetSockOpt(&ecn); err != nil || ecn != 1 {
+		t.Errorf("GetSockOpt(ECNOption) = %v, %v, want 1, nil", ecn, err)
+	}
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&waitEntry, waiter.EventOut)
+	defer c.wq.EventUnregister(&waitEntry)
+
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	b := c.getPacket()
+	checker.IPv4(t, b,
+		checker.TOS(header.ECNNotECT, 0),
+		checker.TCP(checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagEce|header.TCPFlagCwr)),
+	)
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	c.irs = seqnum.Value(tcpHdr.SequenceNumber())
+	c.port = tcpHdr.SourcePort()
+
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagSyn | header.TCPFlagAck | header.TCPFlagEce,
+		seqNum:  789,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000,
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TOS(header.ECNNotECT, 0),
+		checker.TCP(checker.TCPFlags(header.TCPFlagAck)),
+	)
+	select {
+	case <-notifyCh:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for connection")
+	}
+
+	// New data is marked ECN-capable.
+	if _, err := c.ep.Write(buffer.NewView(10), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checker.IPv4(t, c.getPacket(),
+		checker.TOS(header.ECNECT0, 0),
+		checker.PayloadLen(10+header.TCPMinimumSize),
+		checker.TCP(checker.TCPFlags(header.TCPFlagAck|header.TCPFlagPsh)),
+	)
+
+	// Congestion marks are echoed until the peer sets CWR.
+	seq := seqnum.Value(790)
+	for _, test := range []struct {
+		name  string
+		tos   uint8
+		flags int
+		want  uint8
+	}{
+		{"CE", header.ECNCE, 0, header.TCPFlagAck | header.TCPFlagEce},
+		{"ECT(0) after CE", header.ECNECT0, 0, header.TCPFlagAck | header.TCPFlagEce},
+		{"CWR", header.ECNECT0, header.TCPFlagCwr, header.TCPFlagAck},
+		{"ECT(0) after CWR", header.ECNECT0, 0, header.TCPFlagAck},
+	} {
+		c.sendPacket(buffer.NewView(5), &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck | test.flags,
+			seqNum:  seq,
+			ackNum:  c.irs.Add(11),
+			rcvWnd:  30000,
+			tos:     test.tos,
+		})
+		seq = seq.Add(5)
+		b := c.getPacket()
+		checker.IPv4(t, b,
+			checker.TOS(header.ECNNotECT, 0),
+			checker.TCP(checker.AckNum(uint32(seq)), checker.TCPFlags(test.want)),
+		)
+		if t.Failed() {
+			t.Fatalf("Bad ACK after %s segment", test.name)
+		}
+	}
+
+	// The congestion window is reduced in response to ECE, without
+	// retransmitting anything, and the next new data segment has CWR set.
+	if _, err := c.ep.Write(buffer.NewView(10), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checker.IPv4(t, c.getPacket(), checker.TCP(checker.TCPFlags(header.TCPFlagAck|header.TCPFlagPsh)))
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck | header.TCPFlagEce,
+		seqNum:  seq,
+		ackNum:  c.irs.Add(21),
+		rcvWnd:  30000,
+	})
+	c.checkNoPacketTimeout("Packet sent in response to ECE", 50*time.Millisecond)
+
+	for _, flags := range []uint8{header.TCPFlagCwr, 0} {
+		if _, err := c.ep.Write(buffer.NewView(10), nil); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		checker.IPv4(t, c.getPacket(),
+			checker.TOS(header.ECNECT0, 0),
+			checker.TCP(checker.TCPFlags(header.TCPFlagAck|header.TCPFlagPsh|flags)),
+		)
+		if flags != 0 {
+			c.sendPacket(nil, &headers{
+				srcPort: testPort,
+				dstPort: c.port,
+				flags:   header.TCPFlagAck,
+				seqNum:  seq,
+				ackNum:  c.irs.Add(31),
+				rcvWnd:  30000,
+			})
+		}
+	}
+
+	// Retransmissions aren't marked.
+	checker.IPv4(t, c.getPacket(),
+		checker.TOS(header.ECNNotECT, 0),
+		checker.PayloadLen(10+header.TCPMinimumSize),
+	)
+}
+
+func TestECNAccept(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.ECNOption(1)); err != nil {
+		t.Fatalf("SetTransportProtocolOption(ECNOption) failed: %v", err)
+	}
+	var ecn tcpip.ECNOption
+	if err := c.s.TransportProtocolOption(tcp.ProtocolNumber, &ecn); err != nil || ecn != 1 {
+		t.Errorf("TransportProtocolOption(ECNOption) = %v, %v, want 1, nil", ecn, err)
+	}
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := c.ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// ECN is only agreed on when requested with both ECE and CWR.
+	for i, test := range []struct {
+		flags int
+		want  uint8
+	}{
+		{header.TCPFlagEce | header.TCPFlagCwr, header.TCPFlagSyn | header.TCPFlagAck | header.TCPFlagEce},
+		{header.TCPFlagEce, header.TCPFlagSyn | header.TCPFlagAck},
+		{0, header.TCPFlagSyn | header.TCPFlagAck},
+	} {
+		c.sendPacket(nil, &headers{
+			srcPort: testPort + uint16(i),
+			dstPort: stackPort,
+			flags:   header.TCPFlagSyn | test.flags,
+			seqNum:  789,
+			rcvWnd:  30000,
+		})
+		checker.IPv4(t, c.getPacket(),
+			checker.TOS(header.ECNNotECT, 0),
+			checker.TCP(
+				checker.DstPort(testPort+uint16(i)),
+				checker.TCPFlags(test.want),
+			),
+		)
+	}
+}
+
+// sackPermittedOption is the SACK-permitted option, padded to 4 bytes.
+var sackPermittedOption = []byte{header.TCPOptionNOP, header.TCPOptionNOP, header.TCPOptionSACKPermitted, 2}
+
+func TestSACKConnect(t *testing.T) {
+	for _, sack := range []tcpip.SACKOption{0, 1} {
+		c := newTestContext(t, defaultMTU)
+
+		if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, sack); err != nil {
+			t.Fatalf("SetTransportProtocolOption(%T) failed: %v", sack, err)
+		}
+		var got tcpip.SACKOption
+		if err := c.s.TransportProtocolOption(tcp.ProtocolNumber, &got); err != nil || got != sack {
+			t.Errorf("TransportProtocolOption(%T) = %v, %v, want %v, nil", got, got, err, sack)
+		}
+
+		// The SYN offers selective acknowledgements only if they are
+		// enabled on the stack.
+		var err error
+		c.ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+			t.Fatalf("Unexpected return value from Connect: %v", err)
+		}
+		checker.IPv4(t, c.getPacket(),
+			checker.TCP(
+				checker.TCPFlags(header.TCPFlagSyn),
+				checker.TCPSACKPermitted(sack != 0),
+			),
+		)
+
+		c.cleanup()
+	}
+}
+
+func TestSACKAccept(t *testing.T) {
+	for _, test := range []struct {
+		sack  tcpip.SACKOption
+		offer bool
+		want  bool
+	}{
+		{1, true, true},
+		{1, false, false},
+		{0, true, false},
+	} {
+		c := newTestContext(t, defaultMTU)
+
+		if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, test.sack); err != nil {
+			t.Fatalf("SetTransportProtocolOption(%T) failed: %v", test.sack, err)
+		}
+
+		var err error
+		c.ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+			t.Fatalf("Bind failed: %v", err)
+		}
+		if err := c.ep.Listen(10); err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+
+		// Selective acknowledgements are only agreed on if enabled on
+		// the stack and offered by the SYN.
+		var opts []byte
+		if test.offer {
+			opts = sackPermittedOption
+		}
+		c.sendPacket(nil, &headers{
+			srcPort: testPort,
+			dstPort: stackPort,
+			flags:   header.TCPFlagSyn,
+			seqNum:  789,
+			rcvWnd:  30000,
+			tcpOpts: opts,
+		})
+		checker.IPv4(t, c.getPacket(),
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+				checker.TCPSACKPermitted(test.want),
+			),
+		)
+
+		c.cleanup()
+	}
+}
+
+func TestSACKReceive(t *testing.T) {
+	for _, offer := range []bool{true, false} {
+		c := newTestContext(t, defaultMTU)
+
+		if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.SACKOption(1)); err != nil {
+			t.Fatalf("SetTransportProtocolOption(SACKOption) failed: %v", err)
+		}
+
+		var opts []byte
+		if offer {
+			opts = sackPermittedOption
+		}
+		c.createConnectedWithOptions(789, 30000, nil, opts)
+
+		// Send segments out of order. Each one is acknowledged with
+		// the out-of-order data held by the endpoint, the block of the
+		// latest segment first, if the peer agreed to it.
+		block := func(start, end seqnum.Value) header.SACKBlock {
+			return header.SACKBlock{Start: start, End: end}
+		}
+		for _, test := range []struct {
+			seq    seqnum.Value
+			ack    seqnum.Value
+			blocks []header.SACKBlock
+		}{
+			{800, 790, []header.SACKBlock{block(800, 810)}},
+			{830, 790, []header.SACKBlock{block(830, 840), block(800, 810)}},
+			{810, 790, []header.SACKBlock{block(800, 820), block(830, 840)}},
+			{790, 820, []header.SACKBlock{block(830, 840)}},
+			{820, 840, nil},
+		} {
+			c.sendPacket(make([]byte, 10), &headers{
+				srcPort: testPort,
+				dstPort: c.port,
+				flags:   header.TCPFlagAck,
+				seqNum:  test.seq,
+				ackNum:  c.irs.Add(1),
+				rcvWnd:  30000,
+			})
+
+			want := test.blocks
+			if !offer {
+				want = nil
+			}
+			checker.IPv4(t, c.getPacket(),
+				checker.TCP(
+					checker.TCPFlags(header.TCPFlagAck),
+					checker.AckNum(uint32(test.ack)),
+					checker.TCPSACKBlocks(want...),
+				),
+			)
+		}
+
+		c.cleanup()
+	}
+}
+
+// sendSACK sends an ack for the first bytesReceived bytes sent by the endpoint,
+// along with a SACK option reporting the given ranges of bytes, relative to the
+// first one, as received.
+func (c *testContext) sendSACK(bytesReceived int, ranges ...[2]int) {
+	var blocks []header.SACKBlock
+	for _, r := range ranges {
+		blocks = append(blocks, header.SACKBlock{
+			Start: c.irs.Add(1 + seqnum.Size(r[0])),
+			End:   c.irs.Add(1 + seqnum.Size(r[1])),
+		})
+	}
+
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  c.irs.Add(1 + seqnum.Size(bytesReceived)),
+		rcvWnd:  30000,
+		tcpOpts: header.AppendSACKOption(nil, blocks),
+	})
+}
+
+func TestSACKRecovery(t *testing.T) {
+	maxPayload := 10
+	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
+	defer c.cleanup()
+
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.SACKOption(1)); err != nil {
+		t.Fatalf("SetTransportProtocolOption(SACKOption) failed: %v", err)
+	}
+	c.createConnectedWithOptions(789, 30000, nil, sackPermittedOption)
+
+	data := buffer.NewView(64 * maxPayload)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := c.ep.Write(data, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	// Do slow start until 8 packets are in flight.
+	const iterations = 4
+	expected := 1
+	bytesRead := 0
+	for i := 0; i < iterations; i++ {
+		expected = 1 << uint(i)
+		if i > 0 {
+			c.sendAck(790, bytesRead)
+		}
+		for j := 0; j < expected; j++ {
+			c.receiveAndCheckPacket(data, bytesRead, maxPayload)
+			bytesRead += maxPayload
+		}
+		c.checkNoPacketTimeout("More packets received than expected for this cwnd.", 50*time.Millisecond)
+	}
+
+	// Report the first and third packets of the flight as lost. The first
+	// duplicate ack isn't enough to start recovery.
+	first := bytesRead - expected*maxPayload
+	seg := func(i int) int {
+		return first + i*maxPayload
+	}
+	c.sendSACK(first, [2]int{seg(1), seg(2)})
+	c.checkNoPacketTimeout("Packet sent after a single duplicate ack.", 50*time.Millisecond)
+
+	// With 6 packets SACKed above them, both lost packets are retransmitted
+	// at once. The congestion window is halved to 4 packets, leaving room
+	// for 2 new ones.
+	c.sendSACK(first, [2]int{seg(3), seg(8)}, [2]int{seg(1), seg(2)})
+	c.receiveAndCheckPacket(data, seg(0), maxPayload)
+	c.receiveAndCheckPacket(data, seg(2), maxPayload)
+	for j := 0; j < 2; j++ {
+		c.receiveAndCheckPacket(data, bytesRead, maxPayload)
+		bytesRead += maxPayload
+	}
+	c.checkNoPacketTimeout("More packets received than expected for the pipe.", 50*time.Millisecond)
+
+	// Acknowledge everything, and check that the remaining data is sent
+	// without retransmitting the SACKed packets.
+	c.sendAck(790, bytesRead)
+	for offset := bytesRead; offset < len(data); offset += maxPayload {
+		c.receiveAndCheckPacket(data, offset, maxPayload)
+		c.sendAck(790, offset+maxPayload)
+	}
+	c.checkNoPacketTimeout("More packets received than expected.", 50*time.Millisecond)
+}
+
+func TestSACKRecoveryScatteredLoss(t *testing.T) {
+	maxPayload := 10
+	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
+	defer c.cleanup()
+
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.SACKOption(1)); err != nil {
+		t.Fatalf("SetTransportProtocolOption(SACKOption) failed: %v", err)
+	}
+	c.createConnectedWithOptions(789, 30000, nil, sackPermittedOption)
+
+	data := buffer.NewView(64 * maxPayload)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := c.ep.Write(data, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	// Do slow start until 8 packets are in flight.
+	const iterations = 4
+	expected := 1
+	bytesRead := 0
+	for i := 0; i < iterations; i++ {
+		expected = 1 << uint(i)
+		if i > 0 {
+			c.sendAck(790, bytesRead)
+		}
+		for j := 0; j < expected; j++ {
+			c.receiveAndCheckPacket(data, bytesRead, maxPayload)
+			bytesRead += maxPayload
+		}
+		c.checkNoPacketTimeout("More packets received than expected for this cwnd.", 50*time.Millisecond)
+	}
+
+	// Report the first, third and fifth packets of the flight as lost.
+	// Each of them has at least 3 packets SACKed above it, so they are
+	// all retransmitted at once, leaving room for a new packet in the
+	// halved congestion window of 4 packets.
+	first := bytesRead - expected*maxPayload
+	seg := func(i int) int {
+		return first + i*maxPayload
+	}
+	c.sendSACK(first, [2]int{seg(6), seg(8)}, [2]int{seg(5), seg(6)}, [2]int{seg(3), seg(4)}, [2]int{seg(1), seg(2)})
+	c.receiveAndCheckPacket(data, seg(0), maxPayload)
+	c.receiveAndCheckPacket(data, seg(2), maxPayload)
+	c.receiveAndCheckPacket(data, seg(4), maxPayload)
+	c.receiveAndCheckPacket(data, bytesRead, maxPayload)
+	bytesRead += maxPayload
+	c.checkNoPacketTimeout("More packets received than expected for the pipe.", 50*time.Millisecond)
+
+	// A partial ack of the first retransmitted packet and of the SACKed
+	// one after it removes a single packet from the pipe.
+	c.sendSACK(seg(2), [2]int{seg(6), seg(8)}, [2]int{seg(5), seg(6)}, [2]int{seg(3), seg(4)})
+	c.receiveAndCheckPacket(data, bytesRead, maxPayload)
+	bytesRead += maxPayload
+	c.checkNoPacketTimeout("More packets received than expected for the pipe.", 50*time.Millisecond)
+
+	// Acknowledge everything, and check that the remaining data is sent
+	// without retransmitting the SACKed packets.
+	c.sendAck(790, bytesRead)
+	for offset := bytesRead; offset < len(data); offset += maxPayload {
+		c.receiveAndCheckPacket(data, offset, maxPayload)
+		c.sendAck(790, offset+maxPayload)
+	}
+	c.checkNoPacketTimeout("More packets received than expected.", 50*time.Millisecond)
+}
+
+// parseTimestamp returns the fields of the timestamps option of the tcp segment
+// carried by the ipv4 packet b, and whether there is one.
+func parseTimestamp(b []byte) (tsVal, tsEcr uint32, ok bool) {
+	return header.ParseTimestampOption(header.TCP(header.IPv4(b).Payload()).Options())
+}
+
+func TestTimestampsOption(t *testing.T) {
+	for _, ts := range []tcpip.TimestampOption{1, 0} {
+		c := newTestContext(t, defaultMTU)
+
+		// Timestamps are enabled by default.
+		var got tcpip.TimestampOption
+		if err := c.s.TransportProtocolOption(tcp.ProtocolNumber, &got); err != nil || got != 1 {
+			t.Errorf("TransportProtocolOption(%T) = %v, %v, want 1, nil", got, got, err)
+		}
+		if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, ts); err != nil {
+			t.Fatalf("SetTransportProtocolOption(%T) failed: %v", ts, err)
+		}
+
+		var err error
+		c.ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+			t.Fatalf("Unexpected return value from Connect: %v", err)
+		}
+		b := c.getPacket()
+		checker.IPv4(t, b, checker.TCP(checker.TCPFlags(header.TCPFlagSyn)))
+		if _, tsEcr, ok := parseTimestamp(b); ok != (ts != 0) || tsEcr != 0 {
+			t.Errorf("Bad SYN timestamps option: got TSecr %v, presence %v, want 0, %v", tsEcr, ok, ts != 0)
+		}
+
+		c.cleanup()
+	}
+}
+
+func TestTimestampsConnect(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&waitEntry, waiter.EventOut)
+	defer c.wq.EventUnregister(&waitEntry)
+
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	b := c.getPacket()
+	synVal, _, ok := parseTimestamp(b)
+	if !ok {
+		t.Fatalf("SYN has no timestamps option")
+	}
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	c.irs = seqnum.Value(tcpHdr.SequenceNumber())
+	c.port = tcpHdr.SourcePort()
+
+	// The handshake is completed with an ACK echoing the timestamp of the
+	// SYN-ACK.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		seqNum:  789,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000,
+		tcpOpts: header.AppendTimestampOption(nil, 100, synVal),
+	})
+	b = c.getPacket()
+	checker.IPv4(t, b, checker.TCP(checker.TCPFlags(header.TCPFlagAck)))
+	if tsVal, tsEcr, ok := parseTimestamp(b); !ok || tsEcr != 100 || int32(tsVal-synVal) < 0 {
+		t.Fatalf("Bad ACK timestamps option: got %v, %v, %v, want >= %v, 100, true", tsVal, tsEcr, ok, synVal)
+	}
+	select {
+	case <-notifyCh:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for connection")
+	}
+
+	// Data is acknowledged with its timestamp, unless it is older than the
+	// last one received, in which case the segment is dropped by PAWS.
+	for _, test := range []struct {
+		seq  seqnum.Value
+		ts   uint32
+		ack  uint32
+		echo uint32
+	}{
+		{790, 200, 800, 200},
+		{800, 150, 800, 200},
+		{800, 200, 810, 200},
+		{810, 300, 820, 300},
+	} {
+		c.sendPacket(make([]byte, 10), &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck,
+			seqNum:  test.seq,
+			ackNum:  c.irs.Add(1),
+			rcvWnd:  30000,
+			tcpOpts: header.AppendTimestampOption(nil, test.ts, synVal),
+		})
+		b := c.getPacket()
+		checker.IPv4(t, b, checker.TCP(checker.AckNum(test.ack)))
+		if _, tsEcr, ok := parseTimestamp(b); !ok || tsEcr != test.echo {
+			t.Fatalf("Bad timestamps option for segment %v with TSval %v: got TSecr %v, presence %v, want %v, true", test.seq, test.ts, tsEcr, ok, test.echo)
+		}
+	}
+
+	v, err := c.ep.Read(nil)
+	if err != nil || len(v) != 10 {
+		t.Fatalf("Read() = %v, %v, want 10 bytes", v, err)
+	}
+}
+
+func TestTimestampsPayloadSize(t *testing.T) {
+	const maxPayload = 100
+	c := newTestContext(t, header.IPv4MinimumSize+header.TCPMinimumSize+maxPayload)
+	defer c.cleanup()
+
+	c.createConnectedWithOptions(789, 30000, nil, header.AppendTimestampOption(nil, 100, 0))
+
+	// Data segments leave room for the timestamps option.
+	data := buffer.NewView(200)
+	if _, err := c.ep.Write(data, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	const size = maxPayload - header.TCPTimestampOptionSize
+	bytesReceived := 0
+	for _, n := range []int{size, size, len(data) - 2*size} {
+		b := c.getPacket()
+		checker.IPv4(t, b,
+			checker.PayloadLen(header.TCPMinimumSize+header.TCPTimestampOptionSize+n),
+			checker.TCP(checker.SeqNum(uint32(c.irs)+1+uint32(bytesReceived))),
+		)
+		tsVal, tsEcr, ok := parseTimestamp(b)
+		if !ok || tsEcr != 100 {
+			t.Fatalf("Bad timestamps option: got TSecr %v, presence %v, want 100, true", tsEcr, ok)
+		}
+		bytesReceived += n
+
+		c.sendPacket(nil, &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck,
+			seqNum:  790,
+			ackNum:  c.irs.Add(1 + seqnum.Size(bytesReceived)),
+			rcvWnd:  30000,
+			tcpOpts: header.AppendTimestampOption(nil, 100, tsVal),
+		})
+	}
+}
+
+func TestTimestampsAccept(t *testing.T) {
+	for _, test := range []struct {
+		ts    tcpip.TimestampOption
+		offer bool
+		want  bool
+	}{
+		{1, true, true},
+		{1, false, false},
+		{0, true, false},
+	} {
+		c := newTestContext(t, defaultMTU)
+
+		if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, test.ts); err != nil {
+			t.Fatalf("SetTransportProtocolOption(%T) failed: %v", test.ts, err)
+		}
+
+		var err error
+		c.ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+			t.Fatalf("Bind failed: %v", err)
+		}
+		if err := c.ep.Listen(10); err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+
+		var opts []byte
+		if test.offer {
+			opts = header.AppendTimestampOption(nil, 100, 0)
+		}
+		c.sendPacket(nil, &headers{
+			srcPort: testPort,
+			dstPort: stackPort,
+			flags:   header.TCPFlagSyn,
+			seqNum:  789,
+			rcvWnd:  30000,
+			tcpOpts: opts,
+		})
+		b := c.getPacket()
+		checker.IPv4(t, b, checker.TCP(checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck)))
+		if _, tsEcr, ok := parseTimestamp(b); ok != test.want || (ok && tsEcr != 100) {
+			t.Errorf("Bad SYN-ACK timestamps option for %+v: got TSecr %v, presence %v", test, tsEcr, ok)
+		}
+
+		c.cleanup()
+	}
+}
+
+func TestSynCookieTimestamps(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Set the SynRcvd threshold to zero to force a syn cookie based accept
+	// to happen.
+	saved := tcp.SynRcvdCountThreshold
+	defer func() {
+		tcp.SynRcvdCountThreshold = saved
+	}()
+	tcp.SynRcvdCountThreshold = 0
+
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.SACKOption(1)); err != nil {
+		t.Fatalf("SetTransportProtocolOption(SACKOption) failed: %v", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	// Set the buffer size to a deterministic size so that we can check the
+	// window scaling.
+	const rcvBufferSize = 0x20000
+	const wndScale = 2
+	if err := ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(rcvBufferSize)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// The SYN-ACK sent with a cookie agrees on window scaling and SACK,
+	// which are encoded in its timestamp.
+	const sndWndScale = 3
+	opts := []byte{
+		header.TCPOptionMSS, 4, 0x5, 0xb4,
+		header.TCPOptionWS, 3, sndWndScale, header.TCPOptionNOP,
+	}
+	opts = append(opts, sackPermittedOption...)
+	opts = header.AppendTimestampOption(opts, 100, 0)
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+		flags:   header.TCPFlagSyn,
+		seqNum:  789,
+		rcvWnd:  30000,
+		tcpOpts: opts,
+	})
+	b := c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+			checker.TCPSynOptions(defaultMTU-header.IPv4MinimumSize-header.TCPMinimumSize, wndScale),
+			checker.TCPSACKPermitted(true),
+		),
+	)
+	synAckVal, tsEcr, ok := parseTimestamp(b)
+	if !ok || tsEcr != 100 {
+		t.Fatalf("Bad SYN-ACK timestamps option: got TSecr %v, presence %v, want 100, true", tsEcr, ok)
+	}
+	c.irs = seqnum.Value(header.TCP(header.IPv4(b).Payload()).SequenceNumber())
+	c.port = stackPort
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000 >> sndWndScale,
+		tcpOpts: header.AppendTimestampOption(nil, 101, synAckVal),
+	})
+
+	c.ep, _, err = ep.Accept()
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+			c.ep, _, err = ep.Accept()
+			if err != nil {
+				t.Fatalf("Accept failed: %v", err)
+			}
+
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+	}
+
+	// Out-of-order data is reported with a SACK block, and the window is
+	// scaled.
+	c.sendPacket(make([]byte, 10), &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+		flags:   header.TCPFlagAck,
+		seqNum:  800,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000 >> sndWndScale,
+		tcpOpts: header.AppendTimestampOption(nil, 102, synAckVal),
+	})
+	b = c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagAck),
+			checker.AckNum(790),
+			checker.Window(rcvBufferSize>>wndScale),
+			checker.TCPSACKBlocks(header.SACKBlock{Start: 800, End: 810}),
+		),
+	)
+	if _, tsEcr, ok := parseTimestamp(b); !ok || tsEcr != 101 {
+		t.Fatalf("Bad timestamps option: got TSecr %v, presence %v, want 101, true", tsEcr, ok)
+	}
+}
+
+func TestCongestionControlOption(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Reno is used by default.
+	var cc tcpip.CongestionControlOption
+	if err := c.s.TransportProtocolOption(tcp.ProtocolNumber, &cc); err != nil || cc != tcp.Reno {
+		t.Errorf("TransportProtocolOption(%T) = %v, %v, want %v, nil", cc, cc, err, tcp.Reno)
+	}
+
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.CongestionControlOption("vegas")); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetTransportProtocolOption(vegas) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcp.Cubic); err != nil {
+		t.Fatalf("SetTransportProtocolOption(%v) failed: %v", tcp.Cubic, err)
+	}
+
+	// New endpoints start with the algorithm of the stack, and can
+	// change it.
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.GetSockOpt(&cc); err != nil || cc != tcp.Cubic {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want %v, nil", cc, cc, err, tcp.Cubic)
+	}
+	if err := ep.SetSockOpt(tcpip.CongestionControlOption("vegas")); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetSockOpt(vegas) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := ep.SetSockOpt(tcp.Reno); err != nil {
+		t.Fatalf("SetSockOpt(%v) failed: %v", tcp.Reno, err)
+	}
+	if err := ep.GetSockOpt(&cc); err != nil || cc != tcp.Reno {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want %v, nil", cc, cc, err, tcp.Reno)
+	}
+}
+
+func TestCubicFastRecovery(t *testing.T) {
+	maxPayload := 10
+	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
+	defer c.cleanup()
+
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcp.Cubic); err != nil {
+		t.Fatalf("SetTransportProtocolOption(%v) failed: %v", tcp.Cubic, err)
+	}
+
+	c.createConnected(789, 30000, nil)
+
+	const iterations = 7
+	data := buffer.NewView(2 * maxPayload * (1 << (iterations + 1)))
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// Write all the data in one shot. Packets will only be written at the
+	// MTU size though.
+	if _, err := c.ep.Write(data, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	// Do slow start for a few iterations, which is the same as with Reno.
+	expected := 1
+	bytesRead := 0
+	for i := 0; i < iterations; i++ {
+		expected = 1 << uint(i)
+		if i > 0 {
+			// Acknowledge all the data received so far if not on
+			// first iteration.
+			c.sendAck(790, bytesRead)
+		}
+
+		for j := 0; j < expected; j++ {
+			c.receiveAndCheckPacket(data, bytesRead, maxPayload)
+			bytesRead += maxPayload
+		}
+
+		c.checkNoPacketTimeout("More packets received than expected for this cwnd.", 50*time.Millisecond)
+	}
+
+	// Send 3 duplicate acks to force an immediate retransmit of the
+	// pending packet.
+	rtxOffset := bytesRead - maxPayload*expected
+	for i := 0; i < 3; i++ {
+		c.sendAck(790, rtxOffset)
+	}
+	c.receiveAndCheckPacket(data, rtxOffset, maxPayload)
+
+	// Acknowledge all pending data. The congestion window was reduced to
+	// 70% of its value when the loss was detected, where Reno would have
+	// halved it, and starts growing again from there.
+	c.sendAck(790, bytesRead)
+
+	cwnd := expected * 7 / 10
+	for j := 0; j < cwnd; j++ {
+		c.receiveAndCheckPacket(data, bytesRead, maxPayload)
+		bytesRead += maxPayload
+	}
+
+	extra := 0
+	for {
+		select {
+		case <-c.linkEP.C:
+			extra++
+			continue
+		case <-time.After(50 * time.Millisecond):
+		}
+		break
+	}
+	if extra > 2 {
+		t.Fatalf("Got a train of %v packets after recovery, want at most %v", cwnd+extra, cwnd+2)
+	}
+}
+
+func TestNagle(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	// Data is sent immediately by default.
+	var v tcpip.NoDelayOption
+	if err := c.ep.GetSockOpt(&v); err != nil || v != 1 {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want 1, nil", v, v, err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.NoDelayOption(0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	data := []byte{1, 2, 3, 4, 5, 6}
+	write := func(b []byte) {
+		if _, err := c.ep.Write(buffer.View(b), nil); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// A partial segment is sent right away when no data is
+	// unacknowledged, and the following ones are held back until it is
+	// acknowledged.
+	write(data[:1])
+	c.receiveAndCheckPacket(data, 0, 1)
+	write(data[1:2])
+	write(data[2:3])
+	write(data[3:4])
+	c.checkNoPacketTimeout("Partial segment sent with unacknowledged data", 50*time.Millisecond)
+
+	// The data of the writes held back is sent in a single segment.
+	c.sendAck(790, 1)
+	c.receiveAndCheckPacket(data, 1, 3)
+
+	// Disabling Nagle's algorithm sends the data held back.
+	write(data[4:])
+	c.checkNoPacketTimeout("Partial segment sent with unacknowledged data", 50*time.Millisecond)
+	if err := c.ep.SetSockOpt(tcpip.NoDelayOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	c.receiveAndCheckPacket(data, 4, 2)
+}
+
+func TestNagleFullSegments(t *testing.T) {
+	maxPayload := 10
+	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	if err := c.ep.SetSockOpt(tcpip.NoDelayOption(0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	// Grow the congestion window so that more than one segment can be
+	// outstanding.
+	data := make([]byte, 25)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := c.ep.Write(buffer.View(data[:1]), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.receiveAndCheckPacket(data, 0, 1)
+	c.sendAck(790, 1)
+
+	// Small writes are coalesced into full-sized segments, which are sent
+	// even with unacknowledged data, and the remainder is held back.
+	for i := 1; i < len(data); i += 3 {
+		end := i + 3
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := c.ep.Write(buffer.View(data[i:end]), nil); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	c.receiveAndCheckPacket(data, 1, maxPayload)
+	c.receiveAndCheckPacket(data, 1+maxPayload, maxPayload)
+	c.checkNoPacketTimeout("Partial segment sent with unacknowledged data", 50*time.Millisecond)
+
+	c.sendAck(790, 1+2*maxPayload)
+	c.receiveAndCheckPacket(data, 1+2*maxPayload, len(data)-1-2*maxPayload)
+}
+
+func TestCork(t *testing.T) {
+	maxPayload := 10
+	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	if err := c.ep.SetSockOpt(tcpip.CorkOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var v tcpip.CorkOption
+	if err := c.ep.GetSockOpt(&v); err != nil || v != 1 {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want 1, nil", v, v, err)
+	}
+
+	data := make([]byte, 25)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	write := func(b []byte) {
+		if _, err := c.ep.Write(buffer.View(b), nil); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// Partial segments are held back even when no data is unacknowledged,
+	// until the writes fill a segment.
+	write(data[:4])
+	write(data[4:8])
+	c.checkNoPacketTimeout("Partial segment sent while corked", 50*time.Millisecond)
+	write(data[8:12])
+	c.receiveAndCheckPacket(data, 0, maxPayload)
+	c.sendAck(790, maxPayload)
+
+	// The remainder is sent once the cork timer expires.
+	start := time.Now()
+	c.receiveAndCheckPacket(data, maxPayload, 2)
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("Partial segment sent after %v while corked, want about 200ms", d)
+	}
+	c.sendAck(790, maxPayload+2)
+
+	// Removing the cork sends the data held back.
+	write(data[12:15])
+	c.checkNoPacketTimeout("Partial segment sent while corked", 50*time.Millisecond)
+	if err := c.ep.SetSockOpt(tcpip.CorkOption(0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	c.receiveAndCheckPacket(data, 12, 3)
+}
+
+func TestSendOptionsInherited(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createAccepted(func(ep tcpip.Endpoint) {
+		if err := ep.SetSockOpt(tcpip.NoDelayOption(0)); err != nil {
+			t.Fatalf("SetSockOpt(NoDelayOption) failed: %v", err)
+		}
+		if err := ep.SetSockOpt(tcpip.CorkOption(1)); err != nil {
+			t.Fatalf("SetSockOpt(CorkOption) failed: %v", err)
+		}
+		if err := ep.SetSockOpt(tcpip.QuickAckOption(1)); err != nil {
+			t.Fatalf("SetSockOpt(QuickAckOption) failed: %v", err)
+		}
+	})
+
+	var noDelay tcpip.NoDelayOption
+	if err := c.ep.GetSockOpt(&noDelay); err != nil || noDelay != 0 {
+		t.Errorf("GetSockOpt(NoDelayOption) on accepted endpoint = %v, %v, want 0, nil", noDelay, err)
+	}
+	var cork tcpip.CorkOption
+	if err := c.ep.GetSockOpt(&cork); err != nil || cork != 1 {
+		t.Errorf("GetSockOpt(CorkOption) on accepted endpoint = %v, %v, want 1, nil", cork, err)
+	}
+	var quickAck tcpip.QuickAckOption
+	if err := c.ep.GetSockOpt(&quickAck); err != nil || quickAck != 1 {
+		t.Errorf("GetSockOpt(QuickAckOption) on accepted endpoint = %v, %v, want 1, nil", quickAck, err)
+	}
+
+	// Partial segments are held back, as the accepted endpoint is corked.
+	if _, err := c.ep.Write(buffer.View([]byte{1, 2, 3}), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.checkNoPacketTimeout("Partial segment sent while corked", 50*time.Millisecond)
+}
+
+func TestDelayedAckTimeoutOption(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var v tcpip.DelayedAckTimeoutOption
+	if err := c.s.TransportProtocolOption(tcp.ProtocolNumber, &v); err != nil || time.Duration(v) != 40*time.Millisecond {
+		t.Errorf("TransportProtocolOption(%T) = %v, %v, want 40ms, nil", v, time.Duration(v), err)
+	}
+
+	for _, d := range []time.Duration{0, 600 * time.Millisecond} {
+		if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.DelayedAckTimeoutOption(d)); err != tcpip.ErrInvalidOptionValue {
+			t.Errorf("SetTransportProtocolOption(%v) = %v, want %v", d, err, tcpip.ErrInvalidOptionValue)
+		}
+	}
+}
+
+func TestDelayedAck(t *testing.T) {
+	const delay = 300 * time.Millisecond
+
+	for _, test := range []struct {
+		name     string
+		quickAck bool
+		segs     []int
+		flags    int
+		delayed  bool
+	}{
+		{"one full segment", false, []int{100}, header.TCPFlagAck, true},
+		{"two full segments", false, []int{100, 100}, header.TCPFlagAck, false},
+		{"partial segment", false, []int{100, 50}, header.TCPFlagAck, true},
+		{"partial segment with PSH", false, []int{100, 50}, header.TCPFlagAck | header.TCPFlagPsh, false},
+		{"quick ack", true, []int{100}, header.TCPFlagAck, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.DelayedAckTimeoutOption(delay)); err != nil {
+				t.Fatalf("SetTransportProtocolOption failed: %v", err)
+			}
+
+			c.createConnected(789, 30000, nil)
+
+			if test.quickAck {
+				if err := c.ep.SetSockOpt(tcpip.QuickAckOption(1)); err != nil {
+					t.Fatalf("SetSockOpt failed: %v", err)
+				}
+				var v tcpip.QuickAckOption
+				if err := c.ep.GetSockOpt(&v); err != nil || v != 1 {
+					t.Errorf("GetSockOpt(%T) = %v, %v, want 1, nil", v, v, err)
+				}
+			}
+
+			// Only the last segment carries the flags of the test.
+			seq := seqnum.Value(790)
+			for i, n := range test.segs {
+				flags := header.TCPFlagAck
+				if i == len(test.segs)-1 {
+					flags = test.flags
+				}
+				c.sendPacket(make([]byte, n), &headers{
+					srcPort: testPort,
+					dstPort: c.port,
+					flags:   flags,
+					seqNum:  seq,
+					ackNum:  c.irs.Add(1),
+					rcvWnd:  30000,
+				})
+				seq = seq.Add(seqnum.Size(n))
+			}
+
+			start := time.Now()
+			checker.IPv4(t, c.getPacket(),
+				checker.TCP(
+					checker.TCPFlags(header.TCPFlagAck),
+					checker.AckNum(uint32(seq)),
+				),
+			)
+			if d := time.Since(start); (d > delay/2) != test.delayed {
+				t.Errorf("Got ACK after %v, want delayed: %v", d, test.delayed)
+			}
+		})
+	}
+}
+
+func TestDelayedAckFin(t *testing.T) {
+	const delay = 300 * time.Millisecond
+
+	for _, test := range []struct {
+		name string
+		size int
+	}{
+		{"without data", 0},
+		{"with partial segment", 50},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.DelayedAckTimeoutOption(delay)); err != nil {
+				t.Fatalf("SetTransportProtocolOption failed: %v", err)
+			}
+
+			c.createConnected(789, 30000, nil)
+
+			// A full segment first, so that the FIN segment is
+			// partial.
+			c.sendPacket(make([]byte, 100), &headers{
+				srcPort: testPort,
+				dstPort: c.port,
+				flags:   header.TCPFlagAck,
+				seqNum:  790,
+				ackNum:  c.irs.Add(1),
+				rcvWnd:  30000,
+			})
+			c.sendPacket(make([]byte, test.size), &headers{
+				srcPort: testPort,
+				dstPort: c.port,
+				flags:   header.TCPFlagAck | header.TCPFlagFin,
+				seqNum:  seqnum.Value(890),
+				ackNum:  c.irs.Add(1),
+				rcvWnd:  30000,
+			})
+
+			// The FIN is acknowledged immediately, along with the
+			// data before it.
+			start := time.Now()
+			checker.IPv4(t, c.getPacket(),
+				checker.TCP(
+					checker.TCPFlags(header.TCPFlagAck),
+					checker.AckNum(uint32(890+test.size+1)),
+				),
+			)
+			if d := time.Since(start); d > delay/2 {
+				t.Errorf("Got ACK of FIN after %v, want no delay", d)
+			}
+		})
+	}
+}
+
+func TestDelayedAckOutOfOrder(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.DelayedAckTimeoutOption(300*time.Millisecond)); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+
+	c.createConnected(789, 30000, nil)
+
+	// Out-of-order data is acknowledged immediately, and so is the
+	// segment that fills the gap.
+	for _, test := range []struct {
+		seq seqnum.Value
+		ack uint32
+	}{
+		{890, 790},
+		{790, 990},
+	} {
+		c.sendPacket(make([]byte, 100), &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck,
+			seqNum:  test.seq,
+			ackNum:  c.irs.Add(1),
+			rcvWnd:  30000,
+		})
+
+		start := time.Now()
+		checker.IPv4(t, c.getPacket(), checker.TCP(checker.AckNum(test.ack)))
+		if d := time.Since(start); d > 150*time.Millisecond {
+			t.Errorf("Got ACK %v after %v, want it immediately", test.ack, d)
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	// Keepalive is disabled by default.
+	var enabled tcpip.KeepaliveEnabledOption
+	if err := c.ep.GetSockOpt(&enabled); err != nil || enabled != 0 {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want 0, nil", enabled, enabled, err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.KeepaliveCountOption(0)); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetSockOpt(KeepaliveCountOption(0)) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+
+	const count = 2
+	for _, opt := range []interface{}{
+		tcpip.KeepaliveIdleOption(50 * time.Millisecond),
+		tcpip.KeepaliveIntervalOption(20 * time.Millisecond),
+		tcpip.KeepaliveCountOption(count),
+		tcpip.KeepaliveEnabledOption(1),
+	} {
+		if err := c.ep.SetSockOpt(opt); err != nil {
+			t.Fatalf("SetSockOpt(%T) failed: %v", opt, err)
+		}
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventIn)
+	defer c.wq.EventUnregister(&we)
+
+	// Probes carry the sequence number preceding the next one, and no
+	// data.
+	checkProbe := func() {
+		checker.IPv4(t, c.getPacket(),
+			checker.PayloadLen(header.TCPMinimumSize),
+			checker.TCP(
+				checker.SeqNum(uint32(c.irs)),
+				checker.AckNum(790),
+				checker.TCPFlags(header.TCPFlagAck),
+			),
+		)
+	}
+
+	// Answering a probe restarts the count.
+	checkProbe()
+	c.sendAck(790, 0)
+	for i := 0; i < count; i++ {
+		checkProbe()
+	}
+
+	// The connection is reset once the probes are left unanswered.
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.SeqNum(uint32(c.irs)+1),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+		),
+	)
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for the connection to be reset")
+	}
+	if _, err := c.ep.Read(nil); err != tcpip.ErrTimeout {
+		t.Fatalf("Read() = %v, want %v", err, tcpip.ErrTimeout)
+	}
+}
+
+func TestKeepaliveInherited(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createAccepted(func(ep tcpip.Endpoint) {
+		for _, opt := range []interface{}{
+			tcpip.KeepaliveIdleOption(50 * time.Millisecond),
+			tcpip.KeepaliveIntervalOption(20 * time.Millisecond),
+			tcpip.KeepaliveCountOption(1),
+			tcpip.KeepaliveEnabledOption(1),
+		} {
+			if err := ep.SetSockOpt(opt); err != nil {
+				t.Fatalf("SetSockOpt(%T) failed: %v", opt, err)
+			}
+		}
+	})
+
+	var count tcpip.KeepaliveCountOption
+	if err := c.ep.GetSockOpt(&count); err != nil || count != 1 {
+		t.Errorf("GetSockOpt(%T) on accepted endpoint = %v, %v, want 1, nil", count, count, err)
+	}
+
+	// The accepted connection is probed once idle, and reset when the
+	// probe is left unanswered.
+	checker.IPv4(t, c.getPacket(),
+		checker.PayloadLen(header.TCPMinimumSize),
+		checker.TCP(
+			checker.SeqNum(uint32(c.irs)),
+			checker.AckNum(790),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.SeqNum(uint32(c.irs)+1),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+		),
+	)
+}
+
+func TestBufferSizeRangeOptions(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var ss tcpip.SendBufferSizeRangeOption
+	if err := c.s.TransportProtocolOption(tcp.ProtocolNumber, &ss); err != nil {
+		t.Fatalf("TransportProtocolOption failed: %v", err)
+	}
+	if want := (tcpip.SendBufferSizeRangeOption{Min: 1, Default: 208 * 1024, Max: 4 << 20}); ss != want {
+		t.Errorf("Got %+v, want %+v", ss, want)
+	}
+
+	var moderate tcpip.ModerateReceiveBufferOption
+	if err := c.s.TransportProtocolOption(tcp.ProtocolNumber, &moderate); err != nil || moderate != 0 {
+		t.Errorf("TransportProtocolOption(&%T) = %v, %v, want 0, nil", moderate, moderate, err)
+	}
+
+	for _, rs := range []tcpip.ReceiveBufferSizeRangeOption{
+		{Min: 0, Default: 10, Max: 100},
+		{Min: 20, Default: 10, Max: 100},
+		{Min: 1, Default: 1000, Max: 100},
+	} {
+		if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, rs); err != tcpip.ErrInvalidOptionValue {
+			t.Errorf("SetTransportProtocolOption(%+v) = %v, want %v", rs, err, tcpip.ErrInvalidOptionValue)
+		}
+	}
+
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.SendBufferSizeRangeOption{Min: 1000, Default: 2000, Max: 3000}); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+	if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.ReceiveBufferSizeRangeOption{Min: 4000, Default: 5000, Max: 6000}); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	// New endpoints use the default sizes, and sizes outside the range are
+	// rejected.
+	var sndBuf tcpip.SendBufferSizeOption
+	if err := ep.GetSockOpt(&sndBuf); err != nil || sndBuf != 2000 {
+		t.Errorf("GetSockOpt(&%T) = %v, %v, want 2000, nil", sndBuf, sndBuf, err)
+	}
+	var rcvBuf tcpip.ReceiveBufferSizeOption
+	if err := ep.GetSockOpt(&rcvBuf); err != nil || rcvBuf != 5000 {
+		t.Errorf("GetSockOpt(&%T) = %v, %v, want 5000, nil", rcvBuf, rcvBuf, err)
+	}
+
+	for _, test := range []struct {
+		snd, rcv         int
+		wantSnd, wantRcv int
+		wantErr          error
+	}{
+		{1, 1, 2000, 5000, tcpip.ErrInvalidOptionValue},
+		{2500, 5500, 2500, 5500, nil},
+		{10000, 10000, 2500, 5500, tcpip.ErrInvalidOptionValue},
+	} {
+		if err := ep.SetSockOpt(tcpip.SendBufferSizeOption(test.snd)); err != test.wantErr {
+			t.Errorf("SetSockOpt(%v) = %v, want %v", tcpip.SendBufferSizeOption(test.snd), err, test.wantErr)
+		}
+		if err := ep.GetSockOpt(&sndBuf); err != nil || int(sndBuf) != test.wantSnd {
+			t.Errorf("GetSockOpt(&%T) = %v, %v, want %v, nil", sndBuf, sndBuf, err, test.wantSnd)
+		}
+
+		if err := ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(test.rcv)); err != test.wantErr {
+			t.Errorf("SetSockOpt(%v) = %v, want %v", tcpip.ReceiveBufferSizeOption(test.rcv), err, test.wantErr)
+		}
+		if err := ep.GetSockOpt(&rcvBuf); err != nil || int(rcvBuf) != test.wantRcv {
+			t.Errorf("GetSockOpt(&%T) = %v, %v, want %v, nil", rcvBuf, rcvBuf, err, test.wantRcv)
+		}
+	}
+}
+
+func TestReceiveBufferAutoTuning(t *testing.T) {
+	const (
+		initialSize = 8000
+		maxSize     = 1 << 20
+		segSize     = 1000
+		rounds      = 10
+	)
+
+	for _, test := range []struct {
+		name     string
+		autoTune bool
+	}{
+		{"AutoTuned", true},
+		{"SizeSet", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.ReceiveBufferSizeRangeOption{Min: 1, Default: initialSize, Max: maxSize}); err != nil {
+				t.Fatalf("SetTransportProtocolOption failed: %v", err)
+			}
+			if err := c.s.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.ModerateReceiveBufferOption(1)); err != nil {
+				t.Fatalf("SetTransportProtocolOption failed: %v", err)
+			}
+
+			var epRcvBuf *tcpip.ReceiveBufferSizeOption
+			if !test.autoTune {
+				v := tcpip.ReceiveBufferSizeOption(initialSize)
+				epRcvBuf = &v
+			}
+			c.createConnectedWithOptions(789, 30000, epRcvBuf, []byte{
+				header.TCPOptionWS, 3, 0, header.TCPOptionNOP,
+			})
+
+			we, ch := waiter.NewChannelEntry(nil)
+			c.wq.EventRegister(&we, waiter.EventIn)
+			defer c.wq.EventUnregister(&we)
+
+			// The peer sends a full window of data per round trip,
+			// which the application reads right away.
+			data := make([]byte, segSize)
+			seq := seqnum.Value(790)
+			for i := 0; i < rounds; i++ {
+				for j := 0; j < initialSize/segSize; j++ {
+					c.sendPacket(data, &headers{
+						srcPort: testPort,
+						dstPort: c.port,
+						flags:   header.TCPFlagAck,
+						seqNum:  seq,
+						ackNum:  c.irs.Add(1),
+						rcvWnd:  30000,
+					})
+					seq = seq.Add(segSize)
+				}
+
+				for read := 0; read < initialSize; {
+					v, err := c.ep.Read(nil)
+					if err == tcpip.ErrWouldBlock {
+						select {
+						case <-ch:
+						case <-time.After(time.Second):
+							t.Fatalf("Timed out waiting for data")
+						}
+						continue
+					}
+					if err != nil {
+						t.Fatalf("Read failed: %v", err)
+					}
+					read += len(v)
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			var size tcpip.ReceiveBufferSizeOption
+			if err := c.ep.GetSockOpt(&size); err != nil {
+				t.Fatalf("GetSockOpt failed: %v", err)
+			}
+			if test.autoTune {
+				if size <= initialSize || size > maxSize {
+					t.Fatalf("Got receive buffer size %v, want it in (%v, %v]", size, initialSize, maxSize)
+				}
+			} else if size != initialSize {
+				t.Fatalf("Got receive buffer size %v, want %v", size, initialSize)
+			}
+		})
+	}
+}
+
+// fastOpenOption returns the Fast Open option with the given cookie, padded
+// with NOP options.
+func fastOpenOption(cookie []byte) []byte {
+	opts := []byte{header.TCPOptionNOP, header.TCPOptionNOP, header.TCPOptionFastOpen, byte(2 + len(cookie))}
+	return append(opts, cookie...)
+}
+
+func parseFastOpenCookie(b []byte) ([]byte, bool) {
+	return header.TCPOption(header.TCP(header.IPv4(b).Payload()).Options(), header.TCPOptionFastOpen)
+}
+
+func TestFastOpenServer(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	wq := &waiter.Queue{}
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.SetSockOpt(tcpip.FastOpenOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// A SYN requesting a cookie gets one in the SYN-ACK.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+		flags:   header.TCPFlagSyn,
+		seqNum:  789,
+		rcvWnd:  30000,
+		tcpOpts: fastOpenOption(nil),
+	})
+	b := c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+			checker.AckNum(790),
+		),
+	)
+	cookie, ok := parseFastOpenCookie(b)
+	if !ok || len(cookie) < header.TCPFastOpenCookieMinimumSize {
+		t.Fatalf("Bad SYN-ACK Fast Open option: got cookie %x, presence %v", cookie, ok)
+	}
+	cookie = append([]byte(nil), cookie...)
+
+	// A SYN with the cookie is accepted before the handshake completes,
+	// and its data is readable.
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	data := []byte{1, 2, 3, 4, 5}
+	c.sendPacket(data, &headers{
+		srcPort: testPort + 1,
+		dstPort: stackPort,
+		flags:   header.TCPFlagSyn,
+		seqNum:  1789,
+		rcvWnd:  30000,
+		tcpOpts: fastOpenOption(cookie),
+	})
+	b = c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.DstPort(testPort+1),
+			checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+			checker.AckNum(1790+uint32(len(data))),
+		),
+	)
+	if _, ok := parseFastOpenCookie(b); ok {
+		t.Fatalf("Unexpected Fast Open option in SYN-ACK for a valid cookie")
+	}
+
+	n, _, err := ep.Accept()
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+			n, _, err = ep.Accept()
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+	}
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer n.Close()
+
+	v, err := n.Read(nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(data, v) {
+		t.Fatalf("Bad data: got %v, want %v", v, data)
+	}
+
+	// A SYN with an invalid cookie only has its SYN acknowledged, and gets
+	// a valid cookie.
+	c.sendPacket(data, &headers{
+		srcPort: testPort + 2,
+		dstPort: stackPort,
+		flags:   header.TCPFlagSyn,
+		seqNum:  2789,
+		rcvWnd:  30000,
+		tcpOpts: fastOpenOption([]byte{1, 2, 3, 4, 5, 6, 7, 8}),
+	})
+	b = c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.DstPort(testPort+2),
+			checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+			checker.AckNum(2790),
+		),
+	)
+	if got, ok := parseFastOpenCookie(b); !ok || !bytes.Equal(got, cookie) {
+		t.Fatalf("Bad SYN-ACK Fast Open option: got cookie %x, presence %v, want %x", got, ok, cookie)
+	}
+}
+
+// fastOpenConnect connects a new endpoint with Fast Open enabled, and returns
+// it along with the channel notified when it becomes writable.
+func fastOpenConnect(c *testContext) (tcpip.Endpoint, chan struct{}) {
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := ep.SetSockOpt(tcpip.FastOpenConnectOption(1)); err != nil {
+		c.t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventOut)
+	if err := ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+		c.t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	return ep, ch
+}
+
+func TestFastOpenClient(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	mssOpt := []byte{header.TCPOptionMSS, 4, 0x5, 0xb4}
+	cookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	data := []byte{1, 2, 3, 4, 5}
+
+	// Without a cookie, the SYN requests one.
+	ep, _ := fastOpenConnect(c)
+	defer ep.Close()
+
+	b := c.getPacket()
+	checker.IPv4(t, b, checker.TCP(checker.TCPFlags(header.TCPFlagSyn)))
+	if got, ok := parseFastOpenCookie(b); !ok || len(got) != 0 {
+		t.Fatalf("Bad SYN Fast Open option: got cookie %x, presence %v, want a request", got, ok)
+	}
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	irs := seqnum.Value(tcpHdr.SequenceNumber())
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: tcpHdr.SourcePort(),
+		flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		seqNum:  789,
+		ackNum:  irs.Add(1),
+		rcvWnd:  30000,
+		tcpOpts: append(mssOpt, fastOpenOption(cookie)...),
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagAck),
+			checker.SeqNum(uint32(irs)+1),
+		),
+	)
+
+	// With the cookie, the endpoint is writable right away, and the data
+	// written is sent in the SYN.
+	ep, ch := fastOpenConnect(c)
+	defer ep.Close()
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for the endpoint to be writable")
+	}
+	c.checkNoPacketTimeout("SYN sent before data was written", 100*time.Millisecond)
+
+	if _, err := ep.Write(buffer.View(data), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	b = c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagSyn),
+			checker.Payload(data),
+		),
+	)
+	if got, ok := parseFastOpenCookie(b); !ok || !bytes.Equal(got, cookie) {
+		t.Fatalf("Bad SYN Fast Open option: got cookie %x, presence %v, want %x", got, ok, cookie)
+	}
+	tcpHdr = header.TCP(header.IPv4(b).Payload())
+	irs = seqnum.Value(tcpHdr.SequenceNumber())
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: tcpHdr.SourcePort(),
+		flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		seqNum:  789,
+		ackNum:  irs.Add(seqnum.Size(1 + len(data))),
+		rcvWnd:  30000,
+		tcpOpts: mssOpt,
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagAck),
+			checker.SeqNum(uint32(irs)+1+uint32(len(data))),
+			checker.AckNum(790),
+		),
+	)
+	c.checkNoPacketTimeout("Acknowledged SYN data was sent again", 100*time.Millisecond)
+
+	// When the peer doesn't acknowledge the data, it is sent again once
+	// the connection is established.
+	ep, ch = fastOpenConnect(c)
+	defer ep.Close()
+
+	<-ch
+	if _, err := ep.Write(buffer.View(data), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	b = c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagSyn),
+			checker.Payload(data),
+		),
+	)
+	tcpHdr = header.TCP(header.IPv4(b).Payload())
+	irs = seqnum.Value(tcpHdr.SequenceNumber())
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: tcpHdr.SourcePort(),
+		flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		seqNum:  789,
+		ackNum:  irs.Add(1),
+		rcvWnd:  30000,
+		tcpOpts: mssOpt,
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagAck),
+			checker.SeqNum(uint32(irs)+1),
+			checker.AckNum(790),
+		),
+	)
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlagsMatch(header.TCPFlagAck, header.TCPFlagAck),
+			checker.SeqNum(uint32(irs)+1),
+			checker.Payload(data),
+		),
+	)
+
+	// The rejected cookie is forgotten, so the next SYN requests a new one.
+	ep, _ = fastOpenConnect(c)
+	defer ep.Close()
+
+	b = c.getPacket()
+	checker.IPv4(t, b, checker.TCP(checker.TCPFlags(header.TCPFlagSyn)))
+	if got, ok := parseFastOpenCookie(b); !ok || len(got) != 0 {
+		t.Fatalf("Bad SYN Fast Open option: got cookie %x, presence %v, want a request", got, ok)
+	}
+}
+
+// cacheFastOpenCookie connects a Fast Open endpoint, which requests a cookie,
+// and hands out the given cookie in the SYN-ACK, so that the following Fast
+// Open connections use it.
+func cacheFastOpenCookie(c *testContext, cookie []byte) tcpip.Endpoint {
+	ep, _ := fastOpenConnect(c)
+
+	b := c.getPacket()
+	checker.IPv4(c.t, b, checker.TCP(checker.TCPFlags(header.TCPFlagSyn)))
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	irs := seqnum.Value(tcpHdr.SequenceNumber())
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: tcpHdr.SourcePort(),
+		flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		seqNum:  789,
+		ackNum:  irs.Add(1),
+		rcvWnd:  30000,
+		tcpOpts: fastOpenOption(cookie),
+	})
+	checker.IPv4(c.t, c.getPacket(), checker.TCP(checker.TCPFlags(header.TCPFlagAck)))
+	return ep
+}
+
+func TestFastOpenClientPartialAck(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	cookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	data := []byte{1, 2, 3, 4, 5}
+	const acked = 2
+
+	defer cacheFastOpenCookie(c, cookie).Close()
+
+	ep, ch := fastOpenConnect(c)
+	defer ep.Close()
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for the endpoint to be writable")
+	}
+
+	// The endpoint is writable, but not connected until the handshake
+	// completes.
+	var info tcpip.TCPInfoOption
+	if err := ep.GetSockOpt(&info); err != nil || info.State != "SYN_SENT" {
+		t.Fatalf("GetSockOpt(%T) = %+v, %v, want state SYN_SENT", info, info, err)
+	}
+	if _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read returned %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+
+	if _, err := ep.Write(buffer.View(data), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	b := c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagSyn),
+			checker.Payload(data),
+		),
+	)
+
+	// The peer only acknowledges part of the data, so the rest is sent
+	// once the connection is established.
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	irs := seqnum.Value(tcpHdr.SequenceNumber())
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: tcpHdr.SourcePort(),
+		flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		seqNum:  789,
+		ackNum:  irs.Add(1 + acked),
+		rcvWnd:  30000,
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagAck),
+			checker.SeqNum(uint32(irs)+1+acked),
+			checker.AckNum(790),
+		),
+	)
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlagsMatch(header.TCPFlagAck, header.TCPFlagAck),
+			checker.SeqNum(uint32(irs)+1+acked),
+			checker.Payload(data[acked:]),
+		),
+	)
+
+	if err := ep.GetSockOpt(&info); err != nil || info.State != "ESTABLISHED" {
+		t.Fatalf("GetSockOpt(%T) = %+v, %v, want state ESTABLISHED", info, info, err)
+	}
+}
+
+func TestFastOpenClientSynRetransmit(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	cookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	data := []byte{1, 2, 3, 4, 5}
+
+	defer cacheFastOpenCookie(c, cookie).Close()
+
+	ep, ch := fastOpenConnect(c)
+	defer ep.Close()
+
+	<-ch
+	if _, err := ep.Write(buffer.View(data), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	b := c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagSyn),
+			checker.Payload(data),
+		),
+	)
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	irs := seqnum.Value(tcpHdr.SequenceNumber())
+
+	// The retransmitted SYN carries the cookie, but not the data.
+	b = c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagSyn),
+			checker.SeqNum(uint32(irs)),
+			checker.Payload([]byte{}),
+		),
+	)
+	if got, ok := parseFastOpenCookie(b); !ok || !bytes.Equal(got, cookie) {
+		t.Fatalf("Bad SYN Fast Open option: got cookie %x, presence %v, want %x", got, ok, cookie)
+	}
+
+	// The data is sent once the connection is established.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: tcpHdr.SourcePort(),
+		flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		seqNum:  789,
+		ackNum:  irs.Add(1),
+		rcvWnd:  30000,
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagAck),
+			checker.SeqNum(uint32(irs)+1),
+			checker.AckNum(790),
+		),
+	)
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlagsMatch(header.TCPFlagAck, header.TCPFlagAck),
+			checker.SeqNum(uint32(irs)+1),
+			checker.Payload(data),
+		),
+	)
+
+	// The cookie isn't forgotten, as the peer may not have received the
+	// data, so the next endpoint is writable right away.
+	ep, ch = fastOpenConnect(c)
+	defer ep.Close()
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for the endpoint to be writable")
+	}
+}
+
+func TestTCPInfo(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// An endpoint that isn't connected only reports its state.
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	var info tcpip.TCPInfoOption
+	if err := ep.GetSockOpt(&info); err != nil || info != (tcpip.TCPInfoOption{State: "CLOSED"}) {
+		t.Fatalf("GetSockOpt(%T) = %+v, %v, want {State: CLOSED}, nil", info, info, err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err := ep.GetSockOpt(&info); err != nil || info.State != "LISTEN" {
+		t.Fatalf("GetSockOpt(%T) = %+v, %v, want state LISTEN", info, info, err)
+	}
+	ep.Close()
+
+	// The info of an endpoint whose handshake is in progress is gathered
+	// by its protocol goroutine.
+	ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	checker.IPv4(t, c.getPacket(), checker.TCP(checker.TCPFlags(header.TCPFlagSyn)))
+	if err := ep.GetSockOpt(&info); err != nil || info.State != "SYN_SENT" {
+		t.Fatalf("GetSockOpt(%T) = %+v, %v, want state SYN_SENT", info, info, err)
+	}
+	ep.Close()
+
+	c.createConnected(789, 30000, nil)
+
+	// Send data, which is retransmitted once before being acknowledged.
+	data := []byte{1, 2, 3}
+	if _, err := c.ep.Write(buffer.View(data), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.receiveAndCheckPacket(data, 0, len(data))
+	c.receiveAndCheckPacket(data, 0, len(data))
+	c.sendAck(790, len(data))
+
+	// Receive data.
+	c.sendPacket(make([]byte, 10), &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  c.irs.Add(1 + seqnum.Size(len(data))),
+		rcvWnd:  30000,
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagAck),
+			checker.AckNum(800),
+		),
+	)
+
+	if err := c.ep.GetSockOpt(&info); err != nil {
+		t.Fatalf("GetSockOpt(%T) failed: %v", info, err)
+	}
+	if info.State != "ESTABLISHED" {
+		t.Errorf("Got state %v, want ESTABLISHED", info.State)
+	}
+	if info.BytesSent != 2*uint64(len(data)) || info.BytesRetransmitted != uint64(len(data)) || info.SegmentsRetransmitted != 1 {
+		t.Errorf("Got %v bytes sent, %v bytes and %v segments retransmitted, want %v, %v and 1", info.BytesSent, info.BytesRetransmitted, info.SegmentsRetransmitted, 2*len(data), len(data))
+	}
+	if info.BytesReceived != 10 || info.SegmentsReceived != 2 {
+		t.Errorf("Got %v bytes and %v segments received, want 10 and 2", info.BytesReceived, info.SegmentsReceived)
+	}
+	if info.SendWindow != 30000 || info.ReceiveWindow == 0 || info.MSS == 0 || info.CongestionWindow == 0 {
+		t.Errorf("Got send window %v, receive window %v, MSS %v and congestion window %v, want 30000 and non-zero values", info.SendWindow, info.ReceiveWindow, info.MSS, info.CongestionWindow)
+	}
+	if info.RTO == 0 || info.LastAckAge <= 0 || info.LastAckAge > time.Second {
+		t.Errorf("Got RTO %v and last ack age %v, want non-zero values below 1s", info.RTO, info.LastAckAge)
+	}
+
+	// The state follows the closing of the connection.
+	c.ep.Shutdown(tcpip.ShutdownWrite)
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagFin),
+		),
+	)
+	if err := c.ep.GetSockOpt(&info); err != nil || info.State != "FIN_WAIT_1" {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want state FIN_WAIT_1", info, info.State, err)
+	}
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  800,
+		ackNum:  c.irs.Add(2 + seqnum.Size(len(data))),
+		rcvWnd:  30000,
+	})
+	c.checkNoPacketTimeout("Unexpected packet", 100*time.Millisecond)
+	if err := c.ep.GetSockOpt(&info); err != nil || info.State != "FIN_WAIT_2" {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want state FIN_WAIT_2", info, info.State, err)
+	}
+}
+
+func TestCloseStates(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	ep := c.ep
+	c.ep = nil
+
+	// The connection goes through the closing states once the endpoint is
+	// closed, while reads fail right away.
+	ep.Close()
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.SeqNum(uint32(c.irs)+1),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagFin),
+		),
+	)
+	var info tcpip.TCPInfoOption
+	if err := ep.GetSockOpt(&info); err != nil || info.State != "FIN_WAIT_1" {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want state FIN_WAIT_1", info, info.State, err)
+	}
+	if _, err := ep.Read(nil); err != tcpip.ErrConnectionAborted {
+		t.Errorf("Read() = %v, want %v", err, tcpip.ErrConnectionAborted)
+	}
+
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  c.irs.Add(2),
+		rcvWnd:  30000,
+	})
+	c.checkNoPacketTimeout("Unexpected packet", 100*time.Millisecond)
+	if err := ep.GetSockOpt(&info); err != nil || info.State != "FIN_WAIT_2" {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want state FIN_WAIT_2", info, info.State, err)
+	}
+
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck | header.TCPFlagFin,
+		seqNum:  790,
+		ackNum:  c.irs.Add(2),
+		rcvWnd:  30000,
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.AckNum(791),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+	if err := ep.GetSockOpt(&info); err != nil || info.State != "TIME_WAIT" {
+		t.Errorf("GetSockOpt(%T) = %v, %v, want state TIME_WAIT", info, info.State, err)
+	}
+}
+
+func TestLingerInherited(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	want := tcpip.LingerOption{Enabled: true, Timeout: 5 * time.Second}
+	c.createAccepted(func(ep tcpip.Endpoint) {
+		if err := ep.SetSockOpt(want); err != nil {
+			t.Fatalf("SetSockOpt(LingerOption) failed: %v", err)
+		}
+	})
+
+	var linger tcpip.LingerOption
+	if err := c.ep.GetSockOpt(&linger); err != nil || linger != want {
+		t.Errorf("GetSockOpt(LingerOption) on accepted endpoint = %+v, %v, want %+v, nil", linger, err, want)
+	}
+}
+
+func TestMarkInherited(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createAccepted(func(ep tcpip.Endpoint) {
+		if err := ep.SetSockOpt(tcpip.MarkOption(7)); err != nil {
+			t.Fatalf("SetSockOpt(MarkOption) failed: %v", err)
+		}
+	})
+
+	var mark tcpip.MarkOption
+	if err := c.ep.GetSockOpt(&mark); err != nil || mark != 7 {
+		t.Errorf("GetSockOpt(MarkOption) on accepted endpoint = %v, %v, want 7, nil", mark, err)
+	}
+}
+
+func TestFilterRejectWithReset(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	rules := []tcpip.FilterRule{{
+		Protocol:         tcp.ProtocolNumber,
+		DestinationPorts: tcpip.PortRange{Start: stackPort, End: stackPort},
+		Verdict:          tcpip.FilterRejectWithReset,
+	}}
+	if err := c.s.(*stack.Stack).SetFilterRules(tcpip.FilterInput, rules); err != nil {
+		t.Fatalf("SetFilterRules failed: %v", err)
+	}
+
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+		flags:   header.TCPFlagSyn,
+		seqNum:  789,
+		rcvWnd:  30000,
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.SrcPort(stackPort),
+			checker.DstPort(testPort),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+			checker.AckNum(790),
+		),
+	)
+}
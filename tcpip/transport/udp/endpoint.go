@@ -13,18 +13,10 @@ import (
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/datagram"
 	"github.com/google/netstack/waiter"
 )
 
-type udpPacket struct {
-	udpPacketEntry
-	senderAddress tcpip.FullAddress
-	data          buffer.VectorisedView
-	// views is used as buffer for data when its length is large
-	// enough to store a VectorisedView.
-	views [8]buffer.View
-}
-
 type endpointState int
 
 const (
@@ -46,27 +38,19 @@ type endpoint struct {
 	stack       *stack.Stack
 	netProto    tcpip.NetworkProtocolNumber
 	waiterQueue *waiter.Queue
-
-	// The following fields are used to manage the receive queue, and are
-	// protected by rcvMu.
-	rcvMu         sync.Mutex
-	rcvReady      bool
-	rcvList       udpPacketList
-	rcvBufSizeMax int
-	rcvBufSize    int
-	rcvClosed     bool
+	rcv         *datagram.ReceiveQueue
 
 	// The following fields are protected by the mu mutex.
-	mu         sync.RWMutex
-	sndBufSize int
-	id         stack.TransportEndpointID
-	state      endpointState
-	bindNICID  tcpip.NICID
-	bindAddr   tcpip.Address
-	regNICID   tcpip.NICID
-	route      stack.Route
-	dstPort    uint16
-	v6only     bool
+	mu        sync.RWMutex
+	id        stack.TransportEndpointID
+	state     endpointState
+	bindNICID tcpip.NICID
+	bindAddr  tcpip.Address
+	regNICID  tcpip.NICID
+	route     stack.Route
+	dstPort   uint16
+	v6only    bool
+	opts      *datagram.Options
 
 	// effectiveNetProtos contains the network protocols actually in use. In
 	// most cases it will only contain "netProto", but in cases like IPv6
@@ -78,14 +62,13 @@ type endpoint struct {
 }
 
 func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
-	// TODO: Use the send buffer size initialized here.
 	return &endpoint{
-		stack:         stack,
-		netProto:      netProto,
-		waiterQueue:   waiterQueue,
-		v6only:        true,
-		rcvBufSizeMax: 32 * 1024,
-		sndBufSize:    32 * 1024,
+		stack:       stack,
+		netProto:    netProto,
+		waiterQueue: waiterQueue,
+		rcv:         datagram.NewReceiveQueue(waiterQueue, datagram.ReceiveBufferSize),
+		v6only:      true,
+		opts:        datagram.NewOptions(stack, netProto, true),
 	}
 }
 
@@ -121,15 +104,8 @@ func (e *endpoint) Close() {
 		e.stack.UnregisterTransportEndpoint(e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id)
 	}
 
-	// Close the receive list and drain it.
-	e.rcvMu.Lock()
-	e.rcvClosed = true
-	e.rcvBufSize = 0
-	for !e.rcvList.Empty() {
-		p := e.rcvList.Front()
-		e.rcvList.Remove(p)
-	}
-	e.rcvMu.Unlock()
+	e.opts.LeaveGroups()
+	e.rcv.Close()
 
 	e.route.Release()
 
@@ -140,28 +116,7 @@ func (e *endpoint) Close() {
 // Read reads data from the endpoint. This method does not block if
 // there is no data pending.
 func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, error) {
-	e.rcvMu.Lock()
-
-	if e.rcvList.Empty() {
-		err := tcpip.ErrWouldBlock
-		if e.rcvClosed {
-			err = tcpip.ErrClosedForReceive
-		}
-		e.rcvMu.Unlock()
-		return buffer.View{}, err
-	}
-
-	p := e.rcvList.Front()
-	e.rcvList.Remove(p)
-	e.rcvBufSize -= p.data.Size()
-
-	e.rcvMu.Unlock()
-
-	if addr != nil {
-		*addr = p.senderAddress
-	}
-
-	return p.data.ToView(), nil
+	return e.rcv.Read(addr)
 }
 
 // prepareForWrite prepares the endpoint for sending data. In particular, it
@@ -244,17 +199,25 @@ func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error)
 		}
 
 		// Find the enpoint.
-		r, err := e.stack.FindRoute(nicid, e.bindAddr, to.Addr, netProto)
+		nicid, localAddr := e.opts.RouteSource(nicid, e.bindAddr, to.Addr)
+		r, err := e.stack.FindPolicyRoute(nicid, localAddr, to.Addr, netProto, ProtocolNumber, e.opts.Mark())
 		if err != nil {
 			return 0, err
 		}
 		defer r.Release()
+		e.opts.Apply(&r)
 
 		route = &r
 		dstPort = to.Port
 	}
 
-	sendUDP(route, v, e.id.LocalPort, dstPort)
+	if err := e.opts.CheckRoute(route); err != nil {
+		return 0, err
+	}
+
+	if err := sendUDP(route, v, e.id.LocalPort, dstPort); err != nil {
+		return 0, err
+	}
 	return uintptr(len(v)), nil
 }
 
@@ -263,9 +226,8 @@ func (e *endpoint) Peek(io.Writer) (uintptr, error) {
 	return 0, nil
 }
 
-// SetSockOpt sets a socket option. Currently not supported.
+// SetSockOpt sets a socket option.
 func (e *endpoint) SetSockOpt(opt interface{}) error {
-	// TODO: Actually implement this.
 	switch v := opt.(type) {
 	case tcpip.V6OnlyOption:
 		// We only recognize this option on v6 endpoints.
@@ -282,6 +244,13 @@ func (e *endpoint) SetSockOpt(opt interface{}) error {
 		}
 
 		e.v6only = v != 0
+
+	default:
+		e.mu.Lock()
+		err := e.opts.SetOption(opt)
+		e.opts.Apply(&e.route)
+		e.mu.Unlock()
+		return err
 	}
 	return nil
 }
@@ -293,15 +262,11 @@ func (e *endpoint) GetSockOpt(opt interface{}) error {
 		return nil
 
 	case *tcpip.SendBufferSizeOption:
-		e.mu.Lock()
-		*o = tcpip.SendBufferSizeOption(e.sndBufSize)
-		e.mu.Unlock()
+		*o = datagram.SendBufferSize
 		return nil
 
 	case *tcpip.ReceiveBufferSizeOption:
-		e.rcvMu.Lock()
-		*o = tcpip.ReceiveBufferSizeOption(e.rcvBufSizeMax)
-		e.rcvMu.Unlock()
+		*o = tcpip.ReceiveBufferSizeOption(e.rcv.Limit())
 		return nil
 
 	case *tcpip.V6OnlyOption:
@@ -321,7 +286,9 @@ func (e *endpoint) GetSockOpt(opt interface{}) error {
 		return nil
 	}
 
-	return tcpip.ErrInvalidEndpointState
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.opts.GetOption(opt)
 }
 
 // sendUDP sends a UDP segment via the provided network endpoint and under the
@@ -410,12 +377,17 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) error {
 	}
 
 	// Find a route to the desired destination.
-	r, err := e.stack.FindRoute(nicid, e.bindAddr, addr.Addr, netProto)
+	nicid, localAddr := e.opts.RouteSource(nicid, e.bindAddr, addr.Addr)
+	r, err := e.stack.FindPolicyRoute(nicid, localAddr, addr.Addr, netProto, ProtocolNumber, e.opts.Mark())
 	if err != nil {
 		return err
 	}
 	defer r.Release()
 
+	if err := e.opts.CheckRoute(&r); err != nil {
+		return err
+	}
+
 	id := stack.TransportEndpointID{
 		LocalAddress:  r.LocalAddress,
 		LocalPort:     localPort,
@@ -446,15 +418,14 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) error {
 
 	e.id = id
 	e.route = r.Clone()
+	e.opts.Apply(&e.route)
 	e.dstPort = addr.Port
 	e.regNICID = nicid
 	e.effectiveNetProtos = netProtos
 
 	e.state = stateConnected
 
-	e.rcvMu.Lock()
-	e.rcvReady = true
-	e.rcvMu.Unlock()
+	e.rcv.SetReady()
 
 	return nil
 }
@@ -475,14 +446,7 @@ func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) error {
 	}
 
 	if flags&tcpip.ShutdownRead != 0 {
-		e.rcvMu.Lock()
-		wasClosed := e.rcvClosed
-		e.rcvClosed = true
-		e.rcvMu.Unlock()
-
-		if !wasClosed {
-			e.waiterQueue.Notify(waiter.EventIn)
-		}
+		e.rcv.Shutdown()
 	}
 
 	return nil
@@ -546,7 +510,7 @@ func (e *endpoint) bindLocked(addr tcpip.FullAddress, commit func() error) error
 		}
 	}
 
-	if len(addr.Addr) != 0 {
+	if len(addr.Addr) != 0 && !datagram.IsMulticastAddress(addr.Addr) && addr.Addr != header.IPv4Broadcast {
 		// A local address was specified, verify that it's valid.
 		if e.stack.CheckLocalAddress(addr.NIC, addr.Addr) == 0 {
 			return tcpip.ErrBadLocalAddress
@@ -576,9 +540,7 @@ func (e *endpoint) bindLocked(addr tcpip.FullAddress, commit func() error) error
 	// Mark endpoint as bound.
 	e.state = stateBound
 
-	e.rcvMu.Lock()
-	e.rcvReady = true
-	e.rcvMu.Unlock()
+	e.rcv.SetReady()
 
 	return nil
 }
@@ -635,12 +597,8 @@ func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 	result := waiter.EventOut & mask
 
 	// Determine if the endpoint is readable if requested.
-	if (mask & waiter.EventIn) != 0 {
-		e.rcvMu.Lock()
-		if !e.rcvList.Empty() || e.rcvClosed {
-			result |= waiter.EventIn
-		}
-		e.rcvMu.Unlock()
+	if (mask&waiter.EventIn) != 0 && e.rcv.IsReadable() {
+		result |= waiter.EventIn
 	}
 
 	return result
@@ -658,32 +616,13 @@ func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv
 
 	vv.TrimFront(header.UDPMinimumSize)
 
-	e.rcvMu.Lock()
-
-	// Drop the packet if our buffer is currently full.
-	if !e.rcvReady || e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax {
-		e.rcvMu.Unlock()
-		return
-	}
-
-	wasEmpty := e.rcvBufSize == 0
-
-	// Push new packet into receive list and increment the buffer size.
-	pkt := &udpPacket{
-		senderAddress: tcpip.FullAddress{
+	p := &datagram.Packet{
+		SenderAddress: tcpip.FullAddress{
 			NIC:  r.NICID(),
 			Addr: id.RemoteAddress,
 			Port: hdr.SourcePort(),
 		},
 	}
-	pkt.data = vv.Clone(pkt.views[:])
-	e.rcvList.PushBack(pkt)
-	e.rcvBufSize += vv.Size()
-
-	e.rcvMu.Unlock()
-
-	// Notify any waiters that there's data to be read now.
-	if wasEmpty {
-		e.waiterQueue.Notify(waiter.EventIn)
-	}
+	p.SetData(vv)
+	e.rcv.Enqueue(p)
 }
@@ -89,6 +89,10 @@ func newDualTestContext(t *testing.T, mtu uint32) *testContext {
 		},
 	})
 
+	// Discard the MLD report announcing the solicited-node group of the
+	// IPv6 address.
+	linkEP.Drain()
+
 	return &testContext{
 		t:      t,
 		s:      s,
@@ -159,6 +163,10 @@ func (c *testContext) getPacket() []byte {
 }
 
 func (c *testContext) sendV6Packet(payload []byte, h *headers) {
+	c.sendV6PacketTo(payload, h, stackV6Addr)
+}
+
+func (c *testContext) sendV6PacketTo(payload []byte, h *headers, dst tcpip.Address) {
 	// Allocate a buffer for data and headers.
 	buf := buffer.NewView(header.UDPMinimumSize + header.IPv6MinimumSize + len(payload))
 	copy(buf[len(buf)-len(payload):], payload)
@@ -170,7 +178,7 @@ func (c *testContext) sendV6Packet(payload []byte, h *headers) {
 		NextHeader:    uint8(udp.ProtocolNumber),
 		HopLimit:      65,
 		SrcAddr:       testV6Addr,
-		DstAddr:       stackV6Addr,
+		DstAddr:       dst,
 	})
 
 	// Initialize the UDP header.
@@ -183,7 +191,7 @@ func (c *testContext) sendV6Packet(payload []byte, h *headers) {
 
 	// Calculate the UDP pseudo-header checksum.
 	xsum := header.Checksum([]byte(testV6Addr), 0)
-	xsum = header.Checksum([]byte(stackV6Addr), xsum)
+	xsum = header.Checksum([]byte(dst), xsum)
 	xsum = header.Checksum([]byte{0, uint8(udp.ProtocolNumber)}, xsum)
 
 	// Calculate the UDP checksum and set it.
@@ -198,6 +206,10 @@ func (c *testContext) sendV6Packet(payload []byte, h *headers) {
 }
 
 func (c *testContext) sendPacket(payload []byte, h *headers) {
+	c.sendPacketTo(payload, h, stackAddr)
+}
+
+func (c *testContext) sendPacketTo(payload []byte, h *headers, dst tcpip.Address) {
 	// Allocate a buffer for data and headers.
 	buf := buffer.NewView(header.UDPMinimumSize + header.IPv4MinimumSize + len(payload))
 	copy(buf[len(buf)-len(payload):], payload)
@@ -210,7 +222,7 @@ func (c *testContext) sendPacket(payload []byte, h *headers) {
 		TTL:         65,
 		Protocol:    uint8(udp.ProtocolNumber),
 		SrcAddr:     testAddr,
-		DstAddr:     stackAddr,
+		DstAddr:     dst,
 	})
 	ip.SetChecksum(^ip.CalculateChecksum())
 
@@ -224,7 +236,7 @@ func (c *testContext) sendPacket(payload []byte, h *headers) {
 
 	// Calculate the UDP pseudo-header checksum.
 	xsum := header.Checksum([]byte(testAddr), 0)
-	xsum = header.Checksum([]byte(stackAddr), xsum)
+	xsum = header.Checksum([]byte(dst), xsum)
 	xsum = header.Checksum([]byte{0, uint8(udp.ProtocolNumber)}, xsum)
 
 	// Calculate the UDP checksum and set it.
@@ -615,3 +627,684 @@ func TestV4WriteOnConnected(t *testing.T) {
 		c.t.Fatalf("Bad payload: got %x, want %x", udp.Payload(), payload)
 	}
 }
+
+const (
+	multicastAddr   = "\xe8\x2b\xd3\xea"
+	multicastV6Addr = "\xff\x0e\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xe8\x2b\xd3\xea"
+)
+
+// getIGMP waits for the IGMP packet sent when a group is joined or left.
+func (c *testContext) getIGMP() {
+	select {
+	case p := <-c.linkEP.C:
+		b := make([]byte, len(p.Header)+len(p.Payload))
+		copy(b, p.Header)
+		copy(b[len(p.Header):], p.Payload)
+		if proto := header.IPv4(b).Protocol(); proto != uint8(header.IGMPProtocolNumber) {
+			c.t.Fatalf("Bad protocol: got %v, want %v", proto, header.IGMPProtocolNumber)
+		}
+
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("IGMP packet wasn't written out")
+	}
+}
+
+func TestMulticastOptions(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	var ttl tcpip.MulticastTTLOption
+	if err := c.ep.GetSockOpt(&ttl); err != nil || ttl != 1 {
+		t.Fatalf("GetSockOpt(MulticastTTLOption) = %v, %v, want 1, nil", ttl, err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.MulticastTTLOption(256)); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("SetSockOpt(MulticastTTLOption(256)) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+
+	var loop tcpip.MulticastLoopOption
+	if err := c.ep.GetSockOpt(&loop); err != nil || loop != 1 {
+		t.Fatalf("GetSockOpt(MulticastLoopOption) = %v, %v, want 1, nil", loop, err)
+	}
+
+	if err := c.ep.SetSockOpt(tcpip.MulticastInterfaceOption{InterfaceAddr: testAddr}); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("SetSockOpt(MulticastInterfaceOption) with a foreign address = %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+	if err := c.ep.SetSockOpt(tcpip.MulticastInterfaceOption{InterfaceAddr: stackAddr}); err != nil {
+		t.Fatalf("SetSockOpt(MulticastInterfaceOption) failed: %v", err)
+	}
+	var iface tcpip.MulticastInterfaceOption
+	if err := c.ep.GetSockOpt(&iface); err != nil {
+		t.Fatalf("GetSockOpt(MulticastInterfaceOption) failed: %v", err)
+	}
+	if want := (tcpip.MulticastInterfaceOption{NIC: 1, InterfaceAddr: stackAddr}); iface != want {
+		t.Fatalf("GetSockOpt(MulticastInterfaceOption) = %v, want %v", iface, want)
+	}
+
+	if err := c.ep.SetSockOpt(tcpip.AddMembershipOption{MulticastAddr: testAddr}); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("SetSockOpt(AddMembershipOption) with a unicast address = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := c.ep.SetSockOpt(tcpip.AddMembershipOption{MulticastAddr: multicastAddr}); err != nil {
+		t.Fatalf("SetSockOpt(AddMembershipOption) failed: %v", err)
+	}
+	c.getIGMP()
+	if err := c.ep.SetSockOpt(tcpip.AddMembershipOption{NIC: 1, MulticastAddr: multicastAddr}); err != tcpip.ErrDuplicateAddress {
+		t.Fatalf("SetSockOpt(AddMembershipOption) twice = %v, want %v", err, tcpip.ErrDuplicateAddress)
+	}
+	if err := c.ep.SetSockOpt(tcpip.RemoveMembershipOption{InterfaceAddr: stackAddr, MulticastAddr: multicastAddr}); err != nil {
+		t.Fatalf("SetSockOpt(RemoveMembershipOption) failed: %v", err)
+	}
+	c.getIGMP()
+	if err := c.ep.SetSockOpt(tcpip.RemoveMembershipOption{MulticastAddr: multicastAddr}); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("SetSockOpt(RemoveMembershipOption) twice = %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+}
+
+func TestMulticastReceive(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Create an endpoint bound to the wildcard address and one bound to
+	// the group, on the same port.
+	var err error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: multicastAddr, Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	// Packets to the group aren't accepted until it is joined.
+	payload := newPayload()
+	c.sendPacketTo(payload, &headers{srcPort: testPort, dstPort: stackPort}, multicastAddr)
+	if _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read before joining the group = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+
+	if err := c.ep.SetSockOpt(tcpip.AddMembershipOption{NIC: 1, MulticastAddr: multicastAddr}); err != nil {
+		t.Fatalf("SetSockOpt(AddMembershipOption) failed: %v", err)
+	}
+	c.getIGMP()
+
+	// Once joined, every matching endpoint gets a copy.
+	c.sendPacketTo(payload, &headers{srcPort: testPort, dstPort: stackPort}, multicastAddr)
+	for i, ep := range []tcpip.Endpoint{c.ep, ep} {
+		var addr tcpip.FullAddress
+		v, err := ep.Read(&addr)
+		if err != nil {
+			t.Fatalf("Read on endpoint %d failed: %v", i, err)
+		}
+		if addr.Addr != testAddr {
+			t.Errorf("Unexpected remote address on endpoint %d: got %v, want %v", i, addr.Addr, testAddr)
+		}
+		if !bytes.Equal(payload, v) {
+			t.Errorf("Bad payload on endpoint %d: got %x, want %x", i, v, payload)
+		}
+	}
+}
+
+func TestMulticastSend(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.AddMembershipOption{NIC: 1, MulticastAddr: multicastAddr}); err != nil {
+		t.Fatalf("SetSockOpt(AddMembershipOption) failed: %v", err)
+	}
+	c.getIGMP()
+	if err := c.ep.SetSockOpt(tcpip.MulticastTTLOption(3)); err != nil {
+		t.Fatalf("SetSockOpt(MulticastTTLOption) failed: %v", err)
+	}
+
+	for _, loop := range []bool{true, false} {
+		var v tcpip.MulticastLoopOption
+		if loop {
+			v = 1
+		}
+		if err := c.ep.SetSockOpt(v); err != nil {
+			t.Fatalf("SetSockOpt(MulticastLoopOption) failed: %v", err)
+		}
+
+		payload := buffer.View(newPayload())
+		if _, err := c.ep.Write(payload, &tcpip.FullAddress{Addr: multicastAddr, Port: stackPort}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		// The packet goes out with the multicast TTL.
+		select {
+		case p := <-c.linkEP.C:
+			b := make([]byte, len(p.Header)+len(p.Payload))
+			copy(b, p.Header)
+			copy(b[len(p.Header):], p.Payload)
+			checker.IPv4(t, b,
+				checker.SrcAddr(stackAddr),
+				checker.DstAddr(multicastAddr),
+				checker.TTL(3),
+				checker.UDP(checker.DstPort(stackPort), checker.Payload(payload)),
+			)
+
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Packet wasn't written out")
+		}
+
+		// It is looped back to the endpoint only if requested.
+		v2, err := c.ep.Read(nil)
+		if loop {
+			if err != nil {
+				t.Fatalf("Read of looped back packet failed: %v", err)
+			}
+			if !bytes.Equal(payload, v2) {
+				t.Errorf("Bad looped back payload: got %x, want %x", v2, payload)
+			}
+		} else if err != tcpip.ErrWouldBlock {
+			t.Fatalf("Read with loopback disabled = %v, want %v", err, tcpip.ErrWouldBlock)
+		}
+	}
+}
+
+func TestV6MulticastReceive(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// IPv4 endpoints can't join IPv6 groups.
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := ep.SetSockOpt(tcpip.AddMembershipOption{NIC: 1, MulticastAddr: multicastV6Addr}); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("SetSockOpt(AddMembershipOption) on an IPv4 endpoint = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	ep.Close()
+
+	c.createV6Endpoint(true)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	payload := newPayload()
+	c.sendV6PacketTo(payload, &headers{srcPort: testPort, dstPort: stackPort}, multicastV6Addr)
+	if _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read before joining the group = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+
+	// The stack address isn't link-local, so joining sends no MLD report.
+	if err := c.ep.SetSockOpt(tcpip.AddMembershipOption{NIC: 1, MulticastAddr: multicastV6Addr}); err != nil {
+		t.Fatalf("SetSockOpt(AddMembershipOption) failed: %v", err)
+	}
+
+	c.sendV6PacketTo(payload, &headers{srcPort: testPort, dstPort: stackPort}, multicastV6Addr)
+	var addr tcpip.FullAddress
+	v, err := c.ep.Read(&addr)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if addr.Addr != testV6Addr {
+		t.Errorf("Unexpected remote address: got %v, want %v", addr.Addr, testV6Addr)
+	}
+	if !bytes.Equal(payload, v) {
+		t.Errorf("Bad payload: got %x, want %x", v, payload)
+	}
+}
+
+// directedBroadcastAddr is the broadcast address of 10.0.0.0/24, the subnet of
+// stackAddr.
+const directedBroadcastAddr = "\x0a\x00\x00\xff"
+
+// addSubnetRoute adds an on-link route to the subnet of stackAddr, which makes
+// directedBroadcastAddr a broadcast address.
+func (c *testContext) addSubnetRoute() {
+	c.s.SetRouteTable([]tcpip.Route{
+		{
+			Destination: "\x0a\x00\x00\x00",
+			Mask:        "\xff\xff\xff\x00",
+			NIC:         1,
+		},
+		{
+			Destination: "\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00",
+			NIC:         1,
+		},
+	})
+}
+
+func TestBroadcastSend(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+	c.addSubnetRoute()
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	payload := buffer.View(newPayload())
+	for _, addr := range []tcpip.Address{header.IPv4Broadcast, directedBroadcastAddr} {
+		if _, err := c.ep.Write(payload, &tcpip.FullAddress{Addr: addr, Port: testPort}); err != tcpip.ErrBroadcastDisabled {
+			t.Fatalf("Write to %v without BroadcastOption = %v, want %v", addr, err, tcpip.ErrBroadcastDisabled)
+		}
+	}
+
+	if err := c.ep.SetSockOpt(tcpip.BroadcastOption(1)); err != nil {
+		t.Fatalf("SetSockOpt(BroadcastOption) failed: %v", err)
+	}
+	var v tcpip.BroadcastOption
+	if err := c.ep.GetSockOpt(&v); err != nil || v != 1 {
+		t.Fatalf("GetSockOpt(BroadcastOption) = %v, %v, want 1, nil", v, err)
+	}
+
+	for _, addr := range []tcpip.Address{header.IPv4Broadcast, directedBroadcastAddr} {
+		if _, err := c.ep.Write(payload, &tcpip.FullAddress{Addr: addr, Port: testPort}); err != nil {
+			t.Fatalf("Write to %v failed: %v", addr, err)
+		}
+
+		select {
+		case p := <-c.linkEP.C:
+			b := make([]byte, len(p.Header)+len(p.Payload))
+			copy(b, p.Header)
+			copy(b[len(p.Header):], p.Payload)
+			checker.IPv4(t, b,
+				checker.SrcAddr(stackAddr),
+				checker.DstAddr(addr),
+				checker.UDP(checker.DstPort(testPort), checker.Payload(payload)),
+			)
+
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Packet wasn't written out")
+		}
+	}
+}
+
+func TestBroadcastReceive(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+	c.addSubnetRoute()
+
+	// Create an endpoint bound to the wildcard address, one bound to the
+	// limited broadcast address, and one bound to the stack address, all
+	// on the same port.
+	var err error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	var eps []tcpip.Endpoint
+	for _, addr := range []tcpip.Address{header.IPv4Broadcast, stackAddr} {
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			c.t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		defer ep.Close()
+		if err := ep.Bind(tcpip.FullAddress{Addr: addr, Port: stackPort}, nil); err != nil {
+			c.t.Fatalf("Bind to %v failed: %v", addr, err)
+		}
+		eps = append(eps, ep)
+	}
+	broadcastEP, unicastEP := eps[0], eps[1]
+
+	testCases := []struct {
+		dst  tcpip.Address
+		want []tcpip.Endpoint
+	}{
+		{header.IPv4Broadcast, []tcpip.Endpoint{c.ep, broadcastEP}},
+		{directedBroadcastAddr, []tcpip.Endpoint{c.ep}},
+	}
+	for _, tc := range testCases {
+		payload := newPayload()
+		c.sendPacketTo(payload, &headers{srcPort: testPort, dstPort: stackPort}, tc.dst)
+
+		for _, ep := range tc.want {
+			v, err := ep.Read(nil)
+			if err != nil {
+				t.Fatalf("Read of broadcast to %v failed: %v", tc.dst, err)
+			}
+			if !bytes.Equal(payload, v) {
+				t.Errorf("Bad payload of broadcast to %v: got %x, want %x", tc.dst, v, payload)
+			}
+		}
+		for _, ep := range []tcpip.Endpoint{c.ep, broadcastEP, unicastEP} {
+			if _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+				t.Fatalf("Unexpected read of broadcast to %v: %v", tc.dst, err)
+			}
+		}
+	}
+
+	// Without the subnet route, its broadcast address is no longer known.
+	if err := c.s.RemoveRoute(tcpip.Route{Destination: "\x0a\x00\x00\x00", Mask: "\xff\xff\xff\x00", NIC: 1}); err != nil {
+		t.Fatalf("RemoveRoute failed: %v", err)
+	}
+	c.sendPacketTo(newPayload(), &headers{srcPort: testPort, dstPort: stackPort}, directedBroadcastAddr)
+	if _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Unexpected read of broadcast to %v: %v", directedBroadcastAddr, err)
+	}
+}
+
+func TestBroadcastWithoutAddress(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+
+	id, linkEP := channel.New(256, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	c := &testContext{t: t, s: s, linkEP: linkEP}
+	defer c.cleanup()
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.BroadcastOption(1)); err != nil {
+		t.Fatalf("SetSockOpt(BroadcastOption) failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{NIC: 1, Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	// Broadcasts are sent from the unspecified address, even without a
+	// route.
+	payload := buffer.View(newPayload())
+	if _, err := c.ep.Write(payload, &tcpip.FullAddress{Addr: header.IPv4Broadcast, Port: testPort}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case p := <-c.linkEP.C:
+		b := make([]byte, len(p.Header)+len(p.Payload))
+		copy(b, p.Header)
+		copy(b[len(p.Header):], p.Payload)
+		checker.IPv4(t, b,
+			checker.SrcAddr(header.IPv4Any),
+			checker.DstAddr(header.IPv4Broadcast),
+			checker.UDP(checker.DstPort(testPort), checker.Payload(payload)),
+		)
+
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Packet wasn't written out")
+	}
+
+	// And they are received too.
+	c.sendPacketTo(payload, &headers{srcPort: testPort, dstPort: stackPort}, header.IPv4Broadcast)
+	v, err := c.ep.Read(nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(payload, v) {
+		t.Errorf("Bad payload: got %x, want %x", v, payload)
+	}
+}
+
+func TestFilterInput(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	s := c.s.(*stack.Stack)
+	rules := []tcpip.FilterRule{
+		{
+			Source:           testAddr,
+			SourceMask:       "\xff\xff\xff\xff",
+			Protocol:         udp.ProtocolNumber,
+			DestinationPorts: tcpip.PortRange{Start: stackPort, End: stackPort},
+			Verdict:          tcpip.FilterDrop,
+		},
+	}
+	if err := s.SetFilterRules(tcpip.FilterInput, rules); err != nil {
+		t.Fatalf("SetFilterRules failed: %v", err)
+	}
+
+	// Dropped packets are neither delivered nor answered.
+	c.sendPacket(newPayload(), &headers{srcPort: testPort, dstPort: stackPort})
+	if _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read of dropped packet = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+	select {
+	case <-c.linkEP.C:
+		t.Fatalf("Dropped packet was answered")
+	default:
+	}
+
+	// Rejected packets are answered with an ICMP message quoting them.
+	rules[0].Verdict = tcpip.FilterReject
+	if err := s.SetFilterRules(tcpip.FilterInput, rules); err != nil {
+		t.Fatalf("SetFilterRules failed: %v", err)
+	}
+	payload := newPayload()
+	c.sendPacket(payload, &headers{srcPort: testPort, dstPort: stackPort})
+	if _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read of rejected packet = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+
+	b := c.getPacket()
+	ip := header.IPv4(b)
+	if got, want := tcpip.TransportProtocolNumber(ip.Protocol()), header.ICMPv4ProtocolNumber; got != want {
+		t.Fatalf("Bad protocol: got %v, want %v", got, want)
+	}
+	icmp := header.ICMPv4(ip.Payload())
+	if icmp.Type() != header.ICMPv4DstUnreachable || icmp.Code() != header.ICMPv4AdminProhibited {
+		t.Fatalf("Bad ICMP type and code: got %v/%v, want %v/%v", icmp.Type(), icmp.Code(), header.ICMPv4DstUnreachable, header.ICMPv4AdminProhibited)
+	}
+	quoted := header.IPv4(icmp[header.ICMPv4MinimumSize+4:])
+	if quoted.SourceAddress() != testAddr || quoted.DestinationAddress() != stackAddr {
+		t.Errorf("Bad quoted addresses: got %v -> %v, want %v -> %v", quoted.SourceAddress(), quoted.DestinationAddress(), testAddr, stackAddr)
+	}
+	if u := header.UDP(quoted[header.IPv4MinimumSize:]); u.SourcePort() != testPort || u.DestinationPort() != stackPort {
+		t.Errorf("Bad quoted ports: got %v -> %v, want %v -> %v", u.SourcePort(), u.DestinationPort(), testPort, stackPort)
+	}
+
+	// Removing the rules lets packets through again.
+	if err := s.SetFilterRules(tcpip.FilterInput, nil); err != nil {
+		t.Fatalf("SetFilterRules failed: %v", err)
+	}
+	c.sendPacket(payload, &headers{srcPort: testPort, dstPort: stackPort})
+	if v, err := c.ep.Read(nil); err != nil || !bytes.Equal(v, payload) {
+		t.Fatalf("Read = %x, %v, want %x, nil", v, err, payload)
+	}
+
+	if got := s.Stats().FilteredPackets; got != 2 {
+		t.Errorf("Bad FilteredPackets: got %v, want 2", got)
+	}
+}
+
+func TestFilterOutput(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	s := c.s.(*stack.Stack)
+	rules := []tcpip.FilterRule{
+		{Verdict: tcpip.FilterLog, LogPrefix: "output: "},
+		{
+			Destination:      "\x0a\x00\x00\x00",
+			DestinationMask:  "\xff\xff\xff\x00",
+			DestinationPorts: tcpip.PortRange{Start: testPort, End: testPort + 10},
+			Verdict:          tcpip.FilterDrop,
+		},
+		{
+			OutputNIC: 1,
+			Verdict:   tcpip.FilterReject,
+		},
+	}
+	if err := s.SetFilterRules(tcpip.FilterOutput, rules); err != nil {
+		t.Fatalf("SetFilterRules failed: %v", err)
+	}
+	accept := []tcpip.FilterRule{{Destination: testAddr, DestinationMask: "\xff\xff\xff\xff", Verdict: tcpip.FilterAccept}}
+	if err := s.SetFilterRules(tcpip.FilterPostrouting, accept); err != nil {
+		t.Fatalf("SetFilterRules failed: %v", err)
+	}
+
+	payload := buffer.View(newPayload())
+	testCases := []struct {
+		port uint16
+		want error
+	}{
+		{testPort + 5, tcpip.ErrNotPermitted},
+		{testPort + 20, tcpip.ErrConnectionRefused},
+	}
+	for _, tc := range testCases {
+		to := tcpip.FullAddress{Addr: testAddr, Port: tc.port}
+		if _, err := c.ep.Write(payload, &to); err != tc.want {
+			t.Errorf("Write to port %d = %v, want %v", tc.port, err, tc.want)
+		}
+	}
+	select {
+	case <-c.linkEP.C:
+		t.Fatalf("Filtered packet was sent")
+	default:
+	}
+
+	got, counters := s.GetFilterRules(tcpip.FilterOutput)
+	if len(got) != len(rules) {
+		t.Fatalf("Bad number of rules: got %d, want %d", len(got), len(rules))
+	}
+	size := uint64(header.UDPMinimumSize + len(payload))
+	want := []tcpip.FilterCounters{{Packets: 2, Bytes: 2 * size}, {Packets: 1, Bytes: size}, {Packets: 1, Bytes: size}}
+	for i := range want {
+		if counters[i] != want[i] {
+			t.Errorf("Bad counters of rule %d: got %+v, want %+v", i, counters[i], want[i])
+		}
+	}
+	if _, counters := s.GetFilterRules(tcpip.FilterPostrouting); counters[0].Packets != 0 {
+		t.Errorf("Postrouting rule saw %d packets, want 0", counters[0].Packets)
+	}
+
+	// Invalid rule sets are refused and leave the current rules in place.
+	if err := s.SetFilterRules(tcpip.FilterOutput, []tcpip.FilterRule{{Source: testAddr}}); err != tcpip.ErrInvalidFilterRule {
+		t.Fatalf("SetFilterRules with invalid rule = %v, want %v", err, tcpip.ErrInvalidFilterRule)
+	}
+	if got, _ := s.GetFilterRules(tcpip.FilterOutput); len(got) != len(rules) {
+		t.Fatalf("Bad number of rules after invalid update: got %d, want %d", len(got), len(rules))
+	}
+	if err := s.SetFilterRules(tcpip.FilterPrerouting, []tcpip.FilterRule{{ConnStates: tcpip.ConnStateNew}}); err != tcpip.ErrInvalidFilterRule {
+		t.Fatalf("SetFilterRules with prerouting state rule = %v, want %v", err, tcpip.ErrInvalidFilterRule)
+	}
+
+	if err := s.SetFilterRules(tcpip.FilterOutput, nil); err != nil {
+		t.Fatalf("SetFilterRules failed: %v", err)
+	}
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	if _, err := c.ep.Write(payload, &to); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	b := c.getPacket()
+	if p := buffer.View(header.IPv4(b).Payload()[header.UDPMinimumSize:]); !bytes.Equal(p, payload) {
+		t.Errorf("Bad payload: got %x, want %x", p, payload)
+	}
+	if _, counters := s.GetFilterRules(tcpip.FilterPostrouting); counters[0].Packets != 1 {
+		t.Errorf("Postrouting rule saw %d packets, want 1", counters[0].Packets)
+	}
+}
+
+func TestIPOptions(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+
+	s := c.s.(*stack.Stack)
+	if err := s.SetDefaultTTL(ipv4.ProtocolNumber, 100); err != nil {
+		t.Fatalf("SetDefaultTTL failed: %v", err)
+	}
+	if err := s.SetDefaultTOS(ipv6.ProtocolNumber, 0x20); err != nil {
+		t.Fatalf("SetDefaultTOS failed: %v", err)
+	}
+	if err := s.SetDefaultTTL(ipv4.ProtocolNumber, 0); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetDefaultTTL(0) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := s.SetDefaultTTL(0x1234, 10); err != tcpip.ErrUnknownProtocol {
+		t.Errorf("SetDefaultTTL of unknown protocol = %v, want %v", err, tcpip.ErrUnknownProtocol)
+	}
+
+	write := func(addr tcpip.Address) {
+		if _, err := c.ep.Write(buffer.View(newPayload()), &tcpip.FullAddress{Addr: addr, Port: testPort}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// Packets use the defaults of the stack for their network protocol.
+	write(testV4MappedAddr)
+	checker.IPv4(t, c.getPacket(), checker.TTL(100), checker.TOS(0, 0))
+	write(testV6Addr)
+	checker.IPv6(t, c.getV6Packet(), checker.TTL(stack.DefaultTTL), checker.TOS(0x20, 0))
+
+	// Options of the endpoint take precedence.
+	for _, opt := range []interface{}{tcpip.TTLOption(7), tcpip.TOSOption(0x10), tcpip.TrafficClassOption(0x28)} {
+		if err := c.ep.SetSockOpt(opt); err != nil {
+			t.Fatalf("SetSockOpt(%T) failed: %v", opt, err)
+		}
+	}
+	write(testV4MappedAddr)
+	checker.IPv4(t, c.getPacket(), checker.TTL(7), checker.TOS(0x10, 0))
+	write(testV6Addr)
+	checker.IPv6(t, c.getV6Packet(), checker.TTL(7), checker.TOS(0x28, 0))
+
+	var ttl tcpip.TTLOption
+	if err := c.ep.GetSockOpt(&ttl); err != nil || ttl != 7 {
+		t.Errorf("GetSockOpt(TTLOption) = %v, %v, want 7, nil", ttl, err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.TTLOption(256)); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetSockOpt(TTLOption(256)) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+
+	// A traffic class of zero is used as is, while -1 selects the default
+	// of the stack again.
+	for _, opt := range []interface{}{tcpip.TTLOption(-1), tcpip.TrafficClassOption(0)} {
+		if err := c.ep.SetSockOpt(opt); err != nil {
+			t.Fatalf("SetSockOpt(%T) failed: %v", opt, err)
+		}
+	}
+	write(testV6Addr)
+	checker.IPv6(t, c.getV6Packet(), checker.TTL(stack.DefaultTTL), checker.TOS(0, 0))
+	if err := c.ep.SetSockOpt(tcpip.TrafficClassOption(-1)); err != nil {
+		t.Fatalf("SetSockOpt(TrafficClassOption) failed: %v", err)
+	}
+	write(testV6Addr)
+	checker.IPv6(t, c.getV6Packet(), checker.TOS(0x20, 0))
+
+	if err := c.ep.GetSockOpt(&ttl); err != nil || ttl != -1 {
+		t.Errorf("GetSockOpt(TTLOption) = %v, %v, want -1, nil", ttl, err)
+	}
+}